@@ -98,6 +98,8 @@ func main() {
 
 	// Read and parse input
 	scanner := bufio.NewScanner(os.Stdin)
+	// emerge output can contain lines longer than the default 64KB token
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
 	var lines []string
 	for scanner.Scan() {
 		lines = append(lines, scanner.Text())
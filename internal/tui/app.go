@@ -2,12 +2,20 @@
 package tui
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"strings"
 
 	"github.com/charmbracelet/bubbles/spinner"
+	"github.com/charmbracelet/bubbles/textinput"
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/lipgloss"
 	"github.com/japaneseenrichmentorganization/yuno_os/pkg/config"
+	"github.com/japaneseenrichmentorganization/yuno_os/pkg/desktop"
+	"github.com/japaneseenrichmentorganization/yuno_os/pkg/installer"
+	"github.com/japaneseenrichmentorganization/yuno_os/pkg/partition"
+	"github.com/japaneseenrichmentorganization/yuno_os/pkg/utils"
 )
 
 // Screen represents different installer screens
@@ -45,27 +53,64 @@ type App struct {
 	err          error
 
 	// Screen-specific state
-	diskList     []DiskItem
-	selectedDisk int
+	detectedDisks []DiskItem
+	diskList      []DiskItem // detectedDisks without the hidden ones
+	selectedDisk  int
+	showRemovable bool // List removable and read-only disks, such as the live USB
+
+	// Overlay selection, indexed like overlayOptions
+	overlaySelected []bool
+
+	// Text inputs; the focused one of the current screen gets the keys
+	hostnameInput     textinput.Model
+	rootPasswordInput textinput.Model
+	usernameInput     textinput.Model
+	userPasswordInput textinput.Model
+	passphraseInput   textinput.Model // Encryption passphrase
+	passphraseConfirm textinput.Model
+	inputFocus        int
+
+	// Install confirmation, the disk's device name must be typed in
+	confirmingInstall bool
+	confirmInput      textinput.Model
+
+	// Manual partitioning state
+	partitionEditor *PartitionEditor
 
 	// Profile selection state
 	profiles        []config.GentooProfile
 	selectedProfile int
 	profileFilter   config.ProfileCategory
 
+	// Index of the chosen USE flag preset, restored when going back, and
+	// what the preset added, removed again when another one is chosen
+	useFlagChoice int
+	presetChanges *config.PresetChanges
+
 	// Navigation
 	focusIndex   int
 
 	// Installation progress
-	installStep  int
-	installLog   []string
+	installStep    int
+	installMessage string
+	installLog     []string
+	installEvents  chan tea.Msg       // Progress from the installer goroutine
+	cancelInstall  context.CancelFunc // Non-nil while the installer runs
+	installer      *installer.Installer
+	postInstalling bool // The post-install action is running
 }
 
+// maxInstallLog is how many lines of installer output are kept.
+const maxInstallLog = 500
+
 // DiskItem represents a disk in the selection list
 type DiskItem struct {
-	Path  string
-	Size  string
-	Model string
+	Path      string
+	Size      string
+	Bytes     int64
+	Model     string
+	Removable bool
+	ReadOnly  bool
 }
 
 // NewApp creates a new TUI application
@@ -74,11 +119,80 @@ func NewApp() *App {
 	s.Spinner = spinner.Dot
 	s.Style = lipgloss.NewStyle().Foreground(lipgloss.Color("205"))
 
+	cfg := config.NewDefaultConfig()
+
+	hostname := newTextInput("yuno", false)
+	hostname.SetValue(cfg.Hostname)
+
 	return &App{
-		screen:  ScreenWelcome,
-		config:  config.NewDefaultConfig(),
-		spinner: s,
+		screen:            ScreenWelcome,
+		config:            cfg,
+		spinner:           s,
+		overlaySelected:   make([]bool, len(overlayOptions)),
+		hostnameInput:     hostname,
+		rootPasswordInput: newTextInput("required", true),
+		usernameInput:     newTextInput("leave empty for no user", false),
+		userPasswordInput: newTextInput("", true),
+		passphraseInput:   newTextInput("required", true),
+		passphraseConfirm: newTextInput("repeat the passphrase", true),
+		confirmInput:      newTextInput("", false),
+	}
+}
+
+// newTextInput creates a text input, masked for passwords.
+func newTextInput(placeholder string, password bool) textinput.Model {
+	input := textinput.New()
+	input.Prompt = ""
+	input.Placeholder = placeholder
+	input.CharLimit = 64
+	input.Width = 24
+	if password {
+		input.EchoMode = textinput.EchoPassword
+		input.EchoCharacter = '•'
 	}
+	return input
+}
+
+// screenInputs returns the text inputs of the current screen in tab order.
+func (a *App) screenInputs() []*textinput.Model {
+	switch a.screen {
+	case ScreenEncryption:
+		if a.needsPassphrase() {
+			return []*textinput.Model{&a.passphraseInput, &a.passphraseConfirm}
+		}
+		return nil
+	case ScreenTimezone:
+		return []*textinput.Model{&a.hostnameInput}
+	case ScreenUsers:
+		return []*textinput.Model{&a.rootPasswordInput, &a.usernameInput, &a.userPasswordInput}
+	case ScreenSummary:
+		if a.confirmingInstall {
+			return []*textinput.Model{&a.confirmInput}
+		}
+		return nil
+	default:
+		return nil
+	}
+}
+
+// focusInput focuses the n-th input of the current screen, wrapping around.
+func (a *App) focusInput(n int) tea.Cmd {
+	inputs := a.screenInputs()
+	if len(inputs) == 0 {
+		return nil
+	}
+
+	a.inputFocus = (n%len(inputs) + len(inputs)) % len(inputs)
+	for _, input := range inputs {
+		input.Blur()
+	}
+	return inputs[a.inputFocus].Focus()
+}
+
+// Config returns the installation configuration, including the post-install
+// action chosen on the completion screen.
+func (a *App) Config() *config.InstallConfig {
+	return a.config
 }
 
 // Init initializes the application
@@ -101,49 +215,211 @@ func (a *App) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		return a, nil
 
 	case disksDetectedMsg:
-		a.diskList = msg.disks
+		a.detectedDisks = msg.disks
+		a.err = msg.err
+		a.filterDisks()
 		return a, nil
 
 	case errMsg:
 		a.err = msg.err
 		return a, nil
 
+	case installProgressMsg:
+		a.installStep = msg.step
+		a.installMessage = msg.message
+		return a, a.waitForInstall
+
+	case installOutputMsg:
+		a.installLog = append(a.installLog, msg.line)
+		if len(a.installLog) > maxInstallLog {
+			a.installLog = a.installLog[len(a.installLog)-maxInstallLog:]
+		}
+		return a, a.waitForInstall
+
+	case installCompleteMsg:
+		a.cancelInstall = nil
+		if msg.err != nil {
+			a.err = msg.err
+			return a, nil
+		}
+		a.screen = ScreenComplete
+		a.err = nil
+		return a, nil
+
+	case postInstallDoneMsg:
+		a.postInstalling = false
+		if msg.err != nil {
+			a.err = msg.err
+			return a, nil
+		}
+		return a, tea.Quit
+
 	case spinner.TickMsg:
 		var cmd tea.Cmd
 		a.spinner, cmd = a.spinner.Update(msg)
 		return a, cmd
 	}
 
+	// Cursor blinking and the like
+	if inputs := a.screenInputs(); len(inputs) > 0 {
+		input := inputs[a.inputFocus]
+		var cmd tea.Cmd
+		*input, cmd = input.Update(msg)
+		return a, cmd
+	}
+
 	return a, nil
 }
 
 // handleKeyPress handles keyboard input
 func (a *App) handleKeyPress(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	// Installing erases the disk, ask for its name first
+	if a.screen == ScreenSummary {
+		switch msg.String() {
+		case "enter":
+			if !a.confirmingInstall {
+				a.confirmingInstall = true
+				a.confirmInput.Reset()
+				a.err = nil
+				return a, a.focusInput(0)
+			}
+		case "esc":
+			if a.confirmingInstall {
+				a.confirmingInstall = false
+				a.confirmInput.Blur()
+				a.err = nil
+				return a, nil
+			}
+		}
+	}
+
+	// Text inputs take every key that does not navigate
+	if inputs := a.screenInputs(); len(inputs) > 0 {
+		switch msg.String() {
+		case "ctrl+c", "enter", "esc", "up", "down":
+		case "tab":
+			return a, a.focusInput(a.inputFocus + 1)
+		case "shift+tab":
+			return a, a.focusInput(a.inputFocus - 1)
+		default:
+			input := inputs[a.inputFocus]
+			var cmd tea.Cmd
+			*input, cmd = input.Update(msg)
+			return a, cmd
+		}
+	}
+
 	switch msg.String() {
 	case "ctrl+c", "q":
+		// Quitting now would leave the disk mounted, let the installer
+		// clean up and report back first
+		if a.cancelInstall != nil {
+			a.cancelInstall()
+			a.err = fmt.Errorf("aborting installation, please wait")
+			return a, nil
+		}
+		if a.screen == ScreenComplete {
+			return a.postInstall(config.PostInstallExit)
+		}
 		return a, tea.Quit
 
 	case "enter":
+		if a.screen == ScreenComplete {
+			return a.postInstall(config.PostInstallReboot)
+		}
 		return a.nextScreen()
 
+	case "p":
+		if a.screen == ScreenComplete {
+			return a.postInstall(config.PostInstallPoweroff)
+		}
+
+	case "c":
+		if a.screen == ScreenComplete {
+			return a.postInstall(config.PostInstallChroot)
+		}
+
+	case " ":
+		if a.screen == ScreenOverlays && a.focusIndex < len(a.overlaySelected) {
+			a.overlaySelected[a.focusIndex] = !a.overlaySelected[a.focusIndex]
+		}
+
+	case "r":
+		if a.screen == ScreenDisk {
+			a.showRemovable = !a.showRemovable
+			a.filterDisks()
+		}
+
 	case "esc", "backspace":
 		return a.prevScreen()
 
 	case "up", "k":
-		if a.focusIndex > 0 {
-			a.focusIndex--
-		}
+		a.moveFocus(-1)
+		return a, a.focusInput(a.inputFocus)
 
-	case "down", "j":
-		a.focusIndex++
-
-	case "tab":
-		a.focusIndex++
+	case "down", "j", "tab":
+		a.moveFocus(1)
+		return a, a.focusInput(a.inputFocus)
 	}
 
 	return a, nil
 }
 
+// moveFocus moves the cursor by delta, staying within the screen's items
+func (a *App) moveFocus(delta int) {
+	count := a.screenItemCount()
+	if count == 0 {
+		return
+	}
+
+	a.focusIndex = max(0, min(a.focusIndex+delta, count-1))
+
+	// These screens keep their own selection
+	switch a.screen {
+	case ScreenDisk:
+		a.selectedDisk = a.focusIndex
+	case ScreenProfile:
+		a.selectedProfile = a.focusIndex
+	}
+}
+
+// screenItemCount returns the number of selectable items on the current
+// screen, zero if it has none.
+func (a *App) screenItemCount() int {
+	switch a.screen {
+	case ScreenDisk:
+		return len(a.diskList)
+	case ScreenPartition:
+		return len(partitionOptions)
+	case ScreenEncryption:
+		return len(encryptionOptions)
+	case ScreenInitSystem:
+		return len(initOptions)
+	case ScreenProfile:
+		return len(a.profiles)
+	case ScreenOverlays:
+		return len(overlayOptions)
+	case ScreenCFlags:
+		return len(cflagsOptions)
+	case ScreenUseFlags:
+		return len(useFlagOptions)
+	case ScreenKernel:
+		return len(kernelOptions)
+	case ScreenGraphics:
+		return len(graphicsOptions)
+	case ScreenDesktop:
+		return len(desktopOptions)
+	case ScreenPackages:
+		return len(packageOptions)
+	case ScreenSecureBoot:
+		return len(secureBootOptions)
+	case ScreenTimezone:
+		return len(timezoneOptions)
+	default:
+		return 0
+	}
+}
+
 // nextScreen advances to the next screen
 func (a *App) nextScreen() (tea.Model, tea.Cmd) {
 	// Validate current screen before proceeding
@@ -158,27 +434,106 @@ func (a *App) nextScreen() (tea.Model, tea.Cmd) {
 	// Advance to next screen
 	if a.screen < ScreenComplete {
 		a.screen++
-		a.focusIndex = 0
+		a.restoreFocus()
+		a.confirmingInstall = false
 		a.err = nil
 	}
 
 	// Handle screen-specific initialization
 	switch a.screen {
 	case ScreenInstall:
-		return a, a.startInstallation
+		return a, a.startInstallation()
 	}
 
-	return a, nil
+	return a, a.focusInput(0)
 }
 
 // prevScreen goes back to the previous screen
 func (a *App) prevScreen() (tea.Model, tea.Cmd) {
 	if a.screen > ScreenWelcome && a.screen != ScreenInstall {
 		a.screen--
-		a.focusIndex = 0
+		a.restoreFocus()
 		a.err = nil
 	}
-	return a, nil
+	return a, a.focusInput(0)
+}
+
+// restoreFocus puts the cursor on the option the config already holds for
+// the current screen, so going back and forth keeps earlier choices.
+func (a *App) restoreFocus() {
+	cfg := a.config
+	switch a.screen {
+	case ScreenDisk:
+		a.focusIndex = a.selectedDisk
+	case ScreenPartition:
+		a.focusIndex = 0
+		if len(cfg.Partitions) > 0 {
+			a.focusIndex = 1
+		}
+	case ScreenEncryption:
+		a.focusIndex = optionIndex(len(encryptionOptions), func(n int) bool {
+			return encryptionOptions[n].value == cfg.Encryption.Type
+		})
+	case ScreenInitSystem:
+		a.focusIndex = optionIndex(len(initOptions), func(n int) bool {
+			return initOptions[n].value == cfg.InitSystem
+		})
+	case ScreenProfile:
+		a.focusIndex = a.selectedProfile
+	case ScreenCFlags:
+		a.focusIndex = optionIndex(len(cflagsOptions), func(n int) bool {
+			return cflagsOptions[n].value == cfg.Portage.CFlagsPreset
+		})
+	case ScreenUseFlags:
+		a.focusIndex = a.useFlagChoice
+	case ScreenKernel:
+		a.focusIndex = optionIndex(len(kernelOptions), func(n int) bool {
+			return kernelOptions[n].value == cfg.Kernel.Type
+		})
+	case ScreenGraphics:
+		a.focusIndex = optionIndex(len(graphicsOptions), func(n int) bool {
+			return graphicsOptions[n].value == cfg.Graphics.Driver
+		})
+	case ScreenDesktop:
+		a.focusIndex = optionIndex(len(desktopOptions), func(n int) bool {
+			return desktopOptions[n].value != "" && desktopOptions[n].value == cfg.Desktop.Type
+		})
+	case ScreenPackages:
+		a.focusIndex = optionIndex(len(packageOptions), func(n int) bool {
+			return packageOptions[n].value == cfg.Packages.UseBinary
+		})
+	case ScreenSecureBoot:
+		a.focusIndex = optionIndex(len(secureBootOptions), func(n int) bool {
+			if !cfg.Bootloader.SecureBoot.Enabled {
+				return secureBootOptions[n].value == ""
+			}
+			return secureBootOptions[n].value == cfg.Bootloader.SecureBoot.KeyType
+		})
+	case ScreenTimezone:
+		a.focusIndex = optionIndex(len(timezoneOptions), func(n int) bool {
+			return timezoneOptions[n] == cfg.Timezone
+		})
+	default:
+		a.focusIndex = 0
+	}
+}
+
+// optionIndex returns the index of the first of count options that
+// matches, or 0 when none does.
+func optionIndex(count int, match func(n int) bool) int {
+	for n := 0; n < count; n++ {
+		if match(n) {
+			return n
+		}
+	}
+	return 0
+}
+
+// needsPassphrase reports whether the encryption option under the cursor
+// asks for a passphrase.
+func (a *App) needsPassphrase() bool {
+	return a.screen == ScreenEncryption && a.focusIndex < len(encryptionOptions) &&
+		encryptionOptions[a.focusIndex].value != config.EncryptNone
 }
 
 // validateCurrentScreen validates the current screen's selections
@@ -191,10 +546,40 @@ func (a *App) validateCurrentScreen() error {
 		if a.selectedDisk >= len(a.diskList) {
 			return fmt.Errorf("please select a disk")
 		}
+	case ScreenPartition:
+		if a.focusIndex == 1 {
+			return a.editor().Validate()
+		}
+	case ScreenEncryption:
+		if !a.needsPassphrase() {
+			break
+		}
+		if a.passphraseInput.Value() == "" {
+			return fmt.Errorf("encryption passphrase is required")
+		}
+		if a.passphraseInput.Value() != a.passphraseConfirm.Value() {
+			return fmt.Errorf("passphrases do not match")
+		}
+	case ScreenTimezone:
+		if strings.TrimSpace(a.hostnameInput.Value()) == "" {
+			return fmt.Errorf("hostname is required")
+		}
+	case ScreenSummary:
+		if !a.confirmingInstall || a.confirmInput.Value() != a.config.Disk.Device {
+			return fmt.Errorf("type %s to confirm", a.config.Disk.Device)
+		}
+		// The installer trusts the config, so reject it before touching the disk
+		if err := a.config.Validate(); err != nil {
+			return err
+		}
 	case ScreenUsers:
-		if a.config.RootPassword == "" {
+		// Validated before saveScreenToConfig stores it
+		if a.rootPasswordInput.Value() == "" {
 			return fmt.Errorf("root password is required")
 		}
+		if strings.TrimSpace(a.usernameInput.Value()) != "" && a.userPasswordInput.Value() == "" {
+			return fmt.Errorf("user password is required")
+		}
 	}
 	return nil
 }
@@ -206,19 +591,152 @@ func (a *App) saveScreenToConfig() {
 		if a.selectedDisk < len(a.diskList) {
 			a.config.Disk.Device = a.diskList[a.selectedDisk].Path
 		}
-	case ScreenInitSystem:
-		if a.focusIndex == 0 {
-			a.config.InitSystem = config.InitOpenRC
+	case ScreenPartition:
+		if a.focusIndex == 1 {
+			a.config.Partitions = a.editor().Partitions
 		} else {
-			a.config.InitSystem = config.InitSystemd
+			a.config.Partitions = nil
+		}
+	case ScreenEncryption:
+		if a.focusIndex < len(encryptionOptions) {
+			a.config.Encryption.Type = encryptionOptions[a.focusIndex].value
+		}
+		a.config.Encryption.Password = ""
+		if a.needsPassphrase() {
+			a.config.Encryption.Password = a.passphraseInput.Value()
+		}
+	case ScreenInitSystem:
+		if a.focusIndex < len(initOptions) {
+			a.config.InitSystem = initOptions[a.focusIndex].value
 		}
 	case ScreenProfile:
 		if a.selectedProfile < len(a.profiles) {
 			a.config.Portage.Profile = a.profiles[a.selectedProfile].Path
 		}
+	case ScreenOverlays:
+		a.saveOverlays()
+	case ScreenCFlags:
+		if a.focusIndex < len(cflagsOptions) {
+			a.config.Portage.CFlagsPreset = cflagsOptions[a.focusIndex].value
+		}
+	case ScreenUseFlags:
+		a.useFlagChoice = a.focusIndex
+		if a.focusIndex < len(useFlagOptions) {
+			changes, err := a.config.SwitchPreset(a.presetChanges, useFlagOptions[a.focusIndex].preset)
+			if err != nil {
+				a.err = err
+			}
+			a.presetChanges = changes
+		}
+	case ScreenKernel:
+		if a.focusIndex < len(kernelOptions) {
+			a.config.Kernel.Type = kernelOptions[a.focusIndex].value
+		}
+	case ScreenGraphics:
+		if a.focusIndex < len(graphicsOptions) {
+			a.config.Graphics.Driver = graphicsOptions[a.focusIndex].value
+		}
+	case ScreenDesktop:
+		if a.focusIndex < len(desktopOptions) && desktopOptions[a.focusIndex].value != "" {
+			desktopType := desktopOptions[a.focusIndex].value
+			a.config.Desktop.Type = desktopType
+			a.config.Desktop.DisplayManager = desktop.GetRecommendedDM(desktopType)
+			if desktopType != config.DesktopNone {
+				a.config.Desktop.SessionType = desktopType.DefaultSession()
+				a.config.Graphics.DisplayType = a.config.Desktop.SessionType
+			}
+		}
+	case ScreenPackages:
+		if a.focusIndex < len(packageOptions) {
+			a.config.Packages.UseBinary = packageOptions[a.focusIndex].value
+		}
+	case ScreenTimezone:
+		a.config.Hostname = strings.TrimSpace(a.hostnameInput.Value())
+		if a.focusIndex < len(timezoneOptions) {
+			a.config.Timezone = timezoneOptions[a.focusIndex]
+		}
+	case ScreenUsers:
+		a.config.RootPassword = a.rootPasswordInput.Value()
+		a.config.Users = nil
+		if username := strings.TrimSpace(a.usernameInput.Value()); username != "" {
+			a.config.Users = []config.UserConfig{{
+				Username: username,
+				Password: a.userPasswordInput.Value(),
+				Shell:    "/bin/bash",
+				Groups:   []string{"wheel", "audio", "video", "input"},
+				Sudo:     true,
+			}}
+		}
+	case ScreenSecureBoot:
+		if a.focusIndex < len(secureBootOptions) {
+			keyType := secureBootOptions[a.focusIndex].value
+			a.config.Bootloader.SecureBoot.Enabled = keyType != ""
+			a.config.Bootloader.SecureBoot.KeyType = keyType
+		}
 	}
 }
 
+// saveOverlays replaces the overlays offered on the overlays screen in the
+// config with the selected ones, keeping any others.
+func (a *App) saveOverlays() {
+	offered := make(map[string]bool)
+	for _, opt := range overlayOptions {
+		offered[opt.key] = true
+	}
+
+	var kept []config.OverlayConfig
+	for _, ov := range a.config.Overlays {
+		if !offered[ov.Name] {
+			kept = append(kept, ov)
+		}
+	}
+
+	for i, opt := range overlayOptions {
+		if i < len(a.overlaySelected) && a.overlaySelected[i] {
+			kept = append(kept, config.OverlayConfig{Name: opt.key})
+		}
+	}
+	a.config.Overlays = kept
+}
+
+// filterDisks rebuilds the disk list from the detected disks, hiding
+// removable and read-only disks unless showRemovable is set.
+func (a *App) filterDisks() {
+	a.diskList = nil
+	for _, disk := range a.detectedDisks {
+		if (disk.Removable || disk.ReadOnly) && !a.showRemovable {
+			continue
+		}
+		a.diskList = append(a.diskList, disk)
+	}
+
+	if a.selectedDisk >= len(a.diskList) {
+		a.selectedDisk = 0
+	}
+	if a.screen == ScreenDisk {
+		a.focusIndex = a.selectedDisk
+	}
+}
+
+// editor returns the manual partition editor for the selected disk,
+// creating it on first use.
+func (a *App) editor() *PartitionEditor {
+	var disk DiskItem
+	if a.selectedDisk < len(a.diskList) {
+		disk = a.diskList[a.selectedDisk]
+	}
+
+	if a.partitionEditor == nil || a.partitionEditor.DiskMiB != int(disk.Bytes/1024/1024) {
+		parts := a.config.Partitions
+		if len(parts) == 0 {
+			parts = DefaultPartitions(utils.IsUEFI())
+		}
+		a.partitionEditor = NewPartitionEditor(parts, a.config.Disk.PartScheme, disk.Bytes)
+	}
+
+	return a.partitionEditor
+}
+
 // View renders the application
 func (a *App) View() string {
 	// Build the view based on current screen
@@ -295,22 +813,39 @@ func (a *App) applyLayout(content string) string {
 	)
 }
 
+// progressSteps groups the screens into the steps of the progress bar,
+// each step ending with the screen in last.
+var progressSteps = []struct {
+	name string
+	last Screen
+}{
+	{"Disk", ScreenPartition},
+	{"Encrypt", ScreenEncryption},
+	{"Init", ScreenInitSystem},
+	{"Profile", ScreenProfile},
+	{"Overlays", ScreenOverlays},
+	{"Flags", ScreenUseFlags},
+	{"Kernel", ScreenKernel},
+	{"Graphics", ScreenGraphics},
+	{"Desktop", ScreenPackages},
+	{"Boot", ScreenSecureBoot},
+	{"System", ScreenUsers},
+	{"Install", ScreenComplete},
+}
+
 // renderProgress renders the installation progress bar
 func (a *App) renderProgress() string {
-	steps := []string{
-		"Disk", "Encrypt", "Init", "Profile", "Overlays", "Flags",
-		"Kernel", "Graphics", "Desktop", "Users", "Install",
-	}
-
 	var result string
-	for i, step := range steps {
+	first := ScreenDisk
+	for _, step := range progressSteps {
 		style := progressInactiveStyle
-		if i < int(a.screen)-1 {
+		if a.screen > step.last || a.screen == ScreenComplete {
 			style = progressCompleteStyle
-		} else if i == int(a.screen)-1 {
+		} else if a.screen >= first {
 			style = progressActiveStyle
 		}
-		result += style.Render(step) + " "
+		result += style.Render(step.name) + " "
+		first = step.last + 1
 	}
 
 	return result
@@ -320,6 +855,7 @@ func (a *App) renderProgress() string {
 
 type disksDetectedMsg struct {
 	disks []DiskItem
+	err   error
 }
 
 type errMsg struct {
@@ -331,25 +867,114 @@ type installProgressMsg struct {
 	message string
 }
 
-type installCompleteMsg struct{}
+type installOutputMsg struct {
+	line string
+}
+
+type installCompleteMsg struct {
+	err error
+}
 
 // Commands
 
 func (a *App) detectDisks() tea.Msg {
-	// This would use the partition package to detect disks
-	// For now, return mock data
-	return disksDetectedMsg{
-		disks: []DiskItem{
-			{Path: "/dev/sda", Size: "500GB", Model: "Samsung SSD"},
-			{Path: "/dev/nvme0n1", Size: "1TB", Model: "NVMe Drive"},
-		},
+	disks, err := partition.NewManager(a.config).ListDisks()
+	if err != nil {
+		return disksDetectedMsg{err: err}
 	}
+
+	var items []DiskItem
+	for _, disk := range disks {
+		items = append(items, DiskItem{
+			Path:      disk.Path,
+			Size:      disk.SizeHuman,
+			Bytes:     disk.Size,
+			Model:     disk.Model,
+			Removable: disk.Removable,
+			ReadOnly:  disk.ReadOnly,
+		})
+	}
+
+	return disksDetectedMsg{disks: items}
 }
 
-func (a *App) startInstallation() tea.Msg {
-	// Start the installation process
-	// This would be handled by the installer package
-	return nil
+// startInstallation runs the installer in the background. Its progress and
+// output arrive as messages through installEvents.
+func (a *App) startInstallation() tea.Cmd {
+	ctx, cancel := context.WithCancel(context.Background())
+	events := make(chan tea.Msg, 64)
+	a.cancelInstall = cancel
+	a.installEvents = events
+	a.installStep = 0
+	a.installLog = nil
+
+	inst := installer.NewInstaller(a.config)
+	a.installer = inst
+	inst.SetContext(ctx)
+	inst.SetProgressCallback(func(step installer.Step, progress int, message string) {
+		events <- installProgressMsg{step: int(step), message: message}
+	})
+	inst.SetOutputCallback(func(line string) {
+		events <- installOutputMsg{line: line}
+	})
+
+	run := func() tea.Msg {
+		err := inst.Install()
+		cancel()
+		events <- installCompleteMsg{err: err}
+		return nil
+	}
+
+	return tea.Batch(run, a.waitForInstall)
+}
+
+// postInstallDoneMsg reports that the post-install action finished.
+type postInstallDoneMsg struct {
+	err error
+}
+
+// postInstall records the chosen post-install action and runs it. The
+// installer unmounts the target before rebooting or powering off, and the
+// app quits once the action succeeds. The chroot shell takes over the
+// terminal until it exits.
+func (a *App) postInstall(action config.PostInstallAction) (tea.Model, tea.Cmd) {
+	if a.postInstalling {
+		return a, nil
+	}
+
+	a.config.PostInstall = action
+	if a.installer == nil {
+		return a, tea.Quit
+	}
+
+	a.postInstalling = true
+	a.err = nil
+	done := func(err error) tea.Msg {
+		return postInstallDoneMsg{err: err}
+	}
+
+	if action == config.PostInstallChroot {
+		return a, tea.Exec(postInstallCommand{a.installer}, done)
+	}
+	return a, func() tea.Msg {
+		return done(a.installer.PostInstall())
+	}
+}
+
+// postInstallCommand runs the post-install action with the terminal
+// released, for the interactive chroot shell.
+type postInstallCommand struct {
+	installer *installer.Installer
+}
+
+func (c postInstallCommand) Run() error          { return c.installer.PostInstall() }
+func (c postInstallCommand) SetStdin(io.Reader)  {}
+func (c postInstallCommand) SetStdout(io.Writer) {}
+func (c postInstallCommand) SetStderr(io.Writer) {}
+
+// waitForInstall waits for the next message from the installer.
+func (a *App) waitForInstall() tea.Msg {
+	return <-a.installEvents
 }
 
 // Styles
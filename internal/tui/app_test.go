@@ -0,0 +1,161 @@
+package tui
+
+import (
+	"testing"
+
+	"github.com/japaneseenrichmentorganization/yuno_os/pkg/config"
+)
+
+func TestScreenKeepsSelectionWhenGoingBack(t *testing.T) {
+	tests := []struct {
+		screen Screen
+		focus  int
+		check  func(cfg *config.InstallConfig) bool
+	}{
+		{ScreenInitSystem, 1, func(cfg *config.InstallConfig) bool { return cfg.InitSystem == config.InitSystemd }},
+		{ScreenKernel, 3, func(cfg *config.InstallConfig) bool { return cfg.Kernel.Type == config.KernelZen }},
+		{ScreenCFlags, len(cflagsOptions) - 1, func(cfg *config.InstallConfig) bool {
+			return cfg.Portage.CFlagsPreset == cflagsOptions[len(cflagsOptions)-1].value
+		}},
+	}
+
+	for _, tt := range tests {
+		a := NewApp()
+		a.screen = tt.screen
+		a.focusIndex = tt.focus
+
+		a.nextScreen()
+		a.prevScreen()
+
+		if a.screen != tt.screen {
+			t.Fatalf("screen = %d, want %d", a.screen, tt.screen)
+		}
+		if a.focusIndex != tt.focus {
+			t.Errorf("screen %d: focusIndex = %d after going back, want %d", tt.screen, a.focusIndex, tt.focus)
+		}
+
+		// Leaving again must not overwrite the choice with the first option
+		a.nextScreen()
+		if !tt.check(a.config) {
+			t.Errorf("screen %d: selection lost after going back and forth", tt.screen)
+		}
+	}
+}
+
+func TestEncryptionPassphrase(t *testing.T) {
+	tests := []struct {
+		name       string
+		focus      int
+		passphrase string
+		confirm    string
+		wantErr    bool
+	}{
+		{"none needs no passphrase", 0, "", "", false},
+		{"missing", 1, "", "", true},
+		{"mismatch", 1, "secret", "secrte", true},
+		{"match", 1, "secret", "secret", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := NewApp()
+			a.screen = ScreenEncryption
+			a.focusIndex = tt.focus
+			a.passphraseInput.SetValue(tt.passphrase)
+			a.passphraseConfirm.SetValue(tt.confirm)
+
+			a.nextScreen()
+
+			if gotErr := a.err != nil; gotErr != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", a.err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if a.config.Encryption.Password != tt.passphrase {
+				t.Errorf("Encryption.Password = %q, want %q", a.config.Encryption.Password, tt.passphrase)
+			}
+		})
+	}
+}
+
+func TestSummaryValidatesConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(cfg *config.InstallConfig)
+		wantErr bool
+	}{
+		{"automatic layout", func(cfg *config.InstallConfig) {}, false},
+		{"no hostname", func(cfg *config.InstallConfig) { cfg.Hostname = "" }, true},
+		{"shim without grub", func(cfg *config.InstallConfig) {
+			cfg.Bootloader.Type = config.BootSystemdBoot
+			cfg.Bootloader.SecureBoot.Enabled = true
+			cfg.Bootloader.SecureBoot.KeyType = config.SecureBootShim
+		}, true},
+		{"invalid makeopts", func(cfg *config.InstallConfig) { cfg.Portage.MakeOpts = "-jx" }, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := NewApp()
+			a.config.Disk.Device = "/dev/sdz"
+			tt.modify(a.config)
+			a.screen = ScreenSummary
+			a.confirmingInstall = true
+			a.confirmInput.SetValue("/dev/sdz")
+
+			err := a.validateCurrentScreen()
+			if gotErr := err != nil; gotErr != tt.wantErr {
+				t.Fatalf("validateCurrentScreen() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr {
+				return
+			}
+
+			a.nextScreen()
+			if a.screen != ScreenSummary || a.installer != nil || a.err == nil {
+				t.Errorf("screen = %d, installer = %v, err = %v: want the error on the summary screen", a.screen, a.installer, a.err)
+			}
+		})
+	}
+}
+
+func TestSwitchingPresetsDropsThePrevious(t *testing.T) {
+	preset := func(name string) int {
+		for n, option := range useFlagOptions {
+			if option.preset == name {
+				return n
+			}
+		}
+		t.Fatalf("no %q preset option", name)
+		return 0
+	}
+
+	a := NewApp()
+	kernel := a.config.Kernel.Type
+	a.screen = ScreenUseFlags
+	a.focusIndex = preset("gaming")
+	a.nextScreen()
+	a.prevScreen()
+	a.focusIndex = preset("laptop")
+	a.nextScreen()
+
+	gaming := config.Presets["gaming"]
+	for _, flag := range gaming.UseFlags {
+		for _, got := range a.config.Portage.UseFlags {
+			if got == flag {
+				t.Errorf("UseFlags = %v, gaming flag %s kept", a.config.Portage.UseFlags, flag)
+			}
+		}
+	}
+	for _, pkg := range gaming.Packages {
+		for _, got := range a.config.Packages.ExtraPackages {
+			if got == pkg {
+				t.Errorf("ExtraPackages = %v, gaming package %s kept", a.config.Packages.ExtraPackages, pkg)
+			}
+		}
+	}
+	if len(a.config.Overlays) != 0 || a.config.Kernel.Type != kernel {
+		t.Errorf("overlays = %v, kernel = %s: gaming preset kept", a.config.Overlays, a.config.Kernel.Type)
+	}
+}
@@ -0,0 +1,174 @@
+package tui
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/japaneseenrichmentorganization/yuno_os/pkg/config"
+	"github.com/japaneseenrichmentorganization/yuno_os/pkg/partition"
+	"github.com/japaneseenrichmentorganization/yuno_os/pkg/utils"
+)
+
+// PartitionEditor holds the state of the manual partition editor.
+// Every change is checked against the disk before it is accepted.
+type PartitionEditor struct {
+	Partitions []config.PartitionConfig
+	Scheme     config.PartitionScheme
+	DiskMiB    int
+}
+
+// NewPartitionEditor creates an editor for a disk of diskBytes, starting
+// from parts (which are copied).
+func NewPartitionEditor(parts []config.PartitionConfig, scheme config.PartitionScheme, diskBytes int64) *PartitionEditor {
+	return &PartitionEditor{
+		Partitions: append([]config.PartitionConfig(nil), parts...),
+		Scheme:     scheme,
+		DiskMiB:    int(diskBytes / 1024 / 1024),
+	}
+}
+
+// DefaultPartitions returns a starting point for manual partitioning.
+func DefaultPartitions(isUEFI bool) []config.PartitionConfig {
+	boot := config.PartitionConfig{Label: "ESP", Size: "1G", Filesystem: config.FSFat32, MountPoint: "/boot", Flags: []string{"boot", "esp"}}
+	if !isUEFI {
+		boot = config.PartitionConfig{Label: "boot", Size: "512M", Filesystem: config.FSExt4, MountPoint: "/boot", Flags: []string{"boot"}}
+	}
+
+	return []config.PartitionConfig{
+		boot,
+		{Label: "swap", Size: "4G", Filesystem: config.FSSwap},
+		{Label: "root", Size: "100%FREE", Filesystem: config.FSExt4, MountPoint: "/"},
+	}
+}
+
+// Add appends a partition. A partition using the remaining space stays last.
+func (e *PartitionEditor) Add(p config.PartitionConfig) error {
+	parts := append([]config.PartitionConfig(nil), e.Partitions...)
+
+	if n := len(parts); n > 0 && takesRest(parts[n-1]) && !takesRest(p) {
+		parts = append(parts[:n-1], p, parts[n-1])
+	} else {
+		parts = append(parts, p)
+	}
+
+	return e.apply(parts)
+}
+
+// Update replaces the partition at index.
+func (e *PartitionEditor) Update(index int, p config.PartitionConfig) error {
+	if index < 0 || index >= len(e.Partitions) {
+		return fmt.Errorf("no partition at position %d", index+1)
+	}
+
+	parts := append([]config.PartitionConfig(nil), e.Partitions...)
+	parts[index] = p
+	return e.apply(parts)
+}
+
+// Remove deletes the partition at index.
+func (e *PartitionEditor) Remove(index int) error {
+	if index < 0 || index >= len(e.Partitions) {
+		return fmt.Errorf("no partition at position %d", index+1)
+	}
+
+	parts := append([]config.PartitionConfig(nil), e.Partitions[:index]...)
+	parts = append(parts, e.Partitions[index+1:]...)
+	if len(parts) == 0 {
+		e.Partitions = nil
+		return nil
+	}
+	return e.apply(parts)
+}
+
+// Validate checks that the partitions form a complete, installable layout.
+func (e *PartitionEditor) Validate() error {
+	if err := e.check(e.Partitions); err != nil {
+		return err
+	}
+
+	hasRoot := false
+	for _, p := range e.Partitions {
+		if p.MountPoint == "/" {
+			hasRoot = true
+		}
+	}
+	if !hasRoot {
+		return fmt.Errorf("a root (/) partition is required")
+	}
+
+	return config.ValidatePartitionFlags(e.Partitions, e.Scheme, utils.IsUEFI())
+}
+
+// Layout returns the partitions as they would be placed on the disk.
+func (e *PartitionEditor) Layout() (*partition.PartitionLayout, error) {
+	return partition.LayoutFromConfig(e.Partitions, e.Scheme, e.DiskMiB)
+}
+
+// apply accepts parts if they are valid.
+func (e *PartitionEditor) apply(parts []config.PartitionConfig) error {
+	if err := e.check(parts); err != nil {
+		return err
+	}
+	e.Partitions = parts
+	return nil
+}
+
+// check validates individual partitions and that they fit the disk.
+func (e *PartitionEditor) check(parts []config.PartitionConfig) error {
+	for _, p := range parts {
+		if err := checkPartition(p); err != nil {
+			return err
+		}
+	}
+
+	if len(parts) == 0 {
+		return fmt.Errorf("no partitions defined")
+	}
+
+	_, err := partition.LayoutFromConfig(parts, e.Scheme, e.DiskMiB)
+	return err
+}
+
+// checkPartition validates the fields of a single partition.
+func checkPartition(p config.PartitionConfig) error {
+	switch p.Filesystem {
+	case config.FSSwap, config.FSNone:
+		if p.MountPoint != "" {
+			return fmt.Errorf("%s partitions cannot have a mount point", p.Filesystem)
+		}
+	case config.FSExt4, config.FSBtrfs, config.FSXfs, config.FSF2fs, config.FSZfs, config.FSFat32:
+		if !strings.HasPrefix(p.MountPoint, "/") {
+			return fmt.Errorf("mount point must be an absolute path, got %q", p.MountPoint)
+		}
+	default:
+		return fmt.Errorf("unsupported filesystem %q", p.Filesystem)
+	}
+
+	if p.Encrypt && (p.MountPoint == "/boot" || p.Filesystem == config.FSNone) {
+		return fmt.Errorf("%s cannot be encrypted", partitionName(p))
+	}
+
+	if _, _, err := partition.ParseSizeMiB(p.Size); err != nil {
+		return fmt.Errorf("%s: %w", partitionName(p), err)
+	}
+
+	return nil
+}
+
+// takesRest reports whether p uses the remaining disk space.
+func takesRest(p config.PartitionConfig) bool {
+	_, rest, err := partition.ParseSizeMiB(p.Size)
+	return err == nil && rest
+}
+
+// partitionName returns a human-readable name for p.
+func partitionName(p config.PartitionConfig) string {
+	switch {
+	case p.MountPoint != "":
+		return p.MountPoint
+	case p.Label != "":
+		return p.Label
+	default:
+		return string(p.Filesystem)
+	}
+}
@@ -0,0 +1,96 @@
+package tui
+
+import (
+	"testing"
+
+	"github.com/japaneseenrichmentorganization/yuno_os/pkg/config"
+)
+
+// diskBytes is the size of the disk the editor tests partition.
+const diskBytes = 20 * 1024 * 1024 * 1024
+
+func TestPartitionEditorAddKeepsRestLast(t *testing.T) {
+	e := NewPartitionEditor(DefaultPartitions(true), config.PartSchemeGPT, diskBytes)
+
+	home := config.PartitionConfig{Label: "home", Size: "4G", Filesystem: config.FSExt4, MountPoint: "/home"}
+	if err := e.Add(home); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+
+	var mountPoints []string
+	for _, p := range e.Partitions {
+		mountPoints = append(mountPoints, p.MountPoint)
+	}
+	want := []string{"/boot", "", "/home", "/"}
+	if len(mountPoints) != len(want) {
+		t.Fatalf("mount points = %q, want %q", mountPoints, want)
+	}
+	for n := range want {
+		if mountPoints[n] != want[n] {
+			t.Errorf("mount points = %q, want %q", mountPoints, want)
+			break
+		}
+	}
+}
+
+func TestPartitionEditorRejectsInvalidChanges(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(e *PartitionEditor) error
+	}{
+		{"does not fit", func(e *PartitionEditor) error {
+			return e.Add(config.PartitionConfig{Label: "data", Size: "30G", Filesystem: config.FSExt4, MountPoint: "/data"})
+		}},
+		{"duplicate mount point", func(e *PartitionEditor) error {
+			return e.Add(config.PartitionConfig{Label: "boot2", Size: "1G", Filesystem: config.FSExt4, MountPoint: "/boot"})
+		}},
+		{"relative mount point", func(e *PartitionEditor) error {
+			return e.Update(0, config.PartitionConfig{Label: "ESP", Size: "1G", Filesystem: config.FSFat32, MountPoint: "boot"})
+		}},
+		{"encrypted /boot", func(e *PartitionEditor) error {
+			return e.Update(0, config.PartitionConfig{Label: "ESP", Size: "1G", Filesystem: config.FSFat32, MountPoint: "/boot", Encrypt: true})
+		}},
+		{"unknown filesystem", func(e *PartitionEditor) error {
+			return e.Update(2, config.PartitionConfig{Label: "root", Size: "100%FREE", Filesystem: "ntfs", MountPoint: "/"})
+		}},
+		{"update out of range", func(e *PartitionEditor) error {
+			return e.Update(3, config.PartitionConfig{})
+		}},
+		{"remove out of range", func(e *PartitionEditor) error {
+			return e.Remove(-1)
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := NewPartitionEditor(DefaultPartitions(true), config.PartSchemeGPT, diskBytes)
+			before := len(e.Partitions)
+
+			if err := tt.change(e); err == nil {
+				t.Fatal("change accepted, want an error")
+			}
+			if len(e.Partitions) != before || e.Partitions[0].MountPoint != "/boot" {
+				t.Errorf("partitions changed by a rejected edit: %+v", e.Partitions)
+			}
+		})
+	}
+}
+
+func TestPartitionEditorRemove(t *testing.T) {
+	e := NewPartitionEditor(DefaultPartitions(false), config.PartSchemeMBR, diskBytes)
+
+	if err := e.Remove(1); err != nil {
+		t.Fatalf("Remove() error = %v", err)
+	}
+	if len(e.Partitions) != 2 || e.Partitions[1].MountPoint != "/" {
+		t.Errorf("partitions = %+v, want swap removed", e.Partitions)
+	}
+
+	layout, err := e.Layout()
+	if err != nil {
+		t.Fatalf("Layout() error = %v", err)
+	}
+	if layout.Scheme != config.PartSchemeMBR || len(layout.Partitions) != 2 {
+		t.Errorf("Layout() = %+v, want two MBR partitions", layout)
+	}
+}
@@ -7,8 +7,145 @@ import (
 
 	"github.com/charmbracelet/lipgloss"
 	"github.com/japaneseenrichmentorganization/yuno_os/pkg/config"
+	"github.com/japaneseenrichmentorganization/yuno_os/pkg/installer"
 )
 
+// Options of the single-choice screens, in display order. The focused
+// option is saved to the config when the screen is left.
+
+var encryptionOptions = []struct {
+	name  string
+	desc  string
+	value config.EncryptionType
+}{
+	{"None", "No encryption (fastest)", config.EncryptNone},
+	{"LUKS2", "Linux Unified Key Setup - Standard Linux encryption", config.EncryptLUKS2},
+	{"LUKS", "LUKS version 1 - Better compatibility", config.EncryptLUKS},
+	{"ZFS Encryption", "Native ZFS encryption (requires ZFS root)", config.EncryptZFS},
+}
+
+var initOptions = []struct {
+	name  string
+	desc  string
+	value config.InitSystem
+}{
+	{"OpenRC", "Traditional Gentoo init system - Simple and fast", config.InitOpenRC},
+	{"systemd", "Modern init system - More features, wider compatibility", config.InitSystemd},
+}
+
+// overlayOptions are the overlays offered for selection, by their
+// overlays.PredefinedOverlays key.
+var overlayOptions = []struct {
+	name string
+	desc string
+	key  string
+}{
+	{"LTO", "Link-Time Optimization for better performance", "lto"},
+	{"GURU", "Gentoo User Repository - community packages", "guru"},
+	{"Steam", "Steam and gaming packages", "steam"},
+}
+
+var partitionOptions = []string{
+	"Automatic (recommended) - Erase disk and create optimal layout",
+	"Manual - Configure partitions yourself",
+}
+
+var useFlagOptions = []struct {
+	name   string
+	desc   string
+	preset string // Empty to configure USE flags manually
+}{
+	{"Desktop KDE", config.Presets["kde"].Description, "kde"},
+	{"Desktop GNOME", config.Presets["gnome"].Description, "gnome"},
+	{"Desktop XFCE", config.Presets["xfce"].Description, "xfce"},
+	{"Laptop", config.Presets["laptop"].Description, "laptop"},
+	{"Gaming", config.Presets["gaming"].Description, "gaming"},
+	{"Server", config.Presets["server"].Description, "server"},
+	{"Custom", "Configure USE flags manually", ""},
+}
+
+var timezoneOptions = []string{
+	"UTC",
+	"America/New_York",
+	"America/Los_Angeles",
+	"Europe/London",
+	"Europe/Berlin",
+	"Asia/Tokyo",
+}
+
+var cflagsOptions = []struct {
+	name  string
+	desc  string
+	value config.CFlagsPreset
+}{
+	{"Safe", "Maximum compatibility", config.CFlagsSafe},
+	{"Optimized", "Native CPU optimizations (Recommended)", config.CFlagsOptimized},
+	{"Aggressive", "Maximum performance with LTO", config.CFlagsAggressive},
+	{"Custom", "Specify your own CFLAGS", config.CFlagsCustom},
+}
+
+var kernelOptions = []struct {
+	desc  string
+	value config.KernelType
+}{
+	{"Pre-compiled kernel - Fastest install (Recommended)", config.KernelBin},
+	{"Distribution kernel - Compiled during install", config.KernelDist},
+	{"Full customization with genkernel", config.KernelSources},
+	{"Desktop-optimized kernel", config.KernelZen},
+	{"Performance-focused kernel", config.KernelXanmod},
+}
+
+var graphicsOptions = []struct {
+	name  string
+	desc  string
+	value config.GPUDriver // Empty to auto-detect
+}{
+	{"NVIDIA (proprietary)", "Best performance for NVIDIA cards", config.GPUNvidia},
+	{"NVIDIA (open)", "Open kernel modules for newer NVIDIA cards", config.GPUNvidiaOpen},
+	{"Nouveau", "Open-source NVIDIA driver (limited performance)", config.GPUNouveau},
+	{"AMDGPU", "Open-source AMD driver", config.GPUAmdgpu},
+	{"Intel", "Intel integrated graphics", config.GPUIntel},
+	{"None", "Headless server, no graphics stack", config.GPUNone},
+	{"Auto-detect", "Automatically detect and configure", ""},
+}
+
+var desktopOptions = []struct {
+	name  string
+	desc  string
+	value config.DesktopType // Empty for a separator
+}{
+	{"KDE Plasma", "Full-featured, modern desktop", config.DesktopKDE},
+	{"GNOME", "Clean, simple, touch-friendly", config.DesktopGNOME},
+	{"XFCE", "Lightweight, traditional desktop", config.DesktopXFCE},
+	{"LXQt", "Lightweight Qt-based desktop", config.DesktopLXQt},
+	{"Cinnamon", "Traditional, GNOME-based", config.DesktopCinnamon},
+	{"───────────", "─── Window Managers ───", ""},
+	{"i3", "Tiling window manager (X11)", config.WMi3},
+	{"Sway", "i3-compatible Wayland compositor", config.WMSway},
+	{"Hyprland", "Dynamic Wayland compositor", config.WMHyprland},
+	{"None", "Server/minimal installation", config.DesktopNone},
+}
+
+var packageOptions = []struct {
+	name  string
+	desc  string
+	value config.BinaryPreference
+}{
+	{"Binary preferred", "Use pre-built packages when available (Recommended)", config.BinaryPrefer},
+	{"Source only", "Compile everything from source (traditional Gentoo)", config.BinaryNone},
+	{"Binary only", "Only install pre-built packages", config.BinaryOnly},
+}
+
+var secureBootOptions = []struct {
+	name  string
+	desc  string
+	value string // Key type, empty when disabled
+}{
+	{"Disabled", "Do not configure Secure Boot", ""},
+	{"Custom keys", "Generate and enroll your own keys with sbctl", config.SecureBootCustom},
+	{"Shim", "Use shim for compatibility with existing keys", config.SecureBootShim},
+}
+
 // viewWelcome renders the welcome screen
 func (a *App) viewWelcome() string {
 	logo := `
@@ -55,12 +192,32 @@ func (a *App) viewDisk() string {
 			cursor = "▸ "
 			style = selectedStyle
 		}
-		diskList.WriteString(style.Render(fmt.Sprintf("%s%s - %s (%s)\n",
-			cursor, disk.Path, disk.Model, disk.Size)))
+		var tags string
+		if disk.Removable {
+			tags += " [removable]"
+		}
+		if disk.ReadOnly {
+			tags += " [read-only]"
+		}
+		diskList.WriteString(style.Render(fmt.Sprintf("%s%s - %s (%s)%s\n",
+			cursor, disk.Path, disk.Model, disk.Size, tags)))
 	}
 
-	if len(a.diskList) == 0 {
-		diskList.WriteString(errorStyle.Render("No disks detected!"))
+	// A detection failure is shown as the error instead
+	if len(a.diskList) == 0 && a.err == nil {
+		diskList.WriteString(errorStyle.Render("No disks detected!") + "\n")
+	}
+
+	hidden := len(a.detectedDisks) - len(a.diskList)
+	var toggle string
+	switch {
+	case a.showRemovable:
+		toggle = "r: hide removable and read-only disks"
+	case hidden > 0:
+		toggle = fmt.Sprintf("r: show %d removable or read-only disks", hidden)
+	}
+	if toggle != "" {
+		diskList.WriteString("\n" + helpStyle.Render(toggle))
 	}
 
 	return fmt.Sprintf("%s\n%s\n\n%s", title, subtitle, diskList.String())
@@ -71,13 +228,8 @@ func (a *App) viewPartition() string {
 	title := titleStyle.Render("Partitioning")
 	subtitle := subtitleStyle.Render("Choose how to partition the disk")
 
-	options := []string{
-		"Automatic (recommended) - Erase disk and create optimal layout",
-		"Manual - Configure partitions yourself",
-	}
-
 	var optionList strings.Builder
-	for i, opt := range options {
+	for i, opt := range partitionOptions {
 		cursor := "  "
 		style := normalStyle
 		if i == a.focusIndex {
@@ -92,27 +244,45 @@ func (a *App) viewPartition() string {
 ├─ /boot (ESP)  1 GB   FAT32
 ├─ swap         8 GB   swap
 └─ /            rest   ext4`)
+	if a.focusIndex == 1 {
+		layout = boxStyle.Render(a.renderPartitionEditor())
+	}
 
 	return fmt.Sprintf("%s\n%s\n\n%s\n\n%s", title, subtitle, optionList.String(), layout)
 }
 
+// renderPartitionEditor renders the partitions of the manual editor
+func (a *App) renderPartitionEditor() string {
+	parts := a.editor().Partitions
+
+	var b strings.Builder
+	b.WriteString("Manual layout:\n")
+	for i, p := range parts {
+		branch := "├─"
+		if i == len(parts)-1 {
+			branch = "└─"
+		}
+		mount := p.MountPoint
+		if mount == "" {
+			mount = string(p.Filesystem)
+		}
+		encrypt := ""
+		if p.Encrypt {
+			encrypt = "  encrypted"
+		}
+		b.WriteString(fmt.Sprintf("%s %-12s %-9s %s%s\n", branch, mount, p.Size, p.Filesystem, encrypt))
+	}
+
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
 // viewEncryption renders the encryption selection screen
 func (a *App) viewEncryption() string {
 	title := titleStyle.Render("Disk Encryption")
 	subtitle := subtitleStyle.Render("Choose encryption method for your installation")
 
-	options := []struct {
-		name string
-		desc string
-	}{
-		{"None", "No encryption (fastest)"},
-		{"LUKS2", "Linux Unified Key Setup - Standard Linux encryption"},
-		{"LUKS", "LUKS version 1 - Better compatibility"},
-		{"ZFS Encryption", "Native ZFS encryption (requires ZFS root)"},
-	}
-
 	var optionList strings.Builder
-	for i, opt := range options {
+	for i, opt := range encryptionOptions {
 		cursor := "  "
 		style := normalStyle
 		if i == a.focusIndex {
@@ -122,7 +292,30 @@ func (a *App) viewEncryption() string {
 		optionList.WriteString(style.Render(fmt.Sprintf("%s%-15s %s\n", cursor, opt.name, opt.desc)))
 	}
 
-	return fmt.Sprintf("%s\n%s\n\n%s", title, subtitle, optionList.String())
+	if !a.needsPassphrase() {
+		return fmt.Sprintf("%s\n%s\n\n%s", title, subtitle, optionList.String())
+	}
+
+	fields := []struct {
+		label string
+		input string
+	}{
+		{"Passphrase:", a.passphraseInput.View()},
+		{"Confirm:", a.passphraseConfirm.View()},
+	}
+
+	var content strings.Builder
+	for i, field := range fields {
+		style := normalStyle
+		if i == a.inputFocus {
+			style = selectedStyle
+		}
+		content.WriteString(fmt.Sprintf("%s %s\n", style.Render(fmt.Sprintf("%-12s", field.label)), field.input))
+	}
+
+	help := helpStyle.Render("Tab: Next field • Shift+Tab: Previous field")
+
+	return fmt.Sprintf("%s\n%s\n\n%s\n%s\n%s", title, subtitle, optionList.String(), boxStyle.Render(content.String()), help)
 }
 
 // viewInitSystem renders the init system selection screen
@@ -130,16 +323,8 @@ func (a *App) viewInitSystem() string {
 	title := titleStyle.Render("Init System")
 	subtitle := subtitleStyle.Render("Choose your init system")
 
-	options := []struct {
-		name string
-		desc string
-	}{
-		{"OpenRC", "Traditional Gentoo init system - Simple and fast"},
-		{"systemd", "Modern init system - More features, wider compatibility"},
-	}
-
 	var optionList strings.Builder
-	for i, opt := range options {
+	for i, opt := range initOptions {
 		cursor := "  "
 		style := normalStyle
 		if i == a.focusIndex {
@@ -252,18 +437,8 @@ func (a *App) viewOverlays() string {
 	title := titleStyle.Render("Portage Overlays")
 	subtitle := subtitleStyle.Render("Select additional overlays to enable (Space to toggle)")
 
-	overlays := []struct {
-		name     string
-		desc     string
-		selected bool
-	}{
-		{"LTO", "Link-Time Optimization for better performance", false},
-		{"GURU", "Gentoo User Repository - community packages", false},
-		{"Steam", "Steam and gaming packages", false},
-	}
-
 	var overlayList strings.Builder
-	for i, ov := range overlays {
+	for i, ov := range overlayOptions {
 		cursor := "  "
 		style := normalStyle
 		if i == a.focusIndex {
@@ -271,7 +446,7 @@ func (a *App) viewOverlays() string {
 			style = selectedStyle
 		}
 		checkbox := "[ ]"
-		if ov.selected {
+		if i < len(a.overlaySelected) && a.overlaySelected[i] {
 			checkbox = "[✓]"
 		}
 		overlayList.WriteString(style.Render(fmt.Sprintf("%s%s %-10s %s\n", cursor, checkbox, ov.name, ov.desc)))
@@ -285,19 +460,8 @@ func (a *App) viewCFlags() string {
 	title := titleStyle.Render("Compiler Flags")
 	subtitle := subtitleStyle.Render("Choose optimization level for compiled packages")
 
-	presets := []struct {
-		name  string
-		flags string
-		desc  string
-	}{
-		{"Safe", "-march=x86-64 -O2 -pipe", "Maximum compatibility"},
-		{"Optimized", "-march=native -O2 -pipe", "Native CPU optimizations (Recommended)"},
-		{"Aggressive", "-march=native -O3 -pipe -flto=auto", "Maximum performance with LTO"},
-		{"Custom", "", "Specify your own CFLAGS"},
-	}
-
 	var presetList strings.Builder
-	for i, preset := range presets {
+	for i, preset := range cflagsOptions {
 		cursor := "  "
 		style := normalStyle
 		if i == a.focusIndex {
@@ -305,8 +469,8 @@ func (a *App) viewCFlags() string {
 			style = selectedStyle
 		}
 		presetList.WriteString(style.Render(fmt.Sprintf("%s%-12s %s\n", cursor, preset.name, preset.desc)))
-		if preset.flags != "" {
-			presetList.WriteString(helpStyle.Render(fmt.Sprintf("              %s\n", preset.flags)))
+		if flags := preset.value.GetCFlags(); flags != "" {
+			presetList.WriteString(helpStyle.Render(fmt.Sprintf("              %s\n", flags)))
 		}
 	}
 
@@ -318,21 +482,8 @@ func (a *App) viewUseFlags() string {
 	title := titleStyle.Render("USE Flags")
 	subtitle := subtitleStyle.Render("Select a USE flag preset")
 
-	presets := []struct {
-		name string
-		desc string
-	}{
-		{"Desktop KDE", "KDE Plasma desktop with Qt applications"},
-		{"Desktop GNOME", "GNOME desktop with GTK applications"},
-		{"Desktop XFCE", "Lightweight XFCE desktop"},
-		{"Laptop", "Power management and wireless support"},
-		{"Gaming", "Steam, Vulkan, and gaming optimizations"},
-		{"Server", "Minimal server installation"},
-		{"Custom", "Configure USE flags manually"},
-	}
-
 	var presetList strings.Builder
-	for i, preset := range presets {
+	for i, preset := range useFlagOptions {
 		cursor := "  "
 		style := normalStyle
 		if i == a.focusIndex {
@@ -350,26 +501,15 @@ func (a *App) viewKernel() string {
 	title := titleStyle.Render("Kernel Selection")
 	subtitle := subtitleStyle.Render("Choose which kernel to install")
 
-	kernels := []struct {
-		name string
-		desc string
-	}{
-		{"gentoo-kernel-bin", "Pre-compiled kernel - Fastest install (Recommended)"},
-		{"gentoo-kernel", "Distribution kernel - Compiled during install"},
-		{"gentoo-sources", "Full customization with genkernel"},
-		{"zen-sources", "Desktop-optimized kernel"},
-		{"xanmod-sources", "Performance-focused kernel"},
-	}
-
 	var kernelList strings.Builder
-	for i, k := range kernels {
+	for i, k := range kernelOptions {
 		cursor := "  "
 		style := normalStyle
 		if i == a.focusIndex {
 			cursor = "▸ "
 			style = selectedStyle
 		}
-		kernelList.WriteString(style.Render(fmt.Sprintf("%s%-20s %s\n", cursor, k.name, k.desc)))
+		kernelList.WriteString(style.Render(fmt.Sprintf("%s%-20s %s\n", cursor, k.value, k.desc)))
 	}
 
 	return fmt.Sprintf("%s\n%s\n\n%s", title, subtitle, kernelList.String())
@@ -383,20 +523,8 @@ func (a *App) viewGraphics() string {
 	// Show detected GPU
 	detected := boxStyle.Render("Detected: NVIDIA GeForce RTX 3080")
 
-	drivers := []struct {
-		name string
-		desc string
-	}{
-		{"NVIDIA (proprietary)", "Best performance for NVIDIA cards"},
-		{"NVIDIA (open)", "Open kernel modules for newer NVIDIA cards"},
-		{"Nouveau", "Open-source NVIDIA driver (limited performance)"},
-		{"AMDGPU", "Open-source AMD driver"},
-		{"Intel", "Intel integrated graphics"},
-		{"Auto-detect", "Automatically detect and configure"},
-	}
-
 	var driverList strings.Builder
-	for i, d := range drivers {
+	for i, d := range graphicsOptions {
 		cursor := "  "
 		style := normalStyle
 		if i == a.focusIndex {
@@ -416,25 +544,9 @@ func (a *App) viewDesktop() string {
 	title := titleStyle.Render("Desktop Environment")
 	subtitle := subtitleStyle.Render("Choose your desktop environment or window manager")
 
-	desktops := []struct {
-		name string
-		desc string
-	}{
-		{"KDE Plasma", "Full-featured, modern desktop"},
-		{"GNOME", "Clean, simple, touch-friendly"},
-		{"XFCE", "Lightweight, traditional desktop"},
-		{"LXQt", "Lightweight Qt-based desktop"},
-		{"Cinnamon", "Traditional, GNOME-based"},
-		{"───────────", "─── Window Managers ───"},
-		{"i3", "Tiling window manager (X11)"},
-		{"Sway", "i3-compatible Wayland compositor"},
-		{"Hyprland", "Dynamic Wayland compositor"},
-		{"None", "Server/minimal installation"},
-	}
-
 	var desktopList strings.Builder
-	for i, d := range desktops {
-		if strings.HasPrefix(d.name, "───") {
+	for i, d := range desktopOptions {
+		if d.value == "" {
 			desktopList.WriteString(helpStyle.Render(d.name + "\n"))
 			continue
 		}
@@ -455,17 +567,8 @@ func (a *App) viewPackages() string {
 	title := titleStyle.Render("Package Installation")
 	subtitle := subtitleStyle.Render("Choose how packages should be installed")
 
-	options := []struct {
-		name string
-		desc string
-	}{
-		{"Binary preferred", "Use pre-built packages when available (Recommended)"},
-		{"Source only", "Compile everything from source (traditional Gentoo)"},
-		{"Binary only", "Only install pre-built packages"},
-	}
-
 	var optionList strings.Builder
-	for i, opt := range options {
+	for i, opt := range packageOptions {
 		cursor := "  "
 		style := normalStyle
 		if i == a.focusIndex {
@@ -483,17 +586,8 @@ func (a *App) viewSecureBoot() string {
 	title := titleStyle.Render("Secure Boot")
 	subtitle := subtitleStyle.Render("Configure UEFI Secure Boot")
 
-	options := []struct {
-		name string
-		desc string
-	}{
-		{"Disabled", "Do not configure Secure Boot"},
-		{"Custom keys", "Generate and enroll custom MOK keys"},
-		{"Shim", "Use shim for compatibility with existing keys"},
-	}
-
 	var optionList strings.Builder
-	for i, opt := range options {
+	for i, opt := range secureBootOptions {
 		cursor := "  "
 		style := normalStyle
 		if i == a.focusIndex {
@@ -511,18 +605,11 @@ func (a *App) viewTimezone() string {
 	title := titleStyle.Render("Timezone & Locale")
 	subtitle := subtitleStyle.Render("Configure your timezone and language")
 
-	timezones := []string{
-		"UTC",
-		"America/New_York",
-		"America/Los_Angeles",
-		"Europe/London",
-		"Europe/Berlin",
-		"Asia/Tokyo",
-	}
+	hostname := fmt.Sprintf("%s %s", selectedStyle.Render("Hostname:"), a.hostnameInput.View())
 
 	var tzList strings.Builder
 	tzList.WriteString("Timezone:\n")
-	for i, tz := range timezones {
+	for i, tz := range timezoneOptions {
 		cursor := "  "
 		style := normalStyle
 		if i == a.focusIndex {
@@ -534,7 +621,7 @@ func (a *App) viewTimezone() string {
 
 	locale := boxStyle.Render(fmt.Sprintf("Locale: %s\nKeymap: %s", a.config.Locale, a.config.Keymap))
 
-	return fmt.Sprintf("%s\n%s\n\n%s\n\n%s", title, subtitle, tzList.String(), locale)
+	return fmt.Sprintf("%s\n%s\n\n%s\n\n%s\n\n%s", title, subtitle, hostname, tzList.String(), locale)
 }
 
 // viewUsers renders the user configuration screen
@@ -542,22 +629,28 @@ func (a *App) viewUsers() string {
 	title := titleStyle.Render("User Accounts")
 	subtitle := subtitleStyle.Render("Configure user accounts")
 
-	content := `Root Password:     [••••••••]
-Create User:       [Yes]
-
-Username:          [user         ]
-Full Name:         [              ]
-Password:          [••••••••      ]
-Shell:             [/bin/bash     ]
+	fields := []struct {
+		label string
+		input string
+	}{
+		{"Root Password:", a.rootPasswordInput.View()},
+		{"Username:", a.usernameInput.View()},
+		{"Password:", a.userPasswordInput.View()},
+	}
 
-Groups:            [x] wheel (sudo)
-                   [x] audio
-                   [x] video
-                   [x] input
+	var content strings.Builder
+	for i, field := range fields {
+		style := normalStyle
+		if i == a.inputFocus {
+			style = selectedStyle
+		}
+		content.WriteString(fmt.Sprintf("%s %s\n", style.Render(fmt.Sprintf("%-18s", field.label)), field.input))
+	}
+	content.WriteString(helpStyle.Render("\nThe user gets sudo and the wheel, audio, video and input groups."))
 
-Privilege:         [sudo] / [doas]`
+	help := helpStyle.Render("Tab: Next field • Shift+Tab: Previous field")
 
-	return fmt.Sprintf("%s\n%s\n\n%s", title, subtitle, boxStyle.Render(content))
+	return fmt.Sprintf("%s\n%s\n\n%s\n%s", title, subtitle, boxStyle.Render(content.String()), help)
 }
 
 // viewSummary renders the installation summary screen
@@ -596,6 +689,12 @@ func (a *App) viewSummary() string {
 
 	warning := errorStyle.Render("\n⚠️  This will ERASE all data on the selected disk!")
 	instruction := selectedStyle.Render("\nPress Enter to begin installation...")
+	if a.confirmingInstall {
+		instruction = boxStyle.Render(fmt.Sprintf("Type %s to confirm that it may be erased:\n\n%s\n\n%s",
+			selectedStyle.Render(a.config.Disk.Device),
+			a.confirmInput.View(),
+			helpStyle.Render("Enter: Install • Esc: Cancel")))
+	}
 
 	return fmt.Sprintf("%s\n%s\n%s\n%s\n%s", title, subtitle, boxStyle.Render(summary), warning, instruction)
 }
@@ -604,21 +703,9 @@ func (a *App) viewSummary() string {
 func (a *App) viewInstall() string {
 	title := titleStyle.Render("Installing Yuno OS")
 
-	steps := []string{
-		"Partitioning disk",
-		"Setting up encryption",
-		"Installing stage3",
-		"Configuring Portage",
-		"Installing kernel",
-		"Installing graphics drivers",
-		"Installing desktop",
-		"Creating users",
-		"Installing bootloader",
-		"Finalizing",
-	}
-
 	var stepList strings.Builder
-	for i, step := range steps {
+	for step := installer.StepPartition; step <= installer.StepFinalize; step++ {
+		i := int(step)
 		status := "  "
 		style := normalStyle
 		if i < a.installStep {
@@ -630,6 +717,9 @@ func (a *App) viewInstall() string {
 		}
 		stepList.WriteString(style.Render(fmt.Sprintf("%s%s\n", status, step)))
 	}
+	if a.installMessage != "" {
+		stepList.WriteString(helpStyle.Render("\n" + a.installMessage + "\n"))
+	}
 
 	// Show recent log entries
 	var logView strings.Builder
@@ -664,7 +754,10 @@ For help and documentation:
   https://wiki.gentoo.org
   https://github.com/japaneseenrichmentorganization/yuno_os`)
 
-	instruction := selectedStyle.Render("\nPress Enter to reboot, or 'q' to exit...")
+	instruction := selectedStyle.Render("\nPress Enter to reboot, 'p' to power off, 'c' to open a chroot shell, or 'q' to exit...")
+	if a.postInstalling {
+		instruction = selectedStyle.Render("\nUnmounting the new system...")
+	}
 
 	return fmt.Sprintf("%s\n%s\n\n%s\n%s",
 		lipgloss.NewStyle().Foreground(lipgloss.Color("#00FF00")).Render(logo),
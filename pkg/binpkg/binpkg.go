@@ -4,6 +4,7 @@ package binpkg
 import (
 	"fmt"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/japaneseenrichmentorganization/yuno_os/pkg/config"
@@ -31,6 +32,7 @@ type BinaryHost struct {
 	Description string
 	Arch        string
 	Profile     string
+	Level       string // Lowest x86-64 microarchitecture level the packages run on
 }
 
 // OfficialBinaryHosts returns the official Gentoo binary hosts.
@@ -42,6 +44,7 @@ func OfficialBinaryHosts() []BinaryHost {
 			Description: "Official Gentoo binary packages for amd64",
 			Arch:        "amd64",
 			Profile:     "23.0",
+			Level:       "x86-64",
 		},
 		{
 			Name:        "Gentoo Official (amd64-v3)",
@@ -49,10 +52,72 @@ func OfficialBinaryHosts() []BinaryHost {
 			Description: "Official Gentoo binary packages for amd64-v3 (AVX2+)",
 			Arch:        "amd64",
 			Profile:     "23.0/x86-64-v3",
+			Level:       "x86-64-v3",
 		},
 	}
 }
 
+// cpuLevels lists the x86-64 microarchitecture levels with the cpuinfo
+// flags each one adds to the previous level. lzcnt shows up as abm.
+var cpuLevels = []struct {
+	name  string
+	flags []string
+}{
+	{"x86-64", nil},
+	{"x86-64-v2", []string{"cx16", "lahf_lm", "popcnt", "sse4_1", "sse4_2", "ssse3"}},
+	{"x86-64-v3", []string{"avx", "avx2", "bmi1", "bmi2", "f16c", "fma", "abm", "movbe", "xsave"}},
+	{"x86-64-v4", []string{"avx512f", "avx512bw", "avx512cd", "avx512dq", "avx512vl"}},
+}
+
+// DetectCPULevel returns the x86-64 microarchitecture level of the CPU,
+// "x86-64" to "x86-64-v4", falling back to the baseline if /proc/cpuinfo
+// cannot be read.
+func DetectCPULevel() string {
+	info, err := utils.ReadCPUInfo(utils.CPUInfoPath)
+	if err != nil {
+		utils.Warn("Cannot detect the CPU level: %v", err)
+		return cpuLevels[0].name
+	}
+	return cpuLevel(info)
+}
+
+// cpuLevel returns the highest level whose flags, and those of every
+// level below it, the CPU has.
+func cpuLevel(info *utils.CPUInfo) string {
+	level := cpuLevels[0].name
+	for _, l := range cpuLevels[1:] {
+		for _, flag := range l.flags {
+			if !info.HasFlag(flag) {
+				return level
+			}
+		}
+		level = l.name
+	}
+	return level
+}
+
+// officialBinaryHostFor returns the official host with the most optimised
+// packages that still run on a CPU of the given level.
+func officialBinaryHostFor(level string) BinaryHost {
+	rank := func(name string) int {
+		for n, l := range cpuLevels {
+			if l.name == name {
+				return n
+			}
+		}
+		return 0
+	}
+
+	hosts := OfficialBinaryHosts()
+	best := hosts[0]
+	for _, host := range hosts {
+		if rank(host.Level) <= rank(level) && rank(host.Level) > rank(best.Level) {
+			best = host
+		}
+	}
+	return best
+}
+
 // Configure sets up binary package support.
 func (m *Manager) Configure() error {
 	pref := m.config.Packages.UseBinary
@@ -72,6 +137,13 @@ func (m *Manager) Configure() error {
 		return err
 	}
 
+	// Signed packages are checked against the Gentoo release keys
+	if !m.config.Packages.AllowUnsigned {
+		if err := m.setupKeyring(); err != nil {
+			return err
+		}
+	}
+
 	// Set up package.use/binpkg if needed
 	if err := m.setupPackageAcceptRestrict(); err != nil {
 		return err
@@ -87,24 +159,48 @@ func (m *Manager) setupBinreposConf() error {
 		return err
 	}
 
-	host := m.config.Packages.BinaryHost
-	if host == "" {
-		// Use official host
-		hosts := OfficialBinaryHosts()
-		if len(hosts) > 0 {
-			host = hosts[0].URL
-		}
+	hosts := m.config.Packages.BinHosts()
+	if len(hosts) == 0 {
+		// Use the official host matching the CPU
+		level := DetectCPULevel()
+		host := officialBinaryHostFor(level)
+		utils.Info("Using %s for this %s CPU", host.Name, level)
+		hosts = []config.BinaryHostConfig{{
+			URL:      host.URL,
+			Priority: config.DefaultBinhostPriority,
+		}}
 	}
 
-	content := fmt.Sprintf(`# Yuno OS binary package repository
+	confPath := filepath.Join(reposDir, "gentoobinhost.conf")
+	return utils.WriteFile(confPath, binreposConf(hosts, !m.config.Packages.AllowUnsigned), 0644)
+}
 
-[binhost]
-priority = 9999
-sync-uri = %s
-`, host)
+// binreposConf renders binrepos.conf with one section per host, highest
+// priority first.
+func binreposConf(hosts []config.BinaryHostConfig, verify bool) string {
+	sorted := append([]config.BinaryHostConfig(nil), hosts...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Priority > sorted[j].Priority
+	})
+
+	var b strings.Builder
+	b.WriteString("# Yuno OS binary package repositories\n")
+
+	for n, host := range sorted {
+		name := host.Name
+		if name == "" {
+			name = "binhost"
+			if n > 0 {
+				name = fmt.Sprintf("binhost-%d", n+1)
+			}
+		}
+		fmt.Fprintf(&b, "\n[%s]\npriority = %d\nsync-uri = %s\n", name, host.Priority, host.URL)
+		if verify {
+			b.WriteString("verify-signature = true\n")
+		}
+	}
 
-	confPath := filepath.Join(reposDir, "gentoobinhost.conf")
-	return utils.WriteFile(confPath, content, 0644)
+	return b.String()
 }
 
 // updateMakeConf updates make.conf for binary packages.
@@ -121,15 +217,20 @@ func (m *Manager) updateMakeConf() error {
 
 	pref := m.config.Packages.UseBinary
 
+	features := "getbinpkg binpkg-request-signature"
+	if m.config.Packages.AllowUnsigned {
+		features = "getbinpkg"
+	}
+
 	// Set FEATURES
 	additions.WriteString("\n# Binary package configuration\n")
 
 	switch pref {
 	case config.BinaryPrefer:
-		additions.WriteString("FEATURES=\"${FEATURES} getbinpkg binpkg-request-signature\"\n")
+		additions.WriteString(fmt.Sprintf("FEATURES=\"${FEATURES} %s\"\n", features))
 		additions.WriteString("EMERGE_DEFAULT_OPTS=\"${EMERGE_DEFAULT_OPTS} --binpkg-respect-use=y --binpkg-changed-deps=y\"\n")
 	case config.BinaryOnly:
-		additions.WriteString("FEATURES=\"${FEATURES} getbinpkg binpkg-request-signature\"\n")
+		additions.WriteString(fmt.Sprintf("FEATURES=\"${FEATURES} %s\"\n", features))
 		additions.WriteString("EMERGE_DEFAULT_OPTS=\"${EMERGE_DEFAULT_OPTS} --usepkg --binpkg-respect-use=y\"\n")
 	}
 
@@ -144,6 +245,37 @@ func (m *Manager) updateMakeConf() error {
 	return nil
 }
 
+// portageKeyring is the keyring Portage verifies binary packages with.
+const portageKeyring = "etc/portage/gnupg/pubring.kbx"
+
+// setupKeyring imports the Gentoo release keys into Portage's keyring with
+// getuto. Without them every signed binary package fails verification.
+func (m *Manager) setupKeyring() error {
+	utils.Info("Setting up the binary package keyring")
+
+	if !utils.FileExists(filepath.Join(m.targetDir, "usr/bin/getuto")) {
+		// Built from source, nothing can be verified yet
+		result := utils.RunInChroot(m.targetDir, "emerge", "--ask=n", "--noreplace",
+			"--getbinpkg=n", "--usepkg=n", "app-portage/getuto")
+		if result.Error != nil {
+			return utils.NewError("binpkg", "failed to install getuto", result.Error)
+		}
+	}
+
+	result := utils.RunInChroot(m.targetDir, "getuto")
+	if result.Error != nil {
+		return utils.NewError("binpkg",
+			"failed to import the Gentoo release keys, set packages.allow_unsigned to use unsigned binhosts",
+			result.Error)
+	}
+
+	if !utils.IsDryRun() && !utils.FileExists(filepath.Join(m.targetDir, portageKeyring)) {
+		return utils.NewError("binpkg", fmt.Sprintf("getuto did not create /%s", portageKeyring), nil)
+	}
+
+	return nil
+}
+
 // setupPackageAcceptRestrict sets up package-specific binary restrictions.
 func (m *Manager) setupPackageAcceptRestrict() error {
 	// Some packages should always be compiled from source
@@ -206,11 +338,7 @@ func (m *Manager) InstallPackage(pkg string, progress func(line string)) error {
 
 	args = append(args, pkg)
 
-	if progress != nil {
-		return utils.RunCommandWithOutput(progress, "chroot", args...)
-	}
-
-	result := utils.RunCommand("chroot", args...)
+	result := utils.RunCommandStreaming(progress, "chroot", args...)
 	if result.Error != nil {
 		return utils.NewError("binpkg", fmt.Sprintf("failed to install %s", pkg), result.Error)
 	}
@@ -0,0 +1,123 @@
+package binpkg
+
+import (
+	"testing"
+
+	"github.com/japaneseenrichmentorganization/yuno_os/pkg/config"
+	"github.com/japaneseenrichmentorganization/yuno_os/pkg/utils"
+)
+
+func TestBinreposConf(t *testing.T) {
+	tests := []struct {
+		name   string
+		hosts  []config.BinaryHostConfig
+		verify bool
+		want   string
+	}{
+		{
+			name:   "single host",
+			hosts:  config.PackageConfig{BinaryHost: "https://distfiles.gentoo.org/releases/amd64/binpackages/23.0/x86-64"}.BinHosts(),
+			verify: true,
+			want: `# Yuno OS binary package repositories
+
+[binhost]
+priority = 9999
+sync-uri = https://distfiles.gentoo.org/releases/amd64/binpackages/23.0/x86-64
+verify-signature = true
+`,
+		},
+		{
+			name: "ordered by priority",
+			hosts: []config.BinaryHostConfig{
+				{Name: "gentoo", URL: "https://distfiles.gentoo.org/releases/amd64/binpackages/23.0/x86-64", Priority: 10},
+				{Name: "company", URL: "https://binpkg.example.com/amd64", Priority: 100},
+				{Name: "gentoo-v3", URL: "https://distfiles.gentoo.org/releases/amd64/binpackages/23.0/x86-64-v3", Priority: 50},
+			},
+			want: `# Yuno OS binary package repositories
+
+[company]
+priority = 100
+sync-uri = https://binpkg.example.com/amd64
+
+[gentoo-v3]
+priority = 50
+sync-uri = https://distfiles.gentoo.org/releases/amd64/binpackages/23.0/x86-64-v3
+
+[gentoo]
+priority = 10
+sync-uri = https://distfiles.gentoo.org/releases/amd64/binpackages/23.0/x86-64
+`,
+		},
+		{
+			name: "unnamed hosts",
+			hosts: []config.BinaryHostConfig{
+				{URL: "https://a.example.com", Priority: 1},
+				{URL: "https://b.example.com", Priority: 2},
+			},
+			want: `# Yuno OS binary package repositories
+
+[binhost]
+priority = 2
+sync-uri = https://b.example.com
+
+[binhost-2]
+priority = 1
+sync-uri = https://a.example.com
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := binreposConf(tt.hosts, tt.verify); got != tt.want {
+				t.Errorf("binreposConf() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCPULevel(t *testing.T) {
+	v2 := []string{"cx16", "lahf_lm", "popcnt", "sse4_1", "sse4_2", "ssse3"}
+	v3 := append(append([]string(nil), v2...), "avx", "avx2", "bmi1", "bmi2", "f16c", "fma", "abm", "movbe", "xsave")
+	v4 := append(append([]string(nil), v3...), "avx512f", "avx512bw", "avx512cd", "avx512dq", "avx512vl")
+
+	tests := []struct {
+		name  string
+		flags []string
+		want  string
+	}{
+		{"baseline", []string{"fpu", "sse2"}, "x86-64"},
+		{"v2", v2, "x86-64-v2"},
+		{"v3", v3, "x86-64-v3"},
+		{"v4", v4, "x86-64-v4"},
+		{"v3 without xsave", v3[:len(v3)-1], "x86-64-v2"},
+		{"avx512 without v3", append(append([]string(nil), v2...), "avx512f", "avx512bw", "avx512cd", "avx512dq", "avx512vl"), "x86-64-v2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := cpuLevel(&utils.CPUInfo{Flags: tt.flags}); got != tt.want {
+				t.Errorf("cpuLevel() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOfficialBinaryHostFor(t *testing.T) {
+	tests := []struct {
+		level string
+		want  string
+	}{
+		{"x86-64", "x86-64"},
+		{"x86-64-v2", "x86-64"},
+		{"x86-64-v3", "x86-64-v3"},
+		{"x86-64-v4", "x86-64-v3"},
+		{"unknown", "x86-64"},
+	}
+
+	for _, tt := range tests {
+		if got := officialBinaryHostFor(tt.level); got.Level != tt.want {
+			t.Errorf("officialBinaryHostFor(%q) = %s, want the %s host", tt.level, got.Name, tt.want)
+		}
+	}
+}
@@ -7,6 +7,8 @@ import (
 	"strings"
 
 	"github.com/japaneseenrichmentorganization/yuno_os/pkg/config"
+	"github.com/japaneseenrichmentorganization/yuno_os/pkg/graphics"
+	"github.com/japaneseenrichmentorganization/yuno_os/pkg/kernel"
 	"github.com/japaneseenrichmentorganization/yuno_os/pkg/utils"
 )
 
@@ -14,6 +16,8 @@ import (
 type Manager struct {
 	config    *config.InstallConfig
 	targetDir string
+	cmdline   string // Root, encryption and resume parameters
+	espPath   string // Mount point of the EFI system partition in the target
 }
 
 // NewManager creates a new bootloader manager.
@@ -24,6 +28,33 @@ func NewManager(cfg *config.InstallConfig, targetDir string) *Manager {
 	}
 }
 
+// SetKernelCmdline sets the root, encryption and resume kernel parameters.
+// Without it they are derived from the configured partitions.
+func (m *Manager) SetKernelCmdline(cmdline string) {
+	m.cmdline = cmdline
+}
+
+// SetESPPath sets the mount point of the EFI system partition. Without it
+// the partition flagged esp in the config is used, or /boot.
+func (m *Manager) SetESPPath(path string) {
+	m.espPath = path
+}
+
+// esp returns the mount point of the EFI system partition.
+func (m *Manager) esp() string {
+	if m.espPath != "" {
+		return m.espPath
+	}
+	for _, part := range m.config.Partitions {
+		for _, flag := range part.Flags {
+			if flag == "esp" && part.MountPoint != "" {
+				return part.MountPoint
+			}
+		}
+	}
+	return "/boot"
+}
+
 // Install installs the bootloader based on configuration.
 func (m *Manager) Install() error {
 	bootloader := m.config.Bootloader.Type
@@ -42,15 +73,15 @@ func (m *Manager) Install() error {
 
 // installGRUB installs GRUB bootloader.
 func (m *Manager) installGRUB() error {
-	// Install grub package
-	result := utils.RunInChroot(m.targetDir, "emerge", "--ask=n", "sys-boot/grub")
+	// Install grub package (usually already part of the base packages)
+	result := utils.RunInChroot(m.targetDir, "emerge", "--ask=n", "--noreplace", "sys-boot/grub")
 	if result.Error != nil {
 		return utils.NewError("bootloader", "failed to install grub", result.Error)
 	}
 
 	// Install efibootmgr for UEFI
 	if utils.IsUEFI() {
-		result = utils.RunInChroot(m.targetDir, "emerge", "--ask=n", "sys-boot/efibootmgr")
+		result = utils.RunInChroot(m.targetDir, "emerge", "--ask=n", "--noreplace", "sys-boot/efibootmgr")
 		if result.Error != nil {
 			utils.Warn("Failed to install efibootmgr: %v", result.Error)
 		}
@@ -81,7 +112,9 @@ func (m *Manager) configureGRUB() error {
 	var cmdline []string
 
 	// Add encryption support if enabled
-	if m.config.Encryption.Type != config.EncryptNone {
+	if m.cmdline != "" {
+		cmdline = append(cmdline, strings.Fields(m.cmdline)...)
+	} else if m.config.Encryption.Type != config.EncryptNone {
 		// Find root device UUID
 		rootUUID := m.getRootUUID()
 		if rootUUID != "" {
@@ -96,9 +129,12 @@ func (m *Manager) configureGRUB() error {
 	}
 
 	// Graphics options
-	switch m.config.Graphics.Driver {
-	case config.GPUNvidia, config.GPUNvidiaOpen:
-		cmdline = append(cmdline, "nvidia-drm.modeset=1")
+	cmdline = append(cmdline, graphics.NvidiaKernelParams(m.config)...)
+
+	// Kernels on an encrypted root have to be read by GRUB itself
+	var cryptodisk string
+	if m.kernelsEncrypted() {
+		cryptodisk = "\n# Kernels live on an encrypted partition\nGRUB_ENABLE_CRYPTODISK=y\n"
 	}
 
 	content := fmt.Sprintf(`# GRUB configuration - Generated by Yuno OS installer
@@ -113,9 +149,9 @@ GRUB_CMDLINE_LINUX_DEFAULT="quiet"
 GRUB_GFXMODE=auto
 GRUB_GFXPAYLOAD_LINUX=keep
 
-# Security
-GRUB_DISABLE_RECOVERY=true
-`, strings.Join(cmdline, " "))
+# Recovery entries boot single-user without GRUB_CMDLINE_LINUX_DEFAULT
+GRUB_DISABLE_RECOVERY=%t
+%s`, strings.Join(cmdline, " "), !m.config.Bootloader.RescueEntry, cryptodisk)
 
 	confPath := filepath.Join(grubDir, "grub")
 	if err := utils.WriteFile(confPath, content, 0644); err != nil {
@@ -129,15 +165,23 @@ GRUB_DISABLE_RECOVERY=true
 func (m *Manager) installGRUBUEFI() error {
 	utils.Info("Installing GRUB for UEFI")
 
-	// Install GRUB to EFI system partition
-	result := utils.RunInChroot(m.targetDir, "grub-install",
+	args := []string{
 		"--target=x86_64-efi",
-		"--efi-directory=/boot",
+		"--efi-directory=" + m.esp(),
 		"--bootloader-id=YunoOS",
-		"--recheck")
+		"--recheck",
+	}
 
+	// Install GRUB to EFI system partition
+	result := utils.RunInChroot(m.targetDir, "grub-install", args...)
 	if result.Error != nil {
-		return utils.NewError("bootloader", "grub-install failed", result.Error)
+		// Some firmware refuses new boot entries, fall back to the
+		// removable media path (EFI/BOOT/BOOTX64.EFI) that is always tried
+		utils.Warn("grub-install failed, retrying with --removable: %v", result.Error)
+		result = utils.RunInChroot(m.targetDir, "grub-install", append(args, "--removable")...)
+		if result.Error != nil {
+			return utils.NewError("bootloader", "grub-install failed", result.Error)
+		}
 	}
 
 	// Generate GRUB configuration
@@ -171,6 +215,16 @@ func (m *Manager) generateGRUBConfig() error {
 		return utils.NewError("bootloader", "grub-mkconfig failed", result.Error)
 	}
 
+	if m.config.Bootloader.RescueEntry {
+		kernels, err := kernel.NewManager(m.config, m.targetDir).GetInstalledKernels()
+		if err != nil {
+			return err
+		}
+		if _, err := m.rescueKernel(kernels); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -184,7 +238,7 @@ func (m *Manager) installSystemdBoot() error {
 	utils.Info("Installing systemd-boot")
 
 	// Install systemd-boot
-	result := utils.RunInChroot(m.targetDir, "bootctl", "install")
+	result := utils.RunInChroot(m.targetDir, "bootctl", "install", "--esp-path="+m.esp())
 	if result.Error != nil {
 		return utils.NewError("bootloader", "bootctl install failed", result.Error)
 	}
@@ -200,7 +254,7 @@ func (m *Manager) installSystemdBoot() error {
 
 // configureSystemdBoot configures systemd-boot loader.
 func (m *Manager) configureSystemdBoot() error {
-	loaderDir := filepath.Join(m.targetDir, "boot/loader")
+	loaderDir := filepath.Join(m.targetDir, m.esp(), "loader")
 	if err := utils.CreateDir(loaderDir, 0755); err != nil {
 		return err
 	}
@@ -215,208 +269,119 @@ editor no
 	return utils.WriteFile(confPath, content, 0644)
 }
 
-// createSystemdBootEntry creates a boot entry for systemd-boot.
+// createSystemdBootEntry creates a systemd-boot entry for every installed
+// kernel. The newest kernel gets the default entry.
 func (m *Manager) createSystemdBootEntry() error {
-	entriesDir := filepath.Join(m.targetDir, "boot/loader/entries")
+	entriesDir := filepath.Join(m.targetDir, m.esp(), "loader/entries")
 	if err := utils.CreateDir(entriesDir, 0755); err != nil {
 		return err
 	}
 
-	// Get kernel and initramfs
-	kernelVersion := m.getKernelVersion()
-	rootUUID := m.getRootUUID()
+	kernels, err := kernel.NewManager(m.config, m.targetDir).GetInstalledKernels()
+	if err != nil {
+		return err
+	}
 
 	var options []string
-	options = append(options, fmt.Sprintf("root=UUID=%s", rootUUID))
-	options = append(options, "rw")
-
-	if m.config.Encryption.Type != config.EncryptNone {
-		luksUUID := m.getLUKSUUID()
-		if luksUUID != "" {
-			options = append(options, fmt.Sprintf("rd.luks.uuid=%s", luksUUID))
+	if m.cmdline != "" {
+		options = append(options, strings.Fields(m.cmdline)...)
+		options = append(options, "rw")
+	} else {
+		options = append(options, fmt.Sprintf("root=UUID=%s", m.getRootUUID()))
+		options = append(options, "rw")
+
+		if m.config.Encryption.Type != config.EncryptNone {
+			luksUUID := m.getLUKSUUID()
+			if luksUUID != "" {
+				options = append(options, fmt.Sprintf("rd.luks.uuid=%s", luksUUID))
+			}
 		}
 	}
 
-	if m.config.Graphics.Driver == config.GPUNvidia || m.config.Graphics.Driver == config.GPUNvidiaOpen {
-		options = append(options, "nvidia-drm.modeset=1")
-	}
-
-	content := fmt.Sprintf(`title   Yuno OS
-linux   /vmlinuz-%s
-initrd  /initramfs-%s.img
-options %s
-`, kernelVersion, kernelVersion, strings.Join(options, " "))
-
-	entryPath := filepath.Join(entriesDir, "yuno.conf")
-	return utils.WriteFile(entryPath, content, 0644)
-}
-
-// SetupSecureBoot configures Secure Boot.
-func (m *Manager) SetupSecureBoot() error {
-	if !m.config.Bootloader.SecureBoot.Enabled {
-		return nil
-	}
-
-	utils.Info("Setting up Secure Boot")
+	base := options
+	options = append(append([]string(nil), base...), graphics.NvidiaKernelParams(m.config)...)
 
-	// Install required packages
-	result := utils.RunInChroot(m.targetDir, "emerge", "--ask=n",
-		"app-crypt/sbsigntools", "app-crypt/efitools")
-	if result.Error != nil {
-		return utils.NewError("bootloader", "failed to install secure boot tools", result.Error)
-	}
+	for n, k := range kernels {
+		name, title := "yuno.conf", "Yuno OS"
+		if n > 0 {
+			name = fmt.Sprintf("yuno-%s.conf", k.Version)
+			title = fmt.Sprintf("Yuno OS (%s)", k.Version)
+		}
 
-	keyDir := m.config.Bootloader.SecureBoot.KeyDir
-	if keyDir == "" {
-		keyDir = "/etc/secureboot"
+		entryPath := filepath.Join(entriesDir, name)
+		if err := utils.WriteFile(entryPath, systemdBootEntry(title, k, options), 0644); err != nil {
+			return utils.NewError("bootloader", fmt.Sprintf("failed to write boot entry for %s", k.Version), err)
+		}
 	}
 
-	// Generate keys if using custom keys
-	if m.config.Bootloader.SecureBoot.KeyType == "custom" {
-		if err := m.generateSecureBootKeys(keyDir); err != nil {
+	if m.config.Bootloader.RescueEntry {
+		k, err := m.rescueKernel(kernels)
+		if err != nil {
 			return err
 		}
-	}
-
-	// Sign the bootloader and kernel
-	return m.signBootFiles(keyDir)
-}
-
-// generateSecureBootKeys generates MOK keys for Secure Boot.
-func (m *Manager) generateSecureBootKeys(keyDir string) error {
-	utils.Info("Generating Secure Boot keys")
 
-	fullKeyDir := filepath.Join(m.targetDir, keyDir)
-	if err := utils.CreateDir(fullKeyDir, 0700); err != nil {
-		return err
-	}
-
-	// Generate MOK key pair
-	// Create openssl config
-	opensslConf := `[ req ]
-default_bits         = 4096
-encrypt_key          = no
-string_mask          = utf8only
-utf8                 = yes
-prompt               = no
-distinguished_name   = dn
-x509_extensions      = v3_req
-
-[ dn ]
-CN = Yuno OS Secure Boot Signing Key
-
-[ v3_req ]
-basicConstraints     = CA:FALSE
-keyUsage             = digitalSignature
-extendedKeyUsage     = codeSigning
-subjectKeyIdentifier = hash
-`
-	confPath := filepath.Join(fullKeyDir, "openssl.cnf")
-	if err := utils.WriteFile(confPath, opensslConf, 0644); err != nil {
-		return err
-	}
-
-	// Generate key
-	result := utils.RunInChroot(m.targetDir, "openssl", "req",
-		"-new", "-x509",
-		"-newkey", "rsa:4096",
-		"-keyout", filepath.Join(keyDir, "MOK.key"),
-		"-out", filepath.Join(keyDir, "MOK.crt"),
-		"-days", "3650",
-		"-sha256",
-		"-nodes",
-		"-config", filepath.Join(keyDir, "openssl.cnf"))
-
-	if result.Error != nil {
-		return utils.NewError("bootloader", "failed to generate MOK key", result.Error)
-	}
-
-	// Convert to DER format for enrollment
-	result = utils.RunInChroot(m.targetDir, "openssl", "x509",
-		"-in", filepath.Join(keyDir, "MOK.crt"),
-		"-out", filepath.Join(keyDir, "MOK.der"),
-		"-outform", "DER")
-
-	if result.Error != nil {
-		return utils.NewError("bootloader", "failed to convert MOK to DER", result.Error)
+		entryPath := filepath.Join(entriesDir, "yuno-rescue.conf")
+		content := systemdBootEntry("Yuno OS (rescue)", k, rescueOptions(base))
+		if err := utils.WriteFile(entryPath, content, 0644); err != nil {
+			return utils.NewError("bootloader", "failed to write rescue boot entry", err)
+		}
 	}
 
 	return nil
 }
 
-// signBootFiles signs the bootloader and kernel.
-func (m *Manager) signBootFiles(keyDir string) error {
-	utils.Info("Signing boot files")
-
-	keyPath := filepath.Join(keyDir, "MOK.key")
-	certPath := filepath.Join(keyDir, "MOK.crt")
-
-	// Find files to sign
-	bootDir := filepath.Join(m.targetDir, "boot")
-
-	// Sign kernel
-	result := utils.RunCommand("find", bootDir, "-name", "vmlinuz-*")
-	if result.Error == nil {
-		for _, kernel := range strings.Split(result.Stdout, "\n") {
-			if kernel == "" {
-				continue
-			}
-			m.signFile(kernel, keyPath, certPath)
-		}
-	}
-
-	// Sign GRUB EFI if exists
-	grubEFI := filepath.Join(bootDir, "EFI/YunoOS/grubx64.efi")
-	if utils.FileExists(grubEFI) {
-		m.signFile(grubEFI, keyPath, certPath)
+// rescueKernel returns the kernel for the rescue entry: the oldest installed
+// kernel, which is the known-good one once the system has been updated.
+func (m *Manager) rescueKernel(kernels []kernel.KernelInfo) (kernel.KernelInfo, error) {
+	if len(kernels) == 0 {
+		return kernel.KernelInfo{}, utils.NewError("bootloader", "no fallback kernel for the rescue entry", nil)
 	}
 
-	// Enroll keys if requested
-	if m.config.Bootloader.SecureBoot.EnrollKeys {
-		return m.enrollMOK(keyDir)
+	k := kernels[len(kernels)-1]
+	if k.Initramfs == "" && m.config.Encryption.Type != config.EncryptNone {
+		return kernel.KernelInfo{}, utils.NewError("bootloader",
+			fmt.Sprintf("fallback kernel %s has no initramfs to unlock the root partition", k.Version), nil)
 	}
-
-	return nil
+	return k, nil
 }
 
-// signFile signs a single file with sbsign.
-func (m *Manager) signFile(file, keyPath, certPath string) error {
-	utils.Debug("Signing %s", file)
-
-	signedFile := file + ".signed"
-
-	result := utils.RunInChroot(m.targetDir, "sbsign",
-		"--key", keyPath,
-		"--cert", certPath,
-		"--output", signedFile,
-		file)
-
-	if result.Error != nil {
-		return utils.NewError("bootloader", fmt.Sprintf("failed to sign %s", file), result.Error)
-	}
-
-	// Replace original with signed version
-	return utils.RunCommand("mv", signedFile, file).Error
+// rescueOptions returns the command line of the rescue entry: the root and
+// unlock parameters only, booting single-user without graphics drivers.
+func rescueOptions(base []string) []string {
+	return append(append([]string(nil), base...), "single", "nomodeset")
 }
 
-// enrollMOK prepares MOK for enrollment.
-func (m *Manager) enrollMOK(keyDir string) error {
-	utils.Info("Preparing MOK enrollment")
+// systemdBootEntry renders a loader entry. Paths are relative to the ESP,
+// which is mounted at /boot.
+func systemdBootEntry(title string, k kernel.KernelInfo, options []string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "title   %s\n", title)
+	fmt.Fprintf(&b, "version %s\n", k.Version)
+	fmt.Fprintf(&b, "linux   %s\n", strings.TrimPrefix(k.Path, "/boot"))
+	if k.Initramfs != "" {
+		fmt.Fprintf(&b, "initrd  %s\n", strings.TrimPrefix(k.Initramfs, "/boot"))
+	}
+	fmt.Fprintf(&b, "options %s\n", strings.Join(options, " "))
+	return b.String()
+}
 
-	mokDer := filepath.Join(m.targetDir, keyDir, "MOK.der")
+// Helper functions
 
-	// Import MOK for enrollment on next boot
-	result := utils.RunInChroot(m.targetDir, "mokutil", "--import", mokDer)
-	if result.Error != nil {
-		utils.Warn("MOK enrollment will need to be done manually")
-		utils.Info("Run: mokutil --import %s/MOK.der", keyDir)
+// kernelsEncrypted reports whether /boot is on an encrypted root rather
+// than a partition of its own.
+func (m *Manager) kernelsEncrypted() bool {
+	var rootEncrypted, hasBoot bool
+	for _, part := range m.config.Partitions {
+		switch part.MountPoint {
+		case "/":
+			rootEncrypted = part.Encrypt
+		case "/boot":
+			hasBoot = true
+		}
 	}
-
-	return nil
+	return rootEncrypted && !hasBoot && m.config.Encryption.Type != config.EncryptNone
 }
 
-// Helper functions
-
 // getRootUUID returns the UUID of the root partition.
 func (m *Manager) getRootUUID() string {
 	// Try to find root partition
@@ -446,22 +411,6 @@ func (m *Manager) getLUKSUUID() string {
 	return ""
 }
 
-// getKernelVersion returns the installed kernel version.
-func (m *Manager) getKernelVersion() string {
-	bootDir := filepath.Join(m.targetDir, "boot")
-	result := utils.RunCommand("ls", bootDir)
-	if result.Error != nil {
-		return "linux"
-	}
-
-	for _, file := range strings.Split(result.Stdout, "\n") {
-		if strings.HasPrefix(file, "vmlinuz-") {
-			return strings.TrimPrefix(file, "vmlinuz-")
-		}
-	}
-	return "linux"
-}
-
 // getPartitionDevice returns the device path for a partition label.
 func (m *Manager) getPartitionDevice(label string) string {
 	device := m.config.Disk.Device
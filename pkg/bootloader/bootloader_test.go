@@ -0,0 +1,96 @@
+package bootloader
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/japaneseenrichmentorganization/yuno_os/pkg/config"
+	"github.com/japaneseenrichmentorganization/yuno_os/pkg/kernel"
+)
+
+func TestSystemdBootEntry(t *testing.T) {
+	tests := []struct {
+		name   string
+		kernel kernel.KernelInfo
+		want   string
+	}{
+		{
+			"with initramfs",
+			kernel.KernelInfo{
+				Version:   "6.6.30-gentoo-dist",
+				Type:      config.KernelBin,
+				Path:      "/boot/vmlinuz-6.6.30-gentoo-dist",
+				Initramfs: "/boot/initramfs-6.6.30-gentoo-dist.img",
+			},
+			"title   Yuno OS\n" +
+				"version 6.6.30-gentoo-dist\n" +
+				"linux   /vmlinuz-6.6.30-gentoo-dist\n" +
+				"initrd  /initramfs-6.6.30-gentoo-dist.img\n" +
+				"options root=UUID=1234 rw\n",
+		},
+		{
+			"without initramfs",
+			kernel.KernelInfo{Version: "6.9.3", Path: "/boot/vmlinuz-6.9.3"},
+			"title   Yuno OS\n" +
+				"version 6.9.3\n" +
+				"linux   /vmlinuz-6.9.3\n" +
+				"options root=UUID=1234 rw\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := systemdBootEntry("Yuno OS", tt.kernel, []string{"root=UUID=1234", "rw"})
+			if got != tt.want {
+				t.Errorf("systemdBootEntry() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRescueKernel(t *testing.T) {
+	newest := kernel.KernelInfo{Version: "6.10.2-gentoo-dist", Path: "/boot/vmlinuz-6.10.2-gentoo-dist", Initramfs: "/boot/initramfs-6.10.2-gentoo-dist.img"}
+	oldest := kernel.KernelInfo{Version: "6.6.30-gentoo-dist", Path: "/boot/vmlinuz-6.6.30-gentoo-dist", Initramfs: "/boot/initramfs-6.6.30-gentoo-dist.img"}
+	noInitramfs := kernel.KernelInfo{Version: "6.6.9", Path: "/boot/vmlinuz-6.6.9"}
+
+	tests := []struct {
+		name       string
+		kernels    []kernel.KernelInfo
+		encryption config.EncryptionType
+		want       kernel.KernelInfo
+		wantErr    bool
+	}{
+		{"oldest kernel", []kernel.KernelInfo{newest, oldest}, config.EncryptNone, oldest, false},
+		{"single kernel", []kernel.KernelInfo{newest}, config.EncryptLUKS2, newest, false},
+		{"no initramfs unencrypted", []kernel.KernelInfo{newest, noInitramfs}, config.EncryptNone, noInitramfs, false},
+		{"no initramfs encrypted", []kernel.KernelInfo{newest, noInitramfs}, config.EncryptLUKS2, kernel.KernelInfo{}, true},
+		{"no kernels", nil, config.EncryptNone, kernel.KernelInfo{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.NewDefaultConfig()
+			cfg.Encryption.Type = tt.encryption
+
+			got, err := NewManager(cfg, t.TempDir()).rescueKernel(tt.kernels)
+			if gotErr := err != nil; gotErr != tt.wantErr {
+				t.Fatalf("rescueKernel() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("rescueKernel() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRescueOptions(t *testing.T) {
+	// Spare capacity, as the normal entries append their own parameters
+	base := append(make([]string, 0, 8), "root=UUID=1234", "rw")
+	got := rescueOptions(base)
+	_ = append(base, "nvidia-drm.modeset=1")
+
+	want := []string{"root=UUID=1234", "rw", "single", "nomodeset"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("rescueOptions() = %q, want %q (sharing the base array?)", got, want)
+	}
+}
@@ -0,0 +1,302 @@
+package bootloader
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/japaneseenrichmentorganization/yuno_os/pkg/config"
+	"github.com/japaneseenrichmentorganization/yuno_os/pkg/utils"
+)
+
+// setupModeVar is the EFI variable holding whether the firmware is in
+// Secure Boot setup mode.
+const setupModeVar = "/sys/firmware/efi/efivars/SetupMode-8be4df61-93ca-11d2-aa0d-00e098032b8c"
+
+// defaultMOKDir holds the Machine Owner Key used with shim.
+const defaultMOKDir = "/etc/secureboot"
+
+// InSetupMode reports whether the firmware is in Secure Boot setup mode,
+// the only mode in which new platform keys can be enrolled.
+func InSetupMode() (bool, error) {
+	data, err := os.ReadFile(setupModeVar)
+	if err != nil {
+		return false, utils.NewError("bootloader", "failed to read the SetupMode EFI variable", err)
+	}
+
+	// Four bytes of attributes followed by the value
+	if len(data) < 5 {
+		return false, utils.NewError("bootloader", "unexpected SetupMode EFI variable contents", nil)
+	}
+	return data[4] == 1, nil
+}
+
+// SetupSecureBoot configures Secure Boot.
+func (m *Manager) SetupSecureBoot() error {
+	sb := m.config.Bootloader.SecureBoot
+	if !sb.Enabled {
+		return nil
+	}
+
+	if !utils.IsUEFI() {
+		return utils.NewError("bootloader", "Secure Boot requires UEFI", nil)
+	}
+
+	switch sb.KeyType {
+	case config.SecureBootShim:
+		return m.setupShim()
+	default:
+		return m.setupCustomKeys()
+	}
+}
+
+// setupCustomKeys replaces the firmware keys with keys of our own using
+// sbctl, then signs the boot chain with them.
+func (m *Manager) setupCustomKeys() error {
+	utils.Info("Setting up Secure Boot with custom keys")
+
+	enroll := m.config.Bootloader.SecureBoot.EnrollKeys
+
+	// Fail before touching anything if enrollment cannot work
+	if enroll {
+		setupMode, err := InSetupMode()
+		if err != nil {
+			return err
+		}
+		if !setupMode {
+			return utils.NewError("bootloader",
+				"firmware is not in Secure Boot setup mode: clear the platform key in the firmware settings, or disable enroll_keys and run 'sbctl enroll-keys --microsoft' later", nil)
+		}
+	}
+
+	result := utils.RunInChroot(m.targetDir, "emerge", "--ask=n", "--noreplace", "app-crypt/sbctl")
+	if result.Error != nil {
+		return utils.NewError("bootloader", "failed to install sbctl", result.Error)
+	}
+
+	if !utils.FileExists(filepath.Join(m.targetDir, "var/lib/sbctl/keys")) {
+		result = utils.RunInChroot(m.targetDir, "sbctl", "create-keys")
+		if result.Error != nil {
+			return utils.NewError("bootloader", "failed to create Secure Boot keys", result.Error)
+		}
+	}
+
+	// -s records the files so sbctl re-signs them when they are updated
+	for _, file := range m.bootFilesToSign() {
+		utils.Debug("Signing %s", file)
+		result = utils.RunInChroot(m.targetDir, "sbctl", "sign", "-s", file)
+		if result.Error != nil {
+			return utils.NewError("bootloader", fmt.Sprintf("failed to sign %s", file), result.Error)
+		}
+	}
+
+	if !enroll {
+		utils.Info("Secure Boot keys created but not enrolled")
+		utils.Info("Put the firmware in setup mode and run: sbctl enroll-keys --microsoft")
+		return nil
+	}
+
+	// Keep Microsoft's keys so firmware option ROMs still load
+	result = utils.RunInChroot(m.targetDir, "sbctl", "enroll-keys", "--microsoft")
+	if result.Error != nil {
+		return utils.NewError("bootloader", "failed to enroll Secure Boot keys", result.Error)
+	}
+
+	return nil
+}
+
+// setupShim boots GRUB through the Microsoft-signed shim and signs GRUB and
+// the kernels with a Machine Owner Key.
+func (m *Manager) setupShim() error {
+	utils.Info("Setting up Secure Boot with shim")
+
+	result := utils.RunInChroot(m.targetDir, "emerge", "--ask=n", "--noreplace",
+		"sys-boot/shim", "sys-boot/mokutil", "app-crypt/sbsigntools")
+	if result.Error != nil {
+		return utils.NewError("bootloader", "failed to install shim", result.Error)
+	}
+
+	keyDir := m.config.Bootloader.SecureBoot.KeyDir
+	if keyDir == "" {
+		keyDir = defaultMOKDir
+	}
+
+	if !utils.FileExists(filepath.Join(m.targetDir, keyDir, "MOK.key")) {
+		if err := m.generateMOK(keyDir); err != nil {
+			return err
+		}
+	}
+
+	// shim loads grubx64.efi from its own directory
+	vendorDir := filepath.Join(m.targetDir, m.esp(), "EFI/YunoOS")
+	shimFiles := []struct{ src, dst string }{
+		{"BOOTX64.EFI", "shimx64.efi"},
+		{"mmx64.efi", "mmx64.efi"},
+	}
+	for _, f := range shimFiles {
+		if err := utils.CopyFile(filepath.Join(m.targetDir, "usr/share/shim", f.src), filepath.Join(vendorDir, f.dst)); err != nil {
+			return utils.NewError("bootloader", fmt.Sprintf("failed to install %s", f.dst), err)
+		}
+	}
+
+	keyPath := filepath.Join(keyDir, "MOK.key")
+	certPath := filepath.Join(keyDir, "MOK.crt")
+	for _, file := range m.bootFilesToSign() {
+		if err := m.signFile(file, keyPath, certPath); err != nil {
+			return err
+		}
+	}
+
+	if err := m.addShimBootEntry(); err != nil {
+		return err
+	}
+
+	if m.config.Bootloader.SecureBoot.EnrollKeys {
+		return m.enrollMOK(keyDir)
+	}
+
+	utils.Info("Enroll the MOK on first boot with: mokutil --import %s/MOK.der", keyDir)
+	return nil
+}
+
+// generateMOK generates a Machine Owner Key pair under keyDir in the target.
+func (m *Manager) generateMOK(keyDir string) error {
+	utils.Info("Generating Machine Owner Key")
+
+	if err := utils.CreateDir(filepath.Join(m.targetDir, keyDir), 0700); err != nil {
+		return err
+	}
+
+	opensslConf := `[ req ]
+default_bits         = 4096
+encrypt_key          = no
+string_mask          = utf8only
+utf8                 = yes
+prompt               = no
+distinguished_name   = dn
+x509_extensions      = v3_req
+
+[ dn ]
+CN = Yuno OS Secure Boot Signing Key
+
+[ v3_req ]
+basicConstraints     = CA:FALSE
+keyUsage             = digitalSignature
+extendedKeyUsage     = codeSigning
+subjectKeyIdentifier = hash
+`
+	confPath := filepath.Join(m.targetDir, keyDir, "openssl.cnf")
+	if err := utils.WriteFile(confPath, opensslConf, 0644); err != nil {
+		return err
+	}
+
+	result := utils.RunInChroot(m.targetDir, "openssl", "req",
+		"-new", "-x509",
+		"-newkey", "rsa:4096",
+		"-keyout", filepath.Join(keyDir, "MOK.key"),
+		"-out", filepath.Join(keyDir, "MOK.crt"),
+		"-days", "3650",
+		"-sha256",
+		"-nodes",
+		"-config", filepath.Join(keyDir, "openssl.cnf"))
+	if result.Error != nil {
+		return utils.NewError("bootloader", "failed to generate MOK key", result.Error)
+	}
+
+	// mokutil wants the certificate in DER format
+	result = utils.RunInChroot(m.targetDir, "openssl", "x509",
+		"-in", filepath.Join(keyDir, "MOK.crt"),
+		"-out", filepath.Join(keyDir, "MOK.der"),
+		"-outform", "DER")
+	if result.Error != nil {
+		return utils.NewError("bootloader", "failed to convert MOK to DER", result.Error)
+	}
+
+	return nil
+}
+
+// bootFilesToSign returns the kernels and EFI binaries that need a
+// signature, as paths inside the target.
+func (m *Manager) bootFilesToSign() []string {
+	var files []string
+
+	kernels, _ := filepath.Glob(filepath.Join(m.targetDir, "boot/vmlinuz-*"))
+	for _, k := range kernels {
+		files = append(files, strings.TrimPrefix(k, m.targetDir))
+	}
+
+	esp := m.esp()
+	candidates := []string{"EFI/YunoOS/grubx64.efi", "EFI/systemd/systemd-bootx64.efi"}
+	if m.config.Bootloader.SecureBoot.KeyType != config.SecureBootShim {
+		// With shim the fallback path holds Microsoft-signed binaries
+		candidates = append(candidates, "EFI/BOOT/BOOTX64.EFI")
+	}
+	for _, c := range candidates {
+		if utils.FileExists(filepath.Join(m.targetDir, esp, c)) {
+			files = append(files, filepath.Join(esp, c))
+		}
+	}
+
+	return files
+}
+
+// signFile signs a file inside the target with sbsign.
+func (m *Manager) signFile(file, keyPath, certPath string) error {
+	utils.Debug("Signing %s", file)
+
+	result := utils.RunInChroot(m.targetDir, "sbsign",
+		"--key", keyPath,
+		"--cert", certPath,
+		"--output", file,
+		file)
+	if result.Error != nil {
+		return utils.NewError("bootloader", fmt.Sprintf("failed to sign %s", file), result.Error)
+	}
+
+	return nil
+}
+
+// addShimBootEntry registers shim as the firmware boot entry.
+func (m *Manager) addShimBootEntry() error {
+	espDir := filepath.Join(m.targetDir, m.esp())
+
+	source := utils.RunCommand("findmnt", "-no", "SOURCE", espDir)
+	if source.Error != nil || source.Stdout == "" {
+		return utils.NewError("bootloader", "failed to find the EFI system partition device", source.Error)
+	}
+	device := filepath.Base(source.Stdout)
+
+	disk := utils.RunCommand("lsblk", "-no", "PKNAME", source.Stdout)
+	partNum, err := utils.ReadFile(filepath.Join("/sys/class/block", device, "partition"))
+	if disk.Error != nil || err != nil {
+		return utils.NewError("bootloader", fmt.Sprintf("failed to find the disk of %s", source.Stdout), err)
+	}
+
+	result := utils.RunCommand("efibootmgr", "--create",
+		"--disk", "/dev/"+strings.TrimSpace(disk.Stdout),
+		"--part", strings.TrimSpace(partNum),
+		"--label", "Yuno OS",
+		"--loader", `\EFI\YunoOS\shimx64.efi`)
+	if result.Error != nil {
+		return utils.NewError("bootloader", "failed to create the shim boot entry", result.Error)
+	}
+
+	return nil
+}
+
+// enrollMOK queues the MOK for enrollment. shim's MokManager completes it
+// on the next boot after asking for the root password.
+func (m *Manager) enrollMOK(keyDir string) error {
+	utils.Info("Queueing MOK enrollment")
+
+	result := utils.RunInChroot(m.targetDir, "mokutil", "--root-pw", "--import", filepath.Join(keyDir, "MOK.der"))
+	if result.Error != nil {
+		utils.Warn("MOK enrollment will need to be done manually")
+		utils.Info("Run: mokutil --import %s/MOK.der", keyDir)
+		return nil
+	}
+
+	utils.Info("Confirm the key in MokManager on the next boot using the root password")
+	return nil
+}
@@ -5,8 +5,11 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strings"
 
 	"github.com/japaneseenrichmentorganization/yuno_os/pkg/config"
+	"github.com/japaneseenrichmentorganization/yuno_os/pkg/portage"
 	"github.com/japaneseenrichmentorganization/yuno_os/pkg/utils"
 )
 
@@ -91,6 +94,12 @@ func (m *Manager) Setup() error {
 		m.mounted = append(m.mounted, mount.Target)
 	}
 
+	if m.config.Portage.ShareHostCache {
+		if err := m.BindCaches(); err != nil {
+			return err
+		}
+	}
+
 	// Copy DNS resolution
 	if err := m.copyResolv(); err != nil {
 		utils.Warn("Failed to copy resolv.conf: %v", err)
@@ -99,6 +108,78 @@ func (m *Manager) Setup() error {
 	return nil
 }
 
+// BindCaches bind-mounts the host's distfiles and binary package caches
+// into the chroot, so downloads and built packages outlive the install.
+func (m *Manager) BindCaches() error {
+	caches := []struct{ host, target string }{
+		{config.DefaultDistDir, m.config.Portage.GetDistDir()},
+		{config.DefaultPkgDir, m.config.Portage.GetPkgDir()},
+	}
+
+	for _, cache := range caches {
+		target := filepath.Join(m.targetDir, cache.target)
+		if utils.IsMounted(target) {
+			utils.Debug("Already mounted: %s", target)
+			continue
+		}
+
+		for _, dir := range []string{cache.host, target} {
+			if err := utils.CreateDir(dir, 0755); err != nil {
+				return utils.NewError("chroot", fmt.Sprintf("failed to create %s", dir), err)
+			}
+		}
+
+		utils.Info("Sharing host cache %s", cache.host)
+		if err := utils.BindMount(cache.host, target); err != nil {
+			return err
+		}
+		m.mounted = append(m.mounted, target)
+	}
+
+	return nil
+}
+
+// overlayScratchDir holds the tmpfs with the overlay's upper and work
+// directories.
+const overlayScratchDir = "/run/yuno-overlay"
+
+// SetupOverlay mounts target as an overlayfs over lower, typically an
+// extracted stage3, with its changes kept in a tmpfs. Everything written to
+// the chroot is discarded by Teardown.
+func (m *Manager) SetupOverlay(lower, target string) error {
+	utils.Info("Mounting throwaway overlay of %s at %s", lower, target)
+
+	if !utils.DirExists(lower) {
+		return utils.NewError("chroot", fmt.Sprintf("overlay lower directory %s does not exist", lower), nil)
+	}
+
+	scratch := filepath.Join(overlayScratchDir, filepath.Base(target))
+	if err := utils.CreateDir(scratch, 0755); err != nil {
+		return utils.NewError("chroot", fmt.Sprintf("failed to create %s", scratch), err)
+	}
+	if err := utils.Mount("tmpfs", scratch, "tmpfs", "mode=0755"); err != nil {
+		return err
+	}
+	m.mounted = append(m.mounted, scratch)
+
+	upper := filepath.Join(scratch, "upper")
+	work := filepath.Join(scratch, "work")
+	for _, dir := range []string{upper, work, target} {
+		if err := utils.CreateDir(dir, 0755); err != nil {
+			return utils.NewError("chroot", fmt.Sprintf("failed to create %s", dir), err)
+		}
+	}
+
+	options := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", lower, upper, work)
+	if err := utils.Mount("overlay", target, "overlay", options); err != nil {
+		return err
+	}
+	m.mounted = append(m.mounted, target)
+	m.targetDir = target
+
+	return nil
+}
+
 // copyResolv copies /etc/resolv.conf into the chroot.
 func (m *Manager) copyResolv() error {
 	srcPath := "/etc/resolv.conf"
@@ -178,12 +259,16 @@ func (m *Manager) RunInteractive() error {
 func (m *Manager) Emerge(packages ...string) error {
 	args := append([]string{"--ask=n", "--quiet-build"}, packages...)
 
-	result := m.RunWithEnv(map[string]string{
-		"USE":             m.config.Portage.UseFlags[0], // This needs proper handling
-		"FEATURES":        "parallel-fetch",
-		"EMERGE_DEFAULT_OPTS": "--jobs=4 --load-average=4",
-	}, "emerge", args...)
+	jobs := emergeJobs(m.config.Portage.MakeOpts)
+	env := map[string]string{
+		"FEATURES":            "parallel-fetch",
+		"EMERGE_DEFAULT_OPTS": fmt.Sprintf("--jobs=%d --load-average=%d", jobs, jobs),
+	}
+	if len(m.config.Portage.UseFlags) > 0 {
+		env["USE"] = strings.Join(m.config.Portage.UseFlags, " ")
+	}
 
+	result := m.RunWithEnv(env, "emerge", args...)
 	if result.Error != nil {
 		return utils.NewError("chroot", fmt.Sprintf("emerge failed: %s", result.Stderr), result.Error)
 	}
@@ -191,11 +276,25 @@ func (m *Manager) Emerge(packages ...string) error {
 	return nil
 }
 
+// emergeJobs returns the job count from MAKEOPTS, falling back to the
+// number of CPUs.
+func emergeJobs(makeOpts string) int {
+	if jobs, _, err := config.ParseMakeOpts(makeOpts); err == nil && jobs > 0 {
+		return jobs
+	}
+	return utils.GetCPUCount()
+}
+
 // EmergeWithOutput runs emerge with output streaming.
 func (m *Manager) EmergeWithOutput(callback func(line string), packages ...string) error {
 	args := append([]string{m.targetDir, "emerge", "--ask=n"}, packages...)
 
-	return utils.RunCommandWithOutput(callback, "chroot", args...)
+	result := utils.RunCommandStreaming(callback, "chroot", args...)
+	if result.Error != nil {
+		return utils.NewError("chroot", "emerge failed", result.Error)
+	}
+
+	return nil
 }
 
 // WriteFile writes a file inside the chroot.
@@ -230,12 +329,7 @@ func (m *Manager) CreateDir(path string, perm os.FileMode) error {
 
 // Symlink creates a symbolic link inside the chroot.
 func (m *Manager) Symlink(oldname, newname string) error {
-	fullNewname := filepath.Join(m.targetDir, newname)
-
-	// Remove existing symlink if present
-	os.Remove(fullNewname)
-
-	return os.Symlink(oldname, fullNewname)
+	return utils.Symlink(oldname, filepath.Join(m.targetDir, newname))
 }
 
 // SourceProfile sources /etc/profile in the chroot.
@@ -243,16 +337,9 @@ func (m *Manager) SourceProfile() *utils.CommandResult {
 	return m.Run("/bin/bash", "-c", "source /etc/profile")
 }
 
-// SyncPortage syncs the portage tree.
+// SyncPortage syncs the portage tree, see portage.Manager.SyncPortage.
 func (m *Manager) SyncPortage() error {
-	utils.Info("Syncing Portage tree")
-
-	result := m.Run("emerge-webrsync")
-	if result.Error != nil {
-		return utils.NewError("chroot", "failed to sync portage", result.Error)
-	}
-
-	return nil
+	return portage.NewManager(m.config, m.targetDir).SyncPortage()
 }
 
 // SelectProfile selects a Gentoo profile.
@@ -265,16 +352,7 @@ func (m *Manager) SelectProfile(profile string) error {
 		return utils.NewError("chroot", "failed to list profiles", result.Error)
 	}
 
-	// Find the profile number
-	lines := filepath.SplitList(result.Stdout)
-	var profileNum string
-	for _, line := range lines {
-		if filepath.Base(line) == profile || line == profile {
-			// Extract number from line like "[23]  default/linux/amd64/23.0/desktop"
-			fmt.Sscanf(line, "[%s]", &profileNum)
-			break
-		}
-	}
+	profileNum := findProfileNumber(result.Stdout, profile)
 
 	// Set the profile
 	if profileNum != "" {
@@ -291,6 +369,22 @@ func (m *Manager) SelectProfile(profile string) error {
 	return nil
 }
 
+// profileLinePattern matches an entry of "eselect profile list", e.g.
+// "  [23]  default/linux/amd64/23.0/desktop (stable) *".
+var profileLinePattern = regexp.MustCompile(`^\s*\[(\d+)\]\s+(\S+)(?:\s+\([^)]*\))?(?:\s+\*)?\s*$`)
+
+// findProfileNumber returns the number of profile in the output of
+// "eselect profile list", or "" if it is not listed.
+func findProfileNumber(output, profile string) string {
+	for _, line := range strings.Split(output, "\n") {
+		match := profileLinePattern.FindStringSubmatch(line)
+		if match != nil && match[2] == profile {
+			return match[1]
+		}
+	}
+	return ""
+}
+
 // UpdateEnvironment updates the environment after profile changes.
 func (m *Manager) UpdateEnvironment() error {
 	utils.Info("Updating environment")
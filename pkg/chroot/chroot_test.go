@@ -0,0 +1,72 @@
+package chroot
+
+import (
+	"testing"
+
+	"github.com/japaneseenrichmentorganization/yuno_os/pkg/config"
+	"github.com/japaneseenrichmentorganization/yuno_os/pkg/utils"
+)
+
+func TestEmergeJobs(t *testing.T) {
+	tests := []struct {
+		makeOpts string
+		want     int
+	}{
+		{"-j8", 8},
+		{"-j8 -l8", 8},
+		{"--jobs=12", 12},
+		{"-j 6", 6},
+		{"", utils.GetCPUCount()},
+		{"-l4", utils.GetCPUCount()},
+		{"-j0", utils.GetCPUCount()},
+	}
+
+	for _, tt := range tests {
+		if got := emergeJobs(tt.makeOpts); got != tt.want {
+			t.Errorf("emergeJobs(%q) = %d, want %d", tt.makeOpts, got, tt.want)
+		}
+	}
+}
+
+func TestEmergeWithoutUseFlags(t *testing.T) {
+	utils.SetDryRun(true)
+	defer utils.SetDryRun(false)
+
+	for _, useFlags := range [][]string{nil, {}, {"X", "-gnome"}} {
+		cfg := config.NewDefaultConfig()
+		cfg.Portage.UseFlags = useFlags
+		if err := NewManager(cfg, "/mnt/test").Emerge("app-editors/vim"); err != nil {
+			t.Errorf("Emerge() with USE %q error = %v", useFlags, err)
+		}
+	}
+}
+
+func TestFindProfileNumber(t *testing.T) {
+	const list = `Available profile symlink targets:
+  [1]   default/linux/amd64/23.0 (stable)
+  [2]   default/linux/amd64/23.0/systemd (stable)
+  [3]   default/linux/amd64/23.0/desktop (stable) *
+  [4]   default/linux/amd64/23.0/desktop/systemd (stable)
+  [10]  default/linux/amd64/23.0/no-multilib (exp)
+  [11]  default/linux/amd64/23.0/musl
+`
+
+	tests := []struct {
+		profile string
+		want    string
+	}{
+		{"default/linux/amd64/23.0", "1"},
+		{"default/linux/amd64/23.0/desktop", "3"},
+		{"default/linux/amd64/23.0/desktop/systemd", "4"},
+		{"default/linux/amd64/23.0/no-multilib", "10"},
+		{"default/linux/amd64/23.0/musl", "11"},
+		{"desktop", ""},
+		{"default/linux/amd64/17.1", ""},
+	}
+
+	for _, tt := range tests {
+		if got := findProfileNumber(list, tt.profile); got != tt.want {
+			t.Errorf("findProfileNumber(%q) = %q, want %q", tt.profile, got, tt.want)
+		}
+	}
+}
@@ -2,9 +2,16 @@
 package config
 
 import (
+	"encoding/json"
 	"fmt"
+	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
 	"runtime"
+	"strconv"
+	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
@@ -12,50 +19,129 @@ import (
 // InstallConfig holds the complete installation configuration.
 type InstallConfig struct {
 	// System configuration
-	Hostname string `yaml:"hostname"`
-	Timezone string `yaml:"timezone"`
-	Locale   string `yaml:"locale"`
-	Keymap   string `yaml:"keymap"`
+	Hostname string `yaml:"hostname" json:"hostname"`
+	Timezone string `yaml:"timezone" json:"timezone"`
+	Locale   string `yaml:"locale" json:"locale"`
+	Keymap   string `yaml:"keymap" json:"keymap"`
+	Editor   string `yaml:"editor,omitempty" json:"editor,omitempty"` // System-wide EDITOR and VISUAL, nano if empty
 
 	// Disk and partitioning
-	Disk       DiskConfig       `yaml:"disk"`
-	Partitions []PartitionConfig `yaml:"partitions"`
-	Encryption EncryptionConfig `yaml:"encryption"`
+	Disk       DiskConfig       `yaml:"disk" json:"disk"`
+	Partitions []PartitionConfig `yaml:"partitions" json:"partitions"`
+	SwapFile   SwapFileConfig   `yaml:"swap_file,omitempty" json:"swap_file,omitempty"`
+	Encryption EncryptionConfig `yaml:"encryption" json:"encryption"`
 
 	// Init system
-	InitSystem InitSystem `yaml:"init_system"`
+	InitSystem InitSystem `yaml:"init_system" json:"init_system"`
 
 	// Portage configuration
-	Portage PortageConfig `yaml:"portage"`
+	Portage PortageConfig `yaml:"portage" json:"portage"`
+
+	// Distributed compilation
+	Distcc DistccConfig `yaml:"distcc" json:"distcc"`
 
 	// Overlays
-	Overlays []OverlayConfig `yaml:"overlays"`
+	Overlays []OverlayConfig `yaml:"overlays" json:"overlays"`
 
 	// Kernel
-	Kernel KernelConfig `yaml:"kernel"`
+	Kernel KernelConfig `yaml:"kernel" json:"kernel"`
 
 	// Graphics
-	Graphics GraphicsConfig `yaml:"graphics"`
+	Graphics GraphicsConfig `yaml:"graphics" json:"graphics"`
 
 	// Desktop
-	Desktop DesktopConfig `yaml:"desktop"`
+	Desktop DesktopConfig `yaml:"desktop" json:"desktop"`
 
 	// Bootloader
-	Bootloader BootloaderConfig `yaml:"bootloader"`
+	Bootloader BootloaderConfig `yaml:"bootloader" json:"bootloader"`
 
 	// Users
-	RootPassword string       `yaml:"root_password"`
-	Users        []UserConfig `yaml:"users"`
+	RootPassword string       `yaml:"root_password" json:"root_password"`
+	Users        []UserConfig `yaml:"users" json:"users"`
+
+	// SSHKeyOnly turns off SSH password logins, only the users' SSH keys
+	// are accepted
+	SSHKeyOnly bool `yaml:"ssh_key_only" json:"ssh_key_only"`
 
 	// Package management
-	Packages PackageConfig `yaml:"packages"`
+	Packages PackageConfig `yaml:"packages" json:"packages"`
+
+	// Services enabled at boot on top of the essential ones
+	Services []string `yaml:"services,omitempty" json:"services,omitempty"`
+
+	// Firewall installs nftables with a ruleset that only accepts SSH
+	Firewall bool `yaml:"firewall" json:"firewall"`
+
+	// Stage3 selection
+	Stage3 Stage3Config `yaml:"stage3" json:"stage3"`
+
+	// Directory the new system is mounted at and installed into,
+	// /mnt/gentoo if empty
+	TargetDir string `yaml:"target_dir,omitempty" json:"target_dir,omitempty"`
+
+	// Reproducible forbids host- and time-dependent settings so the same
+	// config produces the same install on every machine
+	Reproducible bool `yaml:"reproducible" json:"reproducible"`
+
+	// Scripts run inside the new system once services are enabled.
+	// A trailing "?" marks a script whose failure is only a warning.
+	PostInstallScripts []string `yaml:"post_install_scripts,omitempty" json:"post_install_scripts,omitempty"`
+
+	// What to do once installation finishes
+	PostInstall PostInstallAction `yaml:"post_install" json:"post_install"`
+}
+
+// Stage3Config selects the stage3 tarball.
+type Stage3Config struct {
+	Date    string `yaml:"date,omitempty" json:"date,omitempty"`       // Build to install (e.g., 20240101T170000Z), latest if empty
+	Tarball string `yaml:"tarball,omitempty" json:"tarball,omitempty"` // Local stage3 tarball to install instead of downloading one
 }
 
+// Stage3DateLayout is the time layout of stage3 build dates.
+const Stage3DateLayout = "20060102T150405Z"
+
+// SnapshotDateLayout is the time layout of Portage snapshot dates.
+const SnapshotDateLayout = "20060102"
+
+// PostInstallAction defines what happens after a successful installation.
+type PostInstallAction string
+
+const (
+	PostInstallExit     PostInstallAction = "exit"     // Unmount and return to the live environment
+	PostInstallReboot   PostInstallAction = "reboot"   // Unmount and reboot
+	PostInstallPoweroff PostInstallAction = "poweroff" // Unmount and power off
+	PostInstallChroot   PostInstallAction = "chroot"   // Drop into a shell inside the new system
+)
+
 // DiskConfig holds disk selection configuration.
 type DiskConfig struct {
-	Device     string           `yaml:"device"`      // e.g., /dev/sda, /dev/nvme0n1
-	WipeAll    bool             `yaml:"wipe_all"`    // Erase entire disk
-	PartScheme PartitionScheme  `yaml:"part_scheme"` // GPT or MBR
+	Device     string           `yaml:"device" json:"device"`      // e.g., /dev/sda, /dev/nvme0n1
+	WipeAll    bool             `yaml:"wipe_all" json:"wipe_all"`    // Erase entire disk
+	PartScheme PartitionScheme  `yaml:"part_scheme" json:"part_scheme"` // GPT or MBR
+	BackupDir  string           `yaml:"backup_dir,omitempty" json:"backup_dir,omitempty"` // Save the partition table and LUKS headers here before partitioning
+}
+
+// SwapFileConfig defines a swap file on the root filesystem, used instead
+// of a swap partition.
+type SwapFileConfig struct {
+	Size string `yaml:"size,omitempty" json:"size,omitempty"` // e.g., "8G", no swap file if empty
+	Path string `yaml:"path,omitempty" json:"path,omitempty"` // Path in the new system, DefaultSwapFilePath if empty
+}
+
+// DefaultSwapFilePath is where the swap file is created unless configured.
+const DefaultSwapFilePath = "/swapfile"
+
+// Enabled reports whether a swap file is configured.
+func (s SwapFileConfig) Enabled() bool {
+	return s.Size != ""
+}
+
+// FilePath returns the path of the swap file in the new system.
+func (s SwapFileConfig) FilePath() string {
+	if s.Path == "" {
+		return DefaultSwapFilePath
+	}
+	return filepath.Clean(s.Path)
 }
 
 // PartitionScheme defines the partition table type.
@@ -68,12 +154,18 @@ const (
 
 // PartitionConfig defines a single partition.
 type PartitionConfig struct {
-	Label      string     `yaml:"label"`       // Partition label
-	Size       string     `yaml:"size"`        // Size (e.g., "512M", "50G", "100%FREE")
-	Filesystem Filesystem `yaml:"filesystem"`  // Filesystem type
-	MountPoint string     `yaml:"mount_point"` // Mount point (e.g., "/", "/boot", "/home")
-	Flags      []string   `yaml:"flags"`       // Partition flags (e.g., "boot", "esp")
-	Encrypt    bool       `yaml:"encrypt"`     // Whether to encrypt this partition
+	Label      string     `yaml:"label" json:"label"`       // Partition label
+	Size       string     `yaml:"size" json:"size"`        // Size (e.g., "512M", "50G", "100%FREE")
+	Filesystem Filesystem `yaml:"filesystem" json:"filesystem"`  // Filesystem type
+	MountPoint string     `yaml:"mount_point" json:"mount_point"` // Mount point (e.g., "/", "/boot", "/home")
+	Flags      []string   `yaml:"flags" json:"flags"`       // Partition flags (e.g., "boot", "esp")
+	Encrypt    bool       `yaml:"encrypt" json:"encrypt"`     // Whether to encrypt this partition
+	MkfsOptions []string   `yaml:"mkfs_options,omitempty" json:"mkfs_options,omitempty"` // Extra mkfs options (e.g., ["-O", "^has_journal"])
+
+	// Per-partition credentials; fall back to the global encryption settings
+	Password       string `yaml:"password,omitempty" json:"password,omitempty"`
+	KeyFile        string `yaml:"key_file,omitempty" json:"key_file,omitempty"`
+	UnlockWithRoot bool   `yaml:"unlock_with_root,omitempty" json:"unlock_with_root,omitempty"` // Unlock from a key file stored on the root filesystem
 }
 
 // Filesystem defines supported filesystem types.
@@ -92,13 +184,13 @@ const (
 
 // EncryptionConfig defines encryption settings.
 type EncryptionConfig struct {
-	Type       EncryptionType `yaml:"type"`
-	Password   string         `yaml:"password"`
-	KeyFile    string         `yaml:"key_file,omitempty"`
-	Cipher     string         `yaml:"cipher,omitempty"`      // For LUKS
-	KeySize    int            `yaml:"key_size,omitempty"`    // For LUKS
-	Hash       string         `yaml:"hash,omitempty"`        // For LUKS
-	ZFSDataset string         `yaml:"zfs_dataset,omitempty"` // For ZFS encryption
+	Type       EncryptionType `yaml:"type" json:"type"`
+	Password   string         `yaml:"password" json:"password"`
+	KeyFile    string         `yaml:"key_file,omitempty" json:"key_file,omitempty"`
+	Cipher     string         `yaml:"cipher,omitempty" json:"cipher,omitempty"`      // For LUKS
+	KeySize    int            `yaml:"key_size,omitempty" json:"key_size,omitempty"`    // For LUKS
+	Hash       string         `yaml:"hash,omitempty" json:"hash,omitempty"`        // For LUKS
+	ZFSDataset string         `yaml:"zfs_dataset,omitempty" json:"zfs_dataset,omitempty"` // For ZFS encryption
 }
 
 // EncryptionType defines supported encryption types.
@@ -122,21 +214,152 @@ const (
 
 // PortageConfig holds Portage/make.conf configuration.
 type PortageConfig struct {
-	Profile    string            `yaml:"profile"`     // Gentoo profile path
-	CFlagsPreset CFlagsPreset    `yaml:"cflags_preset"`
-	CFlags     string            `yaml:"cflags"`      // Custom CFLAGS if preset is "custom"
-	CXXFlags   string            `yaml:"cxxflags"`    // Usually "${CFLAGS}"
-	MakeOpts   string            `yaml:"makeopts"`    // e.g., "-j8"
-	UseFlags   []string          `yaml:"use_flags"`   // Global USE flags
-	Features   []string          `yaml:"features"`    // FEATURES
-	Mirrors    []string          `yaml:"mirrors"`     // GENTOO_MIRRORS
-	AcceptKeywords string        `yaml:"accept_keywords,omitempty"`
-	AcceptLicense  string        `yaml:"accept_license,omitempty"`
-	VideoCards []string          `yaml:"video_cards"` // VIDEO_CARDS
-	InputDevices []string        `yaml:"input_devices"` // INPUT_DEVICES
-	Extra      map[string]string `yaml:"extra,omitempty"` // Additional make.conf entries
+	Profile    string            `yaml:"profile" json:"profile"`     // Gentoo profile path
+	CFlagsPreset CFlagsPreset    `yaml:"cflags_preset" json:"cflags_preset"`
+	CFlags     string            `yaml:"cflags" json:"cflags"`      // Custom CFLAGS if preset is "custom"
+	CXXFlags   string            `yaml:"cxxflags" json:"cxxflags"`    // Usually "${CFLAGS}"
+	MakeOpts   string            `yaml:"makeopts" json:"makeopts"`    // e.g., "-j8"
+	UseFlags   []string          `yaml:"use_flags" json:"use_flags"`   // Global USE flags
+	Features   []string          `yaml:"features" json:"features"`    // FEATURES
+	Mirrors    []string          `yaml:"mirrors" json:"mirrors"`     // GENTOO_MIRRORS
+	AcceptKeywords string        `yaml:"accept_keywords,omitempty" json:"accept_keywords,omitempty"`
+	AcceptLicense  string        `yaml:"accept_license,omitempty" json:"accept_license,omitempty"`
+	VideoCards []string          `yaml:"video_cards" json:"video_cards"` // VIDEO_CARDS
+	InputDevices []string        `yaml:"input_devices" json:"input_devices"` // INPUT_DEVICES
+	DistDir    string            `yaml:"distdir,omitempty" json:"distdir,omitempty"`   // DISTDIR (distfiles location)
+	PkgDir     string            `yaml:"pkgdir,omitempty" json:"pkgdir,omitempty"`    // PKGDIR (binary packages location)
+	RepoDir    string            `yaml:"repo_dir,omitempty" json:"repo_dir,omitempty"`  // Location of the gentoo repository
+	Snapshot   string            `yaml:"snapshot,omitempty" json:"snapshot,omitempty"`  // Portage snapshot date (YYYYMMDD), latest if empty
+	LTOBlacklist []string        `yaml:"lto_blacklist,omitempty" json:"lto_blacklist,omitempty"` // Extra atoms built without LTO by the lto overlay
+	ShareHostCache bool          `yaml:"share_host_cache,omitempty" json:"share_host_cache,omitempty"` // Bind-mount the host's distfiles and binpkgs into the chroot
+	KeepGoing  bool              `yaml:"keep_going,omitempty" json:"keep_going,omitempty"` // Continue large emerges past failing packages and report them
+	SkipSnapshotVerify bool      `yaml:"skip_snapshot_verify,omitempty" json:"skip_snapshot_verify,omitempty"` // Accept unsigned Portage snapshots, for offline mirrors
+	Extra      map[string]string `yaml:"extra,omitempty" json:"extra,omitempty"` // Additional make.conf entries
+}
+
+// DefaultRepoDir is the default location of the gentoo repository.
+const DefaultRepoDir = "/var/db/repos/gentoo"
+
+// Default Portage cache locations.
+const (
+	DefaultDistDir = "/var/cache/distfiles"
+	DefaultPkgDir  = "/var/cache/binpkgs"
+)
+
+// GetDistDir returns the distfiles location.
+func (p PortageConfig) GetDistDir() string {
+	if p.DistDir != "" {
+		return p.DistDir
+	}
+	return DefaultDistDir
+}
+
+// GetPkgDir returns the binary packages location.
+func (p PortageConfig) GetPkgDir() string {
+	if p.PkgDir != "" {
+		return p.PkgDir
+	}
+	return DefaultPkgDir
+}
+
+// GetRepoDir returns the gentoo repository location.
+func (p PortageConfig) GetRepoDir() string {
+	if p.RepoDir != "" {
+		return p.RepoDir
+	}
+	return DefaultRepoDir
+}
+
+// EffectiveCFlags returns the CFLAGS written to make.conf.
+func (p PortageConfig) EffectiveCFlags() string {
+	if p.CFlags != "" {
+		return p.CFlags
+	}
+	if cflags := p.CFlagsPreset.GetCFlags(); cflags != "" {
+		return cflags
+	}
+	return "-march=native -O2 -pipe"
+}
+
+// MemoryPerJobMB is the memory a parallel compile job is assumed to need.
+// C++ heavy packages can use more, but this is what the Gentoo handbook
+// suggests planning for.
+const MemoryPerJobMB = 2048
+
+// ParseMakeOpts returns the job count and load limit from a MAKEOPTS value
+// such as "-j8 -l8", "-j 8" or "--jobs=8 --load-average=7.5". Either is 0
+// when not set. Other options are ignored.
+func ParseMakeOpts(makeOpts string) (jobs int, load float64, err error) {
+	fields := strings.Fields(makeOpts)
+	for n := 0; n < len(fields); n++ {
+		field := fields[n]
+
+		var name, value string
+		switch {
+		case strings.HasPrefix(field, "--jobs="):
+			name, value = "jobs", strings.TrimPrefix(field, "--jobs=")
+		case strings.HasPrefix(field, "--load-average="):
+			name, value = "load", strings.TrimPrefix(field, "--load-average=")
+		case field == "--jobs", field == "-j", field == "--load-average", field == "-l":
+			if n+1 == len(fields) {
+				return 0, 0, fmt.Errorf("makeopts: %s needs a value", field)
+			}
+			name, value = "jobs", fields[n+1]
+			if field == "--load-average" || field == "-l" {
+				name = "load"
+			}
+			n++
+		case strings.HasPrefix(field, "-j"):
+			name, value = "jobs", strings.TrimPrefix(field, "-j")
+		case strings.HasPrefix(field, "-l"):
+			name, value = "load", strings.TrimPrefix(field, "-l")
+		default:
+			continue
+		}
+
+		if name == "jobs" {
+			jobs, err = strconv.Atoi(value)
+			if err != nil || jobs < 1 {
+				return 0, 0, fmt.Errorf("makeopts: invalid job count %q", value)
+			}
+		} else {
+			load, err = strconv.ParseFloat(value, 64)
+			if err != nil || load <= 0 {
+				return 0, 0, fmt.Errorf("makeopts: invalid load average %q", value)
+			}
+		}
+	}
+
+	return jobs, load, nil
+}
+
+// MaxMakeJobs returns the most parallel jobs worth running on a machine:
+// one per CPU, and no more than fit in memory at MemoryPerJobMB each.
+// memoryMB may be 0 when unknown.
+func MaxMakeJobs(cores, memoryMB int) int {
+	jobs := cores
+	if memoryMB > 0 && memoryMB/MemoryPerJobMB < jobs {
+		jobs = memoryMB / MemoryPerJobMB
+	}
+	if jobs < 1 {
+		jobs = 1
+	}
+	return jobs
 }
 
+// ComputeMakeOpts returns a MAKEOPTS value suited to a machine, with the
+// load limited to the number of CPUs.
+func ComputeMakeOpts(cores, memoryMB int) string {
+	if cores < 1 {
+		cores = 1
+	}
+	return fmt.Sprintf("-j%d -l%d", MaxMakeJobs(cores, memoryMB), cores)
+}
+
+// VolatileFeatures are FEATURES whose results depend on machines or services
+// outside the config. They are not allowed in reproducible mode.
+var VolatileFeatures = []string{"distcc", "getbinpkg"}
+
 // CFlagsPreset defines preset CFLAGS configurations.
 type CFlagsPreset string
 
@@ -147,6 +370,43 @@ const (
 	CFlagsCustom     CFlagsPreset = "custom"     // User-defined
 )
 
+// DistccConfig defines distcc helper hosts for distributed compilation.
+type DistccConfig struct {
+	Enabled bool         `yaml:"enabled" json:"enabled"`
+	Hosts   []DistccHost `yaml:"hosts,omitempty" json:"hosts,omitempty"`
+}
+
+// DistccHost defines a single distcc helper host.
+type DistccHost struct {
+	Address string `yaml:"address" json:"address"`        // Hostname or IP, optionally with :port
+	Jobs    int    `yaml:"jobs,omitempty" json:"jobs,omitempty"` // Max concurrent jobs on this host
+}
+
+// DefaultDistccJobs is the job count assumed for hosts that don't specify one.
+const DefaultDistccJobs = 4
+
+// HostsLine returns the /etc/distcc/hosts representation of the host.
+func (h DistccHost) HostsLine() string {
+	jobs := h.Jobs
+	if jobs <= 0 {
+		jobs = DefaultDistccJobs
+	}
+	return fmt.Sprintf("%s/%d", h.Address, jobs)
+}
+
+// RemoteJobs returns the total number of jobs provided by the helper hosts.
+func (d DistccConfig) RemoteJobs() int {
+	total := 0
+	for _, h := range d.Hosts {
+		if h.Jobs > 0 {
+			total += h.Jobs
+		} else {
+			total += DefaultDistccJobs
+		}
+	}
+	return total
+}
+
 // GentooProfile represents a Gentoo profile with metadata.
 type GentooProfile struct {
 	Path        string      // Full profile path (e.g., "default/linux/amd64/23.0/desktop")
@@ -423,11 +683,32 @@ func (p CFlagsPreset) GetCFlags() string {
 
 // OverlayConfig defines an overlay to add.
 type OverlayConfig struct {
-	Name        string `yaml:"name"`
-	URL         string `yaml:"url,omitempty"`          // For custom overlays
-	SyncType    string `yaml:"sync_type,omitempty"`    // git, rsync, etc.
-	Priority    int    `yaml:"priority,omitempty"`
-	AutoSync    bool   `yaml:"auto_sync"`
+	Name        string `yaml:"name" json:"name"`
+	URL         string `yaml:"url,omitempty" json:"url,omitempty"`          // For custom overlays
+	SyncType    string `yaml:"sync_type,omitempty" json:"sync_type,omitempty"`    // git, rsync, etc., or local for user ebuilds
+	Priority    int    `yaml:"priority,omitempty" json:"priority,omitempty"`
+	AutoSync    bool   `yaml:"auto_sync" json:"auto_sync"`
+	Branch      string `yaml:"branch,omitempty" json:"branch,omitempty"` // git only: branch to track
+	Commit      string `yaml:"commit,omitempty" json:"commit,omitempty"` // git only: commit to pin, disables auto-sync
+}
+
+// commitPattern matches an abbreviated or full git commit hash.
+var commitPattern = regexp.MustCompile(`^[0-9a-fA-F]{7,40}$`)
+
+// repoNamePattern matches the repository names PMS allows.
+var repoNamePattern = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_-]*$`)
+
+// ValidRepoName reports whether name can be used as a repository name.
+func ValidRepoName(name string) bool {
+	return repoNamePattern.MatchString(name)
+}
+
+// IsLocal reports whether the overlay is a local repository for the user's
+// own ebuilds, created empty and never synced: its sync type is local, or
+// it has neither a sync type nor a URL. Predefined overlays are matched by
+// name before this applies.
+func (o OverlayConfig) IsLocal() bool {
+	return o.SyncType == "local" || (o.SyncType == "" && o.URL == "")
 }
 
 // Predefined overlays
@@ -456,12 +737,41 @@ var PredefinedOverlays = map[string]OverlayConfig{
 	},
 }
 
+// Editor describes a text editor that can be set as the system default.
+type Editor struct {
+	Package string // Package providing the editor
+	Command string // Command set as EDITOR and VISUAL
+}
+
+// DefaultEditor is used when no editor is configured.
+const DefaultEditor = "nano"
+
+// Editors lists the editors that can be set as the system default.
+var Editors = map[string]Editor{
+	"nano":   {Package: "app-editors/nano", Command: "/usr/bin/nano"},
+	"vim":    {Package: "app-editors/vim", Command: "/usr/bin/vim"},
+	"neovim": {Package: "app-editors/neovim", Command: "/usr/bin/nvim"},
+	"emacs":  {Package: "app-editors/emacs", Command: "/usr/bin/emacs"},
+	"micro":  {Package: "app-editors/micro", Command: "/usr/bin/micro"},
+	"helix":  {Package: "app-editors/helix", Command: "/usr/bin/hx"},
+}
+
+// GetEditor returns the configured default editor.
+func (c *InstallConfig) GetEditor() Editor {
+	if editor, ok := Editors[c.Editor]; ok {
+		return editor
+	}
+	return Editors[DefaultEditor]
+}
+
 // KernelConfig defines kernel installation options.
 type KernelConfig struct {
-	Type         KernelType `yaml:"type"`
-	CustomConfig string     `yaml:"custom_config,omitempty"` // Path to custom .config
-	Initramfs    string     `yaml:"initramfs"`               // dracut, genkernel
-	Modules      []string   `yaml:"modules,omitempty"`       // Additional modules to build
+	Type         KernelType   `yaml:"type" json:"type"`
+	ExtraTypes   []KernelType `yaml:"extra_types,omitempty" json:"extra_types,omitempty"` // Additional kernels installed alongside Type
+	CustomConfig string     `yaml:"custom_config,omitempty" json:"custom_config,omitempty"` // Path to custom .config
+	Initramfs    string     `yaml:"initramfs" json:"initramfs"`               // dracut, genkernel
+	Modules      []string   `yaml:"modules,omitempty" json:"modules,omitempty"`       // Additional modules to build
+	Microcode    bool       `yaml:"microcode" json:"microcode"`               // Install and early-load CPU microcode
 }
 
 // KernelType defines available kernel options.
@@ -477,6 +787,30 @@ const (
 	KernelVanilla    KernelType = "vanilla-sources"   // Vanilla kernel
 )
 
+// AllTypes returns the primary kernel type followed by any extra types, without duplicates.
+func (k KernelConfig) AllTypes() []KernelType {
+	var types []KernelType
+	seen := make(map[KernelType]bool)
+	for _, t := range append([]KernelType{k.Type}, k.ExtraTypes...) {
+		if t == "" || seen[t] {
+			continue
+		}
+		seen[t] = true
+		types = append(types, t)
+	}
+	return types
+}
+
+// IsValid reports whether the kernel type is a known kernel.
+func (k KernelType) IsValid() bool {
+	switch k {
+	case KernelBin, KernelDist, KernelSources, KernelZen, KernelXanmod, KernelLiquorix, KernelVanilla:
+		return true
+	default:
+		return false
+	}
+}
+
 // GetPackage returns the Gentoo package name for the kernel type.
 func (k KernelType) GetPackage() string {
 	switch k {
@@ -501,11 +835,25 @@ func (k KernelType) GetPackage() string {
 
 // GraphicsConfig defines GPU driver configuration.
 type GraphicsConfig struct {
-	Driver      GPUDriver    `yaml:"driver"`
-	DisplayType DisplayType  `yaml:"display_type"` // X11 or Wayland
-	Compositor  string       `yaml:"compositor,omitempty"` // For Wayland
+	Driver      GPUDriver    `yaml:"driver" json:"driver"`
+	DisplayType DisplayType  `yaml:"display_type" json:"display_type"` // X11 or Wayland
+	Compositor  string       `yaml:"compositor,omitempty" json:"compositor,omitempty"` // For Wayland
+	HybridMode  HybridMode   `yaml:"hybrid_mode,omitempty" json:"hybrid_mode,omitempty"` // For Intel/AMD + NVIDIA laptops
+	PrimaryOutput string     `yaml:"primary_output,omitempty" json:"primary_output,omitempty"` // Xorg output name, e.g. "DP-1"
+	Resolution  string       `yaml:"resolution,omitempty" json:"resolution,omitempty"`     // Preferred mode, e.g. "1920x1080"
+	BlacklistConflicting bool `yaml:"blacklist_conflicting" json:"blacklist_conflicting"` // Keep competing drivers (e.g. nouveau) from loading
+	ColorManagement bool     `yaml:"color_management,omitempty" json:"color_management,omitempty"` // Install colord and the desktop's ICC profile tools
 }
 
+// HybridMode defines how hybrid (Optimus) graphics are used.
+type HybridMode string
+
+const (
+	HybridPowerSave   HybridMode = "power-save"  // Integrated GPU only
+	HybridOnDemand    HybridMode = "on-demand"   // Integrated GPU, NVIDIA via PRIME offload
+	HybridPerformance HybridMode = "performance" // NVIDIA renders everything
+)
+
 // GPUDriver defines GPU driver options.
 type GPUDriver string
 
@@ -519,6 +867,7 @@ const (
 	GPUIntelXe    GPUDriver = "intel-xe"
 	GPUVirtio     GPUDriver = "virtio"
 	GPUVMware     GPUDriver = "vmware"
+	GPUNone       GPUDriver = "none" // Headless, no graphics stack
 )
 
 // GetVideoCards returns the VIDEO_CARDS value for the driver.
@@ -545,6 +894,17 @@ func (g GPUDriver) GetVideoCards() string {
 	}
 }
 
+// IsNvidia reports whether the driver is one of the NVIDIA proprietary drivers.
+func (g GPUDriver) IsNvidia() bool {
+	return g == GPUNvidia || g == GPUNvidiaOpen
+}
+
+// Headless reports whether the system gets no graphics stack: the driver is
+// none, or no driver is chosen for a system without a desktop.
+func (c *InstallConfig) Headless() bool {
+	return c.Graphics.Driver == GPUNone || (c.Graphics.Driver == "" && c.Desktop.Type == DesktopNone)
+}
+
 // DisplayType defines display server preference.
 type DisplayType string
 
@@ -555,12 +915,27 @@ const (
 
 // DesktopConfig defines desktop environment/window manager configuration.
 type DesktopConfig struct {
-	Type           DesktopType    `yaml:"type"`
-	DisplayManager DisplayManager `yaml:"display_manager"`
-	SessionType    DisplayType    `yaml:"session_type"` // X11 or Wayland session
-	ExtraPackages  []string       `yaml:"extra_packages,omitempty"`
+	Type           DesktopType    `yaml:"type" json:"type"`
+	DisplayManager DisplayManager `yaml:"display_manager" json:"display_manager"`
+	SessionType    DisplayType    `yaml:"session_type" json:"session_type"` // X11 or Wayland session
+	AppBundle      AppBundle      `yaml:"app_bundle" json:"app_bundle"`    // Curated applications to install
+	ExtraPackages  []string       `yaml:"extra_packages,omitempty" json:"extra_packages,omitempty"`
+	Flatpaks       []string       `yaml:"flatpaks,omitempty" json:"flatpaks,omitempty"` // Flathub app IDs installed on first boot
+	SessionEnv     map[string]string `yaml:"session_env,omitempty" json:"session_env,omitempty"` // Environment variables set in every graphical session
 }
 
+// envNamePattern matches valid environment variable names.
+var envNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// AppBundle defines how many desktop applications are installed.
+type AppBundle string
+
+const (
+	AppBundleMinimal  AppBundle = "minimal"  // Only what the desktop itself pulls in
+	AppBundleStandard AppBundle = "standard" // Browser, file manager, terminal, media player, archiver
+	AppBundleFull     AppBundle = "full"     // Standard plus office suite and mail client
+)
+
 // DesktopType defines available desktop environments and window managers.
 type DesktopType string
 
@@ -623,6 +998,57 @@ func (d DesktopType) GetPackages() []string {
 	}
 }
 
+// IsWindowManager reports whether the desktop type is a standalone window manager.
+func (d DesktopType) IsWindowManager() bool {
+	switch d {
+	case WMi3, WMSway, WMHyprland, WMBspwm, WMDwm, WMAwesome, WMOpenbox:
+		return true
+	default:
+		return false
+	}
+}
+
+// desktopSessions lists the session types each desktop can run, preferred first.
+var desktopSessions = map[DesktopType][]DisplayType{
+	DesktopKDE:      {DisplayWayland, DisplayX11},
+	DesktopGNOME:    {DisplayWayland, DisplayX11},
+	DesktopXFCE:     {DisplayX11},
+	DesktopLXQt:     {DisplayX11},
+	DesktopCinnamon: {DisplayX11},
+	DesktopMATE:     {DisplayX11},
+	DesktopBudgie:   {DisplayX11},
+	WMi3:            {DisplayX11},
+	WMSway:          {DisplayWayland},
+	WMHyprland:      {DisplayWayland},
+	WMBspwm:         {DisplayX11},
+	WMDwm:           {DisplayX11},
+	WMAwesome:       {DisplayX11},
+	WMOpenbox:       {DisplayX11},
+}
+
+// SupportedSessions returns the session types the desktop can run, preferred first.
+func (d DesktopType) SupportedSessions() []DisplayType {
+	if sessions, ok := desktopSessions[d]; ok {
+		return sessions
+	}
+	return []DisplayType{DisplayWayland, DisplayX11}
+}
+
+// SupportsSession reports whether the desktop can run the given session type.
+func (d DesktopType) SupportsSession(s DisplayType) bool {
+	for _, supported := range d.SupportedSessions() {
+		if supported == s {
+			return true
+		}
+	}
+	return false
+}
+
+// DefaultSession returns the preferred session type for the desktop.
+func (d DesktopType) DefaultSession() DisplayType {
+	return d.SupportedSessions()[0]
+}
+
 // DisplayManager defines available display managers.
 type DisplayManager string
 
@@ -631,7 +1057,8 @@ const (
 	DMGDM     DisplayManager = "gdm"
 	DMLightDM DisplayManager = "lightdm"
 	DMLXDM    DisplayManager = "lxdm"
-	DMNone    DisplayManager = "none" // TTY login
+	DMGreetd  DisplayManager = "greetd" // greetd with tuigreet
+	DMNone    DisplayManager = "none"   // TTY login
 )
 
 // GetPackage returns the package for the display manager.
@@ -645,6 +1072,8 @@ func (d DisplayManager) GetPackage() string {
 		return "x11-misc/lightdm"
 	case DMLXDM:
 		return "lxde-base/lxdm"
+	case DMGreetd:
+		return "gui-libs/greetd"
 	default:
 		return ""
 	}
@@ -652,8 +1081,9 @@ func (d DisplayManager) GetPackage() string {
 
 // BootloaderConfig defines bootloader settings.
 type BootloaderConfig struct {
-	Type       BootloaderType `yaml:"type"`
-	SecureBoot SecureBootConfig `yaml:"secure_boot"`
+	Type        BootloaderType `yaml:"type" json:"type"`
+	SecureBoot  SecureBootConfig `yaml:"secure_boot" json:"secure_boot"`
+	RescueEntry bool           `yaml:"rescue_entry" json:"rescue_entry"` // Add a single-user entry booting a fallback kernel
 }
 
 // BootloaderType defines available bootloaders.
@@ -666,28 +1096,58 @@ const (
 
 // SecureBootConfig defines Secure Boot settings.
 type SecureBootConfig struct {
-	Enabled     bool   `yaml:"enabled"`
-	KeyType     string `yaml:"key_type"` // "custom" or "shim"
-	KeyDir      string `yaml:"key_dir,omitempty"`
-	EnrollKeys  bool   `yaml:"enroll_keys"`
+	Enabled     bool   `yaml:"enabled" json:"enabled"`
+	KeyType     string `yaml:"key_type" json:"key_type"` // "custom" or "shim"
+	KeyDir      string `yaml:"key_dir,omitempty" json:"key_dir,omitempty"`
+	EnrollKeys  bool   `yaml:"enroll_keys" json:"enroll_keys"`
 }
 
+// Secure Boot key types.
+const (
+	SecureBootCustom = "custom" // Own platform keys managed with sbctl
+	SecureBootShim   = "shim"   // Microsoft-signed shim and a Machine Owner Key
+)
+
 // UserConfig defines a user account.
 type UserConfig struct {
-	Username    string   `yaml:"username"`
-	Password    string   `yaml:"password"`
-	FullName    string   `yaml:"full_name,omitempty"`
-	Shell       string   `yaml:"shell"`
-	Groups      []string `yaml:"groups"`
-	Sudo        bool     `yaml:"sudo"`
-	UseDoas     bool     `yaml:"use_doas"` // Use doas instead of sudo
+	Username    string   `yaml:"username" json:"username"`
+	Password    string   `yaml:"password" json:"password"`
+	FullName    string   `yaml:"full_name,omitempty" json:"full_name,omitempty"`
+	Shell       string   `yaml:"shell" json:"shell"`
+	Groups      []string `yaml:"groups" json:"groups"`
+	Sudo        bool     `yaml:"sudo" json:"sudo"`
+	UseDoas     bool     `yaml:"use_doas" json:"use_doas"` // Use doas instead of sudo
+	SSHKeys     []string `yaml:"ssh_keys,omitempty" json:"ssh_keys,omitempty"` // Public keys written to authorized_keys
 }
 
 // PackageConfig defines package installation preferences.
 type PackageConfig struct {
-	UseBinary      BinaryPreference `yaml:"use_binary"`
-	BinaryHost     string           `yaml:"binary_host,omitempty"`
-	ExtraPackages  []string         `yaml:"extra_packages,omitempty"`
+	UseBinary      BinaryPreference `yaml:"use_binary" json:"use_binary"`
+	BinaryHost     string           `yaml:"binary_host,omitempty" json:"binary_host,omitempty"` // Single binhost (superseded by BinaryHosts)
+	BinaryHosts    []BinaryHostConfig `yaml:"binary_hosts,omitempty" json:"binary_hosts,omitempty"`
+	ExtraPackages  []string         `yaml:"extra_packages,omitempty" json:"extra_packages,omitempty"`
+	AllowUnsigned  bool             `yaml:"allow_unsigned,omitempty" json:"allow_unsigned,omitempty"` // Accept unsigned binary packages, for third-party binhosts
+}
+
+// BinaryHostConfig defines a binary package host.
+type BinaryHostConfig struct {
+	Name     string `yaml:"name,omitempty" json:"name,omitempty"` // binrepos.conf section name
+	URL      string `yaml:"url" json:"url"`
+	Priority int    `yaml:"priority" json:"priority"` // Higher priority hosts are preferred
+}
+
+// DefaultBinhostPriority is the priority given to a host configured through BinaryHost.
+const DefaultBinhostPriority = 9999
+
+// BinHosts returns the configured binary hosts, including the legacy BinaryHost.
+func (p PackageConfig) BinHosts() []BinaryHostConfig {
+	if len(p.BinaryHosts) > 0 {
+		return p.BinaryHosts
+	}
+	if p.BinaryHost != "" {
+		return []BinaryHostConfig{{URL: p.BinaryHost, Priority: DefaultBinhostPriority}}
+	}
+	return nil
 }
 
 // BinaryPreference defines binary package preference.
@@ -727,14 +1187,17 @@ func NewDefaultConfig() *InstallConfig {
 		Kernel: KernelConfig{
 			Type:      KernelBin,
 			Initramfs: "dracut",
+			Microcode: true,
 		},
 		Graphics: GraphicsConfig{
-			DisplayType: DisplayWayland,
+			DisplayType:          DisplayWayland,
+			BlacklistConflicting: true,
 		},
 		Desktop: DesktopConfig{
 			Type:           DesktopKDE,
 			DisplayManager: DMSDDM,
 			SessionType:    DisplayWayland,
+			AppBundle:      AppBundleMinimal,
 		},
 		Bootloader: BootloaderConfig{
 			Type: BootGRUB,
@@ -745,11 +1208,89 @@ func NewDefaultConfig() *InstallConfig {
 		Packages: PackageConfig{
 			UseBinary: BinaryPrefer,
 		},
+		PostInstall: PostInstallExit,
 	}
 }
 
-// LoadConfig loads configuration from a YAML file.
+// Persona is a set of defaults for a common kind of machine.
+type Persona string
+
+const (
+	PersonaDesktop Persona = "desktop" // Graphical desktop, the default
+	PersonaServer  Persona = "server"  // Headless, SSH with a firewall and fail2ban
+	PersonaMinimal Persona = "minimal" // Headless base system only
+)
+
+// Personas lists the available personas.
+var Personas = []Persona{PersonaDesktop, PersonaServer, PersonaMinimal}
+
+// ApplyPersona sets the defaults of the named persona, leaving settings it
+// has no opinion on alone. It is meant for a freshly created config; the
+// init system must already be chosen as it decides the profile.
+func (c *InstallConfig) ApplyPersona(name string) error {
+	defaults := NewDefaultConfig()
+	systemd := c.InitSystem == InitSystemd
+
+	switch Persona(name) {
+	case PersonaDesktop:
+		c.Portage.Profile = defaults.Portage.Profile
+		if systemd {
+			c.Portage.Profile += "/systemd"
+		}
+		c.Portage.InputDevices = defaults.Portage.InputDevices
+		c.Graphics = defaults.Graphics
+		c.Desktop = defaults.Desktop
+		c.Firewall = false
+
+	case PersonaServer, PersonaMinimal:
+		c.Portage.Profile = "default/linux/amd64/23.0"
+		if systemd {
+			c.Portage.Profile += "/systemd"
+		}
+		c.Portage.InputDevices = nil
+		c.Graphics = GraphicsConfig{Driver: GPUNone}
+		c.Desktop = DesktopConfig{Type: DesktopNone, DisplayManager: DMNone}
+		c.Kernel.Type = KernelBin
+		c.Packages.UseBinary = BinaryPrefer
+		c.Firewall = false
+
+		if Persona(name) == PersonaServer {
+			c.Firewall = true
+			c.Packages.ExtraPackages = appendMissing(c.Packages.ExtraPackages, "net-analyzer/fail2ban")
+			c.Services = appendMissing(c.Services, "fail2ban")
+		}
+
+	default:
+		return fmt.Errorf("unknown persona %q", name)
+	}
+
+	return nil
+}
+
+// appendMissing appends the values not already in list.
+func appendMissing(list []string, values ...string) []string {
+	for _, v := range values {
+		found := false
+		for _, existing := range list {
+			if existing == v {
+				found = true
+				break
+			}
+		}
+		if !found {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// LoadConfig loads configuration from a YAML file, or a JSON file if path
+// ends in .json.
 func LoadConfig(path string) (*InstallConfig, error) {
+	if isJSONPath(path) {
+		return LoadConfigJSON(path)
+	}
+
 	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read config file: %w", err)
@@ -763,8 +1304,13 @@ func LoadConfig(path string) (*InstallConfig, error) {
 	return config, nil
 }
 
-// SaveConfig saves configuration to a YAML file.
+// SaveConfig saves configuration to a YAML file, or a JSON file if path
+// ends in .json.
 func (c *InstallConfig) SaveConfig(path string) error {
+	if isJSONPath(path) {
+		return c.SaveConfigJSON(path)
+	}
+
 	data, err := yaml.Marshal(c)
 	if err != nil {
 		return fmt.Errorf("failed to marshal config: %w", err)
@@ -777,6 +1323,100 @@ func (c *InstallConfig) SaveConfig(path string) error {
 	return nil
 }
 
+// LoadConfigJSON loads configuration from a JSON file.
+func LoadConfigJSON(path string) (*InstallConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	config := NewDefaultConfig()
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("failed to parse config file: %w", err)
+	}
+
+	return config, nil
+}
+
+// SaveConfigJSON saves configuration to a JSON file.
+func (c *InstallConfig) SaveConfigJSON(path string) error {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal config: %w", err)
+	}
+
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write config file: %w", err)
+	}
+
+	return nil
+}
+
+// isJSONPath reports whether path names a JSON config file.
+func isJSONPath(path string) bool {
+	return strings.EqualFold(filepath.Ext(path), ".json")
+}
+
+// DefaultWorldFile is the location of the Portage world file.
+const DefaultWorldFile = "/var/lib/portage/world"
+
+// ImportWorldFile parses a Portage world file into package atoms.
+// Comments, blank lines and package sets (@name) are skipped.
+func ImportWorldFile(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read world file: %w", err)
+	}
+
+	return parseWorldFile(string(data)), nil
+}
+
+// parseWorldFile extracts unique package atoms from world file content.
+func parseWorldFile(content string) []string {
+	var atoms []string
+	seen := make(map[string]bool)
+
+	for _, line := range strings.Split(content, "\n") {
+		if idx := strings.Index(line, "#"); idx >= 0 {
+			line = line[:idx]
+		}
+		line = strings.TrimSpace(line)
+
+		if line == "" || strings.HasPrefix(line, "@") || !strings.Contains(line, "/") {
+			continue
+		}
+		if seen[line] {
+			continue
+		}
+
+		seen[line] = true
+		atoms = append(atoms, line)
+	}
+
+	return atoms
+}
+
+// ImportWorld adds the packages of a world file to Packages.ExtraPackages.
+func (c *InstallConfig) ImportWorld(path string) error {
+	atoms, err := ImportWorldFile(path)
+	if err != nil {
+		return err
+	}
+
+	existing := make(map[string]bool)
+	for _, pkg := range c.Packages.ExtraPackages {
+		existing[pkg] = true
+	}
+	for _, atom := range atoms {
+		if !existing[atom] {
+			c.Packages.ExtraPackages = append(c.Packages.ExtraPackages, atom)
+			existing[atom] = true
+		}
+	}
+
+	return nil
+}
+
 // Validate checks if the configuration is valid.
 func (c *InstallConfig) Validate() error {
 	if c.Hostname == "" {
@@ -785,26 +1425,607 @@ func (c *InstallConfig) Validate() error {
 	if c.Disk.Device == "" {
 		return fmt.Errorf("disk device is required")
 	}
-	if len(c.Partitions) == 0 {
-		return fmt.Errorf("at least one partition is required")
+	if c.Disk.BackupDir != "" && !filepath.IsAbs(c.Disk.BackupDir) {
+		return fmt.Errorf("disk backup_dir must be an absolute path")
 	}
 
-	// Check for root partition
-	hasRoot := false
+	if err := c.validateSwapFile(); err != nil {
+		return err
+	}
+
+	if err := c.validateMkfsOptions(); err != nil {
+		return err
+	}
+
+	// No partitions selects the automatic layout
+	if len(c.Partitions) > 0 {
+		if c.findPartition("/") == nil {
+			return fmt.Errorf("root partition (/) is required")
+		}
+
+		// The firmware is only known at install time; systemd-boot implies UEFI
+		if err := ValidatePartitionFlags(c.Partitions, c.Disk.PartScheme, c.Bootloader.Type == BootSystemdBoot); err != nil {
+			return err
+		}
+	}
+
+	if _, ok := Editors[c.Editor]; c.Editor != "" && !ok {
+		return fmt.Errorf("unsupported editor %q", c.Editor)
+	}
+
+	if c.TargetDir != "" {
+		if !filepath.IsAbs(c.TargetDir) || filepath.Clean(c.TargetDir) == "/" {
+			return fmt.Errorf("target_dir must be an absolute path other than /, got %q", c.TargetDir)
+		}
+	}
+
+	if err := c.validateUsers(); err != nil {
+		return err
+	}
+
+	if err := c.validateEncryption(); err != nil {
+		return err
+	}
+
+	if err := c.validateBootability(); err != nil {
+		return err
+	}
+
+	if err := c.validateKernel(); err != nil {
+		return err
+	}
+
+	if err := c.validateBinHosts(); err != nil {
+		return err
+	}
+
+	if err := c.validateDistcc(); err != nil {
+		return err
+	}
+
+	if _, _, err := ParseMakeOpts(c.Portage.MakeOpts); err != nil {
+		return err
+	}
+
+	if err := c.validatePortagePaths(); err != nil {
+		return err
+	}
+
+	if err := c.validateReproducible(); err != nil {
+		return err
+	}
+
+	if sb := c.Bootloader.SecureBoot; sb.Enabled {
+		switch sb.KeyType {
+		case "", SecureBootCustom:
+		case SecureBootShim:
+			if c.Bootloader.Type == BootSystemdBoot {
+				return fmt.Errorf("secure boot with shim requires GRUB")
+			}
+		default:
+			return fmt.Errorf("invalid secure boot key_type: %s", sb.KeyType)
+		}
+	}
+
+	for _, svc := range c.Services {
+		if svc == "" || strings.ContainsAny(svc, " \t\n/") {
+			return fmt.Errorf("invalid service name %q", svc)
+		}
+	}
+
+	for _, script := range c.PostInstallScripts {
+		if strings.TrimSuffix(script, "?") == "" {
+			return fmt.Errorf("post-install script path is empty")
+		}
+	}
+
+	for _, overlay := range c.Overlays {
+		switch overlay.SyncType {
+		case "", "rsync", "webrsync", "git", "mercurial", "svn", "cvs", "local":
+		default:
+			return fmt.Errorf("overlay %s: unsupported sync_type %q", overlay.Name, overlay.SyncType)
+		}
+		if overlay.SyncType == "local" {
+			if !ValidRepoName(overlay.Name) {
+				return fmt.Errorf("overlay %s: invalid repository name", overlay.Name)
+			}
+			if overlay.URL != "" || overlay.Branch != "" || overlay.Commit != "" {
+				return fmt.Errorf("overlay %s: local overlays have no url, branch or commit", overlay.Name)
+			}
+		}
+		if overlay.Commit != "" && !commitPattern.MatchString(overlay.Commit) {
+			return fmt.Errorf("overlay %s: commit must be a 7 to 40 character hexadecimal hash", overlay.Name)
+		}
+		if strings.ContainsAny(overlay.Branch, " \t\n") {
+			return fmt.Errorf("overlay %s: invalid branch %q", overlay.Name, overlay.Branch)
+		}
+	}
+
+	for _, atom := range c.Portage.LTOBlacklist {
+		if atom == "" || strings.ContainsAny(atom, " \t\n") {
+			return fmt.Errorf("invalid lto_blacklist entry %q", atom)
+		}
+	}
+
+	if c.Graphics.ColorManagement && c.Desktop.Type == DesktopNone {
+		return fmt.Errorf("color management requires a desktop")
+	}
+
+	if c.Graphics.Driver == GPUNone && c.Desktop.Type != "" && c.Desktop.Type != DesktopNone {
+		return fmt.Errorf("desktop %s requires a graphics driver, graphics driver is none", c.Desktop.Type)
+	}
+
+	switch c.Graphics.HybridMode {
+	case "", HybridPowerSave, HybridOnDemand, HybridPerformance:
+	default:
+		return fmt.Errorf("invalid graphics hybrid_mode: %s", c.Graphics.HybridMode)
+	}
+
+	switch c.Desktop.AppBundle {
+	case "", AppBundleMinimal, AppBundleStandard, AppBundleFull:
+	default:
+		return fmt.Errorf("invalid desktop app_bundle: %s", c.Desktop.AppBundle)
+	}
+
+	for name, value := range c.Desktop.SessionEnv {
+		if !envNamePattern.MatchString(name) {
+			return fmt.Errorf("invalid session environment variable name %q", name)
+		}
+		if strings.ContainsAny(value, "\n\x00") {
+			return fmt.Errorf("session environment variable %s: value must be a single line", name)
+		}
+	}
+
+	switch c.PostInstall {
+	case "", PostInstallExit, PostInstallReboot, PostInstallPoweroff, PostInstallChroot:
+	default:
+		return fmt.Errorf("invalid post_install action: %s", c.PostInstall)
+	}
+
+	return nil
+}
+
+// usernamePattern matches the names useradd accepts by default.
+var usernamePattern = regexp.MustCompile(`^[a-z_][a-z0-9_-]{0,31}$`)
+
+// validateUsers checks usernames and that privileged users agree on sudo
+// or doas, as only one of them is set up.
+func (c *InstallConfig) validateUsers() error {
+	var sudoUser, doasUser string
+	hasKeys := false
+	seen := make(map[string]bool)
+	for _, user := range c.Users {
+		if !usernamePattern.MatchString(user.Username) {
+			return fmt.Errorf("invalid username %q: use lowercase letters, digits, - and _, at most 32 characters", user.Username)
+		}
+		if user.Username == "root" {
+			return fmt.Errorf("root cannot be listed as a user, set root_password instead")
+		}
+		if seen[user.Username] {
+			return fmt.Errorf("user %s is defined twice", user.Username)
+		}
+		seen[user.Username] = true
+		if user.Shell != "" && !filepath.IsAbs(user.Shell) {
+			return fmt.Errorf("user %s: shell must be an absolute path", user.Username)
+		}
+		for _, key := range user.SSHKeys {
+			if len(strings.Fields(key)) < 2 || strings.ContainsAny(key, "\r\n") {
+				return fmt.Errorf("user %s: invalid SSH key %q: expected one \"<type> <key> [comment]\" line", user.Username, key)
+			}
+		}
+		hasKeys = hasKeys || len(user.SSHKeys) > 0
+
+		if user.UseDoas && !user.Sudo {
+			return fmt.Errorf("user %s: use_doas requires sudo to be enabled", user.Username)
+		}
+		switch {
+		case user.UseDoas:
+			doasUser = user.Username
+		case user.Sudo:
+			sudoUser = user.Username
+		}
+	}
+
+	if sudoUser != "" && doasUser != "" {
+		return fmt.Errorf("users %s and %s mix sudo and doas: use one for all users", sudoUser, doasUser)
+	}
+
+	// Nobody could log in over SSH
+	if c.SSHKeyOnly && !hasKeys {
+		return fmt.Errorf("ssh_key_only requires at least one user with ssh_keys")
+	}
+
+	return nil
+}
+
+// validateSwapFile checks the swap file path and that the root filesystem
+// can hold one. Its size is checked against the root partition once the
+// layout is known.
+func (c *InstallConfig) validateSwapFile() error {
+	if !c.SwapFile.Enabled() {
+		return nil
+	}
+
+	if path := c.SwapFile.FilePath(); !filepath.IsAbs(path) || path == "/" {
+		return fmt.Errorf("swap_file path must be an absolute file path, got %q", c.SwapFile.Path)
+	}
+
+	// Swap files on ZFS can deadlock under memory pressure
 	for _, p := range c.Partitions {
-		if p.MountPoint == "/" {
-			hasRoot = true
-			break
+		if p.MountPoint == "/" && p.Filesystem == FSZfs {
+			return fmt.Errorf("swap_file is not supported on a ZFS root")
+		}
+	}
+
+	return nil
+}
+
+// validateMkfsOptions checks that mkfs options are only given where mkfs
+// runs, and that they start with an option rather than a stray argument
+// mkfs would take as the device.
+func (c *InstallConfig) validateMkfsOptions() error {
+	for _, p := range c.Partitions {
+		if len(p.MkfsOptions) == 0 {
+			continue
+		}
+
+		name := p.Label
+		if name == "" {
+			name = p.MountPoint
+		}
+
+		switch p.Filesystem {
+		case FSZfs, FSNone:
+			return fmt.Errorf("partition %s: mkfs_options are not supported for %s", name, p.Filesystem)
+		}
+		if !strings.HasPrefix(p.MkfsOptions[0], "-") {
+			return fmt.Errorf("partition %s: mkfs_options must start with an option, got %q", name, p.MkfsOptions[0])
+		}
+		for _, opt := range p.MkfsOptions {
+			if strings.TrimSpace(opt) == "" || strings.ContainsAny(opt, "\n\x00") {
+				return fmt.Errorf("partition %s: invalid mkfs option %q", name, opt)
+			}
 		}
 	}
-	if !hasRoot {
-		return fmt.Errorf("root partition (/) is required")
+
+	return nil
+}
+
+// validateEncryption checks that every encrypted partition has a credential.
+func (c *InstallConfig) validateEncryption() error {
+	if c.Encryption.Type == EncryptNone {
+		return nil
 	}
 
-	// Validate encryption password if encryption is enabled
-	if c.Encryption.Type != EncryptNone && c.Encryption.Password == "" && c.Encryption.KeyFile == "" {
+	hasEncrypted := false
+	for _, p := range c.Partitions {
+		if !p.Encrypt {
+			continue
+		}
+		hasEncrypted = true
+
+		if p.UnlockWithRoot {
+			if p.MountPoint == "/" {
+				return fmt.Errorf("root partition cannot be unlocked with a key file on itself")
+			}
+			continue
+		}
+		if password, keyFile := c.EncryptionCredential(p.MountPoint); password == "" && keyFile == "" {
+			return fmt.Errorf("encrypted partition %s requires a password or key file", p.MountPoint)
+		}
+	}
+
+	// The automatic layout encrypts root with the global credential
+	if !hasEncrypted && c.Encryption.Password == "" && c.Encryption.KeyFile == "" {
 		return fmt.Errorf("encryption password or key file is required")
 	}
 
 	return nil
 }
+
+// EncryptionCredential returns the password and key file used for the
+// encrypted partition at mountPoint, falling back to the global settings.
+func (c *InstallConfig) EncryptionCredential(mountPoint string) (password, keyFile string) {
+	if p := c.findPartition(mountPoint); p != nil && (p.Password != "" || p.KeyFile != "") {
+		return p.Password, p.KeyFile
+	}
+	return c.Encryption.Password, c.Encryption.KeyFile
+}
+
+// UnlocksWithRoot reports whether the partition at mountPoint is unlocked by
+// a key file stored on the root filesystem.
+func (c *InstallConfig) UnlocksWithRoot(mountPoint string) bool {
+	p := c.findPartition(mountPoint)
+	return p != nil && p.Encrypt && p.UnlockWithRoot && mountPoint != "/"
+}
+
+// findPartition returns the configured partition mounted at mountPoint.
+func (c *InstallConfig) findPartition(mountPoint string) *PartitionConfig {
+	for i := range c.Partitions {
+		if c.Partitions[i].MountPoint == mountPoint {
+			return &c.Partitions[i]
+		}
+	}
+	return nil
+}
+
+// validateBootability checks that the bootloader can read the kernel and
+// initramfs from wherever /boot ends up.
+func (c *InstallConfig) validateBootability() error {
+	root := c.findPartition("/")
+	if root == nil {
+		return nil
+	}
+	boot := c.findPartition("/boot")
+
+	if boot != nil {
+		switch {
+		case boot.Encrypt:
+			return fmt.Errorf("/boot cannot be encrypted: the bootloader must read the kernel before any container is unlocked")
+		case boot.Filesystem == FSZfs || boot.Filesystem == FSSwap || boot.Filesystem == FSNone:
+			return fmt.Errorf("/boot cannot use %s: use fat32 (UEFI) or ext4", boot.Filesystem)
+		}
+	}
+
+	switch c.Bootloader.Type {
+	case BootSystemdBoot:
+		// systemd-boot only reads the ESP, so kernels must live there
+		if c.Disk.PartScheme == PartSchemeMBR {
+			return fmt.Errorf("systemd-boot requires UEFI with a GPT disk; use part_scheme gpt or the grub bootloader")
+		}
+		if boot == nil || boot.Filesystem != FSFat32 {
+			return fmt.Errorf("systemd-boot loads kernels from the ESP: add a fat32 /boot partition with the esp flag")
+		}
+
+	case BootGRUB, "":
+		if boot != nil {
+			return nil
+		}
+		// Kernels live on the root filesystem, which GRUB has to read itself
+		if root.Filesystem == FSZfs {
+			return fmt.Errorf("GRUB cannot reliably boot from a ZFS root: add a separate ext4 or fat32 /boot partition")
+		}
+		if root.Encrypt && c.Encryption.Type == EncryptLUKS2 {
+			return fmt.Errorf("GRUB cannot unlock LUKS2 (argon2) containers: add an unencrypted /boot partition or use luks encryption")
+		}
+		if root.Encrypt && (c.Encryption.Type == EncryptZFS || c.Encryption.Type == EncryptDMCrypt) {
+			return fmt.Errorf("GRUB cannot unlock %s root: add an unencrypted /boot partition", c.Encryption.Type)
+		}
+	}
+
+	return nil
+}
+
+// ValidatePartitionFlags checks that the partition flags suit the
+// partition scheme and firmware. On GPT with UEFI, parted treats "boot" as
+// an alias for "esp", so both mark the EFI system partition.
+func ValidatePartitionFlags(parts []PartitionConfig, scheme PartitionScheme, uefi bool) error {
+	if scheme == "" {
+		scheme = PartSchemeGPT
+	}
+
+	var esps, boots, biosGrubs []string
+	for n, p := range parts {
+		name := p.MountPoint
+		if name == "" {
+			name = p.Label
+		}
+		if name == "" {
+			name = fmt.Sprintf("#%d", n+1)
+		}
+
+		var esp, boot, biosGrub bool
+		for _, flag := range p.Flags {
+			switch flag {
+			case "esp":
+				esp = true
+			case "boot":
+				boot = true
+			case "bios_grub":
+				biosGrub = true
+			}
+		}
+
+		switch scheme {
+		case PartSchemeMBR:
+			if esp {
+				return fmt.Errorf("partition %s: the esp flag requires a GPT partition table", name)
+			}
+			if biosGrub {
+				return fmt.Errorf("partition %s: the bios_grub flag requires a GPT partition table", name)
+			}
+			if boot {
+				boots = append(boots, name)
+			}
+		default:
+			if esp || uefi && boot {
+				if p.Filesystem != FSFat32 {
+					return fmt.Errorf("partition %s: the EFI system partition must be fat32, not %s", name, p.Filesystem)
+				}
+				esps = append(esps, name)
+			}
+			if biosGrub {
+				if uefi {
+					return fmt.Errorf("partition %s: bios_grub is only used when booting in BIOS mode", name)
+				}
+				if (p.Filesystem != FSNone && p.Filesystem != "") || p.MountPoint != "" {
+					return fmt.Errorf("partition %s: a bios_grub partition must be unformatted and unmounted", name)
+				}
+				biosGrubs = append(biosGrubs, name)
+			}
+			if boot && !uefi {
+				boots = append(boots, name)
+			}
+		}
+	}
+
+	switch {
+	case len(esps) > 1:
+		return fmt.Errorf("only one EFI system partition is allowed, found %s", strings.Join(esps, ", "))
+	case len(boots) > 1:
+		return fmt.Errorf("only one partition can have the boot flag, found %s", strings.Join(boots, ", "))
+	case len(biosGrubs) > 1:
+		return fmt.Errorf("only one bios_grub partition is allowed, found %s", strings.Join(biosGrubs, ", "))
+	case uefi && scheme == PartSchemeGPT && len(esps) == 0:
+		return fmt.Errorf("UEFI boot requires an EFI system partition: add a fat32 partition with the esp flag")
+	}
+
+	return nil
+}
+
+// validateKernel checks that at least one known kernel is selected.
+func (c *InstallConfig) validateKernel() error {
+	types := c.Kernel.AllTypes()
+	if len(types) == 0 {
+		return fmt.Errorf("at least one kernel is required")
+	}
+	for _, t := range types {
+		if !t.IsValid() {
+			return fmt.Errorf("unknown kernel type: %s", t)
+		}
+	}
+	return nil
+}
+
+// validatePortagePaths checks that custom Portage locations are absolute.
+func (c *InstallConfig) validatePortagePaths() error {
+	paths := []struct{ name, path string }{
+		{"distdir", c.Portage.DistDir},
+		{"pkgdir", c.Portage.PkgDir},
+		{"repo_dir", c.Portage.RepoDir},
+	}
+	for _, p := range paths {
+		if p.path != "" && !filepath.IsAbs(p.path) {
+			return fmt.Errorf("portage %s must be an absolute path: %s", p.name, p.path)
+		}
+	}
+	return nil
+}
+
+// validateReproducible checks pinned versions and, in reproducible mode,
+// rejects settings that vary between machines or over time.
+func (c *InstallConfig) validateReproducible() error {
+	if c.Stage3.Tarball != "" {
+		if !filepath.IsAbs(c.Stage3.Tarball) {
+			return fmt.Errorf("stage3 tarball must be an absolute path")
+		}
+		if c.Stage3.Date != "" {
+			return fmt.Errorf("stage3 date and tarball cannot both be set")
+		}
+	}
+	if c.Stage3.Date != "" {
+		if _, err := time.Parse(Stage3DateLayout, c.Stage3.Date); err != nil {
+			return fmt.Errorf("invalid stage3 date %q: expected a build date like 20240101T170000Z", c.Stage3.Date)
+		}
+	}
+	if c.Portage.Snapshot != "" {
+		if _, err := time.Parse(SnapshotDateLayout, c.Portage.Snapshot); err != nil {
+			return fmt.Errorf("invalid portage snapshot %q: expected a date like 20240101", c.Portage.Snapshot)
+		}
+	}
+
+	if !c.Reproducible {
+		return nil
+	}
+
+	cflags := strings.Fields(c.Portage.EffectiveCFlags())
+	hasMarch := false
+	for _, flag := range cflags {
+		if strings.HasSuffix(flag, "=native") {
+			return fmt.Errorf("reproducible mode does not allow %s: set an explicit -march in portage cflags", flag)
+		}
+		if strings.HasPrefix(flag, "-march=") {
+			hasMarch = true
+		}
+	}
+	if !hasMarch {
+		return fmt.Errorf("reproducible mode requires an explicit -march in portage cflags")
+	}
+
+	if c.Stage3.Date == "" && c.Stage3.Tarball == "" {
+		return fmt.Errorf("reproducible mode requires a pinned stage3 date or a local stage3 tarball")
+	}
+	if c.Portage.Snapshot == "" {
+		return fmt.Errorf("reproducible mode requires a pinned portage snapshot")
+	}
+
+	for _, feature := range c.Portage.Features {
+		for _, volatile := range VolatileFeatures {
+			if feature == volatile {
+				return fmt.Errorf("reproducible mode does not allow FEATURES=%s", feature)
+			}
+		}
+	}
+	if c.Distcc.Enabled {
+		return fmt.Errorf("reproducible mode does not allow distcc")
+	}
+	if c.Packages.UseBinary != "" && c.Packages.UseBinary != BinaryNone {
+		return fmt.Errorf("reproducible mode does not allow binary packages")
+	}
+
+	return nil
+}
+
+// validateBinHosts checks binhost URLs and that priorities are unique.
+func (c *InstallConfig) validateBinHosts() error {
+	priorities := make(map[int]string)
+	names := make(map[string]bool)
+
+	for _, h := range c.Packages.BinHosts() {
+		u, err := url.Parse(h.URL)
+		if err != nil || u.Host == "" && u.Scheme != "file" {
+			return fmt.Errorf("invalid binary host URL %q", h.URL)
+		}
+		switch u.Scheme {
+		case "http", "https", "ftp", "ftps", "file", "ssh":
+		default:
+			return fmt.Errorf("binary host %s: unsupported scheme %q", h.URL, u.Scheme)
+		}
+
+		if other, ok := priorities[h.Priority]; ok {
+			return fmt.Errorf("binary hosts %s and %s share priority %d", other, h.URL, h.Priority)
+		}
+		priorities[h.Priority] = h.URL
+
+		if h.Name != "" {
+			if names[h.Name] {
+				return fmt.Errorf("duplicate binary host name %q", h.Name)
+			}
+			names[h.Name] = true
+		}
+	}
+
+	return nil
+}
+
+// validateDistcc checks distcc host entries.
+func (c *InstallConfig) validateDistcc() error {
+	if !c.Distcc.Enabled {
+		return nil
+	}
+	if len(c.Distcc.Hosts) == 0 {
+		return fmt.Errorf("distcc is enabled but no hosts are configured")
+	}
+
+	for _, h := range c.Distcc.Hosts {
+		if h.Address == "" {
+			return fmt.Errorf("distcc host address is required")
+		}
+		if strings.ContainsAny(h.Address, " \t/") {
+			return fmt.Errorf("invalid distcc host %q", h.Address)
+		}
+		if host, port, ok := strings.Cut(h.Address, ":"); ok {
+			if host == "" {
+				return fmt.Errorf("invalid distcc host %q", h.Address)
+			}
+			if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+				return fmt.Errorf("invalid port in distcc host %q", h.Address)
+			}
+		}
+		if h.Jobs < 0 {
+			return fmt.Errorf("distcc host %s has negative job count", h.Address)
+		}
+	}
+
+	return nil
+}
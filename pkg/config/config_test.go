@@ -0,0 +1,958 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// validConfig returns a config that passes Validate.
+func validConfig() *InstallConfig {
+	cfg := NewDefaultConfig()
+	cfg.Disk.Device = "/dev/sda"
+	cfg.Partitions = []PartitionConfig{
+		{Label: "ESP", Size: "1G", Filesystem: FSFat32, MountPoint: "/boot", Flags: []string{"boot", "esp"}},
+		{Label: "root", Size: "100%FREE", Filesystem: FSExt4, MountPoint: "/"},
+	}
+	return cfg
+}
+
+func TestValidConfig(t *testing.T) {
+	if err := validConfig().Validate(); err != nil {
+		t.Fatalf("Validate() error = %v", err)
+	}
+}
+
+func TestValidatePartitions(t *testing.T) {
+	tests := []struct {
+		name       string
+		partitions []PartitionConfig
+		wantErr    bool
+	}{
+		{"automatic layout", nil, false},
+		{"no root", []PartitionConfig{{Size: "100%FREE", Filesystem: FSExt4, MountPoint: "/home"}}, true},
+		{"root", []PartitionConfig{{Size: "100%FREE", Filesystem: FSExt4, MountPoint: "/"}}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := validConfig()
+			cfg.Disk.PartScheme = PartSchemeMBR
+			cfg.Partitions = tt.partitions
+			if err := cfg.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateHybridMode(t *testing.T) {
+	tests := []struct {
+		mode    HybridMode
+		wantErr bool
+	}{
+		{"", false},
+		{HybridPowerSave, false},
+		{HybridOnDemand, false},
+		{HybridPerformance, false},
+		{"offload", true},
+	}
+
+	for _, tt := range tests {
+		cfg := validConfig()
+		cfg.Graphics.HybridMode = tt.mode
+
+		err := cfg.Validate()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("hybrid_mode %q: Validate() error = %v, wantErr %v", tt.mode, err, tt.wantErr)
+		}
+		if err != nil && !strings.Contains(err.Error(), "hybrid_mode") {
+			t.Errorf("hybrid_mode %q: error %q does not name the field", tt.mode, err)
+		}
+	}
+}
+
+func TestValidateTargetDir(t *testing.T) {
+	tests := []struct {
+		targetDir string
+		wantErr   bool
+	}{
+		{"", false}, // Default mountpoint
+		{"/mnt/test", false},
+		{"/mnt/test/", false},
+		{"/", true},
+		{"/mnt/..", true},
+		{"mnt/gentoo", true},
+	}
+
+	for _, tt := range tests {
+		cfg := validConfig()
+		cfg.TargetDir = tt.targetDir
+
+		if err := cfg.Validate(); (err != nil) != tt.wantErr {
+			t.Errorf("target_dir %q: Validate() error = %v, wantErr %v", tt.targetDir, err, tt.wantErr)
+		}
+	}
+}
+
+func TestDistccHosts(t *testing.T) {
+	distcc := DistccConfig{Enabled: true, Hosts: []DistccHost{
+		{Address: "10.0.0.2", Jobs: 8},
+		{Address: "builder:3632"},
+	}}
+
+	if got, want := distcc.Hosts[0].HostsLine(), "10.0.0.2/8"; got != want {
+		t.Errorf("HostsLine() = %q, want %q", got, want)
+	}
+	if got, want := distcc.Hosts[1].HostsLine(), "builder:3632/4"; got != want {
+		t.Errorf("HostsLine() = %q, want %q", got, want)
+	}
+	if got, want := distcc.RemoteJobs(), 8+DefaultDistccJobs; got != want {
+		t.Errorf("RemoteJobs() = %d, want %d", got, want)
+	}
+}
+
+func TestValidateDistcc(t *testing.T) {
+	tests := []struct {
+		name    string
+		distcc  DistccConfig
+		wantErr bool
+	}{
+		{"disabled", DistccConfig{}, false},
+		{"hosts", DistccConfig{Enabled: true, Hosts: []DistccHost{{Address: "10.0.0.2", Jobs: 8}, {Address: "builder:3632"}}}, false},
+		{"no hosts", DistccConfig{Enabled: true}, true},
+		{"empty address", DistccConfig{Enabled: true, Hosts: []DistccHost{{}}}, true},
+		{"job count in address", DistccConfig{Enabled: true, Hosts: []DistccHost{{Address: "builder/8"}}}, true},
+		{"bad port", DistccConfig{Enabled: true, Hosts: []DistccHost{{Address: "builder:99999"}}}, true},
+		{"port only", DistccConfig{Enabled: true, Hosts: []DistccHost{{Address: ":3632"}}}, true},
+		{"negative jobs", DistccConfig{Enabled: true, Hosts: []DistccHost{{Address: "builder", Jobs: -1}}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := validConfig()
+			cfg.Distcc = tt.distcc
+			if err := cfg.validateDistcc(); (err != nil) != tt.wantErr {
+				t.Errorf("validateDistcc() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidatePortagePaths(t *testing.T) {
+	tests := []struct {
+		name    string
+		portage PortageConfig
+		wantErr bool
+	}{
+		{"defaults", PortageConfig{}, false},
+		{"absolute", PortageConfig{DistDir: "/srv/distfiles", PkgDir: "/srv/binpkgs", RepoDir: "/srv/repos/gentoo"}, false},
+		{"relative distdir", PortageConfig{DistDir: "distfiles"}, true},
+		{"relative pkgdir", PortageConfig{PkgDir: "./binpkgs"}, true},
+		{"relative repo_dir", PortageConfig{RepoDir: "repos/gentoo"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := validConfig()
+			cfg.Portage.DistDir = tt.portage.DistDir
+			cfg.Portage.PkgDir = tt.portage.PkgDir
+			cfg.Portage.RepoDir = tt.portage.RepoDir
+			if err := cfg.validatePortagePaths(); (err != nil) != tt.wantErr {
+				t.Errorf("validatePortagePaths() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestGetRepoDir(t *testing.T) {
+	if got := (PortageConfig{}).GetRepoDir(); got != DefaultRepoDir {
+		t.Errorf("GetRepoDir() = %q, want %q", got, DefaultRepoDir)
+	}
+	if got := (PortageConfig{RepoDir: "/srv/gentoo"}).GetRepoDir(); got != "/srv/gentoo" {
+		t.Errorf("GetRepoDir() = %q, want %q", got, "/srv/gentoo")
+	}
+}
+
+func TestValidatePostInstall(t *testing.T) {
+	tests := []struct {
+		action  PostInstallAction
+		wantErr bool
+	}{
+		{"", false},
+		{PostInstallExit, false},
+		{PostInstallReboot, false},
+		{PostInstallPoweroff, false},
+		{PostInstallChroot, false},
+		{"shutdown", true},
+	}
+
+	for _, tt := range tests {
+		cfg := validConfig()
+		cfg.PostInstall = tt.action
+		if err := cfg.Validate(); (err != nil) != tt.wantErr {
+			t.Errorf("post_install %q: Validate() error = %v, wantErr %v", tt.action, err, tt.wantErr)
+		}
+	}
+}
+
+func TestParseWorldFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+	}{
+		{"empty", "", nil},
+		{"atoms", "app-editors/vim\nwww-client/firefox\n", []string{"app-editors/vim", "www-client/firefox"}},
+		{"comments and blanks", "# packages\n\napp-editors/vim # editor\n   \n", []string{"app-editors/vim"}},
+		{"sets skipped", "@selected\napp-editors/vim\n", []string{"app-editors/vim"}},
+		{"versioned atoms kept", ">=dev-lang/rust-1.75\napp-editors/vim:0\n", []string{">=dev-lang/rust-1.75", "app-editors/vim:0"}},
+		{"duplicates", "app-editors/vim\napp-editors/vim\n", []string{"app-editors/vim"}},
+		{"not an atom", "vim\n", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseWorldFile(tt.content); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseWorldFile() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestImportWorld(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "world")
+	if err := os.WriteFile(path, []byte("app-editors/vim\nwww-client/firefox\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := NewDefaultConfig()
+	cfg.Packages.ExtraPackages = []string{"www-client/firefox"}
+	if err := cfg.ImportWorld(path); err != nil {
+		t.Fatalf("ImportWorld() error = %v", err)
+	}
+
+	want := []string{"www-client/firefox", "app-editors/vim"}
+	if !reflect.DeepEqual(cfg.Packages.ExtraPackages, want) {
+		t.Errorf("ExtraPackages = %q, want %q", cfg.Packages.ExtraPackages, want)
+	}
+
+	if err := cfg.ImportWorld(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("ImportWorld() of a missing file succeeded")
+	}
+}
+
+func TestValidateOverlaySyncType(t *testing.T) {
+	for _, syncType := range []string{"", "rsync", "webrsync", "git", "mercurial", "svn", "cvs", "local"} {
+		cfg := validConfig()
+		cfg.Overlays = []OverlayConfig{{Name: "custom", SyncType: syncType}}
+		if err := cfg.Validate(); err != nil {
+			t.Errorf("sync_type %q: Validate() error = %v", syncType, err)
+		}
+	}
+
+	cfg := validConfig()
+	cfg.Overlays = []OverlayConfig{{Name: "custom", SyncType: "bzr"}}
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "sync_type") {
+		t.Errorf("Validate() error = %v, want an unsupported sync_type error", err)
+	}
+}
+
+func TestValidateUsers(t *testing.T) {
+	tests := []struct {
+		name    string
+		users   []UserConfig
+		wantErr bool
+	}{
+		{"none", nil, false},
+		{"sudo", []UserConfig{{Username: "alice", Sudo: true}, {Username: "bob"}}, false},
+		{"doas", []UserConfig{{Username: "alice", Sudo: true, UseDoas: true}, {Username: "bob", Sudo: true, UseDoas: true}}, false},
+		{"doas without sudo", []UserConfig{{Username: "alice", UseDoas: true}}, true},
+		{"sudo and doas", []UserConfig{{Username: "alice", Sudo: true}, {Username: "bob", Sudo: true, UseDoas: true}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := validConfig()
+			cfg.Users = tt.users
+
+			err := cfg.Validate()
+			if gotErr := err != nil; gotErr != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateEncryption(t *testing.T) {
+	root := PartitionConfig{Label: "root", Size: "100%FREE", Filesystem: FSExt4, MountPoint: "/", Encrypt: true}
+	home := PartitionConfig{Label: "home", Size: "100G", Filesystem: FSExt4, MountPoint: "/home", Encrypt: true}
+
+	tests := []struct {
+		name     string
+		password string
+		keyFile  string
+		parts    []PartitionConfig
+		wantErr  bool
+	}{
+		{"automatic layout", "secret", "", nil, false},
+		{"automatic layout without credential", "", "", nil, true},
+		{"global password", "secret", "", []PartitionConfig{root, home}, false},
+		{"global key file", "", "/root/disk.key", []PartitionConfig{root, home}, false},
+		{"no credential", "", "", []PartitionConfig{root}, true},
+		{"per-partition password", "", "", []PartitionConfig{
+			{MountPoint: "/", Encrypt: true, Password: "root"},
+			{MountPoint: "/home", Encrypt: true, Password: "home"},
+		}, false},
+		{"one partition without credential", "", "", []PartitionConfig{
+			{MountPoint: "/", Encrypt: true, Password: "root"},
+			home,
+		}, true},
+		{"unlock with root", "", "", []PartitionConfig{
+			{MountPoint: "/", Encrypt: true, Password: "root"},
+			{MountPoint: "/home", Encrypt: true, UnlockWithRoot: true},
+		}, false},
+		{"root unlocked with itself", "secret", "", []PartitionConfig{
+			{MountPoint: "/", Encrypt: true, UnlockWithRoot: true},
+		}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := validConfig()
+			cfg.Encryption.Type = EncryptLUKS2
+			cfg.Encryption.Password = tt.password
+			cfg.Encryption.KeyFile = tt.keyFile
+			cfg.Partitions = tt.parts
+
+			err := cfg.validateEncryption()
+			if gotErr := err != nil; gotErr != tt.wantErr {
+				t.Errorf("validateEncryption() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestEncryptionCredential(t *testing.T) {
+	cfg := NewDefaultConfig()
+	cfg.Encryption.Password = "global"
+	cfg.Partitions = []PartitionConfig{
+		{MountPoint: "/", Encrypt: true},
+		{MountPoint: "/home", Encrypt: true, KeyFile: "/root/home.key"},
+		{MountPoint: "/data", Encrypt: true, UnlockWithRoot: true},
+		{MountPoint: "/srv", UnlockWithRoot: true},
+	}
+
+	tests := []struct {
+		mountPoint   string
+		wantPassword string
+		wantKeyFile  string
+		wantRoot     bool
+	}{
+		{"/", "global", "", false},
+		{"/home", "", "/root/home.key", false},
+		{"/data", "global", "", true},
+		{"/srv", "global", "", false}, // Not encrypted
+		{"/missing", "global", "", false},
+	}
+
+	for _, tt := range tests {
+		password, keyFile := cfg.EncryptionCredential(tt.mountPoint)
+		if password != tt.wantPassword || keyFile != tt.wantKeyFile {
+			t.Errorf("EncryptionCredential(%q) = %q, %q, want %q, %q",
+				tt.mountPoint, password, keyFile, tt.wantPassword, tt.wantKeyFile)
+		}
+		if got := cfg.UnlocksWithRoot(tt.mountPoint); got != tt.wantRoot {
+			t.Errorf("UnlocksWithRoot(%q) = %v, want %v", tt.mountPoint, got, tt.wantRoot)
+		}
+	}
+}
+
+func TestKernelTypes(t *testing.T) {
+	tests := []struct {
+		name    string
+		kernel  KernelConfig
+		want    []KernelType
+		wantErr bool
+	}{
+		{"primary only", KernelConfig{Type: KernelBin}, []KernelType{KernelBin}, false},
+		{"extra types", KernelConfig{Type: KernelBin, ExtraTypes: []KernelType{KernelZen, KernelVanilla}},
+			[]KernelType{KernelBin, KernelZen, KernelVanilla}, false},
+		{"duplicates", KernelConfig{Type: KernelZen, ExtraTypes: []KernelType{KernelZen, KernelBin, KernelBin}},
+			[]KernelType{KernelZen, KernelBin}, false},
+		{"extra only", KernelConfig{ExtraTypes: []KernelType{KernelDist}}, []KernelType{KernelDist}, false},
+		{"none", KernelConfig{}, nil, true},
+		{"unknown", KernelConfig{Type: KernelBin, ExtraTypes: []KernelType{"rt-sources"}},
+			[]KernelType{KernelBin, "rt-sources"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.kernel.AllTypes(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("AllTypes() = %v, want %v", got, tt.want)
+			}
+
+			cfg := validConfig()
+			cfg.Kernel = tt.kernel
+			err := cfg.validateKernel()
+			if gotErr := err != nil; gotErr != tt.wantErr {
+				t.Errorf("validateKernel() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateBootability(t *testing.T) {
+	esp := PartitionConfig{Filesystem: FSFat32, MountPoint: "/boot", Flags: []string{"esp"}}
+	ext4Boot := PartitionConfig{Filesystem: FSExt4, MountPoint: "/boot"}
+	root := PartitionConfig{Filesystem: FSExt4, MountPoint: "/"}
+	encryptedRoot := PartitionConfig{Filesystem: FSExt4, MountPoint: "/", Encrypt: true}
+	zfsRoot := PartitionConfig{Filesystem: FSZfs, MountPoint: "/"}
+
+	tests := []struct {
+		name       string
+		bootloader BootloaderType
+		scheme     PartitionScheme
+		encryption EncryptionType
+		parts      []PartitionConfig
+		wantErr    bool
+	}{
+		{"grub with esp", BootGRUB, PartSchemeGPT, EncryptNone, []PartitionConfig{esp, root}, false},
+		{"grub without /boot", BootGRUB, PartSchemeMBR, EncryptNone, []PartitionConfig{root}, false},
+		{"encrypted /boot", BootGRUB, PartSchemeGPT, EncryptLUKS, []PartitionConfig{{Filesystem: FSExt4, MountPoint: "/boot", Encrypt: true}, root}, true},
+		{"zfs /boot", BootGRUB, PartSchemeGPT, EncryptNone, []PartitionConfig{{Filesystem: FSZfs, MountPoint: "/boot"}, root}, true},
+		{"grub zfs root", BootGRUB, PartSchemeGPT, EncryptNone, []PartitionConfig{zfsRoot}, true},
+		{"grub zfs root with /boot", BootGRUB, PartSchemeGPT, EncryptNone, []PartitionConfig{ext4Boot, zfsRoot}, false},
+		{"grub luks1 root", BootGRUB, PartSchemeGPT, EncryptLUKS, []PartitionConfig{encryptedRoot}, false},
+		{"grub luks2 root", BootGRUB, PartSchemeGPT, EncryptLUKS2, []PartitionConfig{encryptedRoot}, true},
+		{"grub luks2 root with /boot", BootGRUB, PartSchemeGPT, EncryptLUKS2, []PartitionConfig{esp, encryptedRoot}, false},
+		{"systemd-boot with esp", BootSystemdBoot, PartSchemeGPT, EncryptLUKS2, []PartitionConfig{esp, encryptedRoot}, false},
+		{"systemd-boot without /boot", BootSystemdBoot, PartSchemeGPT, EncryptNone, []PartitionConfig{root}, true},
+		{"systemd-boot ext4 /boot", BootSystemdBoot, PartSchemeGPT, EncryptNone, []PartitionConfig{ext4Boot, root}, true},
+		{"systemd-boot on mbr", BootSystemdBoot, PartSchemeMBR, EncryptNone, []PartitionConfig{esp, root}, true},
+		{"no root", BootSystemdBoot, PartSchemeGPT, EncryptNone, nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := NewDefaultConfig()
+			cfg.Bootloader.Type = tt.bootloader
+			cfg.Disk.PartScheme = tt.scheme
+			cfg.Encryption.Type = tt.encryption
+			cfg.Partitions = tt.parts
+
+			err := cfg.validateBootability()
+			if gotErr := err != nil; gotErr != tt.wantErr {
+				t.Errorf("validateBootability() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestBinHosts(t *testing.T) {
+	hosts := []BinaryHostConfig{{URL: "https://a.example/", Priority: 10}}
+
+	tests := []struct {
+		name     string
+		packages PackageConfig
+		want     []BinaryHostConfig
+	}{
+		{"none", PackageConfig{}, nil},
+		{"legacy host", PackageConfig{BinaryHost: "https://legacy.example/"},
+			[]BinaryHostConfig{{URL: "https://legacy.example/", Priority: DefaultBinhostPriority}}},
+		{"hosts", PackageConfig{BinaryHosts: hosts}, hosts},
+		{"hosts supersede legacy host", PackageConfig{BinaryHost: "https://legacy.example/", BinaryHosts: hosts}, hosts},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.packages.BinHosts(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("BinHosts() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateBinHosts(t *testing.T) {
+	tests := []struct {
+		name    string
+		hosts   []BinaryHostConfig
+		wantErr bool
+	}{
+		{"none", nil, false},
+		{"https", []BinaryHostConfig{{URL: "https://distfiles.gentoo.org/releases/amd64/binpackages/23.0/x86-64/", Priority: 10}}, false},
+		{"file", []BinaryHostConfig{{URL: "file:///var/cache/binpkgs", Priority: 10}}, false},
+		{"distinct priorities", []BinaryHostConfig{
+			{Name: "local", URL: "http://10.0.0.2/packages", Priority: 20},
+			{Name: "gentoo", URL: "https://distfiles.gentoo.org/", Priority: 10},
+		}, false},
+		{"no host", []BinaryHostConfig{{URL: "https:///packages", Priority: 10}}, true},
+		{"relative", []BinaryHostConfig{{URL: "packages", Priority: 10}}, true},
+		{"unsupported scheme", []BinaryHostConfig{{URL: "gopher://example.org/", Priority: 10}}, true},
+		{"shared priority", []BinaryHostConfig{
+			{URL: "http://10.0.0.2/packages", Priority: 10},
+			{URL: "https://distfiles.gentoo.org/", Priority: 10},
+		}, true},
+		{"duplicate name", []BinaryHostConfig{
+			{Name: "mirror", URL: "http://10.0.0.2/packages", Priority: 20},
+			{Name: "mirror", URL: "https://distfiles.gentoo.org/", Priority: 10},
+		}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := validConfig()
+			cfg.Packages.BinaryHosts = tt.hosts
+
+			err := cfg.validateBinHosts()
+			if gotErr := err != nil; gotErr != tt.wantErr {
+				t.Errorf("validateBinHosts() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestEffectiveCFlags(t *testing.T) {
+	tests := []struct {
+		portage PortageConfig
+		want    string
+	}{
+		{PortageConfig{CFlags: "-march=znver3 -O2 -pipe", CFlagsPreset: CFlagsAggressive}, "-march=znver3 -O2 -pipe"},
+		{PortageConfig{CFlagsPreset: CFlagsSafe}, CFlagsSafe.GetCFlags()},
+		{PortageConfig{}, "-march=native -O2 -pipe"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.portage.EffectiveCFlags(); got != tt.want {
+			t.Errorf("EffectiveCFlags() with %+v = %q, want %q", tt.portage, got, tt.want)
+		}
+	}
+}
+
+func TestValidateReproducible(t *testing.T) {
+	// reproducible returns a config that passes in reproducible mode.
+	reproducible := func() *InstallConfig {
+		cfg := validConfig()
+		cfg.Reproducible = true
+		cfg.Portage.CFlags = "-march=x86-64-v3 -O2 -pipe"
+		cfg.Portage.Features = nil
+		cfg.Stage3.Date = "20240101T170000Z"
+		cfg.Portage.Snapshot = "20240102"
+		cfg.Packages.UseBinary = BinaryNone
+		cfg.Distcc.Enabled = false
+		return cfg
+	}
+
+	tests := []struct {
+		name    string
+		modify  func(cfg *InstallConfig)
+		wantErr string
+	}{
+		{"pinned", func(cfg *InstallConfig) {}, ""},
+		{"not reproducible", func(cfg *InstallConfig) {
+			cfg.Reproducible = false
+			cfg.Portage.CFlags = "-march=native -O2"
+			cfg.Stage3.Date = ""
+		}, ""},
+		{"invalid stage3 date", func(cfg *InstallConfig) { cfg.Stage3.Date = "2024-01-01" }, "invalid stage3 date"},
+		{"invalid snapshot", func(cfg *InstallConfig) { cfg.Portage.Snapshot = "2024-01-02" }, "invalid portage snapshot"},
+		{"native march", func(cfg *InstallConfig) { cfg.Portage.CFlags = "-march=native -O2" }, "-march=native"},
+		{"native mtune", func(cfg *InstallConfig) { cfg.Portage.CFlags = "-march=x86-64 -mtune=native" }, "-mtune=native"},
+		{"no march", func(cfg *InstallConfig) { cfg.Portage.CFlags = "-O2 -pipe" }, "explicit -march"},
+		{"unpinned stage3", func(cfg *InstallConfig) { cfg.Stage3.Date = "" }, "stage3"},
+		{"unpinned snapshot", func(cfg *InstallConfig) { cfg.Portage.Snapshot = "" }, "snapshot"},
+		{"getbinpkg", func(cfg *InstallConfig) { cfg.Portage.Features = []string{"parallel-fetch", "getbinpkg"} }, "FEATURES=getbinpkg"},
+		{"distcc", func(cfg *InstallConfig) {
+			cfg.Distcc.Enabled = true
+			cfg.Distcc.Hosts = []DistccHost{{Address: "10.0.0.2"}}
+		}, "distcc"},
+		{"binary packages", func(cfg *InstallConfig) { cfg.Packages.UseBinary = BinaryPrefer }, "binary packages"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := reproducible()
+			tt.modify(cfg)
+
+			err := cfg.validateReproducible()
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("validateReproducible() error = %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("validateReproducible() error = %v, want one mentioning %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateSessionEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		wantErr bool
+	}{
+		{"none", nil, false},
+		{"valid", map[string]string{"MOZ_ENABLE_WAYLAND": "1", "_PRIVATE": "", "QT_QPA_PLATFORM": "wayland;xcb"}, false},
+		{"leading digit", map[string]string{"1VAR": "x"}, true},
+		{"dash", map[string]string{"MY-VAR": "x"}, true},
+		{"empty name", map[string]string{"": "x"}, true},
+		{"multi-line value", map[string]string{"VAR": "a\nb"}, true},
+		{"nul in value", map[string]string{"VAR": "a\x00b"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := validConfig()
+			cfg.Desktop.SessionEnv = tt.env
+
+			err := cfg.Validate()
+			if gotErr := err != nil; gotErr != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidatePartitionFlags(t *testing.T) {
+	esp := PartitionConfig{Label: "ESP", Filesystem: FSFat32, MountPoint: "/boot", Flags: []string{"esp"}}
+	bootESP := PartitionConfig{Label: "ESP", Filesystem: FSFat32, MountPoint: "/boot", Flags: []string{"boot"}}
+	biosGrub := PartitionConfig{Label: "bios", Filesystem: FSNone, Flags: []string{"bios_grub"}}
+	root := PartitionConfig{Label: "root", Filesystem: FSExt4, MountPoint: "/"}
+	bootRoot := PartitionConfig{Label: "root", Filesystem: FSExt4, MountPoint: "/", Flags: []string{"boot"}}
+
+	tests := []struct {
+		name    string
+		parts   []PartitionConfig
+		scheme  PartitionScheme
+		uefi    bool
+		wantErr bool
+	}{
+		{"uefi gpt esp", []PartitionConfig{esp, root}, PartSchemeGPT, true, false},
+		{"uefi boot is esp", []PartitionConfig{bootESP, root}, "", true, false},
+		{"uefi without esp", []PartitionConfig{root}, PartSchemeGPT, true, true},
+		{"uefi ext4 esp", []PartitionConfig{{Filesystem: FSExt4, MountPoint: "/boot", Flags: []string{"esp"}}, root}, PartSchemeGPT, true, true},
+		{"two esps", []PartitionConfig{esp, {Label: "ESP2", Filesystem: FSFat32, MountPoint: "/efi", Flags: []string{"esp"}}, root}, PartSchemeGPT, true, true},
+		{"uefi bios_grub", []PartitionConfig{esp, biosGrub, root}, PartSchemeGPT, true, true},
+		{"bios gpt bios_grub", []PartitionConfig{biosGrub, root}, PartSchemeGPT, false, false},
+		{"bios formatted bios_grub", []PartitionConfig{{Filesystem: FSExt4, Flags: []string{"bios_grub"}}, root}, PartSchemeGPT, false, true},
+		{"two bios_grub", []PartitionConfig{biosGrub, biosGrub, root}, PartSchemeGPT, false, true},
+		{"bios gpt no flags", []PartitionConfig{root}, PartSchemeGPT, false, false},
+		{"mbr boot", []PartitionConfig{bootRoot}, PartSchemeMBR, false, false},
+		{"mbr two boot", []PartitionConfig{{Filesystem: FSExt4, MountPoint: "/boot", Flags: []string{"boot"}}, bootRoot}, PartSchemeMBR, false, true},
+		{"mbr esp", []PartitionConfig{esp, root}, PartSchemeMBR, true, true},
+		{"mbr bios_grub", []PartitionConfig{biosGrub, root}, PartSchemeMBR, false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidatePartitionFlags(tt.parts, tt.scheme, tt.uefi)
+			if gotErr := err != nil; gotErr != tt.wantErr {
+				t.Errorf("ValidatePartitionFlags() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestGetEditor(t *testing.T) {
+	tests := []struct {
+		editor  string
+		want    Editor
+		wantErr bool
+	}{
+		{"", Editors[DefaultEditor], false},
+		{"vim", Editor{Package: "app-editors/vim", Command: "/usr/bin/vim"}, false},
+		{"helix", Editor{Package: "app-editors/helix", Command: "/usr/bin/hx"}, false},
+		{"ed", Editors[DefaultEditor], true},
+	}
+
+	for _, tt := range tests {
+		cfg := validConfig()
+		cfg.Editor = tt.editor
+		if got := cfg.GetEditor(); got != tt.want {
+			t.Errorf("GetEditor() with %q = %+v, want %+v", tt.editor, got, tt.want)
+		}
+		if err := cfg.Validate(); (err != nil) != tt.wantErr {
+			t.Errorf("Validate() with editor %q error = %v, wantErr %v", tt.editor, err, tt.wantErr)
+		}
+	}
+}
+
+func TestSaveLoadRoundTrip(t *testing.T) {
+	for _, name := range []string{"config.yaml", "config.json", "CONFIG.JSON"} {
+		t.Run(name, func(t *testing.T) {
+			cfg := validConfig()
+			cfg.Hostname = "yuno"
+			cfg.Users = []UserConfig{{Username: "alice", Shell: "/bin/zsh", Groups: []string{"wheel"}, Sudo: true}}
+			cfg.Portage.Extra = map[string]string{"GRUB_PLATFORMS": "efi-64"}
+			path := filepath.Join(t.TempDir(), name)
+
+			if err := cfg.SaveConfig(path); err != nil {
+				t.Fatalf("SaveConfig() error = %v", err)
+			}
+			got, err := LoadConfig(path)
+			if err != nil {
+				t.Fatalf("LoadConfig() error = %v", err)
+			}
+			if !reflect.DeepEqual(got.Users, cfg.Users) || !reflect.DeepEqual(got.Portage.Extra, cfg.Portage.Extra) {
+				t.Errorf("LoadConfig() users = %+v, extra = %v", got.Users, got.Portage.Extra)
+			}
+
+			// Empty lists may load as nil, so compare what is saved again
+			resaved := filepath.Join(t.TempDir(), name)
+			if err := got.SaveConfig(resaved); err != nil {
+				t.Fatalf("SaveConfig() error = %v", err)
+			}
+			want, _ := os.ReadFile(path)
+			again, _ := os.ReadFile(resaved)
+			if string(again) != string(want) {
+				t.Errorf("saved config changed after loading:\n%s\nthen:\n%s", want, again)
+			}
+		})
+	}
+}
+
+func TestLoadConfigJSON(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(`{"hostname": "yuno", "disk": {"device": "/dev/nvme0n1"}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	if cfg.Hostname != "yuno" || cfg.Disk.Device != "/dev/nvme0n1" {
+		t.Errorf("LoadConfig() hostname = %q, device = %q", cfg.Hostname, cfg.Disk.Device)
+	}
+	// Fields missing from the file keep their defaults
+	if want := NewDefaultConfig().InitSystem; cfg.InitSystem != want {
+		t.Errorf("LoadConfig() InitSystem = %q, want default %q", cfg.InitSystem, want)
+	}
+
+	if err := os.WriteFile(path, []byte("hostname: yuno\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadConfig(path); err == nil {
+		t.Error("LoadConfig() of YAML in a .json file succeeded")
+	}
+}
+
+func TestParseMakeOpts(t *testing.T) {
+	tests := []struct {
+		makeOpts string
+		jobs     int
+		load     float64
+		wantErr  bool
+	}{
+		{"", 0, 0, false},
+		{"-j8", 8, 0, false},
+		{"-j8 -l8", 8, 8, false},
+		{"-j 4 -l 3.5", 4, 3.5, false},
+		{"--jobs=6 --load-average=7.5", 6, 7.5, false},
+		{"--jobs 2 --load-average 2", 2, 2, false},
+		{"-s -j12 --keep-going", 12, 0, false},
+		{"-j0", 0, 0, true},
+		{"-jx", 0, 0, true},
+		{"-j", 0, 0, true},
+		{"-j4 -l-1", 0, 0, true},
+		{"--load-average=many", 0, 0, true},
+	}
+
+	for _, tt := range tests {
+		jobs, load, err := ParseMakeOpts(tt.makeOpts)
+		if gotErr := err != nil; gotErr != tt.wantErr {
+			t.Errorf("ParseMakeOpts(%q) error = %v, wantErr %v", tt.makeOpts, err, tt.wantErr)
+			continue
+		}
+		if jobs != tt.jobs || load != tt.load {
+			t.Errorf("ParseMakeOpts(%q) = %d, %v, want %d, %v", tt.makeOpts, jobs, load, tt.jobs, tt.load)
+		}
+	}
+}
+
+func TestComputeMakeOpts(t *testing.T) {
+	tests := []struct {
+		cores    int
+		memoryMB int
+		wantJobs int
+		want     string
+	}{
+		{8, 32768, 8, "-j8 -l8"},
+		{16, 16384, 8, "-j8 -l16"}, // Memory bound
+		{4, 0, 4, "-j4 -l4"},       // Memory unknown
+		{4, 1024, 1, "-j1 -l4"},    // Less than one job's worth of memory
+		{0, 0, 1, "-j1 -l1"},
+	}
+
+	for _, tt := range tests {
+		if got := MaxMakeJobs(tt.cores, tt.memoryMB); got != tt.wantJobs {
+			t.Errorf("MaxMakeJobs(%d, %d) = %d, want %d", tt.cores, tt.memoryMB, got, tt.wantJobs)
+		}
+		if got := ComputeMakeOpts(tt.cores, tt.memoryMB); got != tt.want {
+			t.Errorf("ComputeMakeOpts(%d, %d) = %q, want %q", tt.cores, tt.memoryMB, got, tt.want)
+		}
+	}
+}
+
+func TestValidateMakeOpts(t *testing.T) {
+	tests := []struct {
+		makeOpts string
+		wantErr  bool
+	}{
+		{"", false},
+		{"-j8 -l8", false},
+		{"-jmany", true},
+	}
+
+	for _, tt := range tests {
+		cfg := validConfig()
+		cfg.Portage.MakeOpts = tt.makeOpts
+
+		if err := cfg.Validate(); (err != nil) != tt.wantErr {
+			t.Errorf("makeopts %q: Validate() error = %v, wantErr %v", tt.makeOpts, err, tt.wantErr)
+		}
+	}
+}
+
+func TestApplyPersona(t *testing.T) {
+	tests := []struct {
+		persona      string
+		init         InitSystem
+		wantProfile  string
+		wantDesktop  DesktopType
+		wantFirewall bool
+		wantServices []string
+	}{
+		{"desktop", InitOpenRC, "default/linux/amd64/23.0/desktop", DesktopKDE, false, nil},
+		{"desktop", InitSystemd, "default/linux/amd64/23.0/desktop/systemd", DesktopKDE, false, nil},
+		{"server", InitOpenRC, "default/linux/amd64/23.0", DesktopNone, true, []string{"fail2ban"}},
+		{"server", InitSystemd, "default/linux/amd64/23.0/systemd", DesktopNone, true, []string{"fail2ban"}},
+		{"minimal", InitOpenRC, "default/linux/amd64/23.0", DesktopNone, false, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.persona+"/"+string(tt.init), func(t *testing.T) {
+			cfg := validConfig()
+			cfg.InitSystem = tt.init
+
+			// Applying twice must not duplicate packages or services
+			for n := 0; n < 2; n++ {
+				if err := cfg.ApplyPersona(tt.persona); err != nil {
+					t.Fatalf("ApplyPersona() error = %v", err)
+				}
+			}
+
+			if cfg.Portage.Profile != tt.wantProfile {
+				t.Errorf("Profile = %q, want %q", cfg.Portage.Profile, tt.wantProfile)
+			}
+			if cfg.Desktop.Type != tt.wantDesktop {
+				t.Errorf("Desktop.Type = %q, want %q", cfg.Desktop.Type, tt.wantDesktop)
+			}
+			if cfg.Firewall != tt.wantFirewall {
+				t.Errorf("Firewall = %v, want %v", cfg.Firewall, tt.wantFirewall)
+			}
+			if !reflect.DeepEqual(cfg.Services, tt.wantServices) {
+				t.Errorf("Services = %q, want %q", cfg.Services, tt.wantServices)
+			}
+			if err := cfg.Validate(); err != nil {
+				t.Errorf("Validate() error = %v", err)
+			}
+		})
+	}
+
+	if err := validConfig().ApplyPersona("workstation"); err == nil {
+		t.Error("ApplyPersona(workstation) succeeded")
+	}
+}
+
+func TestAppendMissing(t *testing.T) {
+	tests := []struct {
+		list   []string
+		values []string
+		want   []string
+	}{
+		{nil, nil, nil},
+		{nil, []string{"a", "b"}, []string{"a", "b"}},
+		{[]string{"a"}, []string{"a", "b"}, []string{"a", "b"}},
+		{[]string{"a", "b"}, []string{"b", "a"}, []string{"a", "b"}},
+	}
+
+	for _, tt := range tests {
+		if got := appendMissing(tt.list, tt.values...); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("appendMissing(%q, %q) = %q, want %q", tt.list, tt.values, got, tt.want)
+		}
+	}
+}
+
+func TestValidateServices(t *testing.T) {
+	tests := []struct {
+		services []string
+		wantErr  bool
+	}{
+		{nil, false},
+		{[]string{"fail2ban", "sshd"}, false},
+		{[]string{""}, true},
+		{[]string{"fail2ban sshd"}, true},
+		{[]string{"../sshd"}, true},
+	}
+
+	for _, tt := range tests {
+		cfg := validConfig()
+		cfg.Services = tt.services
+
+		if err := cfg.Validate(); (err != nil) != tt.wantErr {
+			t.Errorf("services %q: Validate() error = %v, wantErr %v", tt.services, err, tt.wantErr)
+		}
+	}
+}
+
+func TestSwitchPreset(t *testing.T) {
+	cfg := validConfig()
+	cfg.Portage.UseFlags = []string{"vulkan"}
+	cfg.Packages.ExtraPackages = []string{"app-editors/vim"}
+	kernel := cfg.Kernel.Type
+
+	gaming, err := cfg.SwitchPreset(nil, "gaming")
+	if err != nil {
+		t.Fatalf("SwitchPreset(gaming) error = %v", err)
+	}
+	if cfg.Kernel.Type != KernelZen || len(cfg.Overlays) != 1 {
+		t.Fatalf("gaming preset not applied: kernel %s, overlays %v", cfg.Kernel.Type, cfg.Overlays)
+	}
+
+	if _, err := cfg.SwitchPreset(gaming, "laptop"); err != nil {
+		t.Fatalf("SwitchPreset(laptop) error = %v", err)
+	}
+
+	laptop := Presets["laptop"]
+	wantUse := append([]string{"vulkan"}, laptop.UseFlags...) // vulkan was set before gaming
+	if !reflect.DeepEqual(cfg.Portage.UseFlags, wantUse) {
+		t.Errorf("UseFlags = %v, want %v", cfg.Portage.UseFlags, wantUse)
+	}
+	wantPackages := append([]string{"app-editors/vim"}, laptop.Packages...)
+	if !reflect.DeepEqual(cfg.Packages.ExtraPackages, wantPackages) {
+		t.Errorf("ExtraPackages = %v, want %v", cfg.Packages.ExtraPackages, wantPackages)
+	}
+	if len(cfg.Overlays) != 0 {
+		t.Errorf("Overlays = %v, gaming overlay kept", cfg.Overlays)
+	}
+	if cfg.Kernel.Type != kernel {
+		t.Errorf("Kernel.Type = %s, want %s restored", cfg.Kernel.Type, kernel)
+	}
+
+	// A kernel chosen after the preset is kept
+	gaming, _ = cfg.SwitchPreset(nil, "gaming")
+	cfg.Kernel.Type = KernelVanilla
+	if _, err := cfg.SwitchPreset(gaming, ""); err != nil {
+		t.Fatalf("SwitchPreset(\"\") error = %v", err)
+	}
+	if cfg.Kernel.Type != KernelVanilla {
+		t.Errorf("Kernel.Type = %s, want the later choice %s", cfg.Kernel.Type, KernelVanilla)
+	}
+
+	if _, err := cfg.SwitchPreset(nil, "unknown"); err == nil {
+		t.Error("SwitchPreset(unknown) succeeded")
+	}
+}
@@ -0,0 +1,206 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Preset is a named set of USE flags, packages and hints for a kind of
+// system, merged into a config by ApplyPreset.
+type Preset struct {
+	Description string
+	UseFlags    []string   // Added to the global USE flags
+	Features    []string   // Added to FEATURES
+	Packages    []string   // Added to the extra packages
+	Services    []string   // Enabled on the installed system
+	Overlays    []string   // Keys of PredefinedOverlays
+	Kernel      KernelType // Kernel to use, empty to keep the configured one
+}
+
+// Presets lists the available presets by name.
+var Presets = map[string]Preset{
+	"kde": {
+		Description: "KDE Plasma desktop with Qt applications",
+		UseFlags:    []string{"qt5", "qt6", "kde", "plasma", "-gnome"},
+	},
+	"gnome": {
+		Description: "GNOME desktop with GTK applications",
+		UseFlags:    []string{"gtk", "gnome", "-qt5", "-qt6", "-kde"},
+	},
+	"xfce": {
+		Description: "Lightweight XFCE desktop",
+		UseFlags:    []string{"gtk", "xfce", "-qt5", "-qt6", "-kde", "-gnome"},
+	},
+	"laptop": {
+		Description: "Power management and wireless support",
+		UseFlags:    []string{"acpi", "wifi", "bluetooth", "networkmanager"},
+		Packages:    []string{"sys-power/tlp"},
+		Services:    []string{"tlp"},
+	},
+	"gaming": {
+		Description: "Steam, Vulkan, and gaming optimizations",
+		UseFlags:    []string{"vulkan", "opengl"},
+		Packages:    []string{"games-util/steam-launcher", "games-util/gamemode"},
+		Overlays:    []string{"steam-overlay"},
+		Kernel:      KernelZen,
+	},
+	"server": {
+		Description: "Minimal server installation",
+		UseFlags:    []string{"-X", "-wayland", "-gtk", "-qt5", "-qt6", "-bluetooth"},
+		Features:    []string{"-news"},
+	},
+}
+
+// PresetNames returns the names of the available presets, sorted.
+func PresetNames() []string {
+	names := make([]string, 0, len(Presets))
+	for name := range Presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// PresetChanges records what applying a preset added to a config, so that
+// RevertPreset removes exactly that and nothing the config already held.
+type PresetChanges struct {
+	UseFlags []string
+	Features []string
+	Packages []string
+	Services []string
+	Overlays []string   // Overlay names
+	Kernel   KernelType // Kernel the preset replaced, empty if unchanged
+
+	presetKernel KernelType
+}
+
+// ApplyPreset merges the named preset into the config. Lists are extended
+// without duplicates, so presets can be combined and applying one twice
+// changes nothing.
+func (c *InstallConfig) ApplyPreset(name string) error {
+	_, err := c.applyPreset(name)
+	return err
+}
+
+// SwitchPreset reverts the changes of a previously applied preset, then
+// applies the named one, so switching presets keeps nothing of the old
+// one. An empty name only reverts. It returns the changes to pass to the
+// next call.
+func (c *InstallConfig) SwitchPreset(previous *PresetChanges, name string) (*PresetChanges, error) {
+	if _, ok := Presets[name]; name != "" && !ok {
+		return previous, fmt.Errorf("unknown preset %q, available: %v", name, PresetNames())
+	}
+
+	c.RevertPreset(previous)
+	if name == "" {
+		return nil, nil
+	}
+	return c.applyPreset(name)
+}
+
+// RevertPreset removes what a preset added. The kernel is only restored if
+// it was not changed again since.
+func (c *InstallConfig) RevertPreset(changes *PresetChanges) {
+	if changes == nil {
+		return
+	}
+
+	c.Portage.UseFlags = removeValues(c.Portage.UseFlags, changes.UseFlags...)
+	c.Portage.Features = removeValues(c.Portage.Features, changes.Features...)
+	c.Packages.ExtraPackages = removeValues(c.Packages.ExtraPackages, changes.Packages...)
+	c.Services = removeValues(c.Services, changes.Services...)
+
+	overlays := c.Overlays[:0]
+	for _, overlay := range c.Overlays {
+		if !contains(changes.Overlays, overlay.Name) {
+			overlays = append(overlays, overlay)
+		}
+	}
+	c.Overlays = overlays
+
+	if changes.Kernel != "" && c.Kernel.Type == changes.presetKernel {
+		c.Kernel.Type = changes.Kernel
+	}
+}
+
+// applyPreset merges the named preset into the config and returns what it
+// added.
+func (c *InstallConfig) applyPreset(name string) (*PresetChanges, error) {
+	preset, ok := Presets[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown preset %q, available: %v", name, PresetNames())
+	}
+
+	changes := &PresetChanges{
+		UseFlags: missingValues(c.Portage.UseFlags, preset.UseFlags...),
+		Features: missingValues(c.Portage.Features, preset.Features...),
+		Packages: missingValues(c.Packages.ExtraPackages, preset.Packages...),
+		Services: missingValues(c.Services, preset.Services...),
+	}
+
+	for _, key := range preset.Overlays {
+		overlay, ok := PredefinedOverlays[key]
+		if !ok {
+			return nil, fmt.Errorf("preset %s: unknown overlay %q", name, key)
+		}
+		if !c.hasOverlay(overlay.Name) {
+			c.Overlays = append(c.Overlays, overlay)
+			changes.Overlays = append(changes.Overlays, overlay.Name)
+		}
+	}
+
+	c.Portage.UseFlags = append(c.Portage.UseFlags, changes.UseFlags...)
+	c.Portage.Features = append(c.Portage.Features, changes.Features...)
+	c.Packages.ExtraPackages = append(c.Packages.ExtraPackages, changes.Packages...)
+	c.Services = append(c.Services, changes.Services...)
+
+	if preset.Kernel != "" && preset.Kernel != c.Kernel.Type {
+		changes.Kernel = c.Kernel.Type
+		changes.presetKernel = preset.Kernel
+		c.Kernel.Type = preset.Kernel
+	}
+
+	return changes, nil
+}
+
+// missingValues returns the values not in list, without duplicates.
+func missingValues(list []string, values ...string) []string {
+	var missing []string
+	for _, v := range values {
+		if !contains(list, v) && !contains(missing, v) {
+			missing = append(missing, v)
+		}
+	}
+	return missing
+}
+
+// removeValues returns list without the given values.
+func removeValues(list []string, values ...string) []string {
+	var kept []string
+	for _, v := range list {
+		if !contains(values, v) {
+			kept = append(kept, v)
+		}
+	}
+	return kept
+}
+
+// contains reports whether list holds v.
+func contains(list []string, v string) bool {
+	for _, existing := range list {
+		if existing == v {
+			return true
+		}
+	}
+	return false
+}
+
+// hasOverlay reports whether an overlay with the given name is configured.
+func (c *InstallConfig) hasOverlay(name string) bool {
+	for _, overlay := range c.Overlays {
+		if overlay.Name == name {
+			return true
+		}
+	}
+	return false
+}
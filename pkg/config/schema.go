@@ -0,0 +1,163 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// schemaEnums lists the values of the string types that are enumerations.
+// Go cannot list the constants of a type, keep this in step with the const
+// blocks.
+var schemaEnums = map[reflect.Type][]string{
+	reflect.TypeOf(PostInstallAction("")): enumValues(PostInstallExit, PostInstallReboot, PostInstallPoweroff, PostInstallChroot),
+	reflect.TypeOf(PartitionScheme("")):   enumValues(PartSchemeGPT, PartSchemeMBR),
+	reflect.TypeOf(Filesystem("")):        enumValues(FSExt4, FSBtrfs, FSXfs, FSF2fs, FSZfs, FSFat32, FSSwap, FSNone),
+	reflect.TypeOf(EncryptionType("")):    enumValues(EncryptNone, EncryptLUKS, EncryptLUKS2, EncryptZFS, EncryptDMCrypt),
+	reflect.TypeOf(InitSystem("")):        enumValues(InitOpenRC, InitSystemd),
+	reflect.TypeOf(CFlagsPreset("")):      enumValues(CFlagsSafe, CFlagsOptimized, CFlagsAggressive, CFlagsCustom),
+	reflect.TypeOf(KernelType("")):        enumValues(KernelBin, KernelDist, KernelSources, KernelZen, KernelXanmod, KernelLiquorix, KernelVanilla),
+	reflect.TypeOf(HybridMode("")):        enumValues(HybridPowerSave, HybridOnDemand, HybridPerformance),
+	reflect.TypeOf(GPUDriver("")):         enumValues(GPUNvidia, GPUNvidiaOpen, GPUNouveau, GPUAmdgpu, GPURadeon, GPUIntel, GPUIntelXe, GPUVirtio, GPUVMware, GPUNone),
+	reflect.TypeOf(DisplayType("")):       enumValues(DisplayX11, DisplayWayland),
+	reflect.TypeOf(AppBundle("")):         enumValues(AppBundleMinimal, AppBundleStandard, AppBundleFull),
+	reflect.TypeOf(DesktopType("")): enumValues(DesktopKDE, DesktopGNOME, DesktopXFCE, DesktopLXQt, DesktopCinnamon, DesktopMATE, DesktopBudgie,
+		WMi3, WMSway, WMHyprland, WMBspwm, WMDwm, WMAwesome, WMOpenbox, DesktopNone),
+	reflect.TypeOf(DisplayManager("")):   enumValues(DMSDDM, DMGDM, DMLightDM, DMLXDM, DMGreetd, DMNone),
+	reflect.TypeOf(BootloaderType("")):   enumValues(BootGRUB, BootSystemdBoot),
+	reflect.TypeOf(BinaryPreference("")): enumValues(BinaryNone, BinaryPrefer, BinaryOnly),
+}
+
+// schemaFields adds the rules Validate enforces on single fields, by struct
+// and JSON field name.
+var schemaFields = map[reflect.Type]map[string]map[string]interface{}{
+	reflect.TypeOf(InstallConfig{}): {
+		"hostname":   {"minLength": 1},
+		"partitions": {"minItems": 1},
+		"target_dir": {"pattern": "^/."},
+	},
+	reflect.TypeOf(DiskConfig{}): {
+		"device":     {"minLength": 1},
+		"backup_dir": {"pattern": "^/"},
+	},
+	reflect.TypeOf(SecureBootConfig{}): {
+		"key_type": {"enum": []string{"", SecureBootCustom, SecureBootShim}},
+	},
+	reflect.TypeOf(OverlayConfig{}): {
+		"sync_type": {"enum": []string{"", "rsync", "webrsync", "git", "mercurial", "svn", "cvs", "local"}},
+		"commit":    {"pattern": commitPattern.String()},
+	},
+	reflect.TypeOf(UserConfig{}): {
+		"username": {"pattern": usernamePattern.String()},
+	},
+}
+
+// schemaRequired lists the fields Validate rejects a config without.
+var schemaRequired = map[reflect.Type][]string{
+	reflect.TypeOf(InstallConfig{}): {"hostname", "disk", "partitions"},
+	reflect.TypeOf(DiskConfig{}):    {"device"},
+	reflect.TypeOf(UserConfig{}):    {"username"},
+}
+
+// enumValues converts the constants of a string type to strings.
+func enumValues[T ~string](values ...T) []string {
+	out := make([]string, len(values))
+	for n, v := range values {
+		out[n] = string(v)
+	}
+	return out
+}
+
+// GenerateSchema returns a JSON Schema describing InstallConfig, for tools
+// that check or edit configs before handing them to the installer. Empty
+// strings are accepted for enumerations, as they select the default.
+func GenerateSchema() ([]byte, error) {
+	schema, err := typeSchema(reflect.TypeOf(InstallConfig{}))
+	if err != nil {
+		return nil, err
+	}
+
+	schema["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	schema["title"] = "Yuno OS installation config"
+
+	return json.MarshalIndent(schema, "", "  ")
+}
+
+// typeSchema returns the schema of a Go type.
+func typeSchema(t reflect.Type) (map[string]interface{}, error) {
+	if values, ok := schemaEnums[t]; ok {
+		return map[string]interface{}{
+			"type": "string",
+			"enum": append([]string{""}, values...),
+		}, nil
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return typeSchema(t.Elem())
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}, nil
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "minimum": 0}, nil
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}, nil
+	case reflect.Slice, reflect.Array:
+		items, err := typeSchema(t.Elem())
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"type": "array", "items": items}, nil
+	case reflect.Map:
+		if t.Key().Kind() != reflect.String {
+			return nil, fmt.Errorf("schema: map key of %s is not a string", t)
+		}
+		values, err := typeSchema(t.Elem())
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"type": "object", "additionalProperties": values}, nil
+	case reflect.Struct:
+		return structSchema(t)
+	default:
+		return nil, fmt.Errorf("schema: unsupported type %s", t)
+	}
+}
+
+// structSchema returns the schema of a struct from its JSON field names.
+func structSchema(t reflect.Type) (map[string]interface{}, error) {
+	properties := make(map[string]interface{})
+	for n := 0; n < t.NumField(); n++ {
+		field := t.Field(n)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if !field.IsExported() || name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		schema, err := typeSchema(field.Type)
+		if err != nil {
+			return nil, fmt.Errorf("%s.%s: %w", t.Name(), field.Name, err)
+		}
+		for key, value := range schemaFields[t][name] {
+			schema[key] = value
+		}
+		properties[name] = schema
+	}
+
+	schema := map[string]interface{}{
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+	if required := schemaRequired[t]; len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema, nil
+}
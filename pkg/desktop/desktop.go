@@ -4,6 +4,7 @@ package desktop
 import (
 	"fmt"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/japaneseenrichmentorganization/yuno_os/pkg/config"
@@ -14,6 +15,7 @@ import (
 type Manager struct {
 	config    *config.InstallConfig
 	targetDir string
+	failed    []string // Packages skipped by emerge --keep-going
 }
 
 // NewManager creates a new desktop manager.
@@ -35,6 +37,13 @@ func (m *Manager) Install(progress func(line string)) error {
 
 	utils.Info("Installing desktop: %s", desktop)
 
+	// Not every desktop runs on every display server
+	if session := m.config.Desktop.SessionType; !desktop.SupportsSession(session) {
+		fallback := desktop.DefaultSession()
+		utils.Warn("%s does not support %q sessions, using %s", desktop, session, fallback)
+		m.config.Desktop.SessionType = fallback
+	}
+
 	// Get packages for the desktop
 	packages := desktop.GetPackages()
 
@@ -45,6 +54,9 @@ func (m *Manager) Install(progress func(line string)) error {
 		if dmPkg != "" {
 			packages = append(packages, dmPkg)
 		}
+		if dm == config.DMGreetd {
+			packages = append(packages, "gui-apps/tuigreet")
+		}
 	}
 
 	// Add session dependencies
@@ -54,6 +66,11 @@ func (m *Manager) Install(progress func(line string)) error {
 		packages = append(packages, m.getX11Packages()...)
 	}
 
+	// Window managers need their own polkit agent and automounter
+	if desktop.IsWindowManager() {
+		packages = append(packages, m.getSessionHelperPackages()...)
+	}
+
 	// Add extra packages from config
 	packages = append(packages, m.config.Desktop.ExtraPackages...)
 
@@ -63,23 +80,39 @@ func (m *Manager) Install(progress func(line string)) error {
 	// Remove duplicates
 	packages = uniqueStrings(packages)
 
+	// Let PipeWire replace the PulseAudio daemon
+	if m.usePipeWire() {
+		usePath := filepath.Join(m.targetDir, "etc/portage/package.use/pipewire")
+		useContent := "media-video/pipewire sound-server\n"
+		if err := utils.WriteFile(usePath, useContent, 0644); err != nil {
+			return utils.NewError("desktop", "failed to write pipewire use flags", err)
+		}
+	}
+
 	// Install packages
-	args := append([]string{m.targetDir, "emerge", "--ask=n"}, packages...)
+	args := []string{m.targetDir, "emerge", "--ask=n"}
+	if m.config.Portage.KeepGoing {
+		args = append(args, "--keep-going")
+	}
+	args = append(args, packages...)
 
-	if progress != nil {
-		if err := utils.RunCommandWithOutput(progress, "chroot", args...); err != nil {
-			return utils.NewError("desktop", "failed to install desktop", err)
-		}
-	} else {
-		result := utils.RunCommand("chroot", args...)
-		if result.Error != nil {
+	result := utils.RunCommandStreaming(progress, "chroot", args...)
+	if result.Error != nil {
+		failed := utils.ParseEmergeFailures(result.Stdout + "\n" + result.Stderr)
+		if !m.config.Portage.KeepGoing || len(failed) == 0 {
 			return utils.NewError("desktop", "failed to install desktop", result.Error)
 		}
+		m.failed = append(m.failed, failed...)
 	}
 
 	return nil
 }
 
+// FailedPackages returns the packages emerge --keep-going skipped.
+func (m *Manager) FailedPackages() []string {
+	return m.failed
+}
+
 // getWaylandPackages returns Wayland session packages.
 func (m *Manager) getWaylandPackages() []string {
 	packages := []string{
@@ -110,18 +143,94 @@ func (m *Manager) getCommonPackages() []string {
 	packages := []string{
 		"app-misc/neofetch",
 		"sys-apps/dbus",
-		"media-sound/pulseaudio", // or pipewire
 		"net-misc/networkmanager",
 	}
 
-	// Use pipewire for Wayland
-	if m.config.Desktop.SessionType == config.DisplayWayland {
+	// Only one sound server: PipeWire for Wayland, PulseAudio for X11
+	if m.usePipeWire() {
 		packages = append(packages, "media-video/pipewire", "media-video/wireplumber")
+		if m.config.InitSystem != config.InitSystemd {
+			// Provides XDG_RUNTIME_DIR for the user session
+			packages = append(packages, "sys-auth/elogind")
+		}
+	} else {
+		packages = append(packages, "media-sound/pulseaudio")
 	}
 
 	return packages
 }
 
+// getAppBundlePackages returns the curated applications for the configured bundle.
+func (m *Manager) getAppBundlePackages() []string {
+	bundle := m.config.Desktop.AppBundle
+	if bundle != config.AppBundleStandard && bundle != config.AppBundleFull {
+		return nil
+	}
+
+	// Match the toolkit of the desktop where it has its own apps
+	var packages []string
+	switch m.config.Desktop.Type {
+	case config.DesktopKDE:
+		packages = []string{"kde-apps/dolphin", "kde-apps/konsole", "kde-apps/ark"}
+	case config.DesktopGNOME:
+		packages = []string{"gnome-base/nautilus", "x11-terms/gnome-terminal", "app-arch/file-roller"}
+	case config.DesktopLXQt:
+		packages = []string{"x11-misc/pcmanfm-qt", "x11-terms/qterminal", "app-arch/lxqt-archiver"}
+	case config.DesktopXFCE:
+		packages = []string{"xfce-base/thunar", "x11-terms/xfce4-terminal", "app-arch/file-roller"}
+	default:
+		packages = []string{"xfce-base/thunar", "x11-terms/alacritty", "app-arch/file-roller"}
+	}
+
+	packages = append(packages,
+		"www-client/firefox",
+		"media-video/mpv",
+	)
+
+	if bundle == config.AppBundleFull {
+		packages = append(packages,
+			"app-office/libreoffice",
+			"mail-client/thunderbird",
+			"media-gfx/gimp",
+		)
+	}
+
+	return packages
+}
+
+// getSessionHelperPackages returns the polkit agent and automount packages for WM sessions.
+func (m *Manager) getSessionHelperPackages() []string {
+	agentPkg, _ := m.polkitAgent()
+	packages := []string{
+		agentPkg,
+		"sys-fs/udisks",
+		"sys-fs/udiskie",
+	}
+
+	if m.config.InitSystem != config.InitSystemd {
+		// polkit needs an active logind session to authorize mounts
+		packages = append(packages, "sys-auth/elogind")
+	}
+
+	return packages
+}
+
+// polkitAgent returns the polkit agent package and command for the selected WM.
+func (m *Manager) polkitAgent() (pkg, command string) {
+	switch m.config.Desktop.Type {
+	case config.WMSway, config.WMHyprland:
+		// Qt agent runs natively on Wayland
+		return "lxqt-base/lxqt-policykit", "lxqt-policykit-agent"
+	default:
+		return "gnome-extra/polkit-gnome", "/usr/libexec/polkit-gnome-authentication-agent-1"
+	}
+}
+
+// usePipeWire reports whether PipeWire is the sound server for this install.
+func (m *Manager) usePipeWire() bool {
+	return m.config.Desktop.SessionType == config.DisplayWayland
+}
+
 // ConfigureDisplayManager configures the display manager.
 func (m *Manager) ConfigureDisplayManager() error {
 	dm := m.config.Desktop.DisplayManager
@@ -148,6 +257,11 @@ func (m *Manager) ConfigureDisplayManager() error {
 		}
 	case config.DMLXDM:
 		serviceName = "lxdm"
+	case config.DMGreetd:
+		serviceName = "greetd"
+		if err := m.configureGreetd(); err != nil {
+			return err
+		}
 	}
 
 	return m.enableService(serviceName)
@@ -184,6 +298,44 @@ SessionDir=/usr/share/wayland-sessions
 	return utils.WriteFile(confPath, content, 0644)
 }
 
+// configureGreetd configures greetd with the tuigreet greeter.
+func (m *Manager) configureGreetd() error {
+	greeter := "tuigreet --time --remember --asterisks"
+	if session := m.greetdSession(); session != "" {
+		greeter += " --cmd " + session
+	} else {
+		greeter += " --sessions /usr/share/wayland-sessions:/usr/share/xsessions"
+	}
+
+	content := fmt.Sprintf(`# greetd configuration - Generated by Yuno OS installer
+
+[terminal]
+vt = 7
+
+[default_session]
+command = "%s"
+user = "greetd"
+`, greeter)
+
+	confPath := filepath.Join(m.targetDir, "etc/greetd/config.toml")
+	return utils.WriteFile(confPath, content, 0644)
+}
+
+// greetdSession returns the command that starts the configured window
+// manager, or "" to let tuigreet offer the installed sessions.
+func (m *Manager) greetdSession() string {
+	switch m.config.Desktop.Type {
+	case config.WMSway:
+		return "sway"
+	case config.WMHyprland:
+		return "Hyprland"
+	case config.WMi3, config.WMBspwm, config.WMDwm, config.WMAwesome, config.WMOpenbox:
+		return "startx"
+	default:
+		return ""
+	}
+}
+
 // configureLightDM configures LightDM display manager.
 func (m *Manager) configureLightDM() error {
 	content := `[Seat:*]
@@ -225,6 +377,15 @@ func (m *Manager) ConfigureSession() error {
 		return nil
 	}
 
+	if desktop.IsWindowManager() {
+		if err := m.configureSessionHelpers(); err != nil {
+			return err
+		}
+		if err := m.createWMConfig(); err != nil {
+			return err
+		}
+	}
+
 	// Create .xinitrc or Wayland session launcher for WM users
 	switch desktop {
 	case config.WMi3:
@@ -261,15 +422,64 @@ fi
 # Set keyboard layout
 setxkbmap %s
 
+# Start polkit agent and automounter
+%s &
+
 # Start the window manager
 %s
-`, m.config.Keymap, exec)
+`, m.config.Keymap, sessionHelpersPath, exec)
 
 	// Write to /etc/skel for new users
 	skelPath := filepath.Join(m.targetDir, "etc/skel/.xinitrc")
 	return utils.WriteFile(skelPath, content, 0644)
 }
 
+// sessionHelpersPath is the script that starts the polkit agent, the
+// automounter and, on OpenRC, PipeWire.
+const sessionHelpersPath = "/usr/local/bin/yuno-session-helpers"
+
+// configureSessionHelpers installs the session helper script and hooks it into WM startup.
+func (m *Manager) configureSessionHelpers() error {
+	_, agent := m.polkitAgent()
+
+	script := fmt.Sprintf(`#!/bin/sh
+# Yuno OS session helpers for window manager sessions
+
+# Polkit authentication agent
+pgrep -u "$(id -u)" -f %[1]s >/dev/null || %[1]s &
+
+# Automount removable media through udisks
+pgrep -u "$(id -u)" -x udiskie >/dev/null || udiskie --automount --notify &
+`, agent)
+
+	// Window managers do not process XDG autostart, and OpenRC has no user
+	// services to start PipeWire from
+	if m.usePipeWire() && m.config.InitSystem != config.InitSystemd {
+		script += `
+# PipeWire, PipeWire-Pulse and WirePlumber
+pgrep -u "$(id -u)" -x pipewire >/dev/null || gentoo-pipewire-launcher &
+`
+	}
+
+	scriptPath := filepath.Join(m.targetDir, sessionHelpersPath)
+	if err := utils.WriteFile(scriptPath, script, 0755); err != nil {
+		return utils.NewError("desktop", "failed to write session helpers", err)
+	}
+
+	// X11 WMs start the helpers from .xinitrc; compositors need them in
+	// their config. Hyprland has no system drop-in directory, its default
+	// config from createWMConfig starts them.
+	if m.config.Desktop.Type == config.WMSway {
+		// The default sway config includes /etc/sway/config.d/*
+		confPath := filepath.Join(m.targetDir, "etc/sway/config.d/50-yuno-session-helpers.conf")
+		if err := utils.WriteFile(confPath, "exec "+sessionHelpersPath+"\n", 0644); err != nil {
+			return utils.NewError("desktop", "failed to write sway session config", err)
+		}
+	}
+
+	return nil
+}
+
 // createWaylandLauncher creates a Wayland session launcher.
 func (m *Manager) createWaylandLauncher(compositor string) error {
 	content := fmt.Sprintf(`#!/bin/sh
@@ -293,6 +503,89 @@ exec %s
 	return utils.WriteFile(scriptPath, content, 0755)
 }
 
+// graphicsEnvPath is the profile script written by the graphics package.
+const graphicsEnvPath = "/etc/profile.d/99-graphics.sh"
+
+// ConfigureSessionEnv writes the user's session environment variables.
+// Login shells read them from profile.d, sourced after the graphics
+// environment so user values win; on systemd they also go to
+// environment.d for sessions started by the user manager.
+func (m *Manager) ConfigureSessionEnv() error {
+	env := m.config.Desktop.SessionEnv
+	if len(env) == 0 {
+		return nil
+	}
+
+	utils.Info("Configuring session environment")
+
+	graphicsEnv, _ := utils.ReadFile(filepath.Join(m.targetDir, graphicsEnvPath))
+	for name, value := range parseExports(graphicsEnv) {
+		if userValue, ok := env[name]; ok && userValue != value {
+			utils.Warn("Session variable %s=%s overrides the graphics default %s", name, userValue, value)
+		}
+	}
+
+	profilePath := filepath.Join(m.targetDir, "etc/profile.d/99-yuno-session-env.sh")
+	if err := utils.WriteFile(profilePath, sessionEnvProfile(env), 0644); err != nil {
+		return utils.NewError("desktop", "failed to write session environment", err)
+	}
+
+	if m.config.InitSystem == config.InitSystemd {
+		confPath := filepath.Join(m.targetDir, "etc/environment.d/60-yuno-session.conf")
+		if err := utils.WriteFile(confPath, sessionEnvEnvironmentD(env), 0644); err != nil {
+			return utils.NewError("desktop", "failed to write session environment", err)
+		}
+	}
+
+	return nil
+}
+
+// sessionEnvProfile renders env as a profile.d script.
+func sessionEnvProfile(env map[string]string) string {
+	var b strings.Builder
+	b.WriteString("# Yuno OS session environment\n")
+	for _, name := range sortedKeys(env) {
+		quoted := "'" + strings.ReplaceAll(env[name], "'", `'\''`) + "'"
+		fmt.Fprintf(&b, "export %s=%s\n", name, quoted)
+	}
+	return b.String()
+}
+
+// sessionEnvEnvironmentD renders env as an environment.d(5) file.
+func sessionEnvEnvironmentD(env map[string]string) string {
+	var b strings.Builder
+	b.WriteString("# Yuno OS session environment\n")
+	for _, name := range sortedKeys(env) {
+		fmt.Fprintf(&b, "%s=%s\n", name, env[name])
+	}
+	return b.String()
+}
+
+// parseExports returns the variables set by "export NAME=value" lines.
+func parseExports(script string) map[string]string {
+	vars := make(map[string]string)
+	for _, line := range strings.Split(script, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "export ") {
+			continue
+		}
+		if name, value, ok := strings.Cut(strings.TrimPrefix(line, "export "), "="); ok {
+			vars[name] = strings.Trim(value, `"'`)
+		}
+	}
+	return vars
+}
+
+// sortedKeys returns the keys of m in sorted order.
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
 // ConfigureNetworkManager configures NetworkManager.
 func (m *Manager) ConfigureNetworkManager() error {
 	utils.Info("Configuring NetworkManager")
@@ -323,31 +616,141 @@ unmanaged-devices=interface-name:lo
 func (m *Manager) ConfigureAudio() error {
 	utils.Info("Configuring audio")
 
-	if m.config.Desktop.SessionType == config.DisplayWayland {
+	if m.usePipeWire() {
 		// PipeWire for Wayland
 		return m.configurePipeWire()
 	}
 
-	// PulseAudio for X11
-	return m.enableService("pulseaudio")
+	// PulseAudio for X11 runs per user; on OpenRC it is autospawned
+	if m.config.InitSystem == config.InitSystemd {
+		return m.enableUserUnits("pulseaudio.socket")
+	}
+
+	return nil
 }
 
 // configurePipeWire configures PipeWire audio system.
 func (m *Manager) configurePipeWire() error {
-	// Enable services
-	services := []string{"pipewire", "pipewire-pulse", "wireplumber"}
+	if m.config.InitSystem == config.InitSystemd {
+		// For systemd, these are user services
+		return m.enableUserUnits("pipewire.socket", "pipewire-pulse.socket", "wireplumber.service")
+	}
 
-	for _, service := range services {
-		if m.config.InitSystem == config.InitSystemd {
-			// For systemd, these are user services
-			// Just ensure the packages are installed
-			continue
-		}
+	// OpenRC has no user services: elogind provides the session and
+	// gentoo-pipewire-launcher starts PipeWire from XDG autostart, or from
+	// the session helpers in window manager sessions
+	if err := m.enableService("elogind"); err != nil {
+		utils.Warn("Failed to enable elogind: %v", err)
+	}
+
+	autostartPath := filepath.Join(m.targetDir, "etc/xdg/autostart/gentoo-pipewire-launcher.desktop")
+	if utils.FileExists(autostartPath) {
+		return nil
+	}
+
+	content := `[Desktop Entry]
+Type=Application
+Name=PipeWire
+Comment=Start PipeWire, PipeWire-Pulse and WirePlumber
+Exec=gentoo-pipewire-launcher restart
+NoDisplay=true
+`
+	if err := utils.WriteFile(autostartPath, content, 0644); err != nil {
+		return utils.NewError("desktop", "failed to write pipewire autostart entry", err)
 	}
 
 	return nil
 }
 
+// enableUserUnits enables systemd user units for all users.
+func (m *Manager) enableUserUnits(units ...string) error {
+	args := append([]string{"--global", "enable"}, units...)
+	result := utils.RunInChroot(m.targetDir, "systemctl", args...)
+	if result.Error != nil {
+		return utils.NewError("desktop", fmt.Sprintf("failed to enable user units %s", strings.Join(units, ", ")), result.Error)
+	}
+
+	return nil
+}
+
+// flathubRepo is the Flathub repository definition.
+const flathubRepo = "https://dl.flathub.org/repo/flathub.flatpakrepo"
+
+// flatpakMarker marks that the first-boot Flatpak installation completed.
+const flatpakMarker = "/var/lib/yuno/flatpaks-installed"
+
+// ConfigureFlatpak installs Flatpak, adds the Flathub remote and schedules
+// the configured apps for installation on first boot, since flatpak install
+// needs networking. It is a no-op when no apps are configured.
+func (m *Manager) ConfigureFlatpak(progress func(line string)) error {
+	apps := m.config.Desktop.Flatpaks
+	if len(apps) == 0 {
+		return nil
+	}
+
+	utils.Info("Configuring Flatpak with %d apps", len(apps))
+
+	args := []string{m.targetDir, "emerge", "--ask=n", "--noreplace", "sys-apps/flatpak"}
+	result := utils.RunCommandStreaming(progress, "chroot", args...)
+	if result.Error != nil {
+		return utils.NewError("desktop", "failed to install flatpak", result.Error)
+	}
+
+	result = utils.RunInChroot(m.targetDir, "flatpak", "remote-add", "--if-not-exists", "flathub", flathubRepo)
+	if result.Error != nil {
+		return utils.NewError("desktop", "failed to add flathub remote", result.Error)
+	}
+
+	install := "/usr/bin/flatpak install --system --noninteractive -y flathub " + strings.Join(apps, " ")
+
+	if m.config.InitSystem == config.InitSystemd {
+		unit := fmt.Sprintf(`[Unit]
+Description=Install Flatpak applications on first boot
+Wants=network-online.target
+After=network-online.target
+ConditionPathExists=!%s
+
+[Service]
+Type=oneshot
+ExecStart=%s
+ExecStartPost=/bin/mkdir -p %s
+ExecStartPost=/bin/touch %s
+
+[Install]
+WantedBy=multi-user.target
+`, flatpakMarker, install, filepath.Dir(flatpakMarker), flatpakMarker)
+
+		unitPath := filepath.Join(m.targetDir, "etc/systemd/system/yuno-flatpak-install.service")
+		if err := utils.WriteFile(unitPath, unit, 0644); err != nil {
+			return utils.NewError("desktop", "failed to write flatpak service", err)
+		}
+	} else {
+		script := fmt.Sprintf(`#!/sbin/openrc-run
+# Install Flatpak applications on first boot - Generated by Yuno OS installer
+
+description="Install Flatpak applications on first boot"
+
+depend() {
+	need net
+}
+
+start() {
+	[ -e %s ] && return 0
+	ebegin "Installing Flatpak applications"
+	%s && mkdir -p %s && touch %s
+	eend $?
+}
+`, flatpakMarker, install, filepath.Dir(flatpakMarker), flatpakMarker)
+
+		scriptPath := filepath.Join(m.targetDir, "etc/init.d/yuno-flatpak-install")
+		if err := utils.WriteFile(scriptPath, script, 0755); err != nil {
+			return utils.NewError("desktop", "failed to write flatpak service", err)
+		}
+	}
+
+	return m.enableService("yuno-flatpak-install")
+}
+
 // Setup performs complete desktop setup.
 func (m *Manager) Setup(progress func(line string)) error {
 	// Install desktop packages
@@ -365,6 +768,11 @@ func (m *Manager) Setup(progress func(line string)) error {
 		return err
 	}
 
+	// Configure user session environment
+	if err := m.ConfigureSessionEnv(); err != nil {
+		return err
+	}
+
 	// Configure NetworkManager
 	if err := m.ConfigureNetworkManager(); err != nil {
 		return err
@@ -383,9 +791,133 @@ func (m *Manager) Setup(progress func(line string)) error {
 		}
 	}
 
+	// Best effort: a broken session is better reported now than after reboot
+	if err := m.VerifySession(); err != nil {
+		utils.Warn("Desktop session check failed: %v", err)
+	}
+
 	return nil
 }
 
+// SetupExtras installs the curated applications of the app bundle and sets
+// up Flatpak. Nothing here is needed to log in, so the installer lets it
+// fail with a warning.
+func (m *Manager) SetupExtras(progress func(line string)) error {
+	if m.config.Desktop.Type == config.DesktopNone {
+		return nil
+	}
+
+	// Bundles overlap with what some desktops already ship
+	if packages := m.getAppBundlePackages(); len(packages) > 0 {
+		utils.Info("Installing the %s application bundle", m.config.Desktop.AppBundle)
+		args := append([]string{m.targetDir, "emerge", "--ask=n", "--noreplace"}, packages...)
+		result := utils.RunCommandStreaming(progress, "chroot", args...)
+		if result.Error != nil {
+			return utils.NewError("desktop", "failed to install the application bundle", result.Error)
+		}
+	}
+
+	return m.ConfigureFlatpak(progress)
+}
+
+// sessionType returns the session type the desktop will run.
+func (m *Manager) sessionType() config.DisplayType {
+	desktop := m.config.Desktop.Type
+	if session := m.config.Desktop.SessionType; session != "" && desktop.SupportsSession(session) {
+		return session
+	}
+	return desktop.DefaultSession()
+}
+
+// sessionBinary returns the program that starts the desktop session.
+func sessionBinary(desktop config.DesktopType, session config.DisplayType) string {
+	switch desktop {
+	case config.DesktopKDE:
+		if session == config.DisplayX11 {
+			return "/usr/bin/startplasma-x11"
+		}
+		return "/usr/bin/startplasma-wayland"
+	case config.DesktopGNOME:
+		return "/usr/bin/gnome-session"
+	case config.DesktopXFCE:
+		return "/usr/bin/startxfce4"
+	case config.DesktopLXQt:
+		return "/usr/bin/startlxqt"
+	case config.DesktopCinnamon:
+		return "/usr/bin/cinnamon-session"
+	case config.DesktopMATE:
+		return "/usr/bin/mate-session"
+	case config.DesktopBudgie:
+		return "/usr/bin/budgie-desktop"
+	case config.WMi3:
+		return "/usr/bin/i3"
+	case config.WMSway:
+		return "/usr/bin/sway"
+	case config.WMHyprland:
+		return "/usr/bin/Hyprland"
+	case config.WMBspwm:
+		return "/usr/bin/bspwm"
+	case config.WMDwm:
+		return "/usr/bin/dwm"
+	case config.WMAwesome:
+		return "/usr/bin/awesome"
+	case config.WMOpenbox:
+		return "/usr/bin/openbox-session"
+	}
+	return ""
+}
+
+// VerifySession checks that the session's programs are installed and that
+// their shared libraries resolve. Nothing is started.
+func (m *Manager) VerifySession() error {
+	desktop := m.config.Desktop.Type
+	if desktop == config.DesktopNone {
+		return nil
+	}
+
+	session := m.sessionType()
+	binaries := []string{sessionBinary(desktop, session)}
+	if session == config.DisplayX11 {
+		binaries = append(binaries, "/usr/bin/Xorg")
+	}
+
+	for _, binary := range binaries {
+		if binary == "" {
+			continue
+		}
+		if utils.IsDryRun() {
+			utils.RecordAction("verify", "%s and its libraries", binary)
+			continue
+		}
+		if !utils.FileExists(filepath.Join(m.targetDir, binary)) {
+			return utils.NewError("desktop", fmt.Sprintf("%s is not installed", binary), nil)
+		}
+
+		// Shell scripts such as startxfce4 have no libraries to check
+		result := utils.RunInChroot(m.targetDir, "ldd", binary)
+		if result.Error != nil {
+			utils.Debug("Skipping library check of %s: %v", binary, result.Error)
+			continue
+		}
+		if missing := missingLibraries(result.Stdout); len(missing) > 0 {
+			return utils.NewError("desktop", fmt.Sprintf("%s is missing libraries: %s", binary, strings.Join(missing, ", ")), nil)
+		}
+	}
+
+	return nil
+}
+
+// missingLibraries returns the libraries ldd reports as "not found".
+func missingLibraries(lddOutput string) []string {
+	var missing []string
+	for _, line := range strings.Split(lddOutput, "\n") {
+		if name, rest, ok := strings.Cut(strings.TrimSpace(line), " => "); ok && strings.HasPrefix(rest, "not found") {
+			missing = append(missing, name)
+		}
+	}
+	return missing
+}
+
 // DesktopDescriptions returns descriptions for each desktop type.
 func DesktopDescriptions() map[config.DesktopType]string {
 	return map[config.DesktopType]string{
@@ -414,6 +946,7 @@ func DisplayManagerDescriptions() map[config.DisplayManager]string {
 		config.DMGDM:     "GDM - GNOME Display Manager",
 		config.DMLightDM: "LightDM - Lightweight, flexible",
 		config.DMLXDM:    "LXDM - LXDE Display Manager",
+		config.DMGreetd:  "greetd - Minimal login daemon with tuigreet",
 		config.DMNone:    "None - TTY login / startx",
 	}
 }
@@ -427,7 +960,9 @@ func GetRecommendedDM(desktop config.DesktopType) config.DisplayManager {
 		return config.DMGDM
 	case config.DesktopXFCE, config.DesktopLXQt, config.DesktopMATE, config.DesktopCinnamon:
 		return config.DMLightDM
-	case config.WMi3, config.WMSway, config.WMHyprland, config.WMBspwm, config.WMDwm:
+	case config.WMSway, config.WMHyprland:
+		return config.DMGreetd
+	case config.WMi3, config.WMBspwm, config.WMDwm:
 		return config.DMNone // WM users often prefer startx
 	default:
 		return config.DMNone
@@ -0,0 +1,299 @@
+package desktop
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/japaneseenrichmentorganization/yuno_os/pkg/config"
+	"github.com/japaneseenrichmentorganization/yuno_os/pkg/utils"
+)
+
+func TestSessionHelpersStartPipeWire(t *testing.T) {
+	tests := []struct {
+		name    string
+		desktop config.DesktopType
+		init    config.InitSystem
+		want    bool
+	}{
+		{"sway on openrc", config.WMSway, config.InitOpenRC, true},
+		{"hyprland on openrc", config.WMHyprland, config.InitOpenRC, true},
+		{"sway on systemd", config.WMSway, config.InitSystemd, false},
+		{"i3 uses pulseaudio", config.WMi3, config.InitOpenRC, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.NewDefaultConfig()
+			cfg.Desktop.Type = tt.desktop
+			cfg.Desktop.SessionType = tt.desktop.DefaultSession()
+			cfg.InitSystem = tt.init
+			target := t.TempDir()
+
+			if err := NewManager(cfg, target).configureSessionHelpers(); err != nil {
+				t.Fatalf("configureSessionHelpers() error = %v", err)
+			}
+
+			script, err := os.ReadFile(filepath.Join(target, sessionHelpersPath))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Contains(string(script), "gentoo-pipewire-launcher"); got != tt.want {
+				t.Errorf("session helpers start PipeWire = %v, want %v:\n%s", got, tt.want, script)
+			}
+		})
+	}
+}
+
+func TestWMConfigsStartSessionHelpers(t *testing.T) {
+	for desktop := range wmConfigs {
+		t.Run(string(desktop), func(t *testing.T) {
+			cfg := config.NewDefaultConfig()
+			cfg.Desktop.Type = desktop
+			target := t.TempDir()
+
+			m := NewManager(cfg, target)
+			if err := m.configureSessionHelpers(); err != nil {
+				t.Fatalf("configureSessionHelpers() error = %v", err)
+			}
+			if err := m.createWMConfig(); err != nil {
+				t.Fatalf("createWMConfig() error = %v", err)
+			}
+
+			// sway picks the helpers up from its drop-in directory
+			files := []string{filepath.Join("etc/skel", wmConfigs[desktop].path)}
+			if desktop == config.WMSway {
+				files = append(files, "etc/sway/config.d/50-yuno-session-helpers.conf")
+			}
+
+			var found bool
+			for _, file := range files {
+				content, err := os.ReadFile(filepath.Join(target, file))
+				if err != nil {
+					t.Fatal(err)
+				}
+				found = found || strings.Contains(string(content), sessionHelpersPath)
+			}
+			if !found {
+				t.Errorf("%s config does not start %s", desktop, sessionHelpersPath)
+			}
+		})
+	}
+}
+
+func TestSessionHelperPackages(t *testing.T) {
+	tests := []struct {
+		name    string
+		desktop config.DesktopType
+		init    config.InitSystem
+		want    []string
+	}{
+		{
+			"sway on openrc", config.WMSway, config.InitOpenRC,
+			[]string{"lxqt-base/lxqt-policykit", "sys-fs/udisks", "sys-fs/udiskie", "sys-auth/elogind"},
+		},
+		{
+			"hyprland on systemd", config.WMHyprland, config.InitSystemd,
+			[]string{"lxqt-base/lxqt-policykit", "sys-fs/udisks", "sys-fs/udiskie"},
+		},
+		{
+			"i3 on openrc", config.WMi3, config.InitOpenRC,
+			[]string{"gnome-extra/polkit-gnome", "sys-fs/udisks", "sys-fs/udiskie", "sys-auth/elogind"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.NewDefaultConfig()
+			cfg.Desktop.Type = tt.desktop
+			cfg.InitSystem = tt.init
+			if got := NewManager(cfg, t.TempDir()).getSessionHelperPackages(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("getSessionHelperPackages() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSessionHelpersStartAgent(t *testing.T) {
+	for _, desktop := range []config.DesktopType{config.WMSway, config.WMi3} {
+		t.Run(string(desktop), func(t *testing.T) {
+			cfg := config.NewDefaultConfig()
+			cfg.Desktop.Type = desktop
+			target := t.TempDir()
+
+			m := NewManager(cfg, target)
+			if err := m.configureSessionHelpers(); err != nil {
+				t.Fatalf("configureSessionHelpers() error = %v", err)
+			}
+
+			script, err := os.ReadFile(filepath.Join(target, sessionHelpersPath))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, agent := m.polkitAgent()
+			for _, want := range []string{agent, "udiskie --automount"} {
+				if !strings.Contains(string(script), want) {
+					t.Errorf("session helpers do not start %q:\n%s", want, script)
+				}
+			}
+		})
+	}
+}
+
+func TestSessionEnvFiles(t *testing.T) {
+	env := map[string]string{
+		"QT_QPA_PLATFORM": "wayland;xcb",
+		"EDITOR":          "nvim",
+		"GREETING":        "it's me",
+	}
+
+	wantProfile := "# Yuno OS session environment\n" +
+		"export EDITOR='nvim'\n" +
+		"export GREETING='it'\\''s me'\n" +
+		"export QT_QPA_PLATFORM='wayland;xcb'\n"
+	if got := sessionEnvProfile(env); got != wantProfile {
+		t.Errorf("sessionEnvProfile() =\n%s\nwant\n%s", got, wantProfile)
+	}
+
+	wantEnvironmentD := "# Yuno OS session environment\n" +
+		"EDITOR=nvim\n" +
+		"GREETING=it's me\n" +
+		"QT_QPA_PLATFORM=wayland;xcb\n"
+	if got := sessionEnvEnvironmentD(env); got != wantEnvironmentD {
+		t.Errorf("sessionEnvEnvironmentD() =\n%s\nwant\n%s", got, wantEnvironmentD)
+	}
+}
+
+func TestParseExports(t *testing.T) {
+	script := `# Graphics environment
+export LIBVA_DRIVER_NAME=nvidia
+export GBM_BACKEND="nvidia-drm"
+  export __GLX_VENDOR_LIBRARY_NAME='nvidia'
+VDPAU_DRIVER=nvidia
+export BROKEN
+`
+	want := map[string]string{
+		"LIBVA_DRIVER_NAME":         "nvidia",
+		"GBM_BACKEND":               "nvidia-drm",
+		"__GLX_VENDOR_LIBRARY_NAME": "nvidia",
+	}
+	if got := parseExports(script); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseExports() = %v, want %v", got, want)
+	}
+}
+
+func TestConfigureSessionEnv(t *testing.T) {
+	tests := []struct {
+		init             config.InitSystem
+		wantEnvironmentD bool
+	}{
+		{config.InitSystemd, true},
+		{config.InitOpenRC, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.init), func(t *testing.T) {
+			cfg := config.NewDefaultConfig()
+			cfg.InitSystem = tt.init
+			cfg.Desktop.SessionEnv = map[string]string{"MOZ_ENABLE_WAYLAND": "1"}
+			target := t.TempDir()
+
+			if err := NewManager(cfg, target).ConfigureSessionEnv(); err != nil {
+				t.Fatalf("ConfigureSessionEnv() error = %v", err)
+			}
+
+			if _, err := os.Stat(filepath.Join(target, "etc/profile.d/99-yuno-session-env.sh")); err != nil {
+				t.Errorf("profile.d script not written: %v", err)
+			}
+			_, err := os.Stat(filepath.Join(target, "etc/environment.d/60-yuno-session.conf"))
+			if got := err == nil; got != tt.wantEnvironmentD {
+				t.Errorf("environment.d written = %v, want %v", got, tt.wantEnvironmentD)
+			}
+		})
+	}
+}
+
+func TestVerifySessionPlan(t *testing.T) {
+	tests := []struct {
+		desktop config.DesktopType
+		session config.DisplayType
+		want    []string
+	}{
+		{config.DesktopNone, "", nil},
+		{config.DesktopKDE, "", []string{"/usr/bin/startplasma-wayland"}},
+		{config.DesktopKDE, config.DisplayX11, []string{"/usr/bin/startplasma-x11", "/usr/bin/Xorg"}},
+		{config.DesktopXFCE, config.DisplayWayland, []string{"/usr/bin/startxfce4", "/usr/bin/Xorg"}}, // Unsupported, X11 is used
+		{config.WMSway, "", []string{"/usr/bin/sway"}},
+		{config.WMi3, "", []string{"/usr/bin/i3", "/usr/bin/Xorg"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.desktop)+"/"+string(tt.session), func(t *testing.T) {
+			utils.SetDryRun(true)
+			defer utils.SetDryRun(false)
+
+			cfg := config.NewDefaultConfig()
+			cfg.Desktop.Type = tt.desktop
+			cfg.Desktop.SessionType = tt.session
+			if err := NewManager(cfg, "/mnt/test").VerifySession(); err != nil {
+				t.Fatalf("VerifySession() error = %v", err)
+			}
+
+			var got []string
+			for _, action := range utils.Plan() {
+				got = append(got, strings.TrimSuffix(action.Detail, " and its libraries"))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("VerifySession() checked %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifySessionMissingBinary(t *testing.T) {
+	cfg := config.NewDefaultConfig()
+	cfg.Desktop.Type = config.WMSway
+
+	err := NewManager(cfg, t.TempDir()).VerifySession()
+	if err == nil || !strings.Contains(err.Error(), "/usr/bin/sway is not installed") {
+		t.Errorf("VerifySession() error = %v, want sway not installed", err)
+	}
+}
+
+func TestMissingLibraries(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   []string
+	}{
+		{
+			name: "complete",
+			output: `	linux-vdso.so.1 (0x00007ffc8d5f2000)
+	libwlroots.so.12 => /usr/lib64/libwlroots.so.12 (0x00007f0c1a000000)
+	libc.so.6 => /lib64/libc.so.6 (0x00007f0c19e00000)
+	/lib64/ld-linux-x86-64.so.2 (0x00007f0c1a400000)
+`,
+			want: nil,
+		},
+		{
+			name: "missing",
+			output: `	linux-vdso.so.1 (0x00007ffc8d5f2000)
+	libwlroots.so.12 => not found
+	libjson-c.so.5 => /usr/lib64/libjson-c.so.5 (0x00007f0c1a000000)
+	libpcre2-8.so.0 => not found
+`,
+			want: []string{"libwlroots.so.12", "libpcre2-8.so.0"},
+		},
+		{"empty", "", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := missingLibraries(tt.output); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("missingLibraries() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,282 @@
+package desktop
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/japaneseenrichmentorganization/yuno_os/pkg/config"
+	"github.com/japaneseenrichmentorganization/yuno_os/pkg/utils"
+)
+
+// wmTerminals maps terminal packages to the command that starts them.
+var wmTerminals = map[string]string{
+	"x11-terms/alacritty": "alacritty",
+	"x11-terms/kitty":     "kitty",
+	"gui-apps/foot":       "foot",
+	"x11-terms/st":        "st",
+	"x11-terms/wezterm":   "wezterm",
+}
+
+// wmLaunchers maps application launcher packages to the command that opens
+// them.
+var wmLaunchers = map[string]string{
+	"gui-apps/wofi":   "wofi --show drun",
+	"gui-apps/fuzzel": "fuzzel",
+	"x11-misc/rofi":   "rofi -show drun",
+	"x11-misc/dmenu":  "dmenu_run",
+}
+
+// wmConfigData is what the window manager config templates are filled with.
+type wmConfigData struct {
+	Terminal       string
+	Launcher       string
+	Keymap         string
+	SessionHelpers string
+}
+
+// wmConfigs holds the default config of the window managers that are
+// unusable without one, by skel path.
+var wmConfigs = map[config.DesktopType]struct {
+	path     string
+	template *template.Template
+}{
+	config.WMSway:     {".config/sway/config", template.Must(template.New("sway").Parse(swayConfig))},
+	config.WMHyprland: {".config/hypr/hyprland.conf", template.Must(template.New("hyprland").Parse(hyprlandConfig))},
+	config.WMi3:       {".config/i3/config", template.Must(template.New("i3").Parse(i3Config))},
+}
+
+// wmApps returns the terminal and launcher commands for the installed
+// packages. Extra packages come first, so a terminal the user added wins
+// over the window manager's default one.
+func (m *Manager) wmApps() (terminal, launcher string) {
+	packages := append(append([]string(nil), m.config.Desktop.ExtraPackages...), m.config.Desktop.Type.GetPackages()...)
+	for _, pkg := range packages {
+		if cmd, ok := wmTerminals[pkg]; ok && terminal == "" {
+			terminal = cmd
+		}
+		if cmd, ok := wmLaunchers[pkg]; ok && launcher == "" {
+			launcher = cmd
+		}
+	}
+	return terminal, launcher
+}
+
+// createWMConfig writes a default config for the window manager to
+// /etc/skel, so new users get a terminal, a launcher and the usual key
+// bindings on first login. An existing config is kept.
+func (m *Manager) createWMConfig() error {
+	wm, ok := wmConfigs[m.config.Desktop.Type]
+	if !ok {
+		return nil
+	}
+
+	confPath := filepath.Join(m.targetDir, "etc/skel", wm.path)
+	if utils.FileExists(confPath) {
+		utils.Debug("Keeping existing %s", confPath)
+		return nil
+	}
+
+	terminal, launcher := m.wmApps()
+	if terminal == "" || launcher == "" {
+		utils.Warn("No terminal or launcher found in the %s packages, the default config binds neither", m.config.Desktop.Type)
+	}
+
+	var content strings.Builder
+	err := wm.template.Execute(&content, wmConfigData{
+		Terminal:       terminal,
+		Launcher:       launcher,
+		Keymap:         m.config.Keymap,
+		SessionHelpers: sessionHelpersPath,
+	})
+	if err != nil {
+		return utils.NewError("desktop", fmt.Sprintf("failed to render the %s config", m.config.Desktop.Type), err)
+	}
+
+	if err := utils.WriteFile(confPath, content.String(), 0644); err != nil {
+		return utils.NewError("desktop", fmt.Sprintf("failed to write the %s config", m.config.Desktop.Type), err)
+	}
+
+	return nil
+}
+
+const swayConfig = `# Yuno OS default sway config, see sway(5)
+
+set $mod Mod4
+set $left h
+set $down j
+set $up k
+set $right l
+{{- if .Terminal}}
+set $term {{.Terminal}}
+{{- end}}
+{{- if .Launcher}}
+set $menu {{.Launcher}}
+{{- end}}
+
+{{- if .Keymap}}
+
+input type:keyboard {
+    xkb_layout {{.Keymap}}
+}
+{{- end}}
+
+output * bg #1e1e2e solid_color
+
+# Key bindings
+{{- if .Terminal}}
+bindsym $mod+Return exec $term
+{{- end}}
+{{- if .Launcher}}
+bindsym $mod+d exec $menu
+{{- end}}
+bindsym $mod+Shift+q kill
+bindsym $mod+Shift+c reload
+bindsym $mod+Shift+e exec swaynag -t warning -m 'Exit sway?' -B 'Exit' 'swaymsg exit'
+floating_modifier $mod normal
+
+bindsym $mod+$left focus left
+bindsym $mod+$down focus down
+bindsym $mod+$up focus up
+bindsym $mod+$right focus right
+bindsym $mod+Shift+$left move left
+bindsym $mod+Shift+$down move down
+bindsym $mod+Shift+$up move up
+bindsym $mod+Shift+$right move right
+
+bindsym $mod+1 workspace number 1
+bindsym $mod+2 workspace number 2
+bindsym $mod+3 workspace number 3
+bindsym $mod+4 workspace number 4
+bindsym $mod+5 workspace number 5
+bindsym $mod+Shift+1 move container to workspace number 1
+bindsym $mod+Shift+2 move container to workspace number 2
+bindsym $mod+Shift+3 move container to workspace number 3
+bindsym $mod+Shift+4 move container to workspace number 4
+bindsym $mod+Shift+5 move container to workspace number 5
+
+bindsym $mod+b splith
+bindsym $mod+v splitv
+bindsym $mod+f fullscreen
+bindsym $mod+Shift+space floating toggle
+
+bar {
+    swaybar_command waybar
+}
+
+# Session helpers and distribution snippets
+include /etc/sway/config.d/*
+`
+
+const hyprlandConfig = `# Yuno OS default Hyprland config, see https://wiki.hyprland.org
+
+$mod = SUPER
+{{- if .Terminal}}
+$terminal = {{.Terminal}}
+{{- end}}
+{{- if .Launcher}}
+$menu = {{.Launcher}}
+{{- end}}
+
+monitor = , preferred, auto, 1
+
+exec-once = {{.SessionHelpers}}
+exec-once = waybar
+
+input {
+{{- if .Keymap}}
+    kb_layout = {{.Keymap}}
+{{- end}}
+    follow_mouse = 1
+}
+
+general {
+    gaps_in = 4
+    gaps_out = 8
+    border_size = 2
+    layout = dwindle
+}
+
+# Key bindings
+{{- if .Terminal}}
+bind = $mod, Return, exec, $terminal
+{{- end}}
+{{- if .Launcher}}
+bind = $mod, D, exec, $menu
+{{- end}}
+bind = $mod SHIFT, Q, killactive,
+bind = $mod SHIFT, E, exit,
+bind = $mod, F, fullscreen,
+bind = $mod SHIFT, Space, togglefloating,
+
+bind = $mod, H, movefocus, l
+bind = $mod, J, movefocus, d
+bind = $mod, K, movefocus, u
+bind = $mod, L, movefocus, r
+
+bind = $mod, 1, workspace, 1
+bind = $mod, 2, workspace, 2
+bind = $mod, 3, workspace, 3
+bind = $mod, 4, workspace, 4
+bind = $mod, 5, workspace, 5
+bind = $mod SHIFT, 1, movetoworkspace, 1
+bind = $mod SHIFT, 2, movetoworkspace, 2
+bind = $mod SHIFT, 3, movetoworkspace, 3
+bind = $mod SHIFT, 4, movetoworkspace, 4
+bind = $mod SHIFT, 5, movetoworkspace, 5
+
+bindm = $mod, mouse:272, movewindow
+bindm = $mod, mouse:273, resizewindow
+`
+
+const i3Config = `# Yuno OS default i3 config, see https://i3wm.org/docs/userguide.html
+
+set $mod Mod4
+font pango:monospace 9
+floating_modifier $mod
+
+# Display managers do not run .xinitrc, start the session helpers here
+exec --no-startup-id {{.SessionHelpers}}
+
+# Key bindings
+{{- if .Terminal}}
+bindsym $mod+Return exec {{.Terminal}}
+{{- end}}
+{{- if .Launcher}}
+bindsym $mod+d exec --no-startup-id {{.Launcher}}
+{{- end}}
+bindsym $mod+Shift+q kill
+bindsym $mod+Shift+c reload
+bindsym $mod+Shift+r restart
+bindsym $mod+Shift+e exec i3-nagbar -t warning -m 'Exit i3?' -B 'Exit' 'i3-msg exit'
+
+bindsym $mod+h focus left
+bindsym $mod+j focus down
+bindsym $mod+k focus up
+bindsym $mod+l focus right
+bindsym $mod+Shift+h move left
+bindsym $mod+Shift+j move down
+bindsym $mod+Shift+k move up
+bindsym $mod+Shift+l move right
+
+bindsym $mod+1 workspace number 1
+bindsym $mod+2 workspace number 2
+bindsym $mod+3 workspace number 3
+bindsym $mod+4 workspace number 4
+bindsym $mod+5 workspace number 5
+bindsym $mod+Shift+1 move container to workspace number 1
+bindsym $mod+Shift+2 move container to workspace number 2
+bindsym $mod+Shift+3 move container to workspace number 3
+bindsym $mod+Shift+4 move container to workspace number 4
+bindsym $mod+Shift+5 move container to workspace number 5
+
+bindsym $mod+b split h
+bindsym $mod+v split v
+bindsym $mod+f fullscreen toggle
+bindsym $mod+Shift+space floating toggle
+
+bar {
+    status_command i3status
+}
+`
@@ -29,11 +29,37 @@ type LUKSInfo struct {
 	Cipher     string
 	KeySize    int
 	Hash       string
-	Version    int // 1 or 2
+	Version    int    // 1 or 2
+	KeyFile    string // Key file under KeyFileDir on the target ("" prompts for a passphrase)
+}
+
+// Credential is the secret used to format and unlock a LUKS device.
+type Credential struct {
+	Password string
+	KeyFile  string // Takes precedence over Password when set
+}
+
+// KeyFileDir is where key files for devices unlocked from root are stored.
+const KeyFileDir = "/etc/cryptsetup-keys.d"
+
+// MapperName returns the device-mapper name for an encrypted mount point.
+func MapperName(mountPoint string) string {
+	if mountPoint == "/" {
+		return "cryptroot"
+	}
+	return "crypt" + strings.ReplaceAll(strings.Trim(mountPoint, "/"), "/", "-")
+}
+
+// runCryptsetup runs cryptsetup with the credential as the key.
+func runCryptsetup(cred Credential, args ...string) *utils.CommandResult {
+	if cred.KeyFile != "" {
+		return utils.RunCommand("cryptsetup", append(args, "--key-file", cred.KeyFile)...)
+	}
+	return runWithStdin(cred.Password, "cryptsetup", args...)
 }
 
 // SetupLUKS creates a LUKS encrypted partition.
-func (m *Manager) SetupLUKS(device, name, password string) (*LUKSInfo, error) {
+func (m *Manager) SetupLUKS(device, name string, cred Credential) (*LUKSInfo, error) {
 	cfg := m.config.Encryption
 	utils.Info("Setting up LUKS encryption on %s", device)
 
@@ -73,14 +99,13 @@ func (m *Manager) SetupLUKS(device, name, password string) (*LUKSInfo, error) {
 	args = append(args, device)
 
 	// Format the device with LUKS
-	// We need to provide the password via stdin
-	result := runWithStdin(password, "cryptsetup", args...)
+	result := runCryptsetup(cred, args...)
 	if result.Error != nil {
 		return nil, utils.NewError("encryption", "failed to format LUKS device", result.Error)
 	}
 
 	// Open the LUKS device
-	mappedPath, err := m.OpenLUKS(device, name, password)
+	mappedPath, err := m.OpenLUKS(device, name, cred)
 	if err != nil {
 		return nil, err
 	}
@@ -103,10 +128,10 @@ func (m *Manager) SetupLUKS(device, name, password string) (*LUKSInfo, error) {
 }
 
 // OpenLUKS opens an existing LUKS device.
-func (m *Manager) OpenLUKS(device, name, password string) (string, error) {
+func (m *Manager) OpenLUKS(device, name string, cred Credential) (string, error) {
 	utils.Info("Opening LUKS device %s as %s", device, name)
 
-	result := runWithStdin(password, "cryptsetup", "luksOpen", device, name)
+	result := runCryptsetup(cred, "luksOpen", device, name)
 	if result.Error != nil {
 		return "", utils.NewError("encryption", "failed to open LUKS device", result.Error)
 	}
@@ -188,7 +213,7 @@ func (m *Manager) GenerateKeyFile(path string, size int) error {
 	}
 
 	// Set restrictive permissions
-	if err := os.Chmod(path, 0400); err != nil {
+	if err := utils.Chmod(path, 0400); err != nil {
 		return utils.NewError("encryption", "failed to set key file permissions", err)
 	}
 
@@ -336,9 +361,11 @@ func (m *Manager) GenerateCrypttab(devices []LUKSInfo, targetRoot string) error
 		result := utils.RunCommand("blkid", "-s", "UUID", "-o", "value", dev.Device)
 		uuid := strings.TrimSpace(result.Stdout)
 
+		// Key files elsewhere are on the live medium and do not exist on
+		// the installed system, so those devices prompt for a passphrase
 		keyFile := "none"
-		if m.config.Encryption.KeyFile != "" {
-			keyFile = m.config.Encryption.KeyFile
+		if strings.HasPrefix(dev.KeyFile, KeyFileDir+"/") {
+			keyFile = dev.KeyFile
 		}
 
 		options := "luks"
@@ -387,15 +414,8 @@ func (m *Manager) UpdateInitramfs(targetRoot string) error {
 
 // Helper function to run commands with stdin input
 func runWithStdin(input string, name string, args ...string) *utils.CommandResult {
-	utils.Debug("Running command with stdin: %s %s", name, strings.Join(args, " "))
-
-	cmd := utils.RunCommand("sh", "-c",
-		fmt.Sprintf("echo -n '%s' | %s %s",
-			strings.ReplaceAll(input, "'", "'\"'\"'"),
-			name,
-			strings.Join(args, " ")))
-
-	return cmd
+	// Passed on stdin so the secret never appears in a command line or the timing report
+	return utils.RunCommandWithStdin(input, name, args...)
 }
 
 // IsLUKS checks if a device is a LUKS encrypted device.
@@ -404,6 +424,16 @@ func IsLUKS(device string) bool {
 	return result.ExitCode == 0
 }
 
+// BackupHeader saves the LUKS header of device to path. Without the header
+// the data on the device cannot be decrypted, even with the passphrase.
+func BackupHeader(device, path string) error {
+	result := utils.RunCommand("cryptsetup", "luksHeaderBackup", device, "--header-backup-file", path)
+	if result.Error != nil {
+		return utils.NewError("encryption", fmt.Sprintf("failed to back up the LUKS header of %s", device), result.Error)
+	}
+	return nil
+}
+
 // GetLUKSUUID returns the UUID of a LUKS device.
 func GetLUKSUUID(device string) string {
 	result := utils.RunCommand("cryptsetup", "luksUUID", device)
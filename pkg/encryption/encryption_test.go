@@ -0,0 +1,59 @@
+package encryption
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/japaneseenrichmentorganization/yuno_os/pkg/config"
+)
+
+func TestMapperName(t *testing.T) {
+	tests := []struct {
+		mountPoint string
+		want       string
+	}{
+		{"/", "cryptroot"},
+		{"/home", "crypthome"},
+		{"/var/lib", "cryptvar-lib"},
+		{"/srv/", "cryptsrv"},
+	}
+
+	for _, tt := range tests {
+		if got := MapperName(tt.mountPoint); got != tt.want {
+			t.Errorf("MapperName(%q) = %q, want %q", tt.mountPoint, got, tt.want)
+		}
+	}
+}
+
+func TestGenerateCrypttab(t *testing.T) {
+	devices := []LUKSInfo{
+		{Device: "/dev/fake2", Name: "cryptroot", Version: 2},
+		{Device: "/dev/fake3", Name: "crypthome", Version: 2, KeyFile: KeyFileDir + "/crypthome.key"},
+		{Device: "/dev/fake4", Name: "cryptsrv", Version: 1, KeyFile: "/run/media/usb/srv.key"}, // Live medium
+	}
+	want := `# <target name> <source device> <key file> <options>
+cryptroot /dev/fake2 none luks,discard
+crypthome /dev/fake3 /etc/cryptsetup-keys.d/crypthome.key luks,discard
+cryptsrv /dev/fake4 none luks
+`
+
+	// blkid finds no UUIDs, so devices are listed by path
+	bin := t.TempDir()
+	if err := os.WriteFile(filepath.Join(bin, "blkid"), []byte("#!/bin/sh\nexit 2\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	target := t.TempDir()
+	if err := NewManager(config.NewDefaultConfig()).GenerateCrypttab(devices, target); err != nil {
+		t.Fatalf("GenerateCrypttab() error = %v", err)
+	}
+	got, err := os.ReadFile(filepath.Join(target, "etc/crypttab"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("crypttab = %q, want %q", got, want)
+	}
+}
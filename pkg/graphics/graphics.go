@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/japaneseenrichmentorganization/yuno_os/pkg/config"
@@ -15,6 +16,8 @@ import (
 type Manager struct {
 	config    *config.InstallConfig
 	targetDir string
+	hybrid    *hybridGPUs      // Set by Install when a hybrid laptop is detected
+	driver    config.GPUDriver // Driver installed by Install, after auto-detection
 }
 
 // NewManager creates a new graphics manager.
@@ -54,76 +57,110 @@ func (m *Manager) DetectGPUs() ([]GPU, error) {
 	}
 
 	var gpus []GPU
-	lines := strings.Split(result.Stdout, "\n")
+	for _, line := range strings.Split(result.Stdout, "\n") {
+		if gpu, ok := parseLspciLine(line); ok {
+			gpus = append(gpus, gpu)
+		}
+	}
 
-	// Pattern to match VGA/3D controllers
-	vgaPattern := regexp.MustCompile(`(?i)(VGA|3D|Display).*controller.*:\s*(.+)\s*\[([0-9a-f:]+)\]`)
+	return gpus, nil
+}
 
-	for _, line := range lines {
-		match := vgaPattern.FindStringSubmatch(line)
-		if match == nil {
-			continue
-		}
+// lspciPattern matches display controllers in lspci -nn output, e.g.
+// "01:00.0 VGA compatible controller [0300]: NVIDIA Corporation GA104 [GeForce RTX 3070] [10de:2484] (rev a1)".
+// Groups: description, vendor ID, device ID.
+var lspciPattern = regexp.MustCompile(`(?i)^\S+\s+(?:VGA compatible|3D|Display) controller(?: \[[0-9a-f]{4}\])?:\s*(.+?)\s*\[([0-9a-f]{4}):([0-9a-f]{4})\](?:\s*\(rev [0-9a-f]+\))?\s*$`)
+
+// PCI vendor IDs of known GPU manufacturers.
+var pciVendors = map[string]GPUVendor{
+	"10de": VendorNVIDIA,
+	"1002": VendorAMD,
+	"8086": VendorIntel,
+	"1af4": VendorVirtio,
+	"15ad": VendorVMware,
+}
 
-		description := strings.TrimSpace(match[2])
-		pciID := match[3]
+// parseLspciLine parses a single lspci -nn line into a GPU.
+func parseLspciLine(line string) (GPU, bool) {
+	match := lspciPattern.FindStringSubmatch(strings.TrimSpace(line))
+	if match == nil {
+		return GPU{}, false
+	}
 
-		gpu := GPU{
-			Description: description,
-			PciID:       pciID,
-		}
+	description := match[1]
+	vendorID := strings.ToLower(match[2])
+
+	gpu := GPU{
+		Description: description,
+		PciID:       vendorID + ":" + strings.ToLower(match[3]),
+	}
 
-		// Determine vendor
+	// Prefer the PCI vendor ID, fall back to the description
+	vendor, ok := pciVendors[vendorID]
+	if !ok {
 		descLower := strings.ToLower(description)
 		switch {
 		case strings.Contains(descLower, "nvidia"):
-			gpu.Vendor = VendorNVIDIA
-			gpu.Driver = config.GPUNvidia
+			vendor = VendorNVIDIA
 		case strings.Contains(descLower, "amd") || strings.Contains(descLower, "radeon"):
-			gpu.Vendor = VendorAMD
-			gpu.Driver = config.GPUAmdgpu
+			vendor = VendorAMD
 		case strings.Contains(descLower, "intel"):
-			gpu.Vendor = VendorIntel
-			gpu.Driver = config.GPUIntel
+			vendor = VendorIntel
 		case strings.Contains(descLower, "virtio"):
-			gpu.Vendor = VendorVirtio
-			gpu.Driver = config.GPUVirtio
+			vendor = VendorVirtio
 		case strings.Contains(descLower, "vmware"):
-			gpu.Vendor = VendorVMware
-			gpu.Driver = config.GPUVMware
+			vendor = VendorVMware
 		default:
-			gpu.Vendor = VendorUnknown
+			vendor = VendorUnknown
 		}
+	}
+	gpu.Vendor = vendor
 
-		// Extract model name
-		gpu.Model = extractModel(description)
-
-		gpus = append(gpus, gpu)
+	switch vendor {
+	case VendorNVIDIA:
+		gpu.Driver = config.GPUNvidia
+	case VendorAMD:
+		gpu.Driver = config.GPUAmdgpu
+	case VendorIntel:
+		gpu.Driver = config.GPUIntel
+	case VendorVirtio:
+		gpu.Driver = config.GPUVirtio
+	case VendorVMware:
+		gpu.Driver = config.GPUVMware
 	}
 
-	return gpus, nil
+	// Extract model name
+	gpu.Model = extractModel(description)
+
+	return gpu, true
 }
 
-// extractModel extracts the GPU model from the description.
+// extractModel extracts the GPU model from the description, preferring the
+// marketing name in brackets (e.g. "GeForce RTX 3070" from
+// "NVIDIA Corporation GA104 [GeForce RTX 3070]").
 func extractModel(desc string) string {
+	if start := strings.LastIndex(desc, "["); start >= 0 {
+		if end := strings.Index(desc[start:], "]"); end > 1 {
+			return strings.TrimSpace(desc[start+1 : start+end])
+		}
+	}
+
 	// Remove vendor prefix
 	desc = strings.TrimPrefix(desc, "NVIDIA Corporation ")
 	desc = strings.TrimPrefix(desc, "Advanced Micro Devices, Inc. ")
 	desc = strings.TrimPrefix(desc, "Intel Corporation ")
-
-	// Remove common suffixes
-	desc = strings.TrimSuffix(desc, " [")
-
-	// Clean up
-	if idx := strings.Index(desc, "["); idx > 0 {
-		desc = desc[:idx]
-	}
+	desc = strings.TrimPrefix(desc, "Red Hat, Inc. ")
 
 	return strings.TrimSpace(desc)
 }
 
 // GetRecommendedDriver returns the recommended driver for a GPU.
 func (m *Manager) GetRecommendedDriver(gpu GPU) config.GPUDriver {
+	return recommendedDriver(gpu)
+}
+
+// recommendedDriver returns the recommended driver for a GPU.
+func recommendedDriver(gpu GPU) config.GPUDriver {
 	switch gpu.Vendor {
 	case VendorNVIDIA:
 		// Check if it's a newer GPU that supports open drivers
@@ -145,19 +182,68 @@ func (m *Manager) GetRecommendedDriver(gpu GPU) config.GPUDriver {
 // Install installs graphics drivers.
 func (m *Manager) Install(progress func(line string)) error {
 	driver := m.config.Graphics.Driver
-	if driver == "" {
-		// Auto-detect
-		gpus, err := m.DetectGPUs()
-		if err != nil {
+
+	gpus, err := m.DetectGPUs()
+	if err != nil {
+		if driver == "" {
 			return err
 		}
-		if len(gpus) > 0 {
-			driver = m.GetRecommendedDriver(gpus[0])
+		utils.Warn("GPU detection failed, using configured driver: %v", err)
+	}
+
+	m.driver = resolveDriver(driver, gpus, m.hybridMode())
+
+	if hybrid := findHybridGPUs(gpus); hybrid != nil && (driver == "" || driver.IsNvidia()) {
+		m.hybrid = hybrid
+		return m.installHybrid(progress)
+	}
+
+	utils.Info("Installing graphics driver: %s", m.driver)
+
+	return m.installDriver(m.driver, progress)
+}
+
+// ResolveDriver returns the driver Install sets up: the configured one, or
+// the one recommended for the detected GPUs when auto-detecting. Steps that
+// run before Install, such as the kernel's, use it to match the driver.
+func ResolveDriver(cfg *config.InstallConfig) config.GPUDriver {
+	m := NewManager(cfg, "")
+	driver := cfg.Graphics.Driver
+
+	// Only auto-detection and hybrid power-save depend on the hardware
+	if driver != "" && !(driver.IsNvidia() && m.hybridMode() == config.HybridPowerSave) {
+		return driver
+	}
+
+	gpus, err := m.DetectGPUs()
+	if err != nil {
+		utils.Warn("GPU detection failed: %v", err)
+		return driver
+	}
+	return resolveDriver(driver, gpus, m.hybridMode())
+}
+
+// resolveDriver returns the driver used for the GPUs. Hybrid laptops resolve
+// to the NVIDIA driver unless the discrete GPU stays off in power-save mode.
+func resolveDriver(driver config.GPUDriver, gpus []GPU, mode config.HybridMode) config.GPUDriver {
+	if hybrid := findHybridGPUs(gpus); hybrid != nil && (driver == "" || driver.IsNvidia()) {
+		if mode == config.HybridPowerSave {
+			return recommendedDriver(hybrid.Integrated)
+		}
+		if driver == "" {
+			return recommendedDriver(hybrid.Discrete)
 		}
+		return driver
 	}
 
-	utils.Info("Installing graphics driver: %s", driver)
+	if driver == "" && len(gpus) > 0 {
+		return recommendedDriver(gpus[0])
+	}
+	return driver
+}
 
+// installDriver installs the packages for a single driver.
+func (m *Manager) installDriver(driver config.GPUDriver, progress func(line string)) error {
 	switch driver {
 	case config.GPUNvidia:
 		return m.installNvidia(false, progress)
@@ -171,12 +257,99 @@ func (m *Manager) Install(progress func(line string)) error {
 		return m.installIntel(progress)
 	case config.GPUVirtio, config.GPUVMware:
 		return m.installVirtual(progress)
+	case config.GPUNone:
+		return nil
 	default:
 		utils.Warn("No specific driver to install")
 		return nil
 	}
 }
 
+// hybridGPUs is an integrated GPU paired with a discrete NVIDIA GPU.
+type hybridGPUs struct {
+	Integrated GPU
+	Discrete   GPU
+}
+
+// findHybridGPUs returns the Intel/AMD + NVIDIA pair of a hybrid laptop, if any.
+func findHybridGPUs(gpus []GPU) *hybridGPUs {
+	var integrated, discrete *GPU
+	for i := range gpus {
+		switch gpus[i].Vendor {
+		case VendorIntel, VendorAMD:
+			if integrated == nil {
+				integrated = &gpus[i]
+			}
+		case VendorNVIDIA:
+			if discrete == nil {
+				discrete = &gpus[i]
+			}
+		}
+	}
+
+	if integrated == nil || discrete == nil {
+		return nil
+	}
+	return &hybridGPUs{Integrated: *integrated, Discrete: *discrete}
+}
+
+// VideoCards returns the VIDEO_CARDS value for the configured driver, or for
+// the detected GPUs when no driver is configured.
+func (m *Manager) VideoCards() string {
+	if m.config.Headless() {
+		return ""
+	}
+
+	gpus, err := m.DetectGPUs()
+	if err != nil {
+		utils.Debug("GPU detection failed: %v", err)
+	}
+	return videoCards(m.config.Graphics.Driver, gpus, m.hybridMode())
+}
+
+// videoCards returns the VIDEO_CARDS value for driver and gpus, following
+// the same driver choice as Install. Hybrid laptops get the integrated GPU's
+// cards plus nvidia, unless NVIDIA is left unused in power-save mode.
+func videoCards(driver config.GPUDriver, gpus []GPU, mode config.HybridMode) string {
+	if hybrid := findHybridGPUs(gpus); hybrid != nil && (driver == "" || driver.IsNvidia()) {
+		cards := recommendedDriver(hybrid.Integrated).GetVideoCards()
+		if mode != config.HybridPowerSave {
+			cards = strings.TrimSpace(cards + " nvidia")
+		}
+		return cards
+	}
+
+	if driver == "" && len(gpus) > 0 {
+		driver = recommendedDriver(gpus[0])
+	}
+	return driver.GetVideoCards()
+}
+
+// hybridMode returns the configured hybrid mode, defaulting to on-demand.
+func (m *Manager) hybridMode() config.HybridMode {
+	if m.config.Graphics.HybridMode == "" {
+		return config.HybridOnDemand
+	}
+	return m.config.Graphics.HybridMode
+}
+
+// installHybrid installs drivers for both GPUs of a hybrid laptop.
+func (m *Manager) installHybrid(progress func(line string)) error {
+	mode := m.hybridMode()
+	utils.Info("Detected hybrid graphics: %s + %s (%s)",
+		m.hybrid.Integrated.Model, m.hybrid.Discrete.Model, mode)
+
+	if err := m.installDriver(m.GetRecommendedDriver(m.hybrid.Integrated), progress); err != nil {
+		return err
+	}
+
+	if mode == config.HybridPowerSave {
+		return nil
+	}
+
+	return m.installNvidia(m.config.Graphics.Driver == config.GPUNvidiaOpen, progress)
+}
+
 // installNvidia installs NVIDIA drivers.
 func (m *Manager) installNvidia(open bool, progress func(line string)) error {
 	packages := []string{
@@ -184,9 +357,9 @@ func (m *Manager) installNvidia(open bool, progress func(line string)) error {
 		"media-libs/mesa",
 	}
 
-	// Add Wayland support
-	if m.config.Graphics.DisplayType == config.DisplayWayland {
-		packages = append(packages, "gui-libs/egl-wayland")
+	wayland := m.config.Graphics.DisplayType == config.DisplayWayland
+	if wayland {
+		packages = append(packages, nvidiaWaylandPackages...)
 	}
 
 	// Configure USE flags for nvidia-drivers
@@ -194,6 +367,9 @@ func (m *Manager) installNvidia(open bool, progress func(line string)) error {
 	if open {
 		useFlags += " kernel-open"
 	}
+	if wayland {
+		useFlags += " wayland"
+	}
 
 	usePath := filepath.Join(m.targetDir, "etc/portage/package.use/nvidia")
 	useContent := fmt.Sprintf("x11-drivers/nvidia-drivers %s\n", useFlags)
@@ -208,14 +384,150 @@ func (m *Manager) installNvidia(open bool, progress func(line string)) error {
 		return utils.NewError("graphics", "failed to write nvidia license", err)
 	}
 
-	return m.emergePackages(packages, progress)
+	if err := m.emergePackages(packages, progress); err != nil {
+		return err
+	}
+
+	if wayland {
+		m.checkNvidiaWaylandVersion()
+	}
+
+	return nil
+}
+
+// NVIDIA on Wayland requirements.
+const (
+	nvidiaMinWaylandVersion = 495 // First branch with GBM support
+	nvidiaFbdevVersion      = 545 // First branch supporting nvidia_drm.fbdev
+)
+
+// nvidiaWaylandPackages are the extra packages needed by NVIDIA on Wayland.
+var nvidiaWaylandPackages = []string{
+	"gui-libs/egl-wayland",
+	"gui-libs/egl-gbm",
+}
+
+// NvidiaKernelParams returns the kernel command line parameters required by
+// the NVIDIA driver, configured or auto-detected, or nil for other drivers.
+func NvidiaKernelParams(cfg *config.InstallConfig) []string {
+	driver := ResolveDriver(cfg)
+	if !driver.IsNvidia() {
+		return nil
+	}
+
+	params := []string{"nvidia-drm.modeset=1"}
+	if cfg.Graphics.DisplayType == config.DisplayWayland {
+		params = append(params, "nvidia-drm.fbdev=1")
+	}
+
+	// Stop conflicting drivers both in the initramfs and the real root
+	if blacklist := blacklistedModules(cfg, driver); len(blacklist) > 0 {
+		modules := strings.Join(blacklist, ",")
+		params = append(params, "modprobe.blacklist="+modules, "rd.driver.blacklist="+modules)
+	}
+	return params
+}
+
+// BlacklistedModules returns the kernel modules that conflict with the
+// driver and must not be loaded.
+func BlacklistedModules(cfg *config.InstallConfig) []string {
+	if !cfg.Graphics.BlacklistConflicting {
+		return nil
+	}
+	return blacklistedModules(cfg, ResolveDriver(cfg))
+}
+
+// blacklistedModules returns the modules that conflict with driver.
+func blacklistedModules(cfg *config.InstallConfig, driver config.GPUDriver) []string {
+	if cfg.Graphics.BlacklistConflicting && driver.IsNvidia() {
+		return []string{"nouveau"}
+	}
+	return nil
+}
+
+// BlacklistModprobeConfig returns the modprobe.d blacklist for conflicting
+// driver modules, or "" if there is nothing to blacklist.
+func BlacklistModprobeConfig(cfg *config.InstallConfig) string {
+	modules := BlacklistedModules(cfg)
+	if len(modules) == 0 {
+		return ""
+	}
+
+	var b strings.Builder
+	b.WriteString("# Conflicting GPU drivers\n")
+	for _, mod := range modules {
+		fmt.Fprintf(&b, "blacklist %s\n", mod)
+		fmt.Fprintf(&b, "options %s modeset=0\n", mod)
+	}
+	return b.String()
+}
+
+// NvidiaModprobeConfig returns the modprobe.d configuration for the
+// NVIDIA driver, configured or auto-detected, or "" for other drivers.
+func NvidiaModprobeConfig(cfg *config.InstallConfig) string {
+	if !ResolveDriver(cfg).IsNvidia() {
+		return ""
+	}
+
+	drmOptions := "modeset=1"
+	if cfg.Graphics.DisplayType == config.DisplayWayland {
+		drmOptions += " fbdev=1"
+	}
+
+	return fmt.Sprintf(`# NVIDIA driver options
+options nvidia_drm %s
+options nvidia NVreg_PreserveVideoMemoryAllocations=1
+`, drmOptions)
+}
+
+// nvidiaWaylandEnv returns the environment variables needed by NVIDIA on Wayland.
+func nvidiaWaylandEnv() []string {
+	return []string{
+		"GBM_BACKEND=nvidia-drm",
+		"__GLX_VENDOR_LIBRARY_NAME=nvidia",
+		"WLR_NO_HARDWARE_CURSORS=1",
+	}
+}
+
+// checkNvidiaWaylandVersion warns if the installed driver is too old for Wayland.
+func (m *Manager) checkNvidiaWaylandVersion() {
+	result := utils.RunInChroot(m.targetDir, "portageq", "best_version", "/", "x11-drivers/nvidia-drivers")
+	if result.Error != nil {
+		utils.Warn("Could not determine nvidia-drivers version: %v", result.Error)
+		return
+	}
+
+	major := parseNvidiaMajor(result.Stdout)
+	switch {
+	case major == 0:
+		utils.Warn("Could not parse nvidia-drivers version from %q", strings.TrimSpace(result.Stdout))
+	case major < nvidiaMinWaylandVersion:
+		utils.Warn("nvidia-drivers %d is too old for Wayland (need %d or newer)", major, nvidiaMinWaylandVersion)
+	case major < nvidiaFbdevVersion:
+		utils.Warn("nvidia-drivers %d ignores nvidia_drm.fbdev, a console framebuffer may be missing", major)
+	}
+}
+
+// parseNvidiaMajor extracts the major version from a package atom such as
+// x11-drivers/nvidia-drivers-550.67-r1.
+func parseNvidiaMajor(atom string) int {
+	version := strings.TrimPrefix(strings.TrimSpace(atom), "x11-drivers/nvidia-drivers-")
+	major, _, _ := strings.Cut(version, ".")
+	n, err := strconv.Atoi(major)
+	if err != nil {
+		return 0
+	}
+	return n
 }
 
 // installNouveau installs the open-source Nouveau driver.
 func (m *Manager) installNouveau(progress func(line string)) error {
 	packages := []string{
 		"media-libs/mesa",
-		"x11-drivers/xf86-video-nouveau",
+	}
+
+	if m.usesX11() {
+		packages = append(packages, "x11-drivers/xf86-video-nouveau")
 	}
 
 	return m.emergePackages(packages, progress)
@@ -225,10 +537,13 @@ func (m *Manager) installNouveau(progress func(line string)) error {
 func (m *Manager) installAMD(progress func(line string)) error {
 	packages := []string{
 		"media-libs/mesa",
-		"x11-drivers/xf86-video-amdgpu",
 		"media-libs/vulkan-loader",
 	}
 
+	if m.usesX11() {
+		packages = append(packages, "x11-drivers/xf86-video-amdgpu")
+	}
+
 	// Add Vulkan support
 	packages = append(packages, "media-libs/mesa", "dev-util/vulkan-tools")
 
@@ -239,10 +554,13 @@ func (m *Manager) installAMD(progress func(line string)) error {
 func (m *Manager) installIntel(progress func(line string)) error {
 	packages := []string{
 		"media-libs/mesa",
-		"x11-drivers/xf86-video-intel",
 		"media-libs/vulkan-loader",
 	}
 
+	if m.usesX11() {
+		packages = append(packages, "x11-drivers/xf86-video-intel")
+	}
+
 	// Add VA-API for hardware video acceleration
 	packages = append(packages, "media-libs/libva-intel-driver")
 
@@ -255,22 +573,24 @@ func (m *Manager) installVirtual(progress func(line string)) error {
 		"media-libs/mesa",
 	}
 
-	if m.config.Graphics.Driver == config.GPUVMware {
+	if m.config.Graphics.Driver == config.GPUVMware && m.usesX11() {
 		packages = append(packages, "x11-drivers/xf86-video-vmware")
 	}
 
 	return m.emergePackages(packages, progress)
 }
 
+// usesX11 reports whether X11 DDX drivers (xf86-video-*) are needed. Wayland
+// relies on the kernel DRM driver and mesa alone.
+func (m *Manager) usesX11() bool {
+	return m.config.Graphics.DisplayType != config.DisplayWayland
+}
+
 // emergePackages installs packages via emerge.
 func (m *Manager) emergePackages(packages []string, progress func(line string)) error {
 	args := append([]string{m.targetDir, "emerge", "--ask=n"}, packages...)
 
-	if progress != nil {
-		return utils.RunCommandWithOutput(progress, "chroot", args...)
-	}
-
-	result := utils.RunCommand("chroot", args...)
+	result := utils.RunCommandStreaming(progress, "chroot", args...)
 	if result.Error != nil {
 		return utils.NewError("graphics", "failed to install packages", result.Error)
 	}
@@ -280,7 +600,7 @@ func (m *Manager) emergePackages(packages []string, progress func(line string))
 
 // ConfigureXorg generates Xorg configuration if needed.
 func (m *Manager) ConfigureXorg() error {
-	if m.config.Graphics.DisplayType == config.DisplayWayland {
+	if m.config.Headless() || m.config.Graphics.DisplayType == config.DisplayWayland {
 		return nil // No Xorg config needed
 	}
 
@@ -291,49 +611,319 @@ func (m *Manager) ConfigureXorg() error {
 		return utils.NewError("graphics", "failed to create xorg.conf.d", err)
 	}
 
+	// Monitor layout
+	outputs, err := DetectOutputs()
+	if err != nil {
+		utils.Warn("Failed to detect display outputs: %v", err)
+	}
+	monitors := m.xorgMonitors(outputs)
+
+	// In performance mode the outputs belong to a PRIME sink set up by the
+	// OutputClass sections, there is no Device to attach the monitors to
+	linked := len(monitors) > 0 && !(m.hybrid != nil && m.hybridMode() == config.HybridPerformance)
+
+	var options []string
+	if linked {
+		options = monitorOptions(monitors)
+	}
+
 	var content string
+	if m.hybrid != nil {
+		content = m.hybridXorgConfig()
+		if linked {
+			content += "\n" + xorgDevice("Integrated GPU outputs", "modesetting", "", options)
+		}
+	} else {
+		content = m.xorgConfig(options)
+	}
+	if content != "" {
+		confPath := filepath.Join(xorgDir, "20-gpu.conf")
+		if err := utils.WriteFile(confPath, content, 0644); err != nil {
+			return utils.NewError("graphics", "failed to write xorg config", err)
+		}
+	}
 
-	switch m.config.Graphics.Driver {
+	if conf := monitorConfig(monitors, linked); conf != "" {
+		confPath := filepath.Join(xorgDir, "10-monitor.conf")
+		if err := utils.WriteFile(confPath, conf, 0644); err != nil {
+			return utils.NewError("graphics", "failed to write monitor config", err)
+		}
+	}
+
+	return nil
+}
+
+// Output is a display connector found under /sys/class/drm.
+type Output struct {
+	Connector string // DRM connector name, e.g. "HDMI-A-1"
+	Connected bool
+	Modes     []string // Supported modes, preferred first
+}
+
+// DetectOutputs lists the display connectors known to the kernel DRM drivers.
+func DetectOutputs() ([]Output, error) {
+	connectors, err := filepath.Glob("/sys/class/drm/card*-*")
+	if err != nil {
+		return nil, err
+	}
+
+	var outputs []Output
+	for _, path := range connectors {
+		status, err := utils.ReadFile(filepath.Join(path, "status"))
+		if err != nil {
+			continue
+		}
+
+		// Drop the card prefix of "card0-HDMI-A-1"
+		_, connector, _ := strings.Cut(filepath.Base(path), "-")
+		output := Output{
+			Connector: connector,
+			Connected: strings.TrimSpace(status) == "connected",
+		}
+
+		if modes, err := utils.ReadFile(filepath.Join(path, "modes")); err == nil {
+			for _, mode := range strings.Split(modes, "\n") {
+				if mode = strings.TrimSpace(mode); mode != "" {
+					output.Modes = append(output.Modes, mode)
+				}
+			}
+		}
+
+		outputs = append(outputs, output)
+	}
+
+	return outputs, nil
+}
+
+// xorgOutputName converts a DRM connector name such as "HDMI-A-1" to the
+// output name used by the Xorg driver: "HDMI-1" for modesetting, "HDMI1"
+// for intel, "HDMI-0" for nvidia and "HDMI-A-0" for amdgpu. The nvidia and
+// amdgpu drivers number each connector type from 0 in the kernel's order.
+func xorgOutputName(connector, driver string) string {
+	i := strings.LastIndex(connector, "-")
+	if i < 0 {
+		return connector
+	}
+	n, err := strconv.Atoi(connector[i+1:])
+	if err != nil {
+		return connector
+	}
+	kind := connector[:i]
+
+	switch driver {
+	case "intel":
+		return fmt.Sprintf("%s%d", strings.TrimSuffix(kind, "-A"), n)
+	case "nvidia":
+		return fmt.Sprintf("%s-%d", strings.TrimSuffix(kind, "-A"), n-1)
+	case "amdgpu":
+		switch kind {
+		case "eDP":
+			return kind
+		case "DP":
+			kind = "DisplayPort"
+		}
+		return fmt.Sprintf("%s-%d", kind, n-1)
+	default:
+		return fmt.Sprintf("%s-%d", strings.TrimSuffix(kind, "-A"), n)
+	}
+}
+
+// xorgDriver returns the Xorg driver that drives the outputs. Hybrid
+// laptops drive them from the integrated GPU with modesetting.
+func (m *Manager) xorgDriver() string {
+	if m.hybrid != nil {
+		return "modesetting"
+	}
+
+	switch m.installedDriver() {
 	case config.GPUNvidia, config.GPUNvidiaOpen:
-		content = `# NVIDIA configuration
-Section "Device"
-    Identifier     "Device0"
-    Driver         "nvidia"
-    VendorName     "NVIDIA Corporation"
-    Option         "NoLogo" "true"
-EndSection
-`
+		return "nvidia"
 	case config.GPUAmdgpu:
-		content = `# AMD configuration
-Section "Device"
-    Identifier     "Device0"
-    Driver         "amdgpu"
-    Option         "TearFree" "true"
-EndSection
-`
+		return "amdgpu"
 	case config.GPUIntel:
-		content = `# Intel configuration
-Section "Device"
-    Identifier     "Device0"
-    Driver         "intel"
-    Option         "TearFree" "true"
-    Option         "DRI" "3"
-EndSection
-`
+		return "intel"
 	default:
-		return nil
+		return "modesetting"
 	}
+}
 
-	confPath := filepath.Join(xorgDir, "20-gpu.conf")
-	if err := utils.WriteFile(confPath, content, 0644); err != nil {
-		return utils.NewError("graphics", "failed to write xorg config", err)
+// xorgMonitor is the Monitor section of one connected output.
+type xorgMonitor struct {
+	Output  string // Xorg output name, also the Monitor identifier
+	Mode    string // Preferred mode, "" to let Xorg choose
+	Primary bool
+}
+
+// xorgMonitors returns the monitors of the connected outputs, named for the
+// Xorg driver, marking the configured (or first connected) output as
+// primary. It returns nil when there is nothing to configure.
+func (m *Manager) xorgMonitors(outputs []Output) []xorgMonitor {
+	primary := m.config.Graphics.PrimaryOutput
+	driver := m.xorgDriver()
+
+	var monitors []xorgMonitor
+	primaryIndex := 0
+	for _, output := range outputs {
+		if !output.Connected {
+			continue
+		}
+
+		monitor := xorgMonitor{Output: xorgOutputName(output.Connector, driver)}
+		if len(output.Modes) > 0 {
+			monitor.Mode = output.Modes[0]
+		}
+		// The primary output may be given as Xorg or DRM connector name
+		if primary != "" && (primary == monitor.Output || primary == output.Connector) {
+			primaryIndex = len(monitors)
+		}
+		monitors = append(monitors, monitor)
 	}
 
-	return nil
+	// Nothing detected, fall back to the configured output alone
+	if len(monitors) == 0 {
+		if primary == "" {
+			return nil
+		}
+		monitors = []xorgMonitor{{Output: primary}}
+	}
+
+	monitors[primaryIndex].Primary = true
+	if resolution := m.config.Graphics.Resolution; resolution != "" {
+		monitors[primaryIndex].Mode = resolution
+	}
+
+	return monitors
+}
+
+// monitorOptions returns the Device options that attach each monitor to
+// its output.
+func monitorOptions(monitors []xorgMonitor) []string {
+	options := make([]string, 0, len(monitors))
+	for _, monitor := range monitors {
+		options = append(options, fmt.Sprintf("\"Monitor-%s\" \"%s\"", monitor.Output, monitor.Output))
+	}
+	return options
+}
+
+// monitorConfig returns the Monitor sections and, when the monitors are
+// linked to the Device by its Monitor-<output> options, the Screen section
+// that ties them together. It returns "" when there is nothing to configure.
+func monitorConfig(monitors []xorgMonitor, linked bool) string {
+	if len(monitors) == 0 {
+		return ""
+	}
+
+	var content strings.Builder
+	content.WriteString("# Monitor configuration - Generated by Yuno OS installer\n")
+
+	primary := monitors[0].Output
+	for _, monitor := range monitors {
+		content.WriteString("\nSection \"Monitor\"\n")
+		content.WriteString(fmt.Sprintf("    Identifier     \"%s\"\n", monitor.Output))
+		if monitor.Primary {
+			content.WriteString("    Option         \"Primary\" \"true\"\n")
+			primary = monitor.Output
+		}
+		if monitor.Mode != "" {
+			content.WriteString(fmt.Sprintf("    Option         \"PreferredMode\" \"%s\"\n", monitor.Mode))
+		}
+		content.WriteString("EndSection\n")
+	}
+
+	if linked {
+		content.WriteString("\nSection \"Screen\"\n")
+		content.WriteString("    Identifier     \"Screen0\"\n")
+		content.WriteString("    Device         \"Device0\"\n")
+		content.WriteString(fmt.Sprintf("    Monitor        \"%s\"\n", primary))
+		content.WriteString("EndSection\n")
+	}
+
+	return content.String()
+}
+
+// xorgConfig returns the Xorg device configuration for a single GPU, with
+// extra Device options such as the monitor links. GPUs driven by
+// modesetting only get a Device section when there are extra options.
+func (m *Manager) xorgConfig(extra []string) string {
+	switch m.installedDriver() {
+	case config.GPUNvidia, config.GPUNvidiaOpen:
+		return xorgDevice("NVIDIA configuration", "nvidia", "NVIDIA Corporation",
+			append([]string{`"NoLogo" "true"`}, extra...))
+	case config.GPUAmdgpu:
+		return xorgDevice("AMD configuration", "amdgpu", "",
+			append([]string{`"TearFree" "true"`}, extra...))
+	case config.GPUIntel:
+		return xorgDevice("Intel configuration", "intel", "",
+			append([]string{`"TearFree" "true"`, `"DRI" "3"`}, extra...))
+	default:
+		if len(extra) == 0 {
+			return ""
+		}
+		return xorgDevice("Display outputs", "modesetting", "", extra)
+	}
+}
+
+// xorgDevice returns a commented "Device0" section for driver.
+func xorgDevice(comment, driver, vendor string, options []string) string {
+	var content strings.Builder
+	content.WriteString("# " + comment + "\n")
+	content.WriteString("Section \"Device\"\n")
+	content.WriteString("    Identifier     \"Device0\"\n")
+	content.WriteString(fmt.Sprintf("    Driver         \"%s\"\n", driver))
+	if vendor != "" {
+		content.WriteString(fmt.Sprintf("    VendorName     \"%s\"\n", vendor))
+	}
+	for _, option := range options {
+		content.WriteString("    Option         " + option + "\n")
+	}
+	content.WriteString("EndSection\n")
+	return content.String()
+}
+
+// hybridXorgConfig returns the Xorg PRIME configuration for a hybrid laptop.
+func (m *Manager) hybridXorgConfig() string {
+	integratedDriver := "i915"
+	if m.hybrid.Integrated.Vendor == VendorAMD {
+		integratedDriver = "amdgpu"
+	}
+
+	switch m.hybridMode() {
+	case config.HybridOnDemand:
+		return `# Hybrid graphics: integrated GPU, NVIDIA via PRIME render offload
+Section "ServerLayout"
+    Identifier     "layout"
+    Option         "AllowNVIDIAGPUScreens"
+EndSection
+`
+	case config.HybridPerformance:
+		return fmt.Sprintf(`# Hybrid graphics: NVIDIA renders, integrated GPU drives the outputs
+Section "OutputClass"
+    Identifier     "integrated"
+    MatchDriver    "%s"
+    Driver         "modesetting"
+EndSection
+
+Section "OutputClass"
+    Identifier     "nvidia"
+    MatchDriver    "nvidia-drm"
+    Driver         "nvidia"
+    Option         "AllowEmptyInitialConfiguration"
+    Option         "PrimaryGPU" "yes"
+    ModulePath     "/usr/lib64/nvidia/xorg"
+    ModulePath     "/usr/lib64/xorg/modules"
+EndSection
+`, integratedDriver)
+	default:
+		return ""
+	}
 }
 
 // ConfigureEnvironment sets up environment variables for graphics.
 func (m *Manager) ConfigureEnvironment() error {
+	if m.config.Headless() {
+		return nil
+	}
+
 	utils.Info("Configuring graphics environment")
 
 	envDir := filepath.Join(m.targetDir, "etc/profile.d")
@@ -352,21 +942,33 @@ func (m *Manager) ConfigureEnvironment() error {
 		content.WriteString("export SDL_VIDEODRIVER=wayland\n")
 		content.WriteString("export _JAVA_AWT_WM_NONREPARENTING=1\n")
 
-		if m.config.Graphics.Driver == config.GPUNvidia || m.config.Graphics.Driver == config.GPUNvidiaOpen {
-			content.WriteString("export GBM_BACKEND=nvidia-drm\n")
-			content.WriteString("export __GLX_VENDOR_LIBRARY_NAME=nvidia\n")
-			content.WriteString("export WLR_NO_HARDWARE_CURSORS=1\n")
+		if m.rendersOnNvidia() {
+			for _, env := range nvidiaWaylandEnv() {
+				content.WriteString("export " + env + "\n")
+			}
 		}
 	}
 
-	// Vulkan ICD
-	switch m.config.Graphics.Driver {
-	case config.GPUNvidia, config.GPUNvidiaOpen:
-		content.WriteString("export VK_ICD_FILENAMES=/usr/share/vulkan/icd.d/nvidia_icd.json\n")
-	case config.GPUAmdgpu:
-		content.WriteString("export VK_ICD_FILENAMES=/usr/share/vulkan/icd.d/radeon_icd.x86_64.json\n")
-	case config.GPUIntel:
-		content.WriteString("export VK_ICD_FILENAMES=/usr/share/vulkan/icd.d/intel_icd.x86_64.json\n")
+	for _, env := range videoAccelFor(m.videoAccelDriver()).Env {
+		content.WriteString("export " + env + "\n")
+	}
+
+	// PRIME offload on hybrid laptops
+	if m.hybrid != nil {
+		switch m.hybridMode() {
+		case config.HybridOnDemand:
+			if err := m.writePrimeRun(); err != nil {
+				return err
+			}
+		case config.HybridPerformance:
+			for _, env := range primeOffloadEnv() {
+				content.WriteString("export " + env + "\n")
+			}
+		}
+	}
+
+	if icds := m.vulkanICDs(); len(icds) > 0 {
+		content.WriteString("export VK_ICD_FILENAMES=" + strings.Join(icds, ":") + "\n")
 	}
 
 	envPath := filepath.Join(envDir, "99-graphics.sh")
@@ -377,8 +979,98 @@ func (m *Manager) ConfigureEnvironment() error {
 	return nil
 }
 
-// Setup performs complete graphics setup.
+// vulkanICDs returns the Vulkan ICD files of the installed drivers. Hybrid
+// laptops list the integrated GPU first, and the NVIDIA one unless it stays
+// off, so PRIME offload can still pick it.
+func (m *Manager) vulkanICDs() []string {
+	var drivers []config.GPUDriver
+	if m.hybrid != nil {
+		drivers = append(drivers, recommendedDriver(m.hybrid.Integrated))
+		if m.hybridMode() != config.HybridPowerSave {
+			drivers = append(drivers, config.GPUNvidia)
+		}
+	} else {
+		drivers = append(drivers, m.installedDriver())
+	}
+
+	var icds []string
+	for _, driver := range drivers {
+		if icd := vulkanICD(driver); icd != "" {
+			icds = append(icds, icd)
+		}
+	}
+	return icds
+}
+
+// vulkanICD returns the Vulkan ICD file of driver, or "" if it has none.
+func vulkanICD(driver config.GPUDriver) string {
+	switch driver {
+	case config.GPUNvidia, config.GPUNvidiaOpen:
+		return "/usr/share/vulkan/icd.d/nvidia_icd.json"
+	case config.GPUAmdgpu:
+		return "/usr/share/vulkan/icd.d/radeon_icd.x86_64.json"
+	case config.GPUIntel:
+		return "/usr/share/vulkan/icd.d/intel_icd.x86_64.json"
+	default:
+		return ""
+	}
+}
+
+// installedDriver returns the driver chosen by Install, falling back to the
+// configured one if Install has not run.
+func (m *Manager) installedDriver() config.GPUDriver {
+	if m.driver != "" {
+		return m.driver
+	}
+	return m.config.Graphics.Driver
+}
+
+// rendersOnNvidia reports whether the desktop is rendered by the NVIDIA
+// GPU, which is not the case for hybrid laptops outside performance mode.
+func (m *Manager) rendersOnNvidia() bool {
+	if m.hybrid != nil {
+		return m.hybridMode() == config.HybridPerformance
+	}
+	return m.installedDriver().IsNvidia()
+}
+
+// primeOffloadEnv returns the environment variables that route rendering to
+// the NVIDIA GPU.
+func primeOffloadEnv() []string {
+	return []string{
+		"__NV_PRIME_RENDER_OFFLOAD=1",
+		"__VK_LAYER_NV_optimus=NVIDIA_only",
+		"__GLX_VENDOR_LIBRARY_NAME=nvidia",
+	}
+}
+
+// writePrimeRun installs a prime-run wrapper for on-demand offloading.
+func (m *Manager) writePrimeRun() error {
+	var content strings.Builder
+
+	content.WriteString("#!/bin/sh\n")
+	content.WriteString("# Run a program on the NVIDIA GPU - Generated by Yuno OS installer\n")
+	for _, env := range primeOffloadEnv() {
+		content.WriteString("export " + env + "\n")
+	}
+	content.WriteString("exec \"$@\"\n")
+
+	scriptPath := filepath.Join(m.targetDir, "usr/local/bin/prime-run")
+	if err := utils.WriteFile(scriptPath, content.String(), 0755); err != nil {
+		return utils.NewError("graphics", "failed to write prime-run", err)
+	}
+
+	return nil
+}
+
+// Setup performs complete graphics setup. Headless systems get nothing,
+// the console uses the firmware framebuffer set up by the kernel package.
 func (m *Manager) Setup(progress func(line string)) error {
+	if m.config.Headless() {
+		utils.Info("Headless system, skipping graphics setup")
+		return nil
+	}
+
 	// Install drivers
 	if err := m.Install(progress); err != nil {
 		return err
@@ -394,9 +1086,114 @@ func (m *Manager) Setup(progress func(line string)) error {
 		return err
 	}
 
+	if err := m.SetupVideoAcceleration(progress); err != nil {
+		return err
+	}
+
+	if err := m.SetupColorManagement(progress); err != nil {
+		return err
+	}
+
 	return nil
 }
 
+// videoAccel is what hardware video decoding needs for one driver.
+type videoAccel struct {
+	Packages []string
+	MesaUse  []string // USE flags for media-libs/mesa
+	Env      []string // Only where libva and libvdpau cannot pick the driver themselves
+}
+
+// videoAccelFor returns the VA-API and VDPAU setup for driver.
+func videoAccelFor(driver config.GPUDriver) videoAccel {
+	switch driver {
+	case config.GPUAmdgpu:
+		return videoAccel{
+			Packages: []string{"media-libs/libva", "media-libs/libvdpau"},
+			MesaUse:  []string{"vaapi", "vdpau"},
+			Env:      []string{"LIBVA_DRIVER_NAME=radeonsi", "VDPAU_DRIVER=radeonsi"},
+		}
+	case config.GPUIntel:
+		// The media driver covers Broadwell and later, libva tries it
+		// before the i965 driver for older chips
+		return videoAccel{
+			Packages: []string{"media-libs/libva-intel-media-driver", "media-libs/libva-intel-driver"},
+			MesaUse:  []string{"vaapi"},
+		}
+	case config.GPUNvidia, config.GPUNvidiaOpen:
+		// VDPAU comes with nvidia-drivers, VA-API is translated to NVDEC
+		return videoAccel{
+			Packages: []string{"media-libs/nvidia-vaapi-driver"},
+			Env:      []string{"LIBVA_DRIVER_NAME=nvidia", "NVD_BACKEND=direct"},
+		}
+	case config.GPUNouveau:
+		return videoAccel{
+			Packages: []string{"media-libs/libva", "media-libs/libvdpau"},
+			MesaUse:  []string{"vaapi", "vdpau"},
+			Env:      []string{"LIBVA_DRIVER_NAME=nouveau", "VDPAU_DRIVER=nouveau"},
+		}
+	default:
+		return videoAccel{}
+	}
+}
+
+// videoAccelDriver returns the driver that decodes video. Hybrid laptops
+// decode on the integrated GPU so the discrete one can stay powered down.
+func (m *Manager) videoAccelDriver() config.GPUDriver {
+	if m.hybrid != nil {
+		return recommendedDriver(m.hybrid.Integrated)
+	}
+	return m.installedDriver()
+}
+
+// SetupVideoAcceleration installs the VA-API and VDPAU drivers for the GPU.
+// The environment variables are written by ConfigureEnvironment.
+func (m *Manager) SetupVideoAcceleration(progress func(line string)) error {
+	accel := videoAccelFor(m.videoAccelDriver())
+	if len(accel.Packages) == 0 {
+		return nil
+	}
+
+	utils.Info("Setting up hardware video acceleration")
+
+	if len(accel.MesaUse) > 0 {
+		usePath := filepath.Join(m.targetDir, "etc/portage/package.use/video-accel")
+		useContent := fmt.Sprintf("media-libs/mesa %s\n", strings.Join(accel.MesaUse, " "))
+		if err := utils.WriteFile(usePath, useContent, 0644); err != nil {
+			return utils.NewError("graphics", "failed to write video acceleration use flags", err)
+		}
+		accel.Packages = append(accel.Packages, "media-libs/mesa")
+	}
+
+	// Rebuilds mesa if the USE flags changed
+	return m.emergePackages(append([]string{"--changed-use"}, accel.Packages...), progress)
+}
+
+// colorManagementPackages returns colord and the desktop's front end for
+// managing display profiles.
+func colorManagementPackages(desktop config.DesktopType) []string {
+	packages := []string{"x11-misc/colord"}
+	switch desktop {
+	case config.DesktopKDE:
+		packages = append(packages, "kde-plasma/colord-kde")
+	case config.DesktopGNOME, config.DesktopCinnamon, config.DesktopBudgie:
+		packages = append(packages, "gnome-extra/gnome-color-manager")
+	}
+	return packages
+}
+
+// SetupColorManagement installs colord for ICC display profiles.
+func (m *Manager) SetupColorManagement(progress func(line string)) error {
+	if !m.config.Graphics.ColorManagement {
+		return nil
+	}
+
+	utils.Info("Setting up color management")
+
+	// colord is started on demand over D-Bus, so there is no service to enable
+	return m.emergePackages(colorManagementPackages(m.config.Desktop.Type), progress)
+}
+
 // DriverOptions returns available driver options for a vendor.
 func DriverOptions(vendor GPUVendor) []config.GPUDriver {
 	switch vendor {
@@ -431,5 +1228,6 @@ func DriverDescriptions() map[config.GPUDriver]string {
 		config.GPUIntel:      "Intel - Integrated graphics",
 		config.GPUVirtio:     "Virtio - Virtual machine graphics",
 		config.GPUVMware:     "VMware - VMware virtual graphics",
+		config.GPUNone:       "None - Headless, no graphics stack",
 	}
 }
@@ -0,0 +1,493 @@
+package graphics
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/japaneseenrichmentorganization/yuno_os/pkg/config"
+	"github.com/japaneseenrichmentorganization/yuno_os/pkg/utils"
+)
+
+var (
+	intelGPU  = GPU{Vendor: VendorIntel, Model: "UHD Graphics 630"}
+	amdGPU    = GPU{Vendor: VendorAMD, Model: "Navi 22"}
+	nvidiaGPU = GPU{Vendor: VendorNVIDIA, Model: "GeForce RTX 3070"}
+)
+
+func TestResolveDriver(t *testing.T) {
+	tests := []struct {
+		name   string
+		driver config.GPUDriver
+		gpus   []GPU
+		mode   config.HybridMode
+		want   config.GPUDriver
+	}{
+		{"configured", config.GPUAmdgpu, []GPU{nvidiaGPU}, config.HybridOnDemand, config.GPUAmdgpu},
+		{"auto-detected nvidia", "", []GPU{nvidiaGPU}, config.HybridOnDemand, config.GPUNvidia},
+		{"auto-detected intel", "", []GPU{intelGPU}, config.HybridOnDemand, config.GPUIntel},
+		{"no gpus", "", nil, config.HybridOnDemand, ""},
+		{"hybrid on-demand", "", []GPU{intelGPU, nvidiaGPU}, config.HybridOnDemand, config.GPUNvidia},
+		{"hybrid performance", "", []GPU{amdGPU, nvidiaGPU}, config.HybridPerformance, config.GPUNvidia},
+		{"hybrid power-save", "", []GPU{intelGPU, nvidiaGPU}, config.HybridPowerSave, config.GPUIntel},
+		{"hybrid open driver", config.GPUNvidiaOpen, []GPU{intelGPU, nvidiaGPU}, config.HybridOnDemand, config.GPUNvidiaOpen},
+		{"hybrid power-save configured nvidia", config.GPUNvidia, []GPU{amdGPU, nvidiaGPU}, config.HybridPowerSave, config.GPUAmdgpu},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := resolveDriver(tt.driver, tt.gpus, tt.mode); got != tt.want {
+				t.Errorf("resolveDriver() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNvidiaKernelParamsConfigured(t *testing.T) {
+	cfg := config.NewDefaultConfig()
+	cfg.Graphics.Driver = config.GPUNvidia
+	cfg.Graphics.DisplayType = config.DisplayWayland
+	cfg.Graphics.BlacklistConflicting = true
+
+	want := []string{
+		"nvidia-drm.modeset=1",
+		"nvidia-drm.fbdev=1",
+		"modprobe.blacklist=nouveau",
+		"rd.driver.blacklist=nouveau",
+	}
+	if got := NvidiaKernelParams(cfg); !reflect.DeepEqual(got, want) {
+		t.Errorf("NvidiaKernelParams() = %q, want %q", got, want)
+	}
+
+	cfg.Graphics.Driver = config.GPUAmdgpu
+	if got := NvidiaKernelParams(cfg); got != nil {
+		t.Errorf("NvidiaKernelParams() = %q for amdgpu, want nil", got)
+	}
+}
+
+func TestVulkanICDs(t *testing.T) {
+	tests := []struct {
+		name   string
+		driver config.GPUDriver
+		hybrid *hybridGPUs
+		mode   config.HybridMode
+		want   []string
+	}{
+		{"amdgpu", config.GPUAmdgpu, nil, "", []string{"/usr/share/vulkan/icd.d/radeon_icd.x86_64.json"}},
+		{"virtio", config.GPUVirtio, nil, "", nil},
+		{"hybrid on-demand", config.GPUNvidia, &hybridGPUs{intelGPU, nvidiaGPU}, config.HybridOnDemand, []string{
+			"/usr/share/vulkan/icd.d/intel_icd.x86_64.json",
+			"/usr/share/vulkan/icd.d/nvidia_icd.json",
+		}},
+		{"hybrid power-save", config.GPUIntel, &hybridGPUs{intelGPU, nvidiaGPU}, config.HybridPowerSave, []string{
+			"/usr/share/vulkan/icd.d/intel_icd.x86_64.json",
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.NewDefaultConfig()
+			cfg.Graphics.HybridMode = tt.mode
+			m := NewManager(cfg, "")
+			m.driver = tt.driver
+			m.hybrid = tt.hybrid
+
+			if got := m.vulkanICDs(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("vulkanICDs() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigureEnvironmentHybridSetsVulkanICD(t *testing.T) {
+	cfg := config.NewDefaultConfig()
+	cfg.Desktop.Type = config.DesktopKDE
+	cfg.Graphics.HybridMode = config.HybridOnDemand
+	target := t.TempDir()
+	m := NewManager(cfg, target)
+	m.driver = config.GPUNvidia
+	m.hybrid = &hybridGPUs{intelGPU, nvidiaGPU}
+
+	if err := m.ConfigureEnvironment(); err != nil {
+		t.Fatalf("ConfigureEnvironment() error = %v", err)
+	}
+
+	env, err := os.ReadFile(filepath.Join(target, "etc/profile.d/99-graphics.sh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(env), "export VK_ICD_FILENAMES=") {
+		t.Errorf("graphics env has no Vulkan ICD:\n%s", env)
+	}
+	if !strings.Contains(string(env), "/usr/share/vulkan/icd.d/nvidia_icd.json") {
+		t.Errorf("graphics env does not offer the NVIDIA ICD:\n%s", env)
+	}
+}
+
+func TestXorgOutputName(t *testing.T) {
+	tests := []struct {
+		connector string
+		driver    string
+		want      string
+	}{
+		{"HDMI-A-1", "modesetting", "HDMI-1"},
+		{"DP-2", "modesetting", "DP-2"},
+		{"eDP-1", "modesetting", "eDP-1"},
+		{"HDMI-A-1", "intel", "HDMI1"},
+		{"DP-1", "intel", "DP1"},
+		{"HDMI-A-1", "nvidia", "HDMI-0"},
+		{"DP-1", "nvidia", "DP-0"},
+		{"DVI-D-2", "nvidia", "DVI-D-1"},
+		{"DP-1", "amdgpu", "DisplayPort-0"},
+		{"HDMI-A-1", "amdgpu", "HDMI-A-0"},
+		{"eDP-1", "amdgpu", "eDP"},
+		{"Virtual", "modesetting", "Virtual"},
+	}
+
+	for _, tt := range tests {
+		if got := xorgOutputName(tt.connector, tt.driver); got != tt.want {
+			t.Errorf("xorgOutputName(%q, %q) = %q, want %q", tt.connector, tt.driver, got, tt.want)
+		}
+	}
+}
+
+func TestXorgMonitorLayoutGolden(t *testing.T) {
+	outputs := []Output{
+		{Connector: "DP-1", Connected: true, Modes: []string{"2560x1440", "1920x1080"}},
+		{Connector: "HDMI-A-1", Connected: true, Modes: []string{"1920x1080"}},
+		{Connector: "DP-2", Connected: false},
+	}
+
+	tests := []struct {
+		golden string
+		driver config.GPUDriver
+	}{
+		{"xorg-nvidia.golden", config.GPUNvidia},
+		{"xorg-intel.golden", config.GPUIntel},
+		{"xorg-modesetting.golden", config.GPUVirtio},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.golden, func(t *testing.T) {
+			cfg := config.NewDefaultConfig()
+			cfg.Graphics.PrimaryOutput = "HDMI-A-1"
+			cfg.Graphics.Resolution = "1920x1080"
+			m := NewManager(cfg, "")
+			m.driver = tt.driver
+
+			monitors := m.xorgMonitors(outputs)
+			got := "## 20-gpu.conf\n" + m.xorgConfig(monitorOptions(monitors)) + "\n## 10-monitor.conf\n" + monitorConfig(monitors, true)
+
+			want, err := os.ReadFile(filepath.Join("testdata", tt.golden))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != string(want) {
+				t.Errorf("layout does not match %s, got:\n%s", tt.golden, got)
+			}
+		})
+	}
+}
+
+func TestParseNvidiaMajor(t *testing.T) {
+	tests := []struct {
+		atom string
+		want int
+	}{
+		{"x11-drivers/nvidia-drivers-550.67-r1", 550},
+		{"x11-drivers/nvidia-drivers-470.256.02\n", 470},
+		{"", 0},
+		{"x11-drivers/nvidia-drivers-beta", 0},
+	}
+
+	for _, tt := range tests {
+		if got := parseNvidiaMajor(tt.atom); got != tt.want {
+			t.Errorf("parseNvidiaMajor(%q) = %d, want %d", tt.atom, got, tt.want)
+		}
+	}
+}
+
+func TestNvidiaModprobeConfig(t *testing.T) {
+	tests := []struct {
+		driver  config.GPUDriver
+		display config.DisplayType
+		want    string
+	}{
+		{config.GPUNvidia, config.DisplayX11, "options nvidia_drm modeset=1\n"},
+		{config.GPUNvidiaOpen, config.DisplayWayland, "options nvidia_drm modeset=1 fbdev=1\n"},
+		{config.GPUAmdgpu, config.DisplayWayland, ""},
+	}
+
+	for _, tt := range tests {
+		cfg := config.NewDefaultConfig()
+		cfg.Graphics.Driver = tt.driver
+		cfg.Graphics.DisplayType = tt.display
+
+		got := NvidiaModprobeConfig(cfg)
+		if tt.want == "" {
+			if got != "" {
+				t.Errorf("NvidiaModprobeConfig(%s) = %q, want none", tt.driver, got)
+			}
+			continue
+		}
+		if !strings.Contains(got, tt.want) {
+			t.Errorf("NvidiaModprobeConfig(%s, %s) = %q, want it to contain %q", tt.driver, tt.display, got, tt.want)
+		}
+	}
+}
+
+func TestParseLspciLine(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want GPU
+		ok   bool
+	}{
+		{
+			"nvidia",
+			"01:00.0 VGA compatible controller [0300]: NVIDIA Corporation GA104 [GeForce RTX 3070] [10de:2484] (rev a1)",
+			GPU{Vendor: VendorNVIDIA, Model: "GeForce RTX 3070", PciID: "10de:2484", Driver: config.GPUNvidia},
+			true,
+		},
+		{
+			"nvidia 3d controller",
+			"01:00.0 3D controller [0302]: NVIDIA Corporation TU117M [GeForce GTX 1650 Mobile / Max-Q] [10de:1f99] (rev a1)",
+			GPU{Vendor: VendorNVIDIA, Model: "GeForce GTX 1650 Mobile / Max-Q", PciID: "10de:1f99", Driver: config.GPUNvidia},
+			true,
+		},
+		{
+			"intel",
+			"00:02.0 VGA compatible controller [0300]: Intel Corporation CometLake-S GT2 [UHD Graphics 630] [8086:9bc5] (rev 03)",
+			GPU{Vendor: VendorIntel, Model: "UHD Graphics 630", PciID: "8086:9bc5", Driver: config.GPUIntel},
+			true,
+		},
+		{
+			"amd",
+			"03:00.0 VGA compatible controller [0300]: Advanced Micro Devices, Inc. [AMD/ATI] Navi 22 [Radeon RX 6700 XT] [1002:73DF] (rev c1)",
+			GPU{Vendor: VendorAMD, Model: "Radeon RX 6700 XT", PciID: "1002:73df", Driver: config.GPUAmdgpu},
+			true,
+		},
+		{
+			"virtio",
+			"00:01.0 VGA compatible controller [0300]: Red Hat, Inc. Virtio 1.0 GPU [1af4:1050] (rev 01)",
+			GPU{Vendor: VendorVirtio, Model: "Virtio 1.0 GPU", PciID: "1af4:1050", Driver: config.GPUVirtio},
+			true,
+		},
+		{
+			"unknown vendor",
+			"0b:00.0 VGA compatible controller [0300]: Matrox Electronics Systems Ltd. MGA G200eR2 [102b:0534] (rev 01)",
+			GPU{Vendor: VendorUnknown, Model: "Matrox Electronics Systems Ltd. MGA G200eR2", PciID: "102b:0534"},
+			true,
+		},
+		{
+			"audio device",
+			"00:1f.3 Audio device [0403]: Intel Corporation Cannon Lake PCH cAVS [8086:a348] (rev 10)",
+			GPU{},
+			false,
+		},
+		{"empty", "", GPU{}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseLspciLine(tt.line)
+			if ok != tt.ok {
+				t.Fatalf("parseLspciLine() ok = %v, want %v", ok, tt.ok)
+			}
+			got.Description = ""
+			if got != tt.want {
+				t.Errorf("parseLspciLine() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBlacklistModprobeConfig(t *testing.T) {
+	tests := []struct {
+		name      string
+		driver    config.GPUDriver
+		blacklist bool
+		want      string
+	}{
+		{"nvidia", config.GPUNvidia, true, "# Conflicting GPU drivers\nblacklist nouveau\noptions nouveau modeset=0\n"},
+		{"nvidia open", config.GPUNvidiaOpen, true, "# Conflicting GPU drivers\nblacklist nouveau\noptions nouveau modeset=0\n"},
+		{"nvidia without blacklisting", config.GPUNvidia, false, ""},
+		{"amdgpu", config.GPUAmdgpu, true, ""},
+		{"nouveau", config.GPUNouveau, true, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.NewDefaultConfig()
+			cfg.Graphics.Driver = tt.driver
+			cfg.Graphics.BlacklistConflicting = tt.blacklist
+
+			if got := BlacklistModprobeConfig(cfg); got != tt.want {
+				t.Errorf("BlacklistModprobeConfig() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestColorManagementPackages(t *testing.T) {
+	tests := []struct {
+		desktop config.DesktopType
+		want    []string
+	}{
+		{config.DesktopKDE, []string{"x11-misc/colord", "kde-plasma/colord-kde"}},
+		{config.DesktopGNOME, []string{"x11-misc/colord", "gnome-extra/gnome-color-manager"}},
+		{config.DesktopCinnamon, []string{"x11-misc/colord", "gnome-extra/gnome-color-manager"}},
+		{config.DesktopXFCE, []string{"x11-misc/colord"}},
+		{config.WMSway, []string{"x11-misc/colord"}},
+	}
+
+	for _, tt := range tests {
+		if got := colorManagementPackages(tt.desktop); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("colorManagementPackages(%s) = %v, want %v", tt.desktop, got, tt.want)
+		}
+	}
+}
+
+func TestSetupColorManagement(t *testing.T) {
+	tests := []struct {
+		enabled bool
+		want    string
+	}{
+		{false, ""},
+		{true, "chroot /mnt/test emerge --ask=n x11-misc/colord kde-plasma/colord-kde"},
+	}
+
+	for _, tt := range tests {
+		utils.SetDryRun(true)
+
+		cfg := config.NewDefaultConfig()
+		cfg.Desktop.Type = config.DesktopKDE
+		cfg.Graphics.ColorManagement = tt.enabled
+		err := NewManager(cfg, "/mnt/test").SetupColorManagement(nil)
+		plan := utils.Plan()
+		utils.SetDryRun(false)
+
+		if err != nil {
+			t.Fatalf("SetupColorManagement() error = %v", err)
+		}
+		var got []string
+		for _, action := range plan {
+			got = append(got, action.Detail)
+		}
+		if got := strings.Join(got, "\n"); got != tt.want {
+			t.Errorf("SetupColorManagement() with color management %v planned %q, want %q", tt.enabled, got, tt.want)
+		}
+	}
+}
+
+func TestVideoCards(t *testing.T) {
+	tests := []struct {
+		name   string
+		driver config.GPUDriver
+		gpus   []GPU
+		mode   config.HybridMode
+		want   string
+	}{
+		{"nothing detected", "", nil, "", ""},
+		{"detected intel", "", []GPU{intelGPU}, "", "intel i965 iris"},
+		{"detected amd", "", []GPU{amdGPU}, "", "amdgpu radeonsi"},
+		{"configured driver wins", config.GPUNouveau, []GPU{nvidiaGPU}, "", "nouveau"},
+		{"configured without detection", config.GPUAmdgpu, nil, "", "amdgpu radeonsi"},
+		{"hybrid on-demand", "", []GPU{intelGPU, nvidiaGPU}, config.HybridOnDemand, "intel i965 iris nvidia"},
+		{"hybrid amd", config.GPUNvidia, []GPU{nvidiaGPU, amdGPU}, config.HybridPerformance, "amdgpu radeonsi nvidia"},
+		{"hybrid power-save", "", []GPU{intelGPU, nvidiaGPU}, config.HybridPowerSave, "intel i965 iris"},
+		{"hybrid with nouveau", config.GPUNouveau, []GPU{intelGPU, nvidiaGPU}, config.HybridOnDemand, "nouveau"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := videoCards(tt.driver, tt.gpus, tt.mode); got != tt.want {
+				t.Errorf("videoCards(%q) = %q, want %q", tt.driver, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetupVideoAcceleration(t *testing.T) {
+	tests := []struct {
+		name    string
+		driver  config.GPUDriver
+		hybrid  *hybridGPUs
+		wantUse string
+		want    string
+	}{
+		{"none", config.GPUNone, nil, "", ""},
+		{"amdgpu", config.GPUAmdgpu, nil, "media-libs/mesa vaapi vdpau\n",
+			"chroot /mnt/test emerge --ask=n --changed-use media-libs/libva media-libs/libvdpau media-libs/mesa"},
+		{"nvidia", config.GPUNvidia, nil, "",
+			"chroot /mnt/test emerge --ask=n --changed-use media-libs/nvidia-vaapi-driver"},
+		{"hybrid decodes on the integrated GPU", config.GPUNvidia, &hybridGPUs{intelGPU, nvidiaGPU}, "media-libs/mesa vaapi\n",
+			"chroot /mnt/test emerge --ask=n --changed-use media-libs/libva-intel-media-driver media-libs/libva-intel-driver media-libs/mesa"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			utils.SetDryRun(true)
+			defer utils.SetDryRun(false)
+
+			m := NewManager(config.NewDefaultConfig(), "/mnt/test")
+			m.driver = tt.driver
+			m.hybrid = tt.hybrid
+			if err := m.SetupVideoAcceleration(nil); err != nil {
+				t.Fatalf("SetupVideoAcceleration() error = %v", err)
+			}
+
+			if use, _ := utils.ReadFile("/mnt/test/etc/portage/package.use/video-accel"); use != tt.wantUse {
+				t.Errorf("package.use/video-accel = %q, want %q", use, tt.wantUse)
+			}
+			var got string
+			for _, action := range utils.Plan() {
+				if action.Kind == "run" {
+					got = action.Detail
+				}
+			}
+			if got != tt.want {
+				t.Errorf("SetupVideoAcceleration() ran %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigureEnvironmentVideoAccel(t *testing.T) {
+	tests := []struct {
+		driver  config.GPUDriver
+		want    []string
+		notWant []string
+	}{
+		{config.GPUAmdgpu, []string{"export LIBVA_DRIVER_NAME=radeonsi\n", "export VDPAU_DRIVER=radeonsi\n"}, nil},
+		{config.GPUNvidia, []string{"export LIBVA_DRIVER_NAME=nvidia\n", "export NVD_BACKEND=direct\n"}, nil},
+		{config.GPUIntel, nil, []string{"LIBVA_DRIVER_NAME"}}, // libva picks the Intel driver itself
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.driver), func(t *testing.T) {
+			cfg := config.NewDefaultConfig()
+			cfg.Desktop.Type = config.DesktopKDE
+			target := t.TempDir()
+			m := NewManager(cfg, target)
+			m.driver = tt.driver
+
+			if err := m.ConfigureEnvironment(); err != nil {
+				t.Fatalf("ConfigureEnvironment() error = %v", err)
+			}
+			env, _ := os.ReadFile(filepath.Join(target, "etc/profile.d/99-graphics.sh"))
+			for _, line := range tt.want {
+				if !strings.Contains(string(env), line) {
+					t.Errorf("graphics env does not contain %q:\n%s", line, env)
+				}
+			}
+			for _, s := range tt.notWant {
+				if strings.Contains(string(env), s) {
+					t.Errorf("graphics env contains %q:\n%s", s, env)
+				}
+			}
+		})
+	}
+}
@@ -2,8 +2,16 @@
 package installer
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/japaneseenrichmentorganization/yuno_os/pkg/binpkg"
 	"github.com/japaneseenrichmentorganization/yuno_os/pkg/bootloader"
@@ -22,6 +30,8 @@ import (
 )
 
 const (
+	// TargetDir is where the new system is installed unless the config
+	// sets target_dir.
 	TargetDir = "/mnt/gentoo"
 )
 
@@ -41,6 +51,8 @@ const (
 	StepKernel
 	StepGraphics
 	StepDesktop
+	StepDesktopExtras
+	StepExtraPackages
 	StepUsers
 	StepBootloader
 	StepFinalize
@@ -60,6 +72,8 @@ func (s Step) String() string {
 		"Installing kernel",
 		"Configuring graphics",
 		"Installing desktop",
+		"Installing desktop extras",
+		"Installing extra packages",
 		"Creating users",
 		"Installing bootloader",
 		"Finalizing installation",
@@ -70,6 +84,18 @@ func (s Step) String() string {
 	return "Unknown step"
 }
 
+// optionalSteps may fail without aborting the installation.
+var optionalSteps = map[Step]bool{
+	StepOverlays:      true,
+	StepDesktopExtras: true,
+	StepExtraPackages: true,
+}
+
+// Optional reports whether a failure of the step only produces a warning.
+func (s Step) Optional() bool {
+	return optionalSteps[s]
+}
+
 // Installer orchestrates the installation process.
 type Installer struct {
 	config        *config.InstallConfig
@@ -79,14 +105,92 @@ type Installer struct {
 	outputCb      func(line string)
 	chrootManager *chroot.Manager
 	layout        *partition.PartitionLayout
+	luksDevices   []encryption.LUKSInfo
+	kernelCmdline string
+	stateFile     string
+	dryRun        bool
+	warnings      []string
+	ctx           context.Context
+
+	// runCommand runs the host commands of PostInstall and unmountTarget
+	runCommand func(name string, args ...string) *utils.CommandResult
+
+	// steps holds the function of each Step, in order
+	steps []func() error
 }
 
-// NewInstaller creates a new installer instance.
-func NewInstaller(cfg *config.InstallConfig) *Installer {
-	return &Installer{
-		config:    cfg,
-		targetDir: TargetDir,
+// State is the machine-readable installer state written to the state file.
+type State struct {
+	Step      int       `json:"step"`
+	StepName  string    `json:"step_name"`
+	Percent   int       `json:"percent"`
+	Message   string    `json:"message"`
+	Status    string    `json:"status"` // running, completed, failed
+	Error     string    `json:"error,omitempty"`
+	Warnings  []string  `json:"warnings,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Installer states reported in the state file.
+const (
+	StatusRunning   = "running"
+	StatusCompleted = "completed"
+	StatusFailed    = "failed"
+)
+
+// Option configures an Installer created by NewInstaller.
+type Option func(*Installer)
+
+// WithTargetDir installs into dir, overriding the config's target_dir. Runs
+// that must not share a mountpoint, such as parallel tests, each get their
+// own.
+func WithTargetDir(dir string) Option {
+	return func(i *Installer) {
+		i.targetDir = filepath.Clean(dir)
+	}
+}
+
+// NewInstaller creates a new installer instance. It installs into the
+// config's target_dir unless an option overrides it.
+func NewInstaller(cfg *config.InstallConfig, opts ...Option) *Installer {
+	targetDir := TargetDir
+	if cfg.TargetDir != "" {
+		targetDir = filepath.Clean(cfg.TargetDir)
+	}
+
+	i := &Installer{
+		config:     cfg,
+		targetDir:  targetDir,
+		runCommand: utils.RunCommand,
+	}
+	for _, opt := range opts {
+		opt(i)
+	}
+	i.steps = []func() error{
+		i.partitionDisk,
+		i.setupEncryption,
+		i.mountPartitions,
+		i.installStage3,
+		i.setupChroot,
+		i.configurePortage,
+		i.syncPortage,
+		i.setupOverlays,
+		i.installBasePackages,
+		i.installKernel,
+		i.installGraphics,
+		i.installDesktop,
+		i.installDesktopExtras,
+		i.installExtraPackages,
+		i.setupUsers,
+		i.installBootloader,
+		i.finalize,
 	}
+	return i
+}
+
+// TargetDir returns the directory the system is installed into.
+func (i *Installer) TargetDir() string {
+	return i.targetDir
 }
 
 // SetProgressCallback sets the progress callback.
@@ -99,65 +203,483 @@ func (i *Installer) SetOutputCallback(cb func(line string)) {
 	i.outputCb = cb
 }
 
+// SetStateFile sets a path where a JSON State is written on every progress
+// update, for out-of-process monitoring.
+func (i *Installer) SetStateFile(path string) {
+	i.stateFile = path
+}
+
+// SetDryRun makes the installer record the commands and file writes it
+// would perform instead of changing the system. Read-only queries such as
+// lsblk still run. The recorded plan is available from Plan.
+func (i *Installer) SetDryRun(enabled bool) {
+	i.dryRun = enabled
+}
+
+// SetContext sets a context that aborts the installation when cancelled:
+// the running command is killed and the installer cleans up as it would
+// after a failed step.
+func (i *Installer) SetContext(ctx context.Context) {
+	i.ctx = ctx
+}
+
+// Plan returns the actions recorded by the last dry run, in order.
+func (i *Installer) Plan() []utils.PlanAction {
+	return utils.Plan()
+}
+
+// WritePlan prints the actions recorded by the last dry run to w.
+func (i *Installer) WritePlan(w io.Writer) error {
+	for n, action := range utils.Plan() {
+		if _, err := fmt.Fprintf(w, "%4d  %s\n", n+1, action); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Warnings returns the problems that did not stop the installation.
+func (i *Installer) Warnings() []string {
+	return i.warnings
+}
+
+// warn logs a warning and keeps it for the final report.
+func (i *Installer) warn(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	utils.Warn("%s", msg)
+	i.warnings = append(i.warnings, msg)
+}
+
 // progress reports progress.
 func (i *Installer) progress(progress int, message string) {
 	if i.progressCb != nil {
 		i.progressCb(i.currentStep, progress, message)
 	}
+
+	i.writeState(State{
+		Percent: progress,
+		Message: message,
+		Status:  StatusRunning,
+	})
+}
+
+// writeState writes the state file, filling in the current step.
+func (i *Installer) writeState(state State) {
+	if i.stateFile == "" || i.dryRun {
+		return
+	}
+
+	state.Step = int(i.currentStep)
+	state.StepName = i.currentStep.String()
+	state.UpdatedAt = time.Now()
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		utils.Warn("Failed to encode installer state: %v", err)
+		return
+	}
+
+	// Write then rename so readers never see a partial file
+	tmpPath := i.stateFile + ".tmp"
+	if err := utils.WriteFile(tmpPath, string(data)+"\n", 0644); err != nil {
+		utils.Warn("Failed to write state file: %v", err)
+		return
+	}
+	if err := os.Rename(tmpPath, i.stateFile); err != nil {
+		utils.Warn("Failed to write state file: %v", err)
+	}
+}
+
+// resumeFile records installer progress under the target root.
+const resumeFile = ".yuno-state"
+
+// resumeState is what Resume needs to pick up where a failed install stopped.
+type resumeState struct {
+	LastCompleted Step                       `json:"last_completed"`
+	Layout        *partition.PartitionLayout `json:"layout"`
+	LUKSDevices   []encryption.LUKSInfo      `json:"luks_devices,omitempty"`
+}
+
+// saveResumeState records the current step as completed.
+func (i *Installer) saveResumeState() {
+	data, err := json.MarshalIndent(resumeState{
+		LastCompleted: i.currentStep,
+		Layout:        i.layout,
+		LUKSDevices:   i.luksDevices,
+	}, "", "  ")
+	if err != nil {
+		utils.Warn("Failed to encode resume state: %v", err)
+		return
+	}
+
+	// May hold key file paths, keep it private
+	path := filepath.Join(i.targetDir, resumeFile)
+	if err := utils.WriteFile(path, string(data)+"\n", 0600); err != nil {
+		utils.Warn("Failed to write resume state: %v", err)
+	}
+}
+
+// loadResumeState reads the resume file, reopening and mounting the target
+// first if it is not mounted. The disk is never repartitioned or formatted.
+func (i *Installer) loadResumeState() (*resumeState, error) {
+	if !utils.IsMounted(i.targetDir) {
+		if err := i.remountTarget(); err != nil {
+			return nil, err
+		}
+	}
+
+	path := filepath.Join(i.targetDir, resumeFile)
+	if !utils.FileExists(path) {
+		return nil, utils.NewError("installer", fmt.Sprintf("no resumable installation found in %s", i.targetDir), nil)
+	}
+
+	content, err := utils.ReadFile(path)
+	if err != nil {
+		return nil, utils.NewError("installer", "failed to read resume state", err)
+	}
+
+	var state resumeState
+	if err := json.Unmarshal([]byte(content), &state); err != nil {
+		return nil, utils.NewError("installer", "failed to parse resume state", err)
+	}
+	if state.Layout == nil {
+		return nil, utils.NewError("installer", "resume state has no partition layout", nil)
+	}
+
+	return &state, nil
+}
+
+// remountTarget reopens encrypted partitions and mounts the existing layout
+// of the configured disk without modifying it.
+func (i *Installer) remountTarget() error {
+	partMgr := partition.NewManager(i.config)
+	encMgr := encryption.NewManager(i.config)
+
+	// Layouts are deterministic for the same config, disk and machine
+	layout, err := i.buildLayout()
+	if err != nil {
+		return err
+	}
+
+	for n := range layout.Partitions {
+		part := &layout.Partitions[n]
+		if !part.Encrypt {
+			continue
+		}
+
+		name := encryption.MapperName(part.MountPoint)
+		if mapped := filepath.Join("/dev/mapper", name); utils.FileExists(mapped) {
+			// Still open from the failed run
+			part.MappedPath = mapped
+			continue
+		}
+
+		var cred encryption.Credential
+		if i.config.UnlocksWithRoot(part.MountPoint) {
+			cred.KeyFile = filepath.Join(os.TempDir(), "yuno-keys", name+".key")
+			if !utils.FileExists(cred.KeyFile) {
+				return utils.NewError("installer", fmt.Sprintf("key file for %s is no longer available", part.MountPoint), nil)
+			}
+		} else {
+			cred.Password, cred.KeyFile = i.config.EncryptionCredential(part.MountPoint)
+		}
+
+		mappedPath, err := encMgr.OpenLUKS(getPartitionDevice(i.config.Disk.Device, part.Number), name, cred)
+		if err != nil {
+			return err
+		}
+		part.MappedPath = mappedPath
+	}
+
+	return partMgr.MountPartitions(i.config.Disk.Device, layout, i.targetDir)
 }
 
-// output sends output line.
+// output sends output line. Emerge progress lines also advance the
+// progress of the current step.
 func (i *Installer) output(line string) {
 	if i.outputCb != nil {
 		i.outputCb(line)
 	}
+
+	if done, total, ok := parseEmergeProgress(line); ok {
+		i.progress(done*100/total, strings.TrimPrefix(strings.TrimSpace(line), ">>> "))
+	}
+}
+
+// Emerge progress lines, e.g. ">>> Emerging (12 of 87) sys-apps/foo-1.0::gentoo",
+// ">>> Emerging binary (3 of 10) ..." and ">>> Jobs: 12 of 87 complete, 1 running".
+var (
+	emergeStartPattern = regexp.MustCompile(`^>>> Emerging (?:binary )?\((\d+) of (\d+)\)`)
+	emergeJobsPattern  = regexp.MustCompile(`^>>> Jobs: (\d+) of (\d+) complete`)
+)
+
+// parseEmergeProgress extracts how many packages of a merge have finished
+// from an emerge output line.
+func parseEmergeProgress(line string) (done, total int, ok bool) {
+	line = strings.TrimSpace(line)
+
+	// A package being emerged is not done yet
+	offset := 1
+	match := emergeStartPattern.FindStringSubmatch(line)
+	if match == nil {
+		offset = 0
+		match = emergeJobsPattern.FindStringSubmatch(line)
+	}
+	if match == nil {
+		return 0, 0, false
+	}
+
+	current, err1 := strconv.Atoi(match[1])
+	total, err2 := strconv.Atoi(match[2])
+	if err1 != nil || err2 != nil || total <= 0 || current > total {
+		return 0, 0, false
+	}
+
+	done = current - offset
+	if done < 0 {
+		done = 0
+	}
+	return done, total, true
 }
 
-// Install performs the complete installation.
+// Install performs the complete installation. A dry run reports failed
+// preflight checks as warnings instead of stopping.
 func (i *Installer) Install() error {
-	steps := []func() error{
-		i.partitionDisk,
-		i.setupEncryption,
-		i.mountPartitions,
-		i.installStage3,
-		i.setupChroot,
-		i.configurePortage,
-		i.syncPortage,
-		i.setupOverlays,
-		i.installBasePackages,
-		i.installKernel,
-		i.installGraphics,
-		i.installDesktop,
-		i.setupUsers,
-		i.installBootloader,
-		i.finalize,
+	if err := i.Preflight(); err != nil {
+		if !i.dryRun {
+			return err
+		}
+		i.warn("%v", err)
+	}
+
+	return i.run(StepPartition)
+}
+
+// Resume continues an interrupted installation after the last completed
+// step recorded in the resume file on the target root.
+func (i *Installer) Resume() error {
+	state, err := i.loadResumeState()
+	if err != nil {
+		return err
+	}
+
+	i.layout = state.Layout
+	i.luksDevices = state.LUKSDevices
+
+	next := state.LastCompleted + 1
+	utils.Info("Resuming installation at: %s", next)
+
+	// Later steps run inside the chroot
+	if next > StepChrootSetup {
+		if err := i.setupChroot(); err != nil {
+			i.cleanup()
+			return err
+		}
+	}
+
+	return i.run(next)
+}
+
+// run executes the installation steps starting at start. On failure
+// everything mounted or opened so far is torn down.
+func (i *Installer) run(start Step) (err error) {
+	if i.dryRun {
+		utils.SetDryRun(true)
+		defer utils.SetDryRun(false)
 	}
 
-	for step, fn := range steps {
+	defer func() {
+		if err != nil {
+			i.cleanup()
+		}
+	}()
+
+	// Registered after cleanup so it runs first: unmounting must not be
+	// cut short by the cancelled context
+	ctx := i.installContext()
+	utils.SetCommandContext(ctx)
+	defer utils.SetCommandContext(nil)
+
+	for step, fn := range i.steps {
+		if Step(step) < start {
+			continue
+		}
+
 		i.currentStep = Step(step)
+		if ctx.Err() != nil {
+			i.writeState(State{Status: StatusFailed, Error: "installation aborted", Warnings: i.warnings})
+			return fmt.Errorf("installation aborted before %s: %w", i.currentStep, ctx.Err())
+		}
 		i.progress(0, fmt.Sprintf("Starting: %s", i.currentStep))
 
 		if err := fn(); err != nil {
-			return fmt.Errorf("step %s failed: %w", i.currentStep, err)
+			if ctx.Err() != nil {
+				i.writeState(State{Status: StatusFailed, Error: "installation aborted", Warnings: i.warnings})
+				return fmt.Errorf("installation aborted during %s: %w", i.currentStep, ctx.Err())
+			}
+			if !i.currentStep.Optional() {
+				i.writeState(State{Status: StatusFailed, Error: err.Error(), Warnings: i.warnings})
+				return fmt.Errorf("step %s failed: %w", i.currentStep, err)
+			}
+			i.warn("Optional step %s failed, continuing: %v", i.currentStep, err)
 		}
 
 		i.progress(100, fmt.Sprintf("Completed: %s", i.currentStep))
+
+		// The resume file lives on the target root, so it can only be
+		// written once partitions are mounted
+		if i.currentStep >= StepMountPartitions && !i.dryRun {
+			i.saveResumeState()
+		}
+	}
+
+	os.Remove(filepath.Join(i.targetDir, resumeFile))
+	utils.LogTimingReport(10)
+
+	if len(i.warnings) > 0 {
+		utils.Warn("Installation finished with %d warnings:", len(i.warnings))
+		for _, w := range i.warnings {
+			utils.Warn("  %s", w)
+		}
+	}
+	i.writeState(State{Percent: 100, Message: "Installation complete", Status: StatusCompleted, Warnings: i.warnings})
+
+	return nil
+}
+
+// PostInstall runs the configured post-install action. Every action except
+// chroot unmounts the target first, and reboot/poweroff are only issued once
+// nothing is left mounted.
+func (i *Installer) PostInstall() error {
+	action := i.config.PostInstall
+
+	if action == config.PostInstallChroot {
+		return i.enterChroot()
+	}
+
+	if err := i.unmountTarget(); err != nil {
+		return err
+	}
+
+	switch action {
+	case config.PostInstallReboot, config.PostInstallPoweroff:
+		utils.Info("Running post-install action: %s", action)
+		result := i.runCommand(string(action))
+		if result.Error != nil {
+			return utils.NewError("installer", fmt.Sprintf("failed to %s", action), result.Error)
+		}
+	}
+
+	return nil
+}
+
+// enterChroot drops into an interactive shell inside the installed system.
+func (i *Installer) enterChroot() error {
+	if i.chrootManager == nil {
+		i.chrootManager = chroot.NewManager(i.config, i.targetDir)
+	}
+
+	// finalize tears the chroot down, so mount it again
+	if err := i.chrootManager.Setup(); err != nil {
+		return err
+	}
+
+	err := i.chrootManager.RunInteractive()
+
+	if unmountErr := i.unmountTarget(); unmountErr != nil {
+		utils.Warn("Failed to unmount target after chroot: %v", unmountErr)
+	}
+
+	return err
+}
+
+// cleanup releases the chroot mounts, swap, target mounts and LUKS mappings
+// left behind by a failed step so the next attempt doesn't find them busy.
+// Every action is best effort.
+func (i *Installer) cleanup() {
+	utils.Info("Cleaning up after failed installation")
+
+	if i.chrootManager != nil {
+		utils.Info("Cleanup: tearing down chroot mounts")
+		i.chrootManager.Teardown()
+	}
+
+	utils.Info("Cleanup: disabling swap")
+	if result := utils.RunCommand("swapoff", "-a"); result.Error != nil {
+		utils.Warn("Cleanup: swapoff failed: %v", result.Error)
+	}
+
+	if utils.IsMounted(i.targetDir) {
+		utils.Info("Cleanup: unmounting %s", i.targetDir)
+		utils.SyncFilesystems()
+		if err := utils.Unmount(i.targetDir); err != nil {
+			utils.Warn("Cleanup: %v", err)
+		}
+	}
+
+	encMgr := encryption.NewManager(i.config)
+	for n := len(i.luksDevices) - 1; n >= 0; n-- {
+		name := i.luksDevices[n].Name
+		utils.Info("Cleanup: closing LUKS mapping %s", name)
+		if err := encMgr.CloseLUKS(name); err != nil {
+			utils.Warn("Cleanup: %v", err)
+		}
+	}
+	i.luksDevices = nil
+}
+
+// unmountTarget unmounts the target and closes any LUKS mappings, then
+// checks that nothing is left mounted.
+func (i *Installer) unmountTarget() error {
+	if i.chrootManager != nil {
+		i.chrootManager.Teardown()
+	}
+
+	i.runCommand("sync")
+
+	if i.isMounted(i.targetDir) {
+		utils.Info("Unmounting partitions from %s", i.targetDir)
+		i.runCommand("swapoff", "-a")
+		if result := i.runCommand("umount", "-R", i.targetDir); result.Error != nil {
+			return utils.NewError("installer", fmt.Sprintf("failed to unmount %s", i.targetDir), result.Error)
+		}
+	}
+
+	encMgr := encryption.NewManager(i.config)
+	for n := len(i.luksDevices) - 1; n >= 0; n-- {
+		name := i.luksDevices[n].Name
+		if err := encMgr.CloseLUKS(name); err != nil {
+			utils.Warn("Failed to close %s: %v", name, err)
+		}
+	}
+	i.luksDevices = nil
+
+	if i.isMounted(i.targetDir) {
+		return utils.NewError("installer", fmt.Sprintf("%s is still mounted", i.targetDir), nil)
 	}
 
 	return nil
 }
 
+// isMounted reports whether path is a mountpoint.
+func (i *Installer) isMounted(path string) bool {
+	return i.runCommand("mountpoint", "-q", path).Error == nil
+}
+
 // partitionDisk partitions the target disk.
 func (i *Installer) partitionDisk() error {
 	partMgr := partition.NewManager(i.config)
 
-	isUEFI := utils.IsUEFI()
-	useEncrypt := i.config.Encryption.Type != config.EncryptNone
+	if dest := i.config.Disk.BackupDir; dest != "" {
+		i.progress(5, "Backing up the partition table")
+		if err := i.BackupDiskMetadata(i.config.Disk.Device, dest); err != nil {
+			return err
+		}
+	}
 
 	i.progress(10, "Creating partition layout")
 
-	// Create auto layout
-	layout, err := partMgr.CreateAutoLayout(i.config.Disk.Device, isUEFI, useEncrypt)
+	layout, err := i.buildLayout()
 	if err != nil {
 		return err
 	}
@@ -174,6 +696,109 @@ func (i *Installer) partitionDisk() error {
 	return nil
 }
 
+// BackupDiskMetadata saves the partition table of device and the headers of
+// the LUKS volumes on it to dest. Partitioning the wrong disk can then be
+// undone with sfdisk and cryptsetup luksHeaderRestore, as long as the data
+// itself has not been overwritten yet.
+func (i *Installer) BackupDiskMetadata(device, dest string) error {
+	utils.Info("Backing up the partition table of %s to %s", device, dest)
+
+	if err := checkBackupDest(device, dest); err != nil {
+		return err
+	}
+
+	stamp := time.Now().Format("20060102-150405")
+	backupPath := func(dev, ext string) string {
+		return filepath.Join(dest, fmt.Sprintf("%s-%s.%s", filepath.Base(dev), stamp, ext))
+	}
+
+	dump := utils.RunCommand("sfdisk", "--dump", device)
+	switch {
+	case dump.Error != nil && strings.Contains(dump.Stderr, "does not contain a recognized partition table"):
+		utils.Info("%s has no partition table to back up", device)
+	case dump.Error != nil:
+		return utils.NewError("installer", fmt.Sprintf("failed to dump the partition table of %s", device), dump.Error)
+	default:
+		if err := utils.WriteFile(backupPath(device, "sfdisk"), dump.Stdout+"\n", 0600); err != nil {
+			return err
+		}
+	}
+
+	// Lists the disk itself too, which covers whole-disk LUKS
+	list := utils.RunCommand("lsblk", "-lnpo", "PATH,FSTYPE", device)
+	if list.Error != nil {
+		return utils.NewError("installer", fmt.Sprintf("failed to list the devices on %s", device), list.Error)
+	}
+	for _, line := range strings.Split(list.Stdout, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 || fields[1] != "crypto_LUKS" {
+			continue
+		}
+		if err := encryption.BackupHeader(fields[0], backupPath(fields[0], "luksheader")); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkBackupDest checks that dest is a writable directory that does not
+// live on device, where the backup would be destroyed with the rest.
+func checkBackupDest(device, dest string) error {
+	if utils.IsDryRun() {
+		utils.RecordAction("verify", "%s is writable and not on %s", dest, device)
+		return nil
+	}
+
+	if err := utils.CreateDir(dest, 0700); err != nil {
+		return utils.NewError("installer", fmt.Sprintf("failed to create backup directory %s", dest), err)
+	}
+	probe, err := os.CreateTemp(dest, ".yuno-write-test-")
+	if err != nil {
+		return utils.NewError("installer", fmt.Sprintf("backup directory %s is not writable", dest), err)
+	}
+	probe.Close()
+	os.Remove(probe.Name())
+
+	source := utils.RunCommand("findmnt", "-nvo", "SOURCE", "--target", dest)
+	if source.Error != nil {
+		return utils.NewError("installer", fmt.Sprintf("failed to find the filesystem holding %s", dest), source.Error)
+	}
+
+	// -s lists the device followed by everything it sits on, so backups on
+	// a LUKS or LVM volume of the disk are caught too
+	stack := utils.RunCommand("lsblk", "-lnspo", "PATH", source.Stdout)
+	if stack.Error != nil {
+		utils.Warn("%s is not on a disk, the backup will not survive a reboot", dest)
+		return nil
+	}
+
+	disk := device
+	if resolved, err := filepath.EvalSymlinks(device); err == nil {
+		disk = resolved
+	}
+	for _, dev := range strings.Fields(stack.Stdout) {
+		if dev == disk {
+			return utils.NewError("installer", fmt.Sprintf("backup directory %s is on %s, which is about to be partitioned", dest, device), nil)
+		}
+	}
+
+	return nil
+}
+
+// buildLayout returns the layout for the configured partitions, or the
+// automatic layout when none are configured.
+func (i *Installer) buildLayout() (*partition.PartitionLayout, error) {
+	partMgr := partition.NewManager(i.config)
+
+	if len(i.config.Partitions) > 0 {
+		return partMgr.CreateLayoutFromConfig(i.config.Disk.Device, i.config.Partitions)
+	}
+
+	useEncrypt := i.config.Encryption.Type != config.EncryptNone
+	return partMgr.CreateAutoLayout(i.config.Disk.Device, utils.IsUEFI(), useEncrypt)
+}
+
 // setupEncryption sets up disk encryption.
 func (i *Installer) setupEncryption() error {
 	if i.config.Encryption.Type == config.EncryptNone {
@@ -182,17 +807,46 @@ func (i *Installer) setupEncryption() error {
 	}
 
 	encMgr := encryption.NewManager(i.config)
+	partMgr := partition.NewManager(i.config)
 
 	i.progress(20, "Setting up LUKS encryption")
 
-	// Find encrypted partition
-	for _, part := range i.layout.Partitions {
-		if part.Encrypt {
-			device := getPartitionDevice(i.config.Disk.Device, part.Number)
-			_, err := encMgr.SetupLUKS(device, "cryptroot", i.config.Encryption.Password)
-			if err != nil {
+	// Each encrypted partition gets its own mapping and credential
+	for n := range i.layout.Partitions {
+		part := &i.layout.Partitions[n]
+		if !part.Encrypt {
+			continue
+		}
+
+		device := getPartitionDevice(i.config.Disk.Device, part.Number)
+		name := encryption.MapperName(part.MountPoint)
+
+		var cred encryption.Credential
+		if i.config.UnlocksWithRoot(part.MountPoint) {
+			// Random key, copied onto the root filesystem in finalize
+			cred.KeyFile = filepath.Join(os.TempDir(), "yuno-keys", name+".key")
+			if err := encMgr.GenerateKeyFile(cred.KeyFile, 4096); err != nil {
 				return err
 			}
+		} else {
+			cred.Password, cred.KeyFile = i.config.EncryptionCredential(part.MountPoint)
+		}
+
+		if err := utils.WaitForDevice(device, partition.DeviceTimeout); err != nil {
+			return err
+		}
+		info, err := encMgr.SetupLUKS(device, name, cred)
+		if err != nil {
+			return err
+		}
+		if i.config.UnlocksWithRoot(part.MountPoint) {
+			info.KeyFile = filepath.Join(encryption.KeyFileDir, name+".key")
+		}
+		i.luksDevices = append(i.luksDevices, *info)
+		part.MappedPath = info.MappedPath
+
+		if err := partMgr.FormatPartition(info.MappedPath, part.Filesystem, part.Label, part.MkfsOptions); err != nil {
+			return err
 		}
 	}
 
@@ -322,8 +976,8 @@ func (i *Installer) installKernel() error {
 
 // installGraphics installs graphics drivers.
 func (i *Installer) installGraphics() error {
-	if i.config.Graphics.Driver == "" {
-		i.progress(100, "No specific graphics driver selected")
+	if i.config.Headless() {
+		i.progress(100, "Headless system, no graphics drivers")
 		return nil
 	}
 
@@ -354,10 +1008,71 @@ func (i *Installer) installDesktop() error {
 		return err
 	}
 
+	if failed := desktopMgr.FailedPackages(); len(failed) > 0 {
+		i.warn("%d desktop packages failed to build: %s", len(failed), strings.Join(failed, " "))
+	}
+
 	i.progress(100, "Desktop environment installed")
 	return nil
 }
 
+// installDesktopExtras installs the app bundle and Flatpak setup.
+func (i *Installer) installDesktopExtras() error {
+	if i.config.Desktop.Type == config.DesktopNone {
+		i.progress(100, "No desktop environment selected")
+		return nil
+	}
+
+	i.progress(10, "Installing desktop applications")
+
+	desktopMgr := desktop.NewManager(i.config, i.targetDir)
+	if err := desktopMgr.SetupExtras(i.output); err != nil {
+		return err
+	}
+
+	i.progress(100, "Desktop extras installed")
+	return nil
+}
+
+// installExtraPackages installs config.Packages.ExtraPackages one at a time.
+// A failing package is reported as a warning rather than aborting the install.
+func (i *Installer) installExtraPackages() error {
+	packages := i.config.Packages.ExtraPackages
+	if len(packages) == 0 {
+		i.progress(100, "No extra packages selected")
+		return nil
+	}
+
+	binpkgMgr := binpkg.NewManager(i.config, i.targetDir)
+
+	var failed []string
+	for n, pkg := range packages {
+		i.progress(n*100/len(packages), fmt.Sprintf("Installing %s", pkg))
+
+		var err error
+		if i.config.Packages.UseBinary != config.BinaryNone {
+			err = binpkgMgr.InstallPackage(pkg, i.output)
+		} else {
+			result := utils.RunCommandStreaming(i.output, "chroot", i.targetDir, "emerge", "--ask=n", "--noreplace", pkg)
+			err = result.Error
+		}
+
+		if err != nil {
+			utils.Warn("Failed to install %s: %v", pkg, err)
+			failed = append(failed, pkg)
+		}
+	}
+
+	if len(failed) > 0 {
+		i.warn("%d extra packages failed to install: %s", len(failed), strings.Join(failed, " "))
+		i.progress(100, fmt.Sprintf("Extra packages installed, %d failed", len(failed)))
+		return nil
+	}
+
+	i.progress(100, "Extra packages installed")
+	return nil
+}
+
 // setupUsers creates user accounts.
 func (i *Installer) setupUsers() error {
 	userMgr := users.NewManager(i.config, i.targetDir)
@@ -376,6 +1091,16 @@ func (i *Installer) setupUsers() error {
 func (i *Installer) installBootloader() error {
 	bootMgr := bootloader.NewManager(i.config, i.targetDir)
 
+	i.progress(10, "Assembling kernel command line")
+	i.kernelCmdline = i.BuildKernelCmdline()
+	bootMgr.SetKernelCmdline(i.kernelCmdline)
+
+	for _, part := range i.layout.Partitions {
+		if hasFlag(part.Flags, "esp") {
+			bootMgr.SetESPPath(part.MountPoint)
+		}
+	}
+
 	i.progress(20, "Installing bootloader")
 
 	if err := bootMgr.Setup(); err != nil {
@@ -410,19 +1135,19 @@ func (i *Installer) finalize() error {
 	// Set timezone
 	i.progress(30, "Setting timezone")
 	if err := i.setTimezone(); err != nil {
-		utils.Warn("Failed to set timezone: %v", err)
+		i.warn("Failed to set timezone: %v", err)
 	}
 
 	// Set locale
 	i.progress(40, "Configuring locale")
 	if err := i.setLocale(); err != nil {
-		utils.Warn("Failed to set locale: %v", err)
+		i.warn("Failed to set locale: %v", err)
 	}
 
 	// Set keymap
 	i.progress(50, "Configuring keymap")
 	if err := i.setKeymap(); err != nil {
-		utils.Warn("Failed to set keymap: %v", err)
+		i.warn("Failed to set keymap: %v", err)
 	}
 
 	// Generate fstab
@@ -431,10 +1156,32 @@ func (i *Installer) finalize() error {
 		return err
 	}
 
+	// Generate crypttab
+	if len(i.luksDevices) > 0 {
+		i.progress(70, "Generating crypttab")
+		if err := i.generateCrypttab(); err != nil {
+			return err
+		}
+	}
+
+	if i.config.Firewall {
+		i.progress(75, "Configuring firewall")
+		if err := i.setupFirewall(); err != nil {
+			return err
+		}
+	}
+
 	// Enable essential services
 	i.progress(80, "Enabling services")
 	if err := i.enableServices(); err != nil {
-		utils.Warn("Failed to enable some services: %v", err)
+		i.warn("Failed to enable some services: %v", err)
+	}
+
+	if len(i.config.PostInstallScripts) > 0 {
+		i.progress(85, "Running post-install scripts")
+		if err := i.runPostInstallScripts(); err != nil {
+			return err
+		}
 	}
 
 	// Cleanup
@@ -449,6 +1196,65 @@ func (i *Installer) finalize() error {
 	return nil
 }
 
+// postInstallDir is where post-install scripts are copied inside the target.
+const postInstallDir = "/tmp/yuno-post-install"
+
+// runPostInstallScripts copies each post-install script into the target and
+// runs it there. Scripts run as root in the chroot with /proc, /sys and /dev
+// mounted, / as the working directory and a clean environment holding only
+// PATH, HOME=/root, TERM, YUNO_HOSTNAME and YUNO_INIT_SYSTEM. Output is
+// streamed to the installer log.
+func (i *Installer) runPostInstallScripts() error {
+	dir := filepath.Join(i.targetDir, postInstallDir)
+	if err := utils.CreateDir(dir, 0700); err != nil {
+		return utils.NewError("installer", "failed to create post-install script directory", err)
+	}
+	defer os.RemoveAll(dir)
+
+	env := []string{
+		"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
+		"HOME=/root",
+		"TERM=linux",
+		"YUNO_HOSTNAME=" + i.config.Hostname,
+		"YUNO_INIT_SYSTEM=" + string(i.config.InitSystem),
+	}
+
+	for n, entry := range i.config.PostInstallScripts {
+		script, optional := strings.CutSuffix(entry, "?")
+
+		content, err := os.ReadFile(script)
+		if err != nil {
+			if optional {
+				i.warn("Skipping post-install script %s: %v", script, err)
+				continue
+			}
+			return utils.NewError("installer", fmt.Sprintf("failed to read post-install script %s", script), err)
+		}
+
+		name := fmt.Sprintf("%02d-%s", n+1, filepath.Base(script))
+		if err := utils.WriteFile(filepath.Join(dir, name), string(content), 0700); err != nil {
+			return utils.NewError("installer", fmt.Sprintf("failed to copy post-install script %s", script), err)
+		}
+
+		utils.Info("Running post-install script %s", script)
+
+		args := []string{i.targetDir, "/usr/bin/env", "-i"}
+		args = append(args, env...)
+		args = append(args, "/bin/sh", "-c", "cd / && exec "+filepath.Join(postInstallDir, name))
+
+		result := utils.RunCommandStreaming(i.output, "chroot", args...)
+		if result.Error != nil {
+			if optional {
+				i.warn("Optional post-install script %s failed: %v", script, result.Error)
+				continue
+			}
+			return utils.NewError("installer", fmt.Sprintf("post-install script %s failed", script), result.Error)
+		}
+	}
+
+	return nil
+}
+
 // setTimezone sets the system timezone.
 func (i *Installer) setTimezone() error {
 	tz := i.config.Timezone
@@ -520,6 +1326,9 @@ func (i *Installer) generateFstab() error {
 		}
 
 		device := getPartitionDevice(i.config.Disk.Device, part.Number)
+		if part.MappedPath != "" {
+			device = part.MappedPath
+		}
 
 		// Get UUID
 		result := utils.RunCommand("blkid", "-s", "UUID", "-o", "value", device)
@@ -572,10 +1381,166 @@ func (i *Installer) generateFstab() error {
 		}
 	}
 
+	if i.config.SwapFile.Enabled() {
+		fstab.WriteString(fmt.Sprintf("%s\tnone\tswap\tsw\t0\t0\n", i.config.SwapFile.FilePath()))
+	}
+
 	fstabPath := i.targetDir + "/etc/fstab"
 	return utils.WriteFile(fstabPath, fstab.String(), 0644)
 }
 
+// defaultZFSRootDataset is the root dataset used when none is configured.
+const defaultZFSRootDataset = "rpool/ROOT/yuno"
+
+// BuildKernelCmdline assembles the root, encryption and resume parameters of
+// the kernel command line from the partition layout.
+func (i *Installer) BuildKernelCmdline() string {
+	if i.layout == nil {
+		return ""
+	}
+
+	genkernel := i.config.Kernel.Initramfs == "genkernel"
+
+	var rootSpec, resumeSpec string
+	var rootZFS bool
+	for _, part := range i.layout.Partitions {
+		device := getPartitionDevice(i.config.Disk.Device, part.Number)
+		if part.MappedPath != "" {
+			device = part.MappedPath
+		}
+
+		switch {
+		case part.MountPoint == "/" && part.Filesystem == config.FSZfs:
+			rootZFS = true
+			rootSpec = i.config.Encryption.ZFSDataset
+			if rootSpec == "" {
+				rootSpec = defaultZFSRootDataset
+			}
+		case part.MountPoint == "/":
+			rootSpec = deviceSpec(device)
+		case part.Filesystem == config.FSSwap:
+			resumeSpec = deviceSpec(device)
+		}
+	}
+
+	// Containers unlocked with a key file from root are opened by crypttab,
+	// the initramfs unlocks the rest, root included
+	var luksUUIDs []string
+	for _, dev := range i.luksDevices {
+		if strings.HasPrefix(dev.KeyFile, encryption.KeyFileDir+"/") {
+			continue
+		}
+		if uuid := encryption.GetLUKSUUID(dev.Device); uuid != "" {
+			luksUUIDs = append(luksUUIDs, uuid)
+		}
+	}
+
+	return assembleCmdline(rootSpec, rootZFS, luksUUIDs, resumeSpec, genkernel)
+}
+
+// assembleCmdline renders kernel parameters in the syntax of the initramfs
+// generator in use.
+func assembleCmdline(rootSpec string, rootZFS bool, luksUUIDs []string, resumeSpec string, genkernel bool) string {
+	var params []string
+
+	switch {
+	case rootZFS && genkernel:
+		params = append(params, "dozfs", "root=ZFS="+rootSpec)
+	case rootZFS:
+		params = append(params, "root=zfs:"+rootSpec)
+	case rootSpec != "":
+		params = append(params, "root="+rootSpec)
+	}
+
+	for n, uuid := range luksUUIDs {
+		switch {
+		case !genkernel:
+			params = append(params, "rd.luks.uuid="+uuid)
+		case n == 0:
+			// genkernel can only unlock a single container itself
+			params = append(params, "crypt_root=UUID="+uuid)
+		}
+	}
+
+	if resumeSpec != "" {
+		params = append(params, "resume="+resumeSpec)
+	}
+
+	return strings.Join(params, " ")
+}
+
+// deviceSpec returns UUID=<uuid> for device, or the device path when the
+// UUID cannot be read.
+func deviceSpec(device string) string {
+	result := utils.RunCommand("blkid", "-s", "UUID", "-o", "value", device)
+	if uuid := strings.TrimSpace(result.Stdout); result.Error == nil && uuid != "" {
+		return "UUID=" + uuid
+	}
+	return device
+}
+
+// generateCrypttab installs key files for partitions unlocked from root and
+// writes /etc/crypttab.
+func (i *Installer) generateCrypttab() error {
+	encMgr := encryption.NewManager(i.config)
+
+	for _, dev := range i.luksDevices {
+		if !strings.HasPrefix(dev.KeyFile, encryption.KeyFileDir) {
+			continue
+		}
+
+		src := filepath.Join(os.TempDir(), "yuno-keys", dev.Name+".key")
+		dst := filepath.Join(i.targetDir, dev.KeyFile)
+		if err := utils.CreateDir(filepath.Dir(dst), 0700); err != nil {
+			return utils.NewError("installer", "failed to create key file directory", err)
+		}
+		// The copy keeps the key's 0400 mode
+		if err := utils.CopyFile(src, dst); err != nil {
+			return utils.NewError("installer", fmt.Sprintf("failed to install key file for %s", dev.Name), err)
+		}
+		os.Remove(src)
+	}
+
+	return encMgr.GenerateCrypttab(i.luksDevices, i.targetDir)
+}
+
+// firewallRules is the nftables ruleset installed when the firewall is
+// enabled: nothing comes in except replies, ICMP and SSH.
+const firewallRules = `#!/sbin/nft -f
+# Yuno OS firewall - Generated by installer
+flush ruleset
+
+table inet filter {
+	chain input {
+		type filter hook input priority filter; policy drop;
+
+		ct state established,related accept
+		ct state invalid drop
+		iif lo accept
+		meta l4proto { icmp, ipv6-icmp } accept
+		tcp dport 22 accept
+	}
+
+	chain forward {
+		type filter hook forward priority filter; policy drop;
+	}
+
+	chain output {
+		type filter hook output priority filter; policy accept;
+	}
+}
+`
+
+// setupFirewall writes the ruleset the nftables service loads at boot, on
+// both OpenRC and systemd.
+func (i *Installer) setupFirewall() error {
+	path := filepath.Join(i.targetDir, "var/lib/nftables/rules-save")
+	if err := utils.WriteFile(path, firewallRules, 0600); err != nil {
+		return utils.NewError("installer", "failed to write the firewall rules", err)
+	}
+	return nil
+}
+
 // enableServices enables essential system services.
 func (i *Installer) enableServices() error {
 	services := []string{"sshd", "metalog"}
@@ -587,6 +1552,11 @@ func (i *Installer) enableServices() error {
 		services = append(services, "NetworkManager", "dbus")
 	}
 
+	if i.config.Firewall {
+		services = append(services, "nftables")
+	}
+	services = append(services, i.config.Services...)
+
 	for _, svc := range services {
 		if i.config.InitSystem == config.InitSystemd {
 			utils.RunInChroot(i.targetDir, "systemctl", "enable", svc)
@@ -598,19 +1568,138 @@ func (i *Installer) enableServices() error {
 	return nil
 }
 
-// installBasePackages installs essential base packages including metalog.
+// installBasePackages installs the base packages later steps rely on.
 func (i *Installer) installBasePackages() error {
-	i.progress(10, "Installing metalog (logging daemon)")
+	if i.config.Distcc.Enabled {
+		i.progress(5, "Setting up distcc")
+		portageMgr := portage.NewManager(i.config, i.targetDir)
+		if err := portageMgr.SetupDistcc(i.output); err != nil {
+			return err
+		}
+	}
 
-	// Install metalog - simple logger with built-in rotation
-	result := utils.RunInChroot(i.targetDir, "emerge", "--ask=n", "--quiet-build", "app-admin/metalog")
+	// systemd-boot is built from systemd (or systemd-utils on OpenRC)
+	if i.config.Bootloader.Type == config.BootSystemdBoot {
+		pkg := "sys-apps/systemd-utils"
+		if i.config.InitSystem == config.InitSystemd {
+			pkg = "sys-apps/systemd"
+		}
+		usePath := filepath.Join(i.targetDir, "etc/portage/package.use/systemd-boot")
+		if err := utils.WriteFile(usePath, pkg+" boot\n", 0644); err != nil {
+			return utils.NewError("installer", "failed to write systemd-boot use flags", err)
+		}
+	}
+
+	packages := i.basePackages()
+	i.progress(10, fmt.Sprintf("Installing %d base packages", len(packages)))
+
+	// --newuse rebuilds anything from the stage3 whose USE flags changed
+	args := append([]string{i.targetDir, "emerge", "--ask=n", "--quiet-build", "--newuse"}, packages...)
+	result := utils.RunCommandStreaming(i.output, "chroot", args...)
+	if result.Error != nil {
+		return utils.NewError("installer", "failed to install base packages", result.Error)
+	}
+
+	return i.setDefaultEditor()
+}
+
+// setDefaultEditor sets EDITOR and VISUAL system-wide for the configured editor.
+func (i *Installer) setDefaultEditor() error {
+	editor := i.config.GetEditor()
+	content := fmt.Sprintf("EDITOR=%q\nVISUAL=%q\n", editor.Command, editor.Command)
+
+	path := filepath.Join(i.targetDir, "etc/env.d/99editor")
+	if err := utils.WriteFile(path, content, 0644); err != nil {
+		return utils.NewError("installer", "failed to set the default editor", err)
+	}
+
+	result := utils.RunInChroot(i.targetDir, "env-update")
 	if result.Error != nil {
-		return utils.NewError("installer", "failed to install metalog", result.Error)
+		return utils.NewError("installer", "failed to run env-update", result.Error)
 	}
 
 	return nil
 }
 
+// basePackages returns the packages the configured install needs before the
+// kernel, bootloader and encryption steps run.
+func (i *Installer) basePackages() []string {
+	// metalog: simple logger with built-in rotation
+	packages := []string{"app-admin/metalog", i.config.GetEditor().Package}
+
+	if i.config.Firewall {
+		packages = append(packages, "net-firewall/nftables")
+	}
+
+	// Initramfs generator
+	if i.config.Kernel.Initramfs == "genkernel" {
+		packages = append(packages, "sys-kernel/genkernel")
+	} else {
+		packages = append(packages, "sys-kernel/dracut")
+	}
+
+	// Encryption tools
+	switch i.config.Encryption.Type {
+	case config.EncryptNone, "":
+	case config.EncryptZFS:
+		packages = append(packages, "sys-fs/zfs")
+	default:
+		packages = append(packages, "sys-fs/cryptsetup")
+	}
+
+	// Filesystem tools for every filesystem in the layout
+	var filesystems []config.Filesystem
+	if i.layout != nil {
+		for _, part := range i.layout.Partitions {
+			filesystems = append(filesystems, part.Filesystem)
+		}
+	} else {
+		for _, part := range i.config.Partitions {
+			filesystems = append(filesystems, part.Filesystem)
+		}
+	}
+	for _, fs := range filesystems {
+		switch fs {
+		case config.FSBtrfs:
+			packages = append(packages, "sys-fs/btrfs-progs")
+		case config.FSXfs:
+			packages = append(packages, "sys-fs/xfsprogs")
+		case config.FSF2fs:
+			packages = append(packages, "sys-fs/f2fs-tools")
+		case config.FSZfs:
+			packages = append(packages, "sys-fs/zfs")
+		case config.FSFat32:
+			packages = append(packages, "sys-fs/dosfstools")
+		}
+	}
+
+	// Bootloader
+	switch i.config.Bootloader.Type {
+	case config.BootSystemdBoot:
+		if i.config.InitSystem == config.InitSystemd {
+			packages = append(packages, "sys-apps/systemd")
+		} else {
+			packages = append(packages, "sys-apps/systemd-utils")
+		}
+	default:
+		packages = append(packages, "sys-boot/grub")
+	}
+	if utils.IsUEFI() {
+		packages = append(packages, "sys-boot/efibootmgr")
+	}
+
+	// Drop duplicates, keeping order
+	seen := make(map[string]bool)
+	var unique []string
+	for _, pkg := range packages {
+		if !seen[pkg] {
+			seen[pkg] = true
+			unique = append(unique, pkg)
+		}
+	}
+	return unique
+}
+
 // Helper functions
 
 func getPartitionDevice(disk string, partNum int) string {
@@ -620,6 +1709,16 @@ func getPartitionDevice(disk string, partNum int) string {
 	return fmt.Sprintf("%s%d", disk, partNum)
 }
 
+// hasFlag reports whether flags contains flag.
+func hasFlag(flags []string, flag string) bool {
+	for _, f := range flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
 func containsAny(s string, substrs ...string) bool {
 	for _, sub := range substrs {
 		if len(s) >= len(sub) {
@@ -0,0 +1,658 @@
+package installer
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/japaneseenrichmentorganization/yuno_os/pkg/config"
+	"github.com/japaneseenrichmentorganization/yuno_os/pkg/encryption"
+	"github.com/japaneseenrichmentorganization/yuno_os/pkg/partition"
+	"github.com/japaneseenrichmentorganization/yuno_os/pkg/utils"
+)
+
+// fakeRunner records commands instead of running them and keeps the target
+// mounted until it is unmounted.
+type fakeRunner struct {
+	commands []string
+	mounted  bool
+	failing  string // Command that fails
+}
+
+func (f *fakeRunner) run(name string, args ...string) *utils.CommandResult {
+	command := strings.TrimSpace(name + " " + strings.Join(args, " "))
+	f.commands = append(f.commands, command)
+
+	switch {
+	case name == f.failing:
+		return &utils.CommandResult{ExitCode: 1, Error: errors.New("failed")}
+	case name == "mountpoint" && !f.mounted:
+		return &utils.CommandResult{ExitCode: 1, Error: errors.New("not a mountpoint")}
+	case name == "umount":
+		f.mounted = false
+	}
+	return &utils.CommandResult{}
+}
+
+// index returns the position of the first command starting with prefix.
+func (f *fakeRunner) index(prefix string) int {
+	for n, command := range f.commands {
+		if strings.HasPrefix(command, prefix) {
+			return n
+		}
+	}
+	return -1
+}
+
+func TestPostInstallUnmountsBeforeAction(t *testing.T) {
+	for _, action := range []config.PostInstallAction{config.PostInstallReboot, config.PostInstallPoweroff} {
+		t.Run(string(action), func(t *testing.T) {
+			cfg := config.NewDefaultConfig()
+			cfg.PostInstall = action
+			fake := &fakeRunner{mounted: true}
+			i := NewInstaller(cfg, WithTargetDir("/mnt/test"))
+			i.runCommand = fake.run
+
+			if err := i.PostInstall(); err != nil {
+				t.Fatalf("PostInstall() error = %v", err)
+			}
+
+			umount := fake.index("umount -R /mnt/test")
+			issued := fake.index(string(action))
+			if umount < 0 || issued < 0 {
+				t.Fatalf("commands = %q, want umount and %s", fake.commands, action)
+			}
+			if umount > issued {
+				t.Errorf("commands = %q, %s issued before unmounting", fake.commands, action)
+			}
+		})
+	}
+}
+
+func TestPostInstallSkipsRebootWhenUnmountFails(t *testing.T) {
+	cfg := config.NewDefaultConfig()
+	cfg.PostInstall = config.PostInstallReboot
+	fake := &fakeRunner{mounted: true, failing: "umount"}
+	i := NewInstaller(cfg, WithTargetDir("/mnt/test"))
+	i.runCommand = fake.run
+
+	if err := i.PostInstall(); err == nil {
+		t.Fatal("PostInstall() succeeded with the target still mounted")
+	}
+	if fake.index("reboot") >= 0 {
+		t.Errorf("commands = %q, reboot issued with the target mounted", fake.commands)
+	}
+}
+
+func TestPostInstallExitOnlyUnmounts(t *testing.T) {
+	cfg := config.NewDefaultConfig()
+	cfg.PostInstall = config.PostInstallExit
+	fake := &fakeRunner{mounted: true}
+	i := NewInstaller(cfg, WithTargetDir("/mnt/test"))
+	i.runCommand = fake.run
+
+	if err := i.PostInstall(); err != nil {
+		t.Fatalf("PostInstall() error = %v", err)
+	}
+	if fake.index("umount") < 0 {
+		t.Errorf("commands = %q, target not unmounted", fake.commands)
+	}
+	if fake.index("reboot") >= 0 || fake.index("poweroff") >= 0 {
+		t.Errorf("commands = %q, exit must not reboot or power off", fake.commands)
+	}
+}
+
+func TestNewInstallerTargetDir(t *testing.T) {
+	cfg := config.NewDefaultConfig()
+	if got := NewInstaller(cfg).TargetDir(); got != TargetDir {
+		t.Errorf("TargetDir() = %q, want the default %q", got, TargetDir)
+	}
+
+	cfg.TargetDir = "/mnt/test/"
+	if got := NewInstaller(cfg).TargetDir(); got != "/mnt/test" {
+		t.Errorf("TargetDir() = %q, want %q", got, "/mnt/test")
+	}
+
+	if got := NewInstaller(cfg, WithTargetDir("/mnt/other/")).TargetDir(); got != "/mnt/other" {
+		t.Errorf("TargetDir() = %q, want the option's %q", got, "/mnt/other")
+	}
+}
+
+func TestCheckTargetDir(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		targetDir string
+		wantErr   bool
+	}{
+		{dir, false},
+		{filepath.Join(dir, "missing"), false}, // Created when mounting
+		{file, true},
+	}
+
+	for _, tt := range tests {
+		i := NewInstaller(config.NewDefaultConfig(), WithTargetDir(tt.targetDir))
+		if err := i.checkTargetDir(); (err != nil) != tt.wantErr {
+			t.Errorf("target dir %q: checkTargetDir() error = %v, wantErr %v", tt.targetDir, err, tt.wantErr)
+		}
+	}
+}
+
+func TestCustomTargetDirReachesEveryStep(t *testing.T) {
+	const target = "/mnt/custom"
+	bin := t.TempDir()
+	lspci := "#!/bin/sh\necho '00:02.0 VGA compatible controller [0300]: Intel Corporation UHD [8086:3e92]'\n"
+	if err := os.WriteFile(filepath.Join(bin, "lspci"), []byte(lspci), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	cfg := config.NewDefaultConfig()
+	cfg.Disk.Device = "/dev/sdz"
+	cfg.TargetDir = target
+	cfg.Users = []config.UserConfig{{Username: "alice", Sudo: true}}
+	i := NewInstaller(cfg)
+	i.layout = &partition.PartitionLayout{Partitions: []partition.LayoutPartition{
+		{Number: 1, MountPoint: "/boot", Filesystem: config.FSFat32, Flags: []string{"esp"}},
+		{Number: 2, MountPoint: "/", Filesystem: config.FSExt4},
+	}}
+
+	utils.SetDryRun(true)
+	defer utils.SetDryRun(false)
+
+	// Partitioning needs the disk and stage3 the network; every other
+	// step plans its actions without touching the host
+	skip := map[Step]bool{StepPartition: true, StepStage3: true}
+	// Steps that plan nothing for this config
+	empty := map[Step]bool{StepEncryption: true, StepOverlays: true, StepDesktopExtras: true, StepExtraPackages: true}
+
+	for n, fn := range i.steps {
+		step := Step(n)
+		if skip[step] {
+			continue
+		}
+		before := len(i.Plan())
+		i.currentStep = step
+		if err := fn(); err != nil {
+			t.Fatalf("%s: error = %v", step, err)
+		}
+
+		reached := false
+		for _, action := range i.Plan()[before:] {
+			for _, field := range strings.Fields(action.Detail) {
+				if field == target || strings.HasPrefix(field, target+"/") {
+					reached = true
+				} else if strings.HasPrefix(field, "/mnt") {
+					t.Errorf("%s: %s %q is outside %s", step, action.Kind, action.Detail, target)
+				}
+			}
+		}
+		if !reached && !empty[step] {
+			t.Errorf("%s: no planned action uses %s", step, target)
+		}
+	}
+}
+
+func TestStateFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	i := NewInstaller(config.NewDefaultConfig())
+
+	// No state file configured writes nothing
+	i.progress(10, "ignored")
+
+	i.SetStateFile(path)
+	i.currentStep = StepStage3
+	i.progress(42, "Downloading stage3")
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("state file not written: %v", err)
+	}
+	var state State
+	if err := json.Unmarshal(data, &state); err != nil {
+		t.Fatalf("state file is not valid JSON: %v", err)
+	}
+
+	if state.Step != int(StepStage3) || state.StepName != StepStage3.String() {
+		t.Errorf("step = %d %q, want %d %q", state.Step, state.StepName, StepStage3, StepStage3.String())
+	}
+	if state.Percent != 42 || state.Message != "Downloading stage3" || state.Status != StatusRunning {
+		t.Errorf("state = %+v, want 42%% running", state)
+	}
+	if state.UpdatedAt.IsZero() {
+		t.Error("UpdatedAt not set")
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary state file left behind: %v", err)
+	}
+
+	i.writeState(State{Status: StatusFailed, Error: "boom"})
+	data, _ = os.ReadFile(path)
+	state = State{}
+	if err := json.Unmarshal(data, &state); err != nil {
+		t.Fatalf("state file is not valid JSON: %v", err)
+	}
+	if state.Status != StatusFailed || state.Error != "boom" {
+		t.Errorf("state = %+v, want failed with the error", state)
+	}
+}
+
+func TestParseEmergeProgress(t *testing.T) {
+	tests := []struct {
+		line      string
+		wantDone  int
+		wantTotal int
+		wantOK    bool
+	}{
+		{">>> Emerging (12 of 87) sys-apps/portage-3.0.63::gentoo", 11, 87, true},
+		{">>> Emerging binary (3 of 10) dev-lang/rust-bin-1.79.0::gentoo", 2, 10, true},
+		{">>> Emerging (1 of 1) app-editors/vim-9.1.0::gentoo", 0, 1, true},
+		{"  >>> Emerging (5 of 5) x11-libs/gtk+-3.24.41::gentoo", 4, 5, true},
+		{">>> Jobs: 12 of 87 complete, 1 running               Load avg: 7.40, 6.12, 5.01", 12, 87, true},
+		{">>> Jobs: 87 of 87 complete", 87, 87, true},
+		{">>> Installing (12 of 87) sys-apps/portage-3.0.63::gentoo", 0, 0, false},
+		{">>> Emerging (9 of 0) sys-apps/foo-1.0::gentoo", 0, 0, false},
+		{">>> Emerging (9 of 8) sys-apps/foo-1.0::gentoo", 0, 0, false},
+		{"checking for gcc... gcc", 0, 0, false},
+		{"", 0, 0, false},
+	}
+
+	for _, tt := range tests {
+		done, total, ok := parseEmergeProgress(tt.line)
+		if done != tt.wantDone || total != tt.wantTotal || ok != tt.wantOK {
+			t.Errorf("parseEmergeProgress(%q) = %d, %d, %v, want %d, %d, %v",
+				tt.line, done, total, ok, tt.wantDone, tt.wantTotal, tt.wantOK)
+		}
+	}
+}
+
+func TestOutputReportsEmergeProgress(t *testing.T) {
+	i := NewInstaller(config.NewDefaultConfig())
+
+	var lines []string
+	var percents []int
+	i.SetOutputCallback(func(line string) { lines = append(lines, line) })
+	i.SetProgressCallback(func(step Step, progress int, message string) { percents = append(percents, progress) })
+
+	i.output("checking for gcc... gcc")
+	i.output(">>> Jobs: 3 of 4 complete")
+
+	if len(lines) != 2 {
+		t.Errorf("output lines = %q, want both lines forwarded", lines)
+	}
+	if len(percents) != 1 || percents[0] != 75 {
+		t.Errorf("progress = %v, want [75]", percents)
+	}
+}
+
+func TestAssembleCmdline(t *testing.T) {
+	tests := []struct {
+		name      string
+		root      string
+		rootZFS   bool
+		luks      []string
+		resume    string
+		genkernel bool
+		want      string
+	}{
+		{"plain root", "UUID=r00t", false, nil, "", false, "root=UUID=r00t"},
+		{"root and resume", "UUID=r00t", false, nil, "UUID=5wap", false, "root=UUID=r00t resume=UUID=5wap"},
+		{"dracut luks", "/dev/mapper/cryptroot", false, []string{"aaaa", "bbbb"}, "", false,
+			"root=/dev/mapper/cryptroot rd.luks.uuid=aaaa rd.luks.uuid=bbbb"},
+		{"genkernel luks", "/dev/mapper/cryptroot", false, []string{"aaaa", "bbbb"}, "", true,
+			"root=/dev/mapper/cryptroot crypt_root=UUID=aaaa"},
+		{"dracut zfs", "rpool/ROOT/yuno", true, nil, "", false, "root=zfs:rpool/ROOT/yuno"},
+		{"genkernel zfs", "rpool/ROOT/yuno", true, nil, "", true, "dozfs root=ZFS=rpool/ROOT/yuno"},
+		{"nothing known", "", false, nil, "", false, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := assembleCmdline(tt.root, tt.rootZFS, tt.luks, tt.resume, tt.genkernel)
+			if got != tt.want {
+				t.Errorf("assembleCmdline() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildKernelCmdlineLUKS(t *testing.T) {
+	bin := t.TempDir()
+	scripts := map[string]string{
+		"blkid":      "exit 2",
+		"cryptsetup": `[ "$1" = luksUUID ] && echo "uuid-${2##*/}"`,
+	}
+	for name, script := range scripts {
+		if err := os.WriteFile(filepath.Join(bin, name), []byte("#!/bin/sh\n"+script+"\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	tests := []struct {
+		name        string
+		rootKeyFile string
+		want        string
+	}{
+		{"root with a passphrase", "", "root=/dev/mapper/cryptroot rd.luks.uuid=uuid-sda2"},
+		{"root with a key file", "/run/media/usb/root.key", "root=/dev/mapper/cryptroot rd.luks.uuid=uuid-sda2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.NewDefaultConfig()
+			cfg.Disk.Device = "/dev/sda"
+			i := NewInstaller(cfg)
+			i.layout = &partition.PartitionLayout{Partitions: []partition.LayoutPartition{
+				{Number: 2, MountPoint: "/", Filesystem: config.FSExt4, Encrypt: true, MappedPath: "/dev/mapper/cryptroot"},
+				{Number: 3, MountPoint: "/home", Filesystem: config.FSExt4, Encrypt: true, MappedPath: "/dev/mapper/crypthome"},
+			}}
+			i.luksDevices = []encryption.LUKSInfo{
+				{Device: "/dev/sda2", Name: "cryptroot", KeyFile: tt.rootKeyFile},
+				// Unlocked from root by crypttab
+				{Device: "/dev/sda3", Name: "crypthome", KeyFile: encryption.KeyFileDir + "/crypthome.key"},
+			}
+
+			if got := i.BuildKernelCmdline(); got != tt.want {
+				t.Errorf("BuildKernelCmdline() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeviceSpec(t *testing.T) {
+	bin := t.TempDir()
+	script := "#!/bin/sh\n[ \"$5\" = /dev/sda2 ] && echo 1234-abcd\nexit 0\n"
+	if err := os.WriteFile(filepath.Join(bin, "blkid"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	if got := deviceSpec("/dev/sda2"); got != "UUID=1234-abcd" {
+		t.Errorf("deviceSpec(/dev/sda2) = %q, want %q", got, "UUID=1234-abcd")
+	}
+	if got := deviceSpec("/dev/sda3"); got != "/dev/sda3" {
+		t.Errorf("deviceSpec(/dev/sda3) = %q, want the device path", got)
+	}
+}
+
+func TestStepOptional(t *testing.T) {
+	tests := []struct {
+		step Step
+		want bool
+	}{
+		{StepOverlays, true},
+		{StepDesktopExtras, true},
+		{StepExtraPackages, true},
+		{StepPartition, false},
+		{StepDesktop, false},
+		{StepKernel, false},
+		{StepBootloader, false},
+	}
+
+	for _, tt := range tests {
+		if got := tt.step.Optional(); got != tt.want {
+			t.Errorf("%s.Optional() = %v, want %v", tt.step, got, tt.want)
+		}
+	}
+}
+
+func TestRunStepFailure(t *testing.T) {
+	tests := []struct {
+		failing   Step
+		wantErr   bool
+		wantSteps int // Steps run, failing one included
+	}{
+		{StepOverlays, false, int(StepFinalize) + 1},
+		{StepDesktopExtras, false, int(StepFinalize) + 1},
+		{StepExtraPackages, false, int(StepFinalize) + 1},
+		{StepKernel, true, int(StepKernel) + 1},
+		{StepDesktop, true, int(StepDesktop) + 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.failing.String(), func(t *testing.T) {
+			cfg := config.NewDefaultConfig()
+			cfg.TargetDir = t.TempDir()
+			i := NewInstaller(cfg)
+			i.dryRun = true
+
+			ran := 0
+			for n := range i.steps {
+				step := Step(n)
+				i.steps[n] = func() error {
+					ran++
+					if step == tt.failing {
+						return errors.New("broken")
+					}
+					return nil
+				}
+			}
+
+			err := i.run(StepPartition)
+			if gotErr := err != nil; gotErr != tt.wantErr {
+				t.Fatalf("run() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if ran != tt.wantSteps {
+				t.Errorf("run() ran %d steps, want %d", ran, tt.wantSteps)
+			}
+			if !tt.wantErr && (len(i.Warnings()) != 1 || !strings.Contains(i.Warnings()[0], tt.failing.String())) {
+				t.Errorf("Warnings() = %q, want the failed %s step", i.Warnings(), tt.failing)
+			}
+		})
+	}
+}
+
+func TestWarningsReachStateFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	i := NewInstaller(config.NewDefaultConfig())
+	i.SetStateFile(path)
+
+	i.warn("Failed to set %s: %v", "timezone", errors.New("no zoneinfo"))
+	i.warn("2 extra packages failed to install: a/b c/d")
+
+	want := []string{"Failed to set timezone: no zoneinfo", "2 extra packages failed to install: a/b c/d"}
+	if got := i.Warnings(); strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("Warnings() = %q, want %q", got, want)
+	}
+
+	i.writeState(State{Status: StatusCompleted, Warnings: i.Warnings()})
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var state State
+	if err := json.Unmarshal(data, &state); err != nil {
+		t.Fatal(err)
+	}
+	if len(state.Warnings) != 2 {
+		t.Errorf("state warnings = %q, want %q", state.Warnings, want)
+	}
+}
+
+func TestSetDefaultEditor(t *testing.T) {
+	tests := []struct {
+		editor string
+		want   string
+	}{
+		{"", "EDITOR=\"/usr/bin/nano\"\nVISUAL=\"/usr/bin/nano\"\n"},
+		{"neovim", "EDITOR=\"/usr/bin/nvim\"\nVISUAL=\"/usr/bin/nvim\"\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.editor, func(t *testing.T) {
+			utils.SetDryRun(true)
+			defer utils.SetDryRun(false)
+
+			cfg := config.NewDefaultConfig()
+			cfg.Editor = tt.editor
+			cfg.TargetDir = "/mnt/test"
+			i := NewInstaller(cfg)
+
+			if err := i.setDefaultEditor(); err != nil {
+				t.Fatalf("setDefaultEditor() error = %v", err)
+			}
+			got, err := utils.ReadFile("/mnt/test/etc/env.d/99editor")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("99editor = %q, want %q", got, tt.want)
+			}
+
+			var envUpdate bool
+			for _, action := range utils.Plan() {
+				envUpdate = envUpdate || strings.HasSuffix(action.Detail, "env-update")
+			}
+			if !envUpdate {
+				t.Errorf("plan = %v, want env-update run", utils.Plan())
+			}
+
+			if packages := i.basePackages(); packages[1] != cfg.GetEditor().Package {
+				t.Errorf("basePackages() = %q, want the editor package", packages)
+			}
+		})
+	}
+}
+
+// fakeDiskTools puts sfdisk, lsblk, findmnt and cryptsetup on PATH for a
+// disk /dev/fake holding a FAT partition and a LUKS partition. findmnt
+// reports the FAKE_SOURCE device for every directory.
+func fakeDiskTools(t *testing.T) {
+	t.Helper()
+	scripts := map[string]string{
+		"sfdisk": `[ "$2" = /dev/blank ] && { echo "sfdisk: $2: does not contain a recognized partition table" >&2; exit 1; }
+echo "label: gpt"`,
+		"lsblk": `case "$1" in
+-lnpo) [ "$3" = /dev/blank ] && echo "/dev/blank" || printf '/dev/fake\n/dev/fake1 vfat\n/dev/fake2 crypto_LUKS\n' ;;
+-lnspo) [ "$3" = /dev/fake2 ] && printf '/dev/fake2\n/dev/fake\n' || printf '%s\n/dev/other\n' "$3" ;;
+esac`,
+		"findmnt":    `echo "$FAKE_SOURCE"`,
+		"cryptsetup": `echo "header of $2" > "$4"`,
+	}
+
+	bin := t.TempDir()
+	for name, script := range scripts {
+		if err := os.WriteFile(filepath.Join(bin, name), []byte("#!/bin/sh\n"+script+"\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestBackupDiskMetadata(t *testing.T) {
+	tests := []struct {
+		name    string
+		device  string
+		source  string // Device holding the backup directory
+		want    []string
+		wantErr bool
+	}{
+		{"partitioned", "/dev/fake", "/dev/other1", []string{"fake-*.sfdisk", "fake2-*.luksheader"}, false},
+		{"no partition table", "/dev/blank", "/dev/other1", nil, false},
+		{"backup on the disk", "/dev/fake", "/dev/fake2", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeDiskTools(t)
+			t.Setenv("FAKE_SOURCE", tt.source)
+			dest := filepath.Join(t.TempDir(), "backup")
+
+			err := NewInstaller(config.NewDefaultConfig()).BackupDiskMetadata(tt.device, dest)
+			if gotErr := err != nil; gotErr != tt.wantErr {
+				t.Fatalf("BackupDiskMetadata() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			entries, _ := os.ReadDir(dest)
+			if len(entries) != len(tt.want) {
+				t.Fatalf("backup directory holds %d files, want %v", len(entries), tt.want)
+			}
+			for n, pattern := range tt.want {
+				if ok, _ := filepath.Match(pattern, entries[n].Name()); !ok {
+					t.Errorf("backup file %s does not match %s", entries[n].Name(), pattern)
+				}
+			}
+		})
+	}
+}
+
+func TestFirewall(t *testing.T) {
+	tests := []struct {
+		name     string
+		init     config.InitSystem
+		firewall bool
+		want     []string
+	}{
+		{"disabled", config.InitOpenRC, false, nil},
+		{"openrc", config.InitOpenRC, true, []string{"rc-update add nftables default", "rc-update add fail2ban default"}},
+		{"systemd", config.InitSystemd, true, []string{"systemctl enable nftables", "systemctl enable fail2ban"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			utils.SetDryRun(true)
+			defer utils.SetDryRun(false)
+
+			cfg := config.NewDefaultConfig()
+			cfg.TargetDir = "/mnt/test"
+			cfg.InitSystem = tt.init
+			cfg.Firewall = tt.firewall
+			if tt.firewall {
+				cfg.Services = []string{"fail2ban"}
+			}
+			i := NewInstaller(cfg)
+
+			if err := i.enableServices(); err != nil {
+				t.Fatalf("enableServices() error = %v", err)
+			}
+			var got []string
+			for _, action := range utils.Plan() {
+				if strings.Contains(action.Detail, "nftables") || strings.Contains(action.Detail, "fail2ban") {
+					got = append(got, strings.TrimPrefix(action.Detail, "chroot /mnt/test "))
+				}
+			}
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("enableServices() ran %q, want %q", got, tt.want)
+			}
+
+			hasNftables := false
+			for _, pkg := range i.basePackages() {
+				hasNftables = hasNftables || pkg == "net-firewall/nftables"
+			}
+			if hasNftables != tt.firewall {
+				t.Errorf("basePackages() has nftables = %v, want %v", hasNftables, tt.firewall)
+			}
+		})
+	}
+}
+
+func TestSetupFirewall(t *testing.T) {
+	cfg := config.NewDefaultConfig()
+	cfg.TargetDir = t.TempDir()
+
+	if err := NewInstaller(cfg).setupFirewall(); err != nil {
+		t.Fatalf("setupFirewall() error = %v", err)
+	}
+	path := filepath.Join(cfg.TargetDir, "var/lib/nftables/rules-save")
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("rules-save mode = %v, want 0600", info.Mode().Perm())
+	}
+	rules, _ := os.ReadFile(path)
+	for _, rule := range []string{"policy drop;", "tcp dport 22 accept"} {
+		if !strings.Contains(string(rules), rule) {
+			t.Errorf("firewall rules do not contain %q:\n%s", rule, rules)
+		}
+	}
+}
@@ -0,0 +1,289 @@
+package installer
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/japaneseenrichmentorganization/yuno_os/pkg/config"
+	"github.com/japaneseenrichmentorganization/yuno_os/pkg/stage3"
+	"github.com/japaneseenrichmentorganization/yuno_os/pkg/utils"
+)
+
+const (
+	// ntpServer is asked for the time by the clock check.
+	ntpServer = "pool.ntp.org"
+
+	// maxClockSkew is how far the clock may be off. Signatures made in
+	// the future and certificates not yet valid fail beyond it.
+	maxClockSkew = 2 * time.Minute
+
+	// preflightTimeout bounds each network check.
+	preflightTimeout = 10 * time.Second
+)
+
+// Preflight checks that the host can run the installation: the tools it
+// needs exist, the target directory is usable, DNS resolves, the mirror
+// answers and the clock is right. Every check runs, and all failures are
+// returned together.
+func (i *Installer) Preflight() error {
+	utils.Info("Running preflight checks")
+
+	var failed []string
+	if err := i.checkTargetDir(); err != nil {
+		failed = append(failed, err.Error())
+	}
+	for _, tool := range i.requiredTools() {
+		if _, err := exec.LookPath(tool); err != nil {
+			failed = append(failed, fmt.Sprintf("%s is not installed", tool))
+		}
+	}
+
+	mirror := stage3.DefaultMirror
+	if len(i.config.Portage.Mirrors) > 0 {
+		mirror = i.config.Portage.Mirrors[0]
+	}
+
+	mirrorTime, err := i.checkMirror(mirror)
+	if err != nil {
+		failed = append(failed, err.Error())
+	}
+
+	if err := i.checkClock(mirrorTime); err != nil {
+		failed = append(failed, err.Error())
+	}
+
+	if len(failed) > 0 {
+		return utils.NewError("installer",
+			fmt.Sprintf("%d preflight checks failed:\n  - %s", len(failed), strings.Join(failed, "\n  - ")), nil)
+	}
+
+	utils.Info("Preflight checks passed")
+	return nil
+}
+
+// checkTargetDir checks that nothing but a directory sits at the target
+// directory. A missing one is created when the partitions are mounted.
+func (i *Installer) checkTargetDir() error {
+	info, err := os.Stat(i.targetDir)
+	switch {
+	case os.IsNotExist(err):
+		return nil
+	case err != nil:
+		return fmt.Errorf("cannot access target directory %s: %v", i.targetDir, err)
+	case !info.IsDir():
+		return fmt.Errorf("target directory %s is not a directory", i.targetDir)
+	}
+	return nil
+}
+
+// requiredTools returns the host commands the configured installation runs.
+func (i *Installer) requiredTools() []string {
+	tools := []string{"parted", "partprobe", "wipefs", "blkid", "lsblk", "mount", "umount", "chroot", "tar", "xz"}
+
+	add := func(tool string) {
+		for _, t := range tools {
+			if t == tool {
+				return
+			}
+		}
+		tools = append(tools, tool)
+	}
+
+	for _, p := range i.config.Partitions {
+		switch p.Filesystem {
+		case config.FSExt4:
+			add("mkfs.ext4")
+		case config.FSBtrfs:
+			add("mkfs.btrfs")
+		case config.FSXfs:
+			add("mkfs.xfs")
+		case config.FSF2fs:
+			add("mkfs.f2fs")
+		case config.FSFat32:
+			add("mkfs.vfat")
+		case config.FSSwap:
+			add("mkswap")
+		case config.FSZfs:
+			add("zpool")
+			add("zfs")
+		}
+	}
+
+	if i.config.SwapFile.Enabled() {
+		add("fallocate")
+		add("mkswap")
+		for _, p := range i.config.Partitions {
+			if p.MountPoint == "/" && p.Filesystem == config.FSBtrfs {
+				add("chattr")
+			}
+		}
+	}
+
+	switch i.config.Encryption.Type {
+	case config.EncryptNone, config.EncryptZFS:
+	default:
+		add("cryptsetup")
+	}
+
+	return tools
+}
+
+// checkMirror resolves the mirror's host and sends it a request. It returns
+// the time the mirror reported, zero if it did not answer.
+func (i *Installer) checkMirror(mirror string) (time.Time, error) {
+	u, err := url.Parse(mirror)
+	if err != nil || u.Hostname() == "" {
+		return time.Time{}, fmt.Errorf("invalid mirror %q", mirror)
+	}
+
+	ctx, cancel := context.WithTimeout(i.installContext(), preflightTimeout)
+	defer cancel()
+
+	if _, err := net.DefaultResolver.LookupHost(ctx, u.Hostname()); err != nil {
+		return time.Time{}, fmt.Errorf("cannot resolve %s, check the network and DNS: %v", u.Hostname(), err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, mirror, nil)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid mirror %q", mirror)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("mirror %s is unreachable: %v", mirror, err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 500 {
+		return time.Time{}, fmt.Errorf("mirror %s answered %s", mirror, resp.Status)
+	}
+
+	date, _ := http.ParseTime(resp.Header.Get("Date"))
+	return date, nil
+}
+
+// checkClock compares the clock with NTP, or with fallback when NTP cannot
+// be reached. A clock too far off is synced once with chronyd or ntpd.
+func (i *Installer) checkClock(fallback time.Time) error {
+	skew, err := i.clockSkew(fallback)
+	if err != nil {
+		return err
+	}
+	if skew.Abs() <= maxClockSkew {
+		return nil
+	}
+
+	if i.dryRun {
+		return fmt.Errorf("system clock is off by %s", skew.Round(time.Second))
+	}
+
+	utils.Warn("System clock is off by %s, syncing it", skew.Round(time.Second))
+	syncClock()
+
+	// The fallback time is stale by now
+	skew, err = i.clockSkew(time.Time{})
+	if err == nil && skew.Abs() <= maxClockSkew {
+		return nil
+	}
+	return fmt.Errorf("system clock is off by %s, set it with: chronyd -q 'server %s iburst'", skew.Round(time.Second), ntpServer)
+}
+
+// clockSkew returns how far the local clock is ahead of NTP, or of
+// fallback when NTP does not answer.
+func (i *Installer) clockSkew(fallback time.Time) (time.Duration, error) {
+	skew, err := ntpOffset(i.installContext(), ntpServer)
+	if err == nil {
+		return skew, nil
+	}
+
+	if fallback.IsZero() {
+		return 0, fmt.Errorf("cannot check the system clock, %s did not answer: %v", ntpServer, err)
+	}
+	utils.Debug("NTP query failed (%v), using the mirror's time", err)
+
+	// The Date header is truncated to the second
+	skew = time.Since(fallback)
+	if skew > 0 && skew < time.Second {
+		skew = 0
+	}
+	return skew, nil
+}
+
+// ntpEpochOffset is the number of seconds from 1900, the NTP epoch, to 1970.
+const ntpEpochOffset = 2208988800
+
+// ntpOffset returns how far the local clock is ahead of an NTP server,
+// asking it with a single SNTP request.
+func ntpOffset(ctx context.Context, server string) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, preflightTimeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", net.JoinHostPort(server, "123"))
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	// Version 4, client mode
+	request := make([]byte, 48)
+	request[0] = 4<<3 | 3
+	sent := time.Now()
+	if _, err := conn.Write(request); err != nil {
+		return 0, err
+	}
+
+	response := make([]byte, 48)
+	if _, err := conn.Read(response); err != nil {
+		return 0, err
+	}
+	received := time.Now()
+
+	// Transmit timestamp: seconds and fraction since 1900
+	secs := binary.BigEndian.Uint32(response[40:44])
+	frac := binary.BigEndian.Uint32(response[44:48])
+	if secs == 0 {
+		return 0, fmt.Errorf("invalid NTP response from %s", server)
+	}
+	serverTime := time.Unix(int64(secs)-ntpEpochOffset, int64(frac)*1e9>>32)
+
+	// The answer took about half the round trip to arrive
+	return received.Round(0).Sub(serverTime.Add(received.Sub(sent) / 2)), nil
+}
+
+// syncClock sets the clock from NTP once with whichever daemon is present.
+func syncClock() {
+	switch {
+	case commandExists("chronyd"):
+		utils.RunCommand("chronyd", "-q", fmt.Sprintf("server %s iburst", ntpServer))
+	case commandExists("ntpd"):
+		utils.RunCommand("ntpd", "-gq")
+	default:
+		utils.Warn("Neither chronyd nor ntpd is installed, cannot sync the clock")
+	}
+}
+
+// commandExists reports whether a command is in PATH.
+func commandExists(name string) bool {
+	_, err := exec.LookPath(name)
+	return err == nil
+}
+
+// installContext returns the installation's context.
+func (i *Installer) installContext() context.Context {
+	if i.ctx == nil {
+		return context.Background()
+	}
+	return i.ctx
+}
@@ -4,9 +4,12 @@ package kernel
 import (
 	"fmt"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/japaneseenrichmentorganization/yuno_os/pkg/config"
+	"github.com/japaneseenrichmentorganization/yuno_os/pkg/graphics"
 	"github.com/japaneseenrichmentorganization/yuno_os/pkg/utils"
 )
 
@@ -32,10 +35,18 @@ type KernelInfo struct {
 	Initramfs string
 }
 
-// Install installs the kernel based on configuration.
+// Install installs every configured kernel.
 func (m *Manager) Install(progress func(line string)) error {
-	kernelType := m.config.Kernel.Type
+	for _, kernelType := range m.config.Kernel.AllTypes() {
+		if err := m.installKernel(kernelType, progress); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
+// installKernel installs a single kernel type.
+func (m *Manager) installKernel(kernelType config.KernelType, progress func(line string)) error {
 	utils.Info("Installing kernel: %s", kernelType)
 
 	switch kernelType {
@@ -44,20 +55,60 @@ func (m *Manager) Install(progress func(line string)) error {
 	case config.KernelDist:
 		return m.installDistKernel("sys-kernel/gentoo-kernel", progress)
 	case config.KernelSources:
-		return m.installSources("sys-kernel/gentoo-sources", progress)
+		return m.installSources("sys-kernel/gentoo-sources", kernelType, progress)
 	case config.KernelZen:
-		return m.installSources("sys-kernel/zen-sources", progress)
+		return m.installSources("sys-kernel/zen-sources", kernelType, progress)
 	case config.KernelXanmod:
-		return m.installSources("sys-kernel/xanmod-sources", progress)
+		return m.installSources("sys-kernel/xanmod-sources", kernelType, progress)
 	case config.KernelLiquorix:
-		return m.installSources("sys-kernel/liquorix-sources", progress)
+		return m.installSources("sys-kernel/liquorix-sources", kernelType, progress)
 	case config.KernelVanilla:
-		return m.installSources("sys-kernel/vanilla-sources", progress)
+		return m.installSources("sys-kernel/vanilla-sources", kernelType, progress)
 	default:
 		return m.installDistKernel("sys-kernel/gentoo-kernel-bin", progress)
 	}
 }
 
+// SetupMicrocode installs CPU microcode and configures early loading.
+// It must run before the initramfs is generated.
+func (m *Manager) SetupMicrocode(progress func(line string)) error {
+	if !m.config.Kernel.Microcode {
+		return nil
+	}
+
+	var pkg string
+	switch utils.GetCPUVendor() {
+	case utils.CPUVendorIntel:
+		pkg = "sys-firmware/intel-microcode"
+	case utils.CPUVendorAMD:
+		// AMD microcode ships with linux-firmware
+		pkg = "sys-kernel/linux-firmware"
+	default:
+		utils.Warn("Unknown CPU vendor, skipping microcode setup")
+		return nil
+	}
+
+	utils.Info("Installing CPU microcode: %s", pkg)
+
+	args := []string{m.targetDir, "emerge", "--ask=n", "--noreplace", pkg}
+
+	result := utils.RunCommandStreaming(progress, "chroot", args...)
+	if result.Error != nil {
+		return utils.NewError("kernel", "failed to install microcode", result.Error)
+	}
+
+	// Prepend microcode to the dracut initramfs
+	if m.config.Kernel.Initramfs != "genkernel" {
+		dracutConf := "# Yuno OS microcode early loading\nearly_microcode=\"yes\"\n"
+		confPath := filepath.Join(m.targetDir, "etc/dracut.conf.d/microcode.conf")
+		if err := utils.WriteFile(confPath, dracutConf, 0644); err != nil {
+			return utils.NewError("kernel", "failed to write dracut microcode config", err)
+		}
+	}
+
+	return nil
+}
+
 // installDistKernel installs a distribution kernel (pre-configured).
 func (m *Manager) installDistKernel(pkg string, progress func(line string)) error {
 	utils.Info("Installing distribution kernel: %s", pkg)
@@ -80,53 +131,118 @@ func (m *Manager) installDistKernel(pkg string, progress func(line string)) erro
 
 	args = append(args, packages...)
 
-	if progress != nil {
-		if err := utils.RunCommandWithOutput(progress, "chroot", args...); err != nil {
-			return utils.NewError("kernel", "failed to install kernel", err)
-		}
-	} else {
-		result := utils.RunCommand("chroot", args...)
-		if result.Error != nil {
-			return utils.NewError("kernel", "failed to install kernel", result.Error)
-		}
+	result := utils.RunCommandStreaming(progress, "chroot", args...)
+	if result.Error != nil {
+		return utils.NewError("kernel", "failed to install kernel", result.Error)
 	}
 
 	return nil
 }
 
 // installSources installs kernel sources and builds with genkernel.
-func (m *Manager) installSources(pkg string, progress func(line string)) error {
+func (m *Manager) installSources(pkg string, kernelType config.KernelType, progress func(line string)) error {
 	utils.Info("Installing kernel sources: %s", pkg)
 
 	// Install kernel sources and genkernel
 	args := []string{m.targetDir, "emerge", "--ask=n", pkg, "sys-kernel/genkernel"}
 
-	if progress != nil {
-		if err := utils.RunCommandWithOutput(progress, "chroot", args...); err != nil {
-			return utils.NewError("kernel", "failed to install kernel sources", err)
+	result := utils.RunCommandStreaming(progress, "chroot", args...)
+	if result.Error != nil {
+		return utils.NewError("kernel", "failed to install kernel sources", result.Error)
+	}
+
+	// Build kernel with genkernel, pointing it at this kernel's sources
+	// since /usr/src/linux may belong to another installed kernel
+	return m.buildWithGenkernel(m.sourceDir(kernelType), progress)
+}
+
+// sourceDir returns the newest /usr/src directory for a sources kernel, or
+// "" to let genkernel use /usr/src/linux.
+func (m *Manager) sourceDir(kernelType config.KernelType) string {
+	result := utils.RunCommand("ls", filepath.Join(m.targetDir, "usr/src"))
+	if result.Error != nil {
+		return ""
+	}
+
+	var newest string
+	for _, dir := range strings.Split(result.Stdout, "\n") {
+		dir = strings.TrimSpace(dir)
+		if !strings.HasPrefix(dir, "linux-") || !matchesKernelType(dir, kernelType) {
+			continue
 		}
-	} else {
-		result := utils.RunCommand("chroot", args...)
-		if result.Error != nil {
-			return utils.NewError("kernel", "failed to install kernel sources", result.Error)
+		version := strings.TrimPrefix(dir, "linux-")
+		if newest == "" || CompareVersions(version, strings.TrimPrefix(newest, "linux-")) > 0 {
+			newest = dir
+		}
+	}
+
+	if newest == "" {
+		return ""
+	}
+	return "/usr/src/" + newest
+}
+
+// versionMarker returns the string that identifies a kernel type in its
+// version or source directory name. Vanilla kernels have none.
+func versionMarker(kernelType config.KernelType) string {
+	switch kernelType {
+	case config.KernelBin, config.KernelDist:
+		return "-dist"
+	case config.KernelSources:
+		return "-gentoo"
+	case config.KernelZen:
+		return "-zen"
+	case config.KernelXanmod:
+		return "xanmod"
+	case config.KernelLiquorix:
+		return "lqx"
+	default:
+		return ""
+	}
+}
+
+// matchesKernelType reports whether a kernel version or source directory
+// belongs to the given kernel type.
+func matchesKernelType(name string, kernelType config.KernelType) bool {
+	marker := versionMarker(kernelType)
+	if marker == "" {
+		// Vanilla: none of the other markers
+		for _, other := range []config.KernelType{config.KernelBin, config.KernelSources,
+			config.KernelZen, config.KernelXanmod, config.KernelLiquorix} {
+			if strings.Contains(name, versionMarker(other)) {
+				return false
+			}
 		}
+		return true
 	}
 
-	// Build kernel with genkernel
-	return m.buildWithGenkernel(progress)
+	// Distribution kernels are also "-gentoo"
+	if kernelType == config.KernelSources && strings.Contains(name, "-dist") {
+		return false
+	}
+	return strings.Contains(name, marker)
 }
 
-// buildWithGenkernel builds the kernel using genkernel.
-func (m *Manager) buildWithGenkernel(progress func(line string)) error {
+// buildWithGenkernel builds the kernel using genkernel. kernelDir may be
+// empty to use /usr/src/linux.
+func (m *Manager) buildWithGenkernel(kernelDir string, progress func(line string)) error {
 	utils.Info("Building kernel with genkernel")
 
 	args := []string{m.targetDir, "genkernel", "all"}
 
+	if kernelDir != "" {
+		args = append(args, "--kerneldir="+kernelDir)
+	}
+
 	// Add options based on encryption
 	if m.config.Encryption.Type != config.EncryptNone {
 		args = append(args, "--luks")
 	}
 
+	if m.config.Kernel.Microcode {
+		args = append(args, "--microcode-initramfs")
+	}
+
 	// Add custom config if specified
 	if m.config.Kernel.CustomConfig != "" {
 		args = append(args, "--kernel-config="+m.config.Kernel.CustomConfig)
@@ -137,11 +253,7 @@ func (m *Manager) buildWithGenkernel(progress func(line string)) error {
 		args = append(args, "--kernel-append-localversion=-"+mod)
 	}
 
-	if progress != nil {
-		return utils.RunCommandWithOutput(progress, "chroot", args...)
-	}
-
-	result := utils.RunCommand("chroot", args...)
+	result := utils.RunCommandStreaming(progress, "chroot", args...)
 	if result.Error != nil {
 		return utils.NewError("kernel", "genkernel build failed", result.Error)
 	}
@@ -196,6 +308,10 @@ func (m *Manager) generateGenkernelInitramfs() error {
 		args = append(args, "--luks")
 	}
 
+	if m.config.Kernel.Microcode {
+		args = append(args, "--microcode-initramfs")
+	}
+
 	result := utils.RunInChroot(m.targetDir, args[0], args[1:]...)
 	if result.Error != nil {
 		return utils.NewError("kernel", "genkernel initramfs failed", result.Error)
@@ -204,9 +320,18 @@ func (m *Manager) generateGenkernelInitramfs() error {
 	return nil
 }
 
-// GetInstalledKernel returns information about the installed kernel.
+// GetInstalledKernel returns information about the newest installed kernel.
 func (m *Manager) GetInstalledKernel() (*KernelInfo, error) {
-	// Find kernel in /boot
+	kernels, err := m.GetInstalledKernels()
+	if err != nil {
+		return nil, err
+	}
+
+	return &kernels[0], nil
+}
+
+// GetInstalledKernels returns all kernels found in /boot, newest first.
+func (m *Manager) GetInstalledKernels() ([]KernelInfo, error) {
 	bootDir := filepath.Join(m.targetDir, "boot")
 
 	result := utils.RunCommand("ls", bootDir)
@@ -214,28 +339,151 @@ func (m *Manager) GetInstalledKernel() (*KernelInfo, error) {
 		return nil, utils.NewError("kernel", "failed to list /boot", result.Error)
 	}
 
-	var kernelPath, initramfsPath, version string
-	for _, file := range strings.Split(result.Stdout, "\n") {
+	kernels := parseBootKernels(strings.Split(result.Stdout, "\n"), m.config.Kernel.AllTypes())
+	if len(kernels) == 0 {
+		return nil, utils.NewError("kernel", "no kernel found in /boot", nil)
+	}
+
+	return kernels, nil
+}
+
+// parseBootKernels matches vmlinuz-* files with their initramfs, newest first.
+// Each kernel is attributed to one of types by its version string.
+func parseBootKernels(files []string, types []config.KernelType) []KernelInfo {
+	present := make(map[string]bool)
+	for _, file := range files {
+		present[strings.TrimSpace(file)] = true
+	}
+
+	var kernels []KernelInfo
+	for _, file := range files {
 		file = strings.TrimSpace(file)
-		if strings.HasPrefix(file, "vmlinuz-") {
-			kernelPath = "/boot/" + file
-			version = strings.TrimPrefix(file, "vmlinuz-")
+		if !strings.HasPrefix(file, "vmlinuz-") || strings.HasSuffix(file, ".old") {
+			continue
 		}
-		if strings.HasPrefix(file, "initramfs-") && strings.HasSuffix(file, ".img") {
-			initramfsPath = "/boot/" + file
+
+		version := strings.TrimPrefix(file, "vmlinuz-")
+		info := KernelInfo{
+			Version: version,
+			Type:    kernelTypeForVersion(version, types),
+			Path:    "/boot/" + file,
 		}
+
+		initramfs := fmt.Sprintf("initramfs-%s.img", version)
+		if present[initramfs] {
+			info.Initramfs = "/boot/" + initramfs
+		}
+
+		kernels = append(kernels, info)
 	}
 
-	if kernelPath == "" {
-		return nil, utils.NewError("kernel", "no kernel found in /boot", nil)
+	sort.SliceStable(kernels, func(i, j int) bool {
+		return CompareVersions(kernels[i].Version, kernels[j].Version) > 0
+	})
+
+	return kernels
+}
+
+// kernelTypeForVersion returns the type in types that a kernel version
+// belongs to, defaulting to the first.
+func kernelTypeForVersion(version string, types []config.KernelType) config.KernelType {
+	for _, t := range types {
+		if matchesKernelType(version, t) {
+			return t
+		}
+	}
+	if len(types) > 0 {
+		return types[0]
+	}
+	return ""
+}
+
+// CompareVersions compares two kernel version strings such as 6.6.30-gentoo
+// and 6.6.9-gentoo. Numeric components are compared numerically and release
+// candidates sort before the final release. It returns -1, 0 or 1.
+func CompareVersions(a, b string) int {
+	ta, tb := versionTokens(a), versionTokens(b)
+
+	for i := 0; i < len(ta) && i < len(tb); i++ {
+		if c := compareVersionToken(ta[i], tb[i]); c != 0 {
+			return c
+		}
+	}
+
+	switch {
+	case len(ta) == len(tb):
+		return 0
+	case len(ta) > len(tb):
+		if isPreRelease(ta[len(tb):]) {
+			return -1
+		}
+		return 1
+	default:
+		if isPreRelease(tb[len(ta):]) {
+			return 1
+		}
+		return -1
+	}
+}
+
+// versionTokens splits a version into runs of digits and non-digits,
+// dropping separators.
+func versionTokens(version string) []string {
+	var tokens []string
+	var current strings.Builder
+	lastDigit := false
+
+	flush := func() {
+		if current.Len() > 0 {
+			tokens = append(tokens, current.String())
+			current.Reset()
+		}
+	}
+
+	for _, r := range version {
+		if r == '.' || r == '-' || r == '_' || r == '+' {
+			flush()
+			continue
+		}
+		isDigit := r >= '0' && r <= '9'
+		if current.Len() > 0 && isDigit != lastDigit {
+			flush()
+		}
+		current.WriteRune(r)
+		lastDigit = isDigit
 	}
+	flush()
 
-	return &KernelInfo{
-		Version:   version,
-		Type:      m.config.Kernel.Type,
-		Path:      kernelPath,
-		Initramfs: initramfsPath,
-	}, nil
+	return tokens
+}
+
+// compareVersionToken compares two version tokens.
+func compareVersionToken(a, b string) int {
+	na, errA := strconv.Atoi(a)
+	nb, errB := strconv.Atoi(b)
+
+	switch {
+	case errA == nil && errB == nil:
+		switch {
+		case na < nb:
+			return -1
+		case na > nb:
+			return 1
+		}
+		return 0
+	case errA == nil:
+		// Numbers sort after suffixes (6.6.1 > 6.6-gentoo)
+		return 1
+	case errB == nil:
+		return -1
+	}
+
+	return strings.Compare(a, b)
+}
+
+// isPreRelease reports whether trailing version tokens mark a release candidate.
+func isPreRelease(tokens []string) bool {
+	return len(tokens) > 0 && tokens[0] == "rc"
 }
 
 // SetupModules configures kernel modules.
@@ -258,6 +506,12 @@ func (m *Manager) SetupModules() error {
 		modules = append(modules, "amdgpu")
 	case config.GPUIntel:
 		modules = append(modules, "i915")
+	case config.GPUNone:
+		// No GPU driver takes over the display, keep a console on the
+		// firmware framebuffer
+		if utils.IsUEFI() {
+			modules = append(modules, "simpledrm")
+		}
 	}
 
 	// Encryption modules
@@ -287,17 +541,28 @@ func (m *Manager) SetupModprobeConfig() error {
 	}
 
 	// NVIDIA-specific configuration
-	if m.config.Graphics.Driver == config.GPUNvidia || m.config.Graphics.Driver == config.GPUNvidiaOpen {
-		nvidiaConf := `# NVIDIA driver options
-options nvidia_drm modeset=1
-options nvidia NVreg_PreserveVideoMemoryAllocations=1
-`
+	if nvidiaConf := graphics.NvidiaModprobeConfig(m.config); nvidiaConf != "" {
 		confPath := filepath.Join(modprobeDir, "nvidia.conf")
 		if err := utils.WriteFile(confPath, nvidiaConf, 0644); err != nil {
 			utils.Warn("Failed to write nvidia modprobe config: %v", err)
 		}
 	}
 
+	// Blacklist conflicting GPU drivers, including inside the dracut initramfs
+	if blacklistConf := graphics.BlacklistModprobeConfig(m.config); blacklistConf != "" {
+		confPath := filepath.Join(modprobeDir, "blacklist-gpu.conf")
+		if err := utils.WriteFile(confPath, blacklistConf, 0644); err != nil {
+			return utils.NewError("kernel", "failed to write GPU blacklist", err)
+		}
+
+		dracutConf := fmt.Sprintf("# Yuno OS GPU driver blacklist\ninstall_items+=\" /etc/modprobe.d/blacklist-gpu.conf \"\nomit_drivers+=\" %s \"\n",
+			strings.Join(graphics.BlacklistedModules(m.config), " "))
+		dracutPath := filepath.Join(m.targetDir, "etc/dracut.conf.d/blacklist-gpu.conf")
+		if err := utils.WriteFile(dracutPath, dracutConf, 0644); err != nil {
+			return utils.NewError("kernel", "failed to write dracut blacklist config", err)
+		}
+	}
+
 	return nil
 }
 
@@ -341,6 +606,16 @@ kernel.unprivileged_bpf_disabled = 1
 
 // Setup performs complete kernel setup.
 func (m *Manager) Setup(progress func(line string)) error {
+	// Microcode must be in place before the initramfs is built
+	if err := m.SetupMicrocode(progress); err != nil {
+		return err
+	}
+
+	// So is the modprobe config, which the initramfs includes
+	if err := m.SetupModprobeConfig(); err != nil {
+		return err
+	}
+
 	// Install kernel
 	if err := m.Install(progress); err != nil {
 		return err
@@ -351,11 +626,6 @@ func (m *Manager) Setup(progress func(line string)) error {
 		return err
 	}
 
-	// Setup modprobe config
-	if err := m.SetupModprobeConfig(); err != nil {
-		return err
-	}
-
 	// Configure sysctl
 	if err := m.ConfigureSysctl(); err != nil {
 		return err
@@ -0,0 +1,144 @@
+package kernel
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/japaneseenrichmentorganization/yuno_os/pkg/config"
+)
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"6.6.30-gentoo", "6.6.30-gentoo", 0},
+		{"6.6.30-gentoo", "6.6.9-gentoo", 1},
+		{"6.10.1", "6.9.12", 1},
+		{"6.1.0", "6.1", 1},
+		{"6.9", "6.9-rc7", 1},
+		{"6.9-rc7", "6.9-rc10", -1},
+		{"6.6.30-gentoo-dist", "6.6.31-gentoo-dist", -1},
+		{"6.6.30-gentoo-r1", "6.6.30-gentoo", 1},
+	}
+
+	for _, tt := range tests {
+		if got := CompareVersions(tt.a, tt.b); got != tt.want {
+			t.Errorf("CompareVersions(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+		if got := CompareVersions(tt.b, tt.a); got != -tt.want {
+			t.Errorf("CompareVersions(%q, %q) = %d, want %d", tt.b, tt.a, got, -tt.want)
+		}
+	}
+}
+
+func TestParseBootKernels(t *testing.T) {
+	files := []string{
+		"System.map-6.6.30-gentoo-dist",
+		"config-6.6.30-gentoo-dist",
+		"initramfs-6.6.30-gentoo-dist.img",
+		"vmlinuz-6.6.30-gentoo-dist",
+		"vmlinuz-6.6.9-gentoo-dist",
+		"vmlinuz-6.10.2-gentoo-dist",
+		"vmlinuz-6.10.2-gentoo-dist.old",
+		"initramfs-6.10.2-gentoo-dist.img",
+	}
+
+	got := parseBootKernels(files, []config.KernelType{config.KernelBin})
+	want := []KernelInfo{
+		{Version: "6.10.2-gentoo-dist", Type: config.KernelBin, Path: "/boot/vmlinuz-6.10.2-gentoo-dist", Initramfs: "/boot/initramfs-6.10.2-gentoo-dist.img"},
+		{Version: "6.6.30-gentoo-dist", Type: config.KernelBin, Path: "/boot/vmlinuz-6.6.30-gentoo-dist", Initramfs: "/boot/initramfs-6.6.30-gentoo-dist.img"},
+		{Version: "6.6.9-gentoo-dist", Type: config.KernelBin, Path: "/boot/vmlinuz-6.6.9-gentoo-dist"},
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseBootKernels() =\n%+v\nwant\n%+v", got, want)
+	}
+}
+
+func TestMatchesKernelType(t *testing.T) {
+	tests := []struct {
+		name       string
+		kernelType config.KernelType
+		want       bool
+	}{
+		{"6.6.30-gentoo-dist", config.KernelBin, true},
+		{"6.6.30-gentoo-dist", config.KernelDist, true},
+		{"6.6.30-gentoo-dist", config.KernelSources, false},
+		{"linux-6.6.30-gentoo", config.KernelSources, true},
+		{"linux-6.6.30-gentoo", config.KernelZen, false},
+		{"linux-6.9.3-zen1", config.KernelZen, true},
+		{"linux-6.9.3-xanmod1", config.KernelXanmod, true},
+		{"linux-6.9.3-lqx1", config.KernelLiquorix, true},
+		{"linux-6.9.3", config.KernelVanilla, true},
+		{"linux-6.9.3-zen1", config.KernelVanilla, false},
+		{"6.6.30-gentoo-dist", config.KernelVanilla, false},
+	}
+
+	for _, tt := range tests {
+		if got := matchesKernelType(tt.name, tt.kernelType); got != tt.want {
+			t.Errorf("matchesKernelType(%q, %s) = %v, want %v", tt.name, tt.kernelType, got, tt.want)
+		}
+	}
+}
+
+func TestParseBootKernelsMultipleTypes(t *testing.T) {
+	files := []string{
+		"vmlinuz-6.6.30-gentoo-dist",
+		"vmlinuz-6.9.3-zen1",
+		"vmlinuz-6.9.3",
+	}
+	types := []config.KernelType{config.KernelBin, config.KernelZen, config.KernelVanilla}
+
+	got := make(map[string]config.KernelType)
+	for _, k := range parseBootKernels(files, types) {
+		got[k.Version] = k.Type
+	}
+	want := map[string]config.KernelType{
+		"6.6.30-gentoo-dist": config.KernelBin,
+		"6.9.3-zen1":         config.KernelZen,
+		"6.9.3":              config.KernelVanilla,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("kernel types = %v, want %v", got, want)
+	}
+
+	// Unmatched versions fall back to the primary kernel
+	if got := kernelTypeForVersion("6.9.3-custom", []config.KernelType{config.KernelZen}); got != config.KernelZen {
+		t.Errorf("kernelTypeForVersion() = %q, want %q", got, config.KernelZen)
+	}
+}
+
+func TestSetupModprobeConfigBlacklistsNouveau(t *testing.T) {
+	tests := []struct {
+		driver config.GPUDriver
+		want   bool
+	}{
+		{config.GPUNvidia, true},
+		{config.GPUAmdgpu, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.driver), func(t *testing.T) {
+			cfg := config.NewDefaultConfig()
+			cfg.Graphics.Driver = tt.driver
+			target := t.TempDir()
+
+			if err := NewManager(cfg, target).SetupModprobeConfig(); err != nil {
+				t.Fatalf("SetupModprobeConfig() error = %v", err)
+			}
+
+			modprobe, err := os.ReadFile(filepath.Join(target, "etc/modprobe.d/blacklist-gpu.conf"))
+			if got := err == nil && strings.Contains(string(modprobe), "blacklist nouveau"); got != tt.want {
+				t.Errorf("modprobe.d blacklists nouveau = %v, want %v", got, tt.want)
+			}
+			dracut, err := os.ReadFile(filepath.Join(target, "etc/dracut.conf.d/blacklist-gpu.conf"))
+			if got := err == nil && strings.Contains(string(dracut), `omit_drivers+=" nouveau "`); got != tt.want {
+				t.Errorf("dracut omits nouveau = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -4,6 +4,8 @@ package overlays
 import (
 	"fmt"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
 
 	"github.com/japaneseenrichmentorganization/yuno_os/pkg/config"
@@ -33,6 +35,8 @@ type Overlay struct {
 	AutoSync    bool
 	Priority    int
 	Description string
+	Branch      string // git only
+	Commit      string // git only, checked out after syncing
 }
 
 // PredefinedOverlays contains well-known overlay configurations.
@@ -111,25 +115,33 @@ func (m *Manager) ListInstalled() ([]Overlay, error) {
 		return nil, utils.NewError("overlays", "failed to list installed overlays", result.Error)
 	}
 
+	return parseRepositoryList(result.Stdout), nil
+}
+
+// repositoryLinePattern matches an entry of "eselect repository list", e.g.
+// "  [2]   guru * (https://wiki.gentoo.org/wiki/Project:GURU)". The status
+// marker (* enabled, # enabled but unregistered, @ local) may come before or
+// after the name; the parenthesised part is a sync type or a URL.
+var repositoryLinePattern = regexp.MustCompile(`^\s*\[\s*(\d+)\]\s+(?:[*#@]\s+)?([^\s*#@()]+)(?:\s+[*#@])?(?:\s+\(([^)]*)\))?\s*$`)
+
+// parseRepositoryList parses the output of "eselect repository list".
+func parseRepositoryList(output string) []Overlay {
 	var overlays []Overlay
-	lines := strings.Split(result.Stdout, "\n")
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if line == "" || strings.HasPrefix(line, "No") {
+	for _, line := range strings.Split(output, "\n") {
+		match := repositoryLinePattern.FindStringSubmatch(line)
+		if match == nil {
 			continue
 		}
 
-		// Parse line like "[1] gentoo (rsync)"
-		var name, syncType string
-		if n, _ := fmt.Sscanf(line, "[%*d] %s (%s)", &name, &syncType); n >= 1 {
-			overlays = append(overlays, Overlay{
-				Name:     strings.TrimSpace(name),
-				SyncType: strings.TrimSuffix(strings.TrimSpace(syncType), ")"),
-			})
+		overlay := Overlay{Name: match[2]}
+		if detail := strings.TrimSpace(match[3]); strings.Contains(detail, "://") {
+			overlay.SyncURI = detail
+		} else {
+			overlay.SyncType = detail
 		}
+		overlays = append(overlays, overlay)
 	}
-
-	return overlays, nil
+	return overlays
 }
 
 // EnsureEselectRepository installs eselect-repository if not present.
@@ -181,9 +193,16 @@ func (m *Manager) AddCustom(overlay Overlay) error {
 		return err
 	}
 
-	// For git overlays, use eselect repository add
-	if overlay.SyncType == "git" {
-		result := m.runInChroot("eselect", "repository", "add", overlay.Name, "git", overlay.SyncURI)
+	if overlay.Branch != "" || overlay.Commit != "" {
+		if overlay.SyncType == "git" && overlay.SyncURI != "" {
+			return m.addPinned(overlay)
+		}
+		utils.Warn("Overlay %s: branch and commit pins only apply to git overlays, ignoring them", overlay.Name)
+	}
+
+	// For VCS overlays, use eselect repository add
+	if _, vcs := vcsPackages[overlay.SyncType]; vcs && overlay.SyncURI != "" {
+		result := m.runInChroot("eselect", "repository", "add", overlay.Name, overlay.SyncType, overlay.SyncURI)
 		if result.Error != nil {
 			return utils.NewError("overlays", fmt.Sprintf("failed to add overlay %s", overlay.Name), result.Error)
 		}
@@ -198,6 +217,75 @@ func (m *Manager) AddCustom(overlay Overlay) error {
 	return nil
 }
 
+// addPinned adds a git overlay that tracks a branch or is pinned to a commit.
+// eselect cannot express either, so the repos.conf entry is written directly.
+func (m *Manager) addPinned(overlay Overlay) error {
+	if err := m.WriteReposConf(overlay); err != nil {
+		return utils.NewError("overlays", fmt.Sprintf("failed to configure overlay %s", overlay.Name), err)
+	}
+
+	if overlay.Commit == "" {
+		return nil
+	}
+
+	// Pinned overlays have auto-sync disabled, so sync them by name
+	if err := m.Sync(overlay.Name); err != nil {
+		return err
+	}
+
+	utils.Info("Pinning overlay %s to %s", overlay.Name, overlay.Commit)
+	location := overlayLocation(overlay)
+	result := m.runInChroot("git", "-c", "safe.directory="+location, "-C", location,
+		"checkout", "--quiet", "--detach", overlay.Commit)
+	if result.Error != nil {
+		return utils.NewError("overlays", fmt.Sprintf("failed to check out %s in overlay %s", overlay.Commit, overlay.Name), result.Error)
+	}
+
+	return nil
+}
+
+// CreateLocalOverlay creates an empty repository at /var/db/repos/<name>
+// for the user's own ebuilds. It has no sync type, so emaint sync leaves it
+// alone. Existing files are kept.
+func (m *Manager) CreateLocalOverlay(name string) error {
+	return m.addLocal(Overlay{Name: name})
+}
+
+// addLocal creates a local overlay and its repos.conf entry.
+func (m *Manager) addLocal(overlay Overlay) error {
+	if !config.ValidRepoName(overlay.Name) {
+		return utils.NewError("overlays", fmt.Sprintf("invalid repository name %q", overlay.Name), nil)
+	}
+
+	utils.Info("Creating local overlay %s", overlay.Name)
+
+	location := overlayLocation(overlay)
+	files := map[string]string{
+		"profiles/repo_name":   overlay.Name + "\n",
+		"metadata/layout.conf": "masters = gentoo\nthin-manifests = true\nsign-manifests = false\n",
+	}
+	for file, content := range files {
+		if m.fileExists(filepath.Join(location, file)) {
+			continue
+		}
+		if err := utils.WriteFile(filepath.Join(m.targetDir, location, file), content, 0644); err != nil {
+			return utils.NewError("overlays", fmt.Sprintf("failed to create overlay %s", overlay.Name), err)
+		}
+	}
+
+	content := fmt.Sprintf("[%s]\nlocation = %s\n", overlay.Name, location)
+	if overlay.Priority > 0 {
+		content += fmt.Sprintf("priority = %d\n", overlay.Priority)
+	}
+
+	confPath := filepath.Join(m.targetDir, "etc/portage/repos.conf", overlay.Name+".conf")
+	if err := utils.WriteFile(confPath, content, 0644); err != nil {
+		return utils.NewError("overlays", fmt.Sprintf("failed to configure overlay %s", overlay.Name), err)
+	}
+
+	return nil
+}
+
 // Remove removes an overlay.
 func (m *Manager) Remove(name string) error {
 	utils.Info("Removing overlay %s", name)
@@ -229,7 +317,39 @@ func (m *Manager) Sync(name string) error {
 	return nil
 }
 
-// SetupLTO sets up the LTO overlay with proper configuration.
+// DefaultLTOBlacklist lists packages known to fail or misbehave when built
+// with LTO.
+var DefaultLTOBlacklist = []string{
+	"sys-libs/glibc",
+	"dev-qt/*",
+	"www-client/firefox",
+	"www-client/chromium",
+	"mail-client/thunderbird",
+	"llvm-core/llvm",
+	"llvm-core/clang",
+	"dev-lang/rust",
+	"dev-lang/go",
+	"dev-lang/ghc",
+	"dev-libs/elfutils",
+	"app-emulation/wine-vanilla",
+	"app-emulation/wine-staging",
+}
+
+// ltoBlacklist merges extra into the default blacklist, dropping duplicates.
+func ltoBlacklist(extra []string) []string {
+	var atoms []string
+	seen := make(map[string]bool)
+	for _, atom := range append(append([]string(nil), DefaultLTOBlacklist...), extra...) {
+		if !seen[atom] {
+			seen[atom] = true
+			atoms = append(atoms, atom)
+		}
+	}
+	return atoms
+}
+
+// SetupLTO sets up the LTO overlay with proper configuration. The generated
+// files are rewritten as a whole, so running it again is harmless.
 func (m *Manager) SetupLTO() error {
 	utils.Info("Setting up LTO overlay")
 
@@ -249,19 +369,22 @@ func (m *Manager) SetupLTO() error {
 		return err
 	}
 
+	blacklist := ltoBlacklist(m.config.Portage.LTOBlacklist)
+
 	// Add LTO use flags
-	ltoUse := `# LTO overlay configuration
-*/* lto
-sys-devel/gcc graphite lto pgo
-sys-libs/glibc -lto
-dev-qt/* -lto
-`
+	var ltoUse strings.Builder
+	ltoUse.WriteString("# LTO overlay configuration\n*/* lto\nsys-devel/gcc graphite lto pgo\n")
+	ltoUse.WriteString("# Packages that don't work with LTO\n")
+	for _, atom := range blacklist {
+		ltoUse.WriteString(atom + " -lto\n")
+	}
+
 	usePath := filepath.Join(configDir, "lto")
-	if err := utils.WriteFile(usePath, ltoUse, 0644); err != nil {
+	if err := utils.WriteFile(usePath, ltoUse.String(), 0644); err != nil {
 		return utils.NewError("overlays", "failed to write LTO use flags", err)
 	}
 
-	// Create env file for LTO
+	// Create env files for LTO
 	envDir := filepath.Join(m.targetDir, "etc/portage/env")
 	if err := utils.CreateDir(envDir, 0755); err != nil {
 		return err
@@ -277,20 +400,35 @@ LDFLAGS="${LDFLAGS} -flto=auto -fuse-linker-plugin"
 		return utils.NewError("overlays", "failed to write LTO env", err)
 	}
 
+	// The last of -flto and -fno-lto wins, so this undoes lto.conf
+	noLTOEnv := `# Disable LTO for packages that break with it
+CFLAGS="${CFLAGS} -fno-lto"
+CXXFLAGS="${CXXFLAGS} -fno-lto"
+FCFLAGS="${FCFLAGS} -fno-lto"
+FFLAGS="${FFLAGS} -fno-lto"
+LDFLAGS="${LDFLAGS} -fno-lto"
+`
+	noLTOPath := filepath.Join(envDir, "nolto.conf")
+	if err := utils.WriteFile(noLTOPath, noLTOEnv, 0644); err != nil {
+		return utils.NewError("overlays", "failed to write no-LTO env", err)
+	}
+
 	// Create package.env to apply LTO
 	pkgEnvDir := filepath.Join(m.targetDir, "etc/portage/package.env")
 	if err := utils.CreateDir(pkgEnvDir, 0755); err != nil {
 		return err
 	}
 
-	pkgEnv := `# Apply LTO to all packages
-*/* lto.conf
-# Packages that don't work with LTO
-sys-libs/glibc -lto.conf
-dev-qt/* -lto.conf
-`
+	// package.env has no negation; later entries are applied after earlier ones
+	var pkgEnv strings.Builder
+	pkgEnv.WriteString("# Apply LTO to all packages\n*/* lto.conf\n")
+	pkgEnv.WriteString("# Packages that don't work with LTO\n")
+	for _, atom := range blacklist {
+		pkgEnv.WriteString(atom + " nolto.conf\n")
+	}
+
 	pkgEnvPath := filepath.Join(pkgEnvDir, "lto")
-	if err := utils.WriteFile(pkgEnvPath, pkgEnv, 0644); err != nil {
+	if err := utils.WriteFile(pkgEnvPath, pkgEnv.String(), 0644); err != nil {
 		return utils.NewError("overlays", "failed to write package.env", err)
 	}
 
@@ -298,14 +436,76 @@ dev-qt/* -lto.conf
 	return nil
 }
 
+// vcsPackages maps overlay sync types to the package providing their tooling.
+var vcsPackages = map[string]string{
+	"git":       "dev-vcs/git",
+	"mercurial": "dev-vcs/mercurial",
+	"svn":       "dev-vcs/subversion",
+	"cvs":       "dev-vcs/cvs",
+}
+
+// requiredVCSForOverlays returns the VCS packages needed to sync the
+// configured overlays, in a stable order.
+func requiredVCSForOverlays(cfg *config.InstallConfig) []string {
+	var packages []string
+	seen := make(map[string]bool)
+
+	for _, overlayConfig := range cfg.Overlays {
+		syncType := overlayConfig.SyncType
+		if predefined, ok := PredefinedOverlays[overlayConfig.Name]; ok {
+			syncType = predefined.SyncType
+		}
+
+		if pkg, ok := vcsPackages[syncType]; ok && !seen[pkg] {
+			seen[pkg] = true
+			packages = append(packages, pkg)
+		}
+	}
+
+	sort.Strings(packages)
+	return packages
+}
+
+// EnsureVCS installs the VCS tools needed by the configured overlays.
+func (m *Manager) EnsureVCS() error {
+	packages := requiredVCSForOverlays(m.config)
+	if len(packages) == 0 {
+		return nil
+	}
+
+	utils.Info("Installing overlay sync tools: %s", strings.Join(packages, " "))
+
+	args := append([]string{"--ask=n", "--noreplace"}, packages...)
+	result := m.runInChroot("emerge", args...)
+	if result.Error != nil {
+		return utils.NewError("overlays", "failed to install overlay sync tools", result.Error)
+	}
+
+	return nil
+}
+
 // SetupFromConfig sets up overlays based on configuration.
 func (m *Manager) SetupFromConfig() error {
+	if err := m.EnsureVCS(); err != nil {
+		return err
+	}
+
+	var names []string
 	for _, overlayConfig := range m.config.Overlays {
 		var overlay Overlay
 
 		// Check if it's a predefined overlay
-		if predefined, ok := PredefinedOverlays[overlayConfig.Name]; ok {
+		predefined, isPredefined := PredefinedOverlays[overlayConfig.Name]
+		isLTO := overlayConfig.Name == "lto" || overlayConfig.Name == "lto-overlay"
+		if isPredefined {
 			overlay = predefined
+		} else if overlayConfig.IsLocal() && !isLTO {
+			// Local overlays start empty, so there is nothing to verify
+			err := m.addLocal(Overlay{Name: overlayConfig.Name, Priority: overlayConfig.Priority})
+			if err != nil {
+				return err
+			}
+			continue
 		} else {
 			overlay = Overlay{
 				Name:     overlayConfig.Name,
@@ -315,8 +515,13 @@ func (m *Manager) SetupFromConfig() error {
 				Priority: overlayConfig.Priority,
 			}
 		}
+		overlay.Branch = overlayConfig.Branch
+		overlay.Commit = overlayConfig.Commit
 
-		if overlayConfig.Name == "lto" || overlayConfig.Name == "lto-overlay" {
+		if isLTO {
+			if overlay.Branch != "" || overlay.Commit != "" {
+				utils.Warn("Overlay %s: branch and commit pins are not supported, ignoring them", overlay.Name)
+			}
 			if err := m.SetupLTO(); err != nil {
 				return err
 			}
@@ -325,10 +530,54 @@ func (m *Manager) SetupFromConfig() error {
 				return err
 			}
 		}
+		names = append(names, overlay.Name)
 	}
 
 	// Sync all overlays
-	return m.Sync("")
+	if err := m.Sync(""); err != nil {
+		return err
+	}
+
+	// eselect and emaint can succeed without producing a usable repository
+	for _, name := range names {
+		if err := m.VerifyOverlay(name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// VerifyOverlay checks that an added overlay was synced into a usable
+// repository containing ebuilds.
+func (m *Manager) VerifyOverlay(name string) error {
+	location := overlayLocation(Overlay{Name: name})
+
+	if utils.IsDryRun() {
+		utils.RecordAction("verify", "overlay %s at %s", name, location)
+		return nil
+	}
+
+	if !m.fileExists(location) {
+		return utils.NewError("overlays", fmt.Sprintf("overlay %s was not created at %s", name, location), nil)
+	}
+
+	var missing []string
+	for _, file := range []string{"metadata/layout.conf", "profiles/repo_name"} {
+		if !m.fileExists(filepath.Join(location, file)) {
+			missing = append(missing, file)
+		}
+	}
+	if ebuilds, _ := filepath.Glob(filepath.Join(m.targetDir, location, "*/*/*.ebuild")); len(ebuilds) == 0 {
+		missing = append(missing, "ebuilds")
+	}
+
+	if len(missing) > 0 {
+		return utils.NewError("overlays", fmt.Sprintf("overlay %s at %s is incomplete, missing: %s",
+			name, location, strings.Join(missing, ", ")), nil)
+	}
+
+	return nil
 }
 
 // WriteReposConf generates the repos.conf file for an overlay.
@@ -338,13 +587,11 @@ func (m *Manager) WriteReposConf(overlay Overlay) error {
 		return err
 	}
 
-	location := overlay.Location
-	if location == "" {
-		location = filepath.Join("/var/db/repos", overlay.Name)
-	}
+	location := overlayLocation(overlay)
 
+	// A pinned commit must not move on the next sync
 	autoSync := "yes"
-	if !overlay.AutoSync {
+	if !overlay.AutoSync || overlay.Commit != "" {
 		autoSync = "no"
 	}
 
@@ -358,6 +605,13 @@ auto-sync = %s
 	if overlay.Priority > 0 {
 		content += fmt.Sprintf("priority = %d\n", overlay.Priority)
 	}
+	if overlay.Branch != "" {
+		content += fmt.Sprintf("sync-git-clone-extra-opts = --branch %s\n", overlay.Branch)
+	}
+	if overlay.Commit != "" {
+		// Shallow clones may not contain the pinned commit
+		content += "clone-depth = 0\n"
+	}
 
 	confPath := filepath.Join(reposDir, overlay.Name+".conf")
 	return utils.WriteFile(confPath, content, 0644)
@@ -365,6 +619,14 @@ auto-sync = %s
 
 // Helper functions
 
+// overlayLocation returns where the overlay repository is checked out.
+func overlayLocation(overlay Overlay) string {
+	if overlay.Location != "" {
+		return overlay.Location
+	}
+	return filepath.Join("/var/db/repos", overlay.Name)
+}
+
 func (m *Manager) runInChroot(name string, args ...string) *utils.CommandResult {
 	return utils.RunInChroot(m.targetDir, name, args...)
 }
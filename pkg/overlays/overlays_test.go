@@ -0,0 +1,74 @@
+package overlays
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/japaneseenrichmentorganization/yuno_os/pkg/config"
+)
+
+func TestRequiredVCSForOverlays(t *testing.T) {
+	tests := []struct {
+		name     string
+		overlays []config.OverlayConfig
+		want     []string
+	}{
+		{"none", nil, nil},
+		{"rsync only", []config.OverlayConfig{{Name: "custom", SyncType: "rsync"}}, nil},
+		{"git", []config.OverlayConfig{{Name: "custom", SyncType: "git"}}, []string{"dev-vcs/git"}},
+		{
+			"deduplicated and sorted",
+			[]config.OverlayConfig{
+				{Name: "a", SyncType: "svn"},
+				{Name: "b", SyncType: "git"},
+				{Name: "c", SyncType: "mercurial"},
+				{Name: "d", SyncType: "git"},
+			},
+			[]string{"dev-vcs/git", "dev-vcs/mercurial", "dev-vcs/subversion"},
+		},
+		{"predefined sync type wins", []config.OverlayConfig{{Name: "guru", SyncType: "git"}}, nil},
+		{"predefined git overlay", []config.OverlayConfig{{Name: "gentoo-zh"}}, []string{"dev-vcs/git"}},
+		{"local", []config.OverlayConfig{{Name: "mine", SyncType: "local"}}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.NewDefaultConfig()
+			cfg.Overlays = tt.overlays
+			if got := requiredVCSForOverlays(cfg); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("requiredVCSForOverlays() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRepositoryList(t *testing.T) {
+	output := `Available repositories:
+  [1]   gentoo # (https://gentoo.org/)
+  [2]   guru * (https://wiki.gentoo.org/wiki/Project:GURU)
+  [3]   steam-overlay (https://github.com/anyc/steam-overlay)
+  [4]   @ localrepo
+  [5]   * lto-overlay (git)
+  [10]  local-only
+`
+	want := []Overlay{
+		{Name: "gentoo", SyncURI: "https://gentoo.org/"},
+		{Name: "guru", SyncURI: "https://wiki.gentoo.org/wiki/Project:GURU"},
+		{Name: "steam-overlay", SyncURI: "https://github.com/anyc/steam-overlay"},
+		{Name: "localrepo"},
+		{Name: "lto-overlay", SyncType: "git"},
+		{Name: "local-only"},
+	}
+
+	if got := parseRepositoryList(output); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseRepositoryList() =\n%+v\nwant\n%+v", got, want)
+	}
+}
+
+func TestParseRepositoryListEmpty(t *testing.T) {
+	for _, output := range []string{"", "No repositories found\n", "Available repositories:\n"} {
+		if got := parseRepositoryList(output); len(got) != 0 {
+			t.Errorf("parseRepositoryList(%q) = %+v, want none", output, got)
+		}
+	}
+}
@@ -7,11 +7,15 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/japaneseenrichmentorganization/yuno_os/pkg/config"
 	"github.com/japaneseenrichmentorganization/yuno_os/pkg/utils"
 )
 
+// DeviceTimeout is how long to wait for a new partition's device node.
+const DeviceTimeout = 30 * time.Second
+
 // Manager handles partition operations.
 type Manager struct {
 	config *config.InstallConfig
@@ -232,7 +236,9 @@ func (m *Manager) CreatePartition(device string, partNum int, start, end, fstype
 }
 
 // FormatPartition formats a partition with the specified filesystem.
-func (m *Manager) FormatPartition(device string, fs config.Filesystem, label string) error {
+// options are passed to mkfs after the default flags, so they can
+// override them.
+func (m *Manager) FormatPartition(device string, fs config.Filesystem, label string, options []string) error {
 	utils.Info("Formatting %s as %s", device, fs)
 
 	var result *utils.CommandResult
@@ -243,7 +249,7 @@ func (m *Manager) FormatPartition(device string, fs config.Filesystem, label str
 		if label != "" {
 			args = append(args, "-L", label)
 		}
-		args = append(args, device)
+		args = append(append(args, options...), device)
 		result = utils.RunCommand("mkfs.ext4", args...)
 
 	case config.FSBtrfs:
@@ -251,7 +257,7 @@ func (m *Manager) FormatPartition(device string, fs config.Filesystem, label str
 		if label != "" {
 			args = append(args, "-L", label)
 		}
-		args = append(args, device)
+		args = append(append(args, options...), device)
 		result = utils.RunCommand("mkfs.btrfs", args...)
 
 	case config.FSXfs:
@@ -259,7 +265,7 @@ func (m *Manager) FormatPartition(device string, fs config.Filesystem, label str
 		if label != "" {
 			args = append(args, "-L", label)
 		}
-		args = append(args, device)
+		args = append(append(args, options...), device)
 		result = utils.RunCommand("mkfs.xfs", args...)
 
 	case config.FSF2fs:
@@ -267,7 +273,7 @@ func (m *Manager) FormatPartition(device string, fs config.Filesystem, label str
 		if label != "" {
 			args = append(args, "-l", label)
 		}
-		args = append(args, device)
+		args = append(append(args, options...), device)
 		result = utils.RunCommand("mkfs.f2fs", args...)
 
 	case config.FSFat32:
@@ -275,7 +281,7 @@ func (m *Manager) FormatPartition(device string, fs config.Filesystem, label str
 		if label != "" {
 			args = append(args, "-n", strings.ToUpper(label))
 		}
-		args = append(args, device)
+		args = append(append(args, options...), device)
 		result = utils.RunCommand("mkfs.vfat", args...)
 
 	case config.FSSwap:
@@ -283,15 +289,14 @@ func (m *Manager) FormatPartition(device string, fs config.Filesystem, label str
 		if label != "" {
 			args = append(args, "-L", label)
 		}
-		args = append(args, device)
+		args = append(append(args, options...), device)
 		result = utils.RunCommand("mkswap", args...)
 
-	case config.FSZfs:
-		// ZFS is handled separately
-		return nil
-
-	case config.FSNone:
-		// No formatting needed
+	case config.FSZfs, config.FSNone:
+		// ZFS is handled separately, and none needs no formatting
+		if len(options) > 0 {
+			return utils.NewError("partition", fmt.Sprintf("mkfs options are not supported for %s", fs), nil)
+		}
 		return nil
 
 	default:
@@ -313,15 +318,17 @@ type PartitionLayout struct {
 
 // LayoutPartition represents a partition in the layout.
 type LayoutPartition struct {
-	Number     int
-	Start      string
-	End        string
-	Size       string
-	Filesystem config.Filesystem
-	MountPoint string
-	Label      string
-	Flags      []string
-	Encrypt    bool
+	Number      int
+	Start       string
+	End         string
+	Size        string
+	Filesystem  config.Filesystem
+	MountPoint  string
+	Label       string
+	Flags       []string
+	Encrypt     bool
+	MkfsOptions []string // Extra options passed to mkfs
+	MappedPath  string   // /dev/mapper/<name> once an encrypted partition is opened
 }
 
 // CreateAutoLayout creates an automatic partition layout for the disk.
@@ -331,6 +338,12 @@ func (m *Manager) CreateAutoLayout(device string, isUEFI bool, useEncryption boo
 		return nil, err
 	}
 
+	if minSize := m.MinDiskSize(); disk.Size < minSize {
+		return nil, utils.NewError("partition", fmt.Sprintf("disk %s is too small: %s, need at least %s",
+			device, humanSize(disk.Size), humanSize(minSize)), nil)
+	}
+	diskMiB := int(disk.Size / 1024 / 1024)
+
 	layout := &PartitionLayout{
 		Scheme: config.PartSchemeGPT,
 	}
@@ -385,43 +398,239 @@ func (m *Manager) CreateAutoLayout(device string, isUEFI bool, useEncryption boo
 		currentPos = "515MiB"
 	}
 
-	// Swap partition (size based on RAM, max 8GB)
-	memMB := utils.GetMemoryMB()
-	swapMB := memMB
-	if swapMB > 8192 {
-		swapMB = 8192
-	}
-	if swapMB < 1024 {
-		swapMB = 1024
-	}
+	// Swap partition (size based on RAM, max 8GB), unless swap goes to a
+	// file on the root filesystem
+	if !m.config.SwapFile.Enabled() {
+		memMB := utils.GetMemoryMB()
+		swapMB := memMB
+		if swapMB > 8192 {
+			swapMB = 8192
+		}
+		if swapMB < 1024 {
+			swapMB = 1024
+		}
+		// Don't let swap eat a small disk
+		if swapMB > diskMiB/4 {
+			swapMB = diskMiB / 4
+		}
 
-	swapEnd := fmt.Sprintf("%dMiB", parseStartMiB(currentPos)+swapMB)
-	layout.Partitions = append(layout.Partitions, LayoutPartition{
-		Number:     partNum,
-		Start:      currentPos,
-		End:        swapEnd,
-		Size:       fmt.Sprintf("%dMiB", swapMB),
-		Filesystem: config.FSSwap,
-		Label:      "swap",
-	})
-	partNum++
-	currentPos = swapEnd
+		swapEnd := fmt.Sprintf("%dMiB", parseStartMiB(currentPos)+swapMB)
+		layout.Partitions = append(layout.Partitions, LayoutPartition{
+			Number:     partNum,
+			Start:      currentPos,
+			End:        swapEnd,
+			Size:       fmt.Sprintf("%dMiB", swapMB),
+			Filesystem: config.FSSwap,
+			Label:      "swap",
+		})
+		partNum++
+		currentPos = swapEnd
+	}
 
 	// Root partition (rest of disk)
 	layout.Partitions = append(layout.Partitions, LayoutPartition{
 		Number:     partNum,
 		Start:      currentPos,
 		End:        "100%",
-		Size:       fmt.Sprintf("%dMiB", disk.Size/1024/1024-parseStartMiB(currentPos)),
+		Size:       fmt.Sprintf("%dMiB", diskMiB-parseStartMiB(currentPos)),
 		Filesystem: config.FSExt4,
 		MountPoint: "/",
 		Label:      "root",
 		Encrypt:    useEncryption,
 	})
 
+	if err := validateLayout(layout, diskMiB); err != nil {
+		return nil, err
+	}
+	if err := m.checkSwapFile(layout); err != nil {
+		return nil, err
+	}
+
+	return layout, nil
+}
+
+// CreateLayoutFromConfig creates a layout from the configured partitions,
+// placed on the disk in order.
+func (m *Manager) CreateLayoutFromConfig(device string, parts []config.PartitionConfig) (*PartitionLayout, error) {
+	if err := config.ValidatePartitionFlags(parts, m.config.Disk.PartScheme, utils.IsUEFI()); err != nil {
+		return nil, utils.NewError("partition", "invalid partition flags", err)
+	}
+
+	disk, err := m.GetDisk(device)
+	if err != nil {
+		return nil, err
+	}
+
+	layout, err := LayoutFromConfig(parts, m.config.Disk.PartScheme, int(disk.Size/1024/1024))
+	if err != nil {
+		return nil, err
+	}
+
+	// Encryption is only set up when an encryption type is selected
+	for n := range layout.Partitions {
+		layout.Partitions[n].Encrypt = layout.Partitions[n].Encrypt && m.config.Encryption.Type != config.EncryptNone
+	}
+
+	if err := m.checkSwapFile(layout); err != nil {
+		return nil, err
+	}
+
 	return layout, nil
 }
 
+// LayoutFromConfig lays out parts one after another on a disk of diskMiB.
+// Only the last partition may take the remaining space.
+func LayoutFromConfig(parts []config.PartitionConfig, scheme config.PartitionScheme, diskMiB int) (*PartitionLayout, error) {
+	if len(parts) == 0 {
+		return nil, utils.NewError("partition", "no partitions configured", nil)
+	}
+	if scheme == "" {
+		scheme = config.PartSchemeGPT
+	}
+
+	layout := &PartitionLayout{Scheme: scheme}
+	mountPoints := make(map[string]bool)
+	pos := 1 // Start after 1MiB for alignment
+
+	for n, p := range parts {
+		name := p.Label
+		if name == "" {
+			name = fmt.Sprintf("#%d", n+1)
+		}
+
+		if p.MountPoint != "" {
+			if mountPoints[p.MountPoint] {
+				return nil, utils.NewError("partition", fmt.Sprintf("mount point %s is used by more than one partition", p.MountPoint), nil)
+			}
+			mountPoints[p.MountPoint] = true
+		}
+		if p.Filesystem == config.FSSwap && p.MountPoint != "" {
+			return nil, utils.NewError("partition", fmt.Sprintf("swap partition %s cannot have a mount point", name), nil)
+		}
+
+		sizeMiB, rest, err := ParseSizeMiB(p.Size)
+		if err != nil {
+			return nil, utils.NewError("partition", fmt.Sprintf("partition %s", name), err)
+		}
+		if rest && n != len(parts)-1 {
+			return nil, utils.NewError("partition", fmt.Sprintf("partition %s uses the remaining space but is not the last partition", name), nil)
+		}
+
+		part := LayoutPartition{
+			Number:      n + 1,
+			Start:       fmt.Sprintf("%dMiB", pos),
+			Filesystem:  p.Filesystem,
+			MountPoint:  p.MountPoint,
+			Label:       p.Label,
+			Flags:       p.Flags,
+			Encrypt:     p.Encrypt,
+			MkfsOptions: p.MkfsOptions,
+		}
+		if rest {
+			part.End = "100%"
+			part.Size = fmt.Sprintf("%dMiB", diskMiB-pos)
+		} else {
+			part.End = fmt.Sprintf("%dMiB", pos+sizeMiB)
+			part.Size = fmt.Sprintf("%dMiB", sizeMiB)
+			pos += sizeMiB
+		}
+		layout.Partitions = append(layout.Partitions, part)
+	}
+
+	if err := validateLayout(layout, diskMiB); err != nil {
+		return nil, err
+	}
+
+	return layout, nil
+}
+
+// sizeUnits maps size suffixes to MiB multipliers.
+var sizeUnits = map[string]float64{
+	"K": 1.0 / 1024, "KB": 1.0 / 1024, "KIB": 1.0 / 1024,
+	"M": 1, "MB": 1, "MIB": 1,
+	"G": 1024, "GB": 1024, "GIB": 1024,
+	"T": 1024 * 1024, "TB": 1024 * 1024, "TIB": 1024 * 1024,
+}
+
+// ParseSizeMiB parses a partition size such as "512M", "1.5G" or "2048MiB".
+// "100%FREE", "100%" and "rest" take the remaining space and set rest.
+func ParseSizeMiB(size string) (mib int, rest bool, err error) {
+	s := strings.ToUpper(strings.TrimSpace(size))
+	switch s {
+	case "100%FREE", "100%", "REST":
+		return 0, true, nil
+	case "":
+		return 0, false, fmt.Errorf("size is required")
+	}
+
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	number, unit := s, "M"
+	if i >= 0 {
+		number, unit = s[:i], strings.TrimSpace(s[i:])
+	}
+
+	multiplier, ok := sizeUnits[unit]
+	if !ok {
+		return 0, false, fmt.Errorf("invalid size %q: unknown unit %q", size, unit)
+	}
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("invalid size %q", size)
+	}
+
+	mib = int(value * multiplier)
+	if mib < 1 {
+		return 0, false, fmt.Errorf("size %q is smaller than 1MiB", size)
+	}
+	return mib, false, nil
+}
+
+// Minimum disk sizes for the automatic layout.
+const (
+	MinDiskSizeDesktop int64 = 10 * 1024 * 1024 * 1024
+	MinDiskSizeMinimal int64 = 4 * 1024 * 1024 * 1024
+)
+
+// minRootMiB is the smallest root partition the automatic layout accepts.
+const minRootMiB = 2048
+
+// MinDiskSize returns the minimum disk size in bytes for the configured install.
+func (m *Manager) MinDiskSize() int64 {
+	if m.config.Desktop.Type == config.DesktopNone {
+		return MinDiskSizeMinimal
+	}
+	return MinDiskSizeDesktop
+}
+
+// validateLayout checks that every partition fits on a disk of diskMiB and
+// that the root partition is usable.
+func validateLayout(layout *PartitionLayout, diskMiB int) error {
+	for _, part := range layout.Partitions {
+		start := parseStartMiB(part.Start)
+		end := diskMiB
+		if part.End != "100%" {
+			end = parseStartMiB(part.End)
+		}
+
+		if end > diskMiB {
+			return utils.NewError("partition", fmt.Sprintf("partition %s ends at %dMiB, beyond the disk size of %dMiB",
+				part.Label, end, diskMiB), nil)
+		}
+		if end <= start {
+			return utils.NewError("partition", fmt.Sprintf("partition %s has no space left (%s - %s)",
+				part.Label, part.Start, part.End), nil)
+		}
+		if part.MountPoint == "/" && end-start < minRootMiB {
+			return utils.NewError("partition", fmt.Sprintf("root partition would only be %dMiB, need at least %dMiB",
+				end-start, minRootMiB), nil)
+		}
+	}
+
+	return nil
+}
+
 // ApplyLayout applies a partition layout to a disk.
 func (m *Manager) ApplyLayout(device string, layout *PartitionLayout) error {
 	utils.Info("Applying partition layout to %s", device)
@@ -463,7 +672,10 @@ func (m *Manager) ApplyLayout(device string, layout *PartitionLayout) error {
 			continue
 		}
 
-		if err := m.FormatPartition(partDevice, part.Filesystem, part.Label); err != nil {
+		if err := utils.WaitForDevice(partDevice, DeviceTimeout); err != nil {
+			return err
+		}
+		if err := m.FormatPartition(partDevice, part.Filesystem, part.Label, part.MkfsOptions); err != nil {
 			return err
 		}
 	}
@@ -489,6 +701,9 @@ func (m *Manager) MountPartitions(device string, layout *PartitionLayout, target
 		}
 
 		partDevice := getPartitionDevice(device, part.Number)
+		if part.MappedPath != "" {
+			partDevice = part.MappedPath
+		}
 		mounts = append(mounts, mountInfo{
 			device:     partDevice,
 			mountPoint: part.MountPoint,
@@ -507,6 +722,10 @@ func (m *Manager) MountPartitions(device string, layout *PartitionLayout, target
 
 	// Mount each partition
 	for _, mount := range mounts {
+		if err := utils.WaitForDevice(mount.device, DeviceTimeout); err != nil {
+			return err
+		}
+
 		target := targetRoot + mount.mountPoint
 		if err := utils.CreateDir(target, 0755); err != nil {
 			return utils.NewError("partition", fmt.Sprintf("failed to create mount point %s", target), err)
@@ -530,6 +749,10 @@ func (m *Manager) MountPartitions(device string, layout *PartitionLayout, target
 		}
 	}
 
+	if m.config.SwapFile.Enabled() {
+		return m.CreateSwapFile(targetRoot, rootFilesystem(layout))
+	}
+
 	return nil
 }
 
@@ -0,0 +1,193 @@
+package partition
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/japaneseenrichmentorganization/yuno_os/pkg/config"
+)
+
+func TestValidateLayout(t *testing.T) {
+	tests := []struct {
+		name    string
+		parts   []LayoutPartition
+		diskMiB int
+		wantErr bool
+	}{
+		{
+			"fits",
+			[]LayoutPartition{
+				{Label: "ESP", Start: "1MiB", End: "1025MiB", MountPoint: "/boot"},
+				{Label: "root", Start: "1025MiB", End: "100%", MountPoint: "/"},
+			},
+			10240, false,
+		},
+		{
+			"beyond the disk",
+			[]LayoutPartition{{Label: "swap", Start: "1MiB", End: "20481MiB"}},
+			10240, true,
+		},
+		{
+			"no space left",
+			[]LayoutPartition{
+				{Label: "ESP", Start: "1MiB", End: "4097MiB", MountPoint: "/boot"},
+				{Label: "root", Start: "4097MiB", End: "100%", MountPoint: "/"},
+			},
+			4096, true,
+		},
+		{
+			"root too small",
+			[]LayoutPartition{
+				{Label: "ESP", Start: "1MiB", End: "1025MiB", MountPoint: "/boot"},
+				{Label: "root", Start: "1025MiB", End: "100%", MountPoint: "/"},
+			},
+			2048, true,
+		},
+		{
+			"root exactly the minimum",
+			[]LayoutPartition{{Label: "root", Start: "0MiB", End: "100%", MountPoint: "/"}},
+			minRootMiB, false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateLayout(&PartitionLayout{Partitions: tt.parts}, tt.diskMiB)
+			if gotErr := err != nil; gotErr != tt.wantErr {
+				t.Errorf("validateLayout() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMinDiskSize(t *testing.T) {
+	tests := []struct {
+		desktop config.DesktopType
+		want    int64
+	}{
+		{config.DesktopNone, MinDiskSizeMinimal},
+		{config.DesktopKDE, MinDiskSizeDesktop},
+		{config.WMSway, MinDiskSizeDesktop},
+	}
+
+	for _, tt := range tests {
+		cfg := config.NewDefaultConfig()
+		cfg.Desktop.Type = tt.desktop
+		if got := NewManager(cfg).MinDiskSize(); got != tt.want {
+			t.Errorf("MinDiskSize() with %q = %d, want %d", tt.desktop, got, tt.want)
+		}
+	}
+}
+
+func TestHumanSize(t *testing.T) {
+	tests := []struct {
+		bytes int64
+		want  string
+	}{
+		{512, "512 B"},
+		{1536, "1.5 KB"},
+		{MinDiskSizeMinimal, "4.0 GB"},
+		{500107862016, "465.8 GB"},
+	}
+
+	for _, tt := range tests {
+		if got := humanSize(tt.bytes); got != tt.want {
+			t.Errorf("humanSize(%d) = %q, want %q", tt.bytes, got, tt.want)
+		}
+	}
+}
+
+func TestParseSizeMiB(t *testing.T) {
+	tests := []struct {
+		size     string
+		wantMiB  int
+		wantRest bool
+		wantErr  bool
+	}{
+		{"512M", 512, false, false},
+		{"512", 512, false, false},
+		{"2048MiB", 2048, false, false},
+		{"1G", 1024, false, false},
+		{"1.5G", 1536, false, false},
+		{"1 GiB", 1024, false, false},
+		{"1t", 1024 * 1024, false, false},
+		{"100%FREE", 0, true, false},
+		{"100%", 0, true, false},
+		{"rest", 0, true, false},
+		{"", 0, false, true},
+		{"512K", 0, false, true},
+		{"10X", 0, false, true},
+		{"G", 0, false, true},
+		{"50%", 0, false, true},
+	}
+
+	for _, tt := range tests {
+		mib, rest, err := ParseSizeMiB(tt.size)
+		if gotErr := err != nil; gotErr != tt.wantErr {
+			t.Errorf("ParseSizeMiB(%q) error = %v, wantErr %v", tt.size, err, tt.wantErr)
+			continue
+		}
+		if mib != tt.wantMiB || rest != tt.wantRest {
+			t.Errorf("ParseSizeMiB(%q) = %d, %v, want %d, %v", tt.size, mib, rest, tt.wantMiB, tt.wantRest)
+		}
+	}
+}
+
+func TestLayoutFromConfig(t *testing.T) {
+	parts := []config.PartitionConfig{
+		{Label: "ESP", Size: "1G", Filesystem: config.FSFat32, MountPoint: "/boot", Flags: []string{"esp"}},
+		{Label: "swap", Size: "4G", Filesystem: config.FSSwap},
+		{Label: "root", Size: "100%FREE", Filesystem: config.FSExt4, MountPoint: "/", Encrypt: true},
+	}
+
+	layout, err := LayoutFromConfig(parts, "", 20480)
+	if err != nil {
+		t.Fatalf("LayoutFromConfig() error = %v", err)
+	}
+
+	want := &PartitionLayout{
+		Scheme: config.PartSchemeGPT,
+		Partitions: []LayoutPartition{
+			{Number: 1, Start: "1MiB", End: "1025MiB", Size: "1024MiB", Filesystem: config.FSFat32, MountPoint: "/boot", Label: "ESP", Flags: []string{"esp"}},
+			{Number: 2, Start: "1025MiB", End: "5121MiB", Size: "4096MiB", Filesystem: config.FSSwap, Label: "swap"},
+			{Number: 3, Start: "5121MiB", End: "100%", Size: "15359MiB", Filesystem: config.FSExt4, MountPoint: "/", Label: "root", Encrypt: true},
+		},
+	}
+	if !reflect.DeepEqual(layout, want) {
+		t.Errorf("LayoutFromConfig() =\n%+v\nwant\n%+v", layout, want)
+	}
+}
+
+func TestLayoutFromConfigErrors(t *testing.T) {
+	root := config.PartitionConfig{Label: "root", Size: "100%FREE", Filesystem: config.FSExt4, MountPoint: "/"}
+
+	tests := []struct {
+		name  string
+		parts []config.PartitionConfig
+	}{
+		{"none", nil},
+		{"duplicate mount point", []config.PartitionConfig{
+			{Label: "a", Size: "4G", Filesystem: config.FSExt4, MountPoint: "/"}, root,
+		}},
+		{"swap with mount point", []config.PartitionConfig{
+			{Label: "swap", Size: "4G", Filesystem: config.FSSwap, MountPoint: "/swap"}, root,
+		}},
+		{"rest not last", []config.PartitionConfig{
+			root, {Label: "home", Size: "4G", Filesystem: config.FSExt4, MountPoint: "/home"},
+		}},
+		{"invalid size", []config.PartitionConfig{
+			{Label: "boot", Size: "lots", Filesystem: config.FSExt4, MountPoint: "/boot"}, root,
+		}},
+		{"does not fit", []config.PartitionConfig{
+			{Label: "home", Size: "30G", Filesystem: config.FSExt4, MountPoint: "/home"}, root,
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := LayoutFromConfig(tt.parts, config.PartSchemeGPT, 20480); err == nil {
+				t.Error("LayoutFromConfig() succeeded, want an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package partition
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"syscall"
+
+	"github.com/japaneseenrichmentorganization/yuno_os/pkg/config"
+	"github.com/japaneseenrichmentorganization/yuno_os/pkg/utils"
+)
+
+// swapFileMiB returns the configured swap file size.
+func (m *Manager) swapFileMiB() (int, error) {
+	mib, rest, err := ParseSizeMiB(m.config.SwapFile.Size)
+	if err != nil {
+		return 0, utils.NewError("partition", "invalid swap_file size", err)
+	}
+	if rest {
+		return 0, utils.NewError("partition", "swap_file size must be a fixed size", nil)
+	}
+	return mib, nil
+}
+
+// checkSwapFile checks that the configured swap file leaves at least half
+// of the root partition for the system.
+func (m *Manager) checkSwapFile(layout *PartitionLayout) error {
+	if !m.config.SwapFile.Enabled() {
+		return nil
+	}
+
+	swapMiB, err := m.swapFileMiB()
+	if err != nil {
+		return err
+	}
+
+	for _, part := range layout.Partitions {
+		if part.MountPoint != "/" {
+			continue
+		}
+		if part.Filesystem == config.FSZfs {
+			return utils.NewError("partition", "swap_file is not supported on a ZFS root", nil)
+		}
+		if rootMiB, _, err := ParseSizeMiB(part.Size); err == nil && swapMiB > rootMiB/2 {
+			return utils.NewError("partition", fmt.Sprintf("a %dMiB swap file does not fit on a %dMiB root partition, use at most %dMiB",
+				swapMiB, rootMiB, rootMiB/2), nil)
+		}
+	}
+
+	return nil
+}
+
+// rootFilesystem returns the filesystem of the layout's root partition.
+func rootFilesystem(layout *PartitionLayout) config.Filesystem {
+	for _, part := range layout.Partitions {
+		if part.MountPoint == "/" {
+			return part.Filesystem
+		}
+	}
+	return ""
+}
+
+// CreateSwapFile creates and enables the configured swap file on the root
+// filesystem mounted at targetRoot. An existing swap file, from a resumed
+// installation, is only enabled.
+func (m *Manager) CreateSwapFile(targetRoot string, rootFS config.Filesystem) error {
+	path := filepath.Join(targetRoot, m.config.SwapFile.FilePath())
+
+	if !utils.FileExists(path) {
+		sizeMiB, err := m.swapFileMiB()
+		if err != nil {
+			return err
+		}
+
+		utils.Info("Creating a %dMiB swap file at %s", sizeMiB, m.config.SwapFile.FilePath())
+
+		if !utils.IsDryRun() {
+			var stat syscall.Statfs_t
+			if err := syscall.Statfs(targetRoot, &stat); err != nil {
+				return utils.NewError("partition", fmt.Sprintf("failed to check the free space on %s", targetRoot), err)
+			}
+			freeMiB := int64(stat.Bavail) * int64(stat.Bsize) / 1024 / 1024
+			if int64(sizeMiB) > freeMiB/2 {
+				return utils.NewError("partition", fmt.Sprintf("a %dMiB swap file would take more than half of the %dMiB free on /",
+					sizeMiB, freeMiB), nil)
+			}
+		}
+
+		if err := writeSwapFile(path, sizeMiB, rootFS); err != nil {
+			utils.RunCommand("rm", "-f", path)
+			return err
+		}
+	}
+
+	result := utils.RunCommand("swapon", path)
+	if result.Error != nil {
+		return utils.NewError("partition", fmt.Sprintf("failed to enable swap file %s", path), result.Error)
+	}
+
+	return nil
+}
+
+// writeSwapFile allocates a swap file and formats it.
+func writeSwapFile(path string, sizeMiB int, rootFS config.Filesystem) error {
+	size := strconv.Itoa(sizeMiB) + "M"
+
+	if rootFS == config.FSBtrfs {
+		// btrfs only swaps to an empty file with copy-on-write turned off,
+		// which must be set before any data is written
+		if result := utils.RunCommand("truncate", "-s", "0", path); result.Error != nil {
+			return utils.NewError("partition", "failed to create the swap file", result.Error)
+		}
+		if result := utils.RunCommand("chattr", "+C", path); result.Error != nil {
+			return utils.NewError("partition", "failed to disable copy-on-write on the swap file", result.Error)
+		}
+	}
+
+	// Not every filesystem supports fallocate, dd works everywhere
+	if result := utils.RunCommand("fallocate", "-l", size, path); result.Error != nil {
+		utils.Debug("fallocate failed (%v), writing the swap file with dd", result.Error)
+		result = utils.RunCommand("dd", "if=/dev/zero", "of="+path, "bs=1M", "count="+strconv.Itoa(sizeMiB))
+		if result.Error != nil {
+			return utils.NewError("partition", "failed to allocate the swap file", result.Error)
+		}
+	}
+
+	if result := utils.RunCommand("chmod", "600", path); result.Error != nil {
+		return utils.NewError("partition", "failed to restrict the swap file permissions", result.Error)
+	}
+
+	if result := utils.RunCommand("mkswap", path); result.Error != nil {
+		return utils.NewError("partition", "failed to format the swap file", result.Error)
+	}
+
+	return nil
+}
@@ -5,9 +5,12 @@ import (
 	"fmt"
 	"path/filepath"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/japaneseenrichmentorganization/yuno_os/pkg/config"
+	"github.com/japaneseenrichmentorganization/yuno_os/pkg/graphics"
 	"github.com/japaneseenrichmentorganization/yuno_os/pkg/utils"
 )
 
@@ -29,22 +32,88 @@ func NewManager(cfg *config.InstallConfig, targetDir string) *Manager {
 func (m *Manager) GenerateMakeConf() error {
 	utils.Info("Generating make.conf")
 
-	cfg := m.config.Portage
+	makeConfPath := filepath.Join(m.targetDir, "etc/portage/make.conf")
+	if err := utils.WriteFile(makeConfPath, m.MakeConf(), 0644); err != nil {
+		return utils.NewError("portage", "failed to write make.conf", err)
+	}
 
-	// Determine CFLAGS
-	cflags := cfg.CFlags
-	if cflags == "" {
-		cflags = cfg.CFlagsPreset.GetCFlags()
+	return nil
+}
+
+// makeOpts returns MAKEOPTS for this machine. A configured value with more
+// jobs than the machine can run is kept with a warning, unless it is over
+// twice that, which is far more likely to run out of memory than to help.
+func (m *Manager) makeOpts() string {
+	cores := runtime.NumCPU()
+	memoryMB := utils.GetMemoryMB()
+
+	makeopts := m.config.Portage.MakeOpts
+	if makeopts == "" {
+		return config.ComputeMakeOpts(cores, memoryMB)
 	}
-	if cflags == "" {
-		cflags = "-march=native -O2 -pipe"
+
+	jobs, _, err := config.ParseMakeOpts(makeopts)
+	if err != nil {
+		return makeopts
+	}
+	max := config.MaxMakeJobs(cores, memoryMB)
+	switch {
+	case jobs > 2*max:
+		capped := config.ComputeMakeOpts(cores, memoryMB)
+		utils.Warn("MAKEOPTS %q runs %d jobs on %d CPUs and %d MB of memory, using %q instead", makeopts, jobs, cores, memoryMB, capped)
+		return capped
+	case jobs > max:
+		utils.Warn("MAKEOPTS %q runs more than the %d jobs this machine can comfortably run", makeopts, max)
 	}
+	return makeopts
+}
+
+// distccMakeOpts raises the job count of makeopts by the jobs the distcc
+// hosts run. The other options are kept, and a load limit of one per local
+// CPU is added when there is none, so remote jobs do not overload this
+// machine. A value that cannot be parsed is kept as is.
+func distccMakeOpts(makeopts string, remoteJobs, cores int) string {
+	jobs, load, err := config.ParseMakeOpts(makeopts)
+	if err != nil {
+		utils.Warn("Keeping MAKEOPTS %q for distcc: %v", makeopts, err)
+		return makeopts
+	}
+	if jobs == 0 {
+		jobs = cores
+	}
+
+	opts := []string{fmt.Sprintf("-j%d", jobs+remoteJobs)}
+	fields := strings.Fields(makeopts)
+	for n := 0; n < len(fields); n++ {
+		switch field := fields[n]; {
+		case field == "-j", field == "--jobs":
+			n++ // Skip the value
+		case strings.HasPrefix(field, "-j"), strings.HasPrefix(field, "--jobs="):
+		default:
+			opts = append(opts, field)
+		}
+	}
+	if load == 0 {
+		opts = append(opts, fmt.Sprintf("-l%d", cores))
+	}
+
+	return strings.Join(opts, " ")
+}
+
+// MakeConf renders make.conf from the configuration. The same configuration
+// on the same machine always gives the same file.
+func (m *Manager) MakeConf() string {
+	cfg := m.config.Portage
+
+	// Determine CFLAGS
+	cflags := cfg.EffectiveCFlags()
 
 	// Determine MAKEOPTS
-	makeopts := cfg.MakeOpts
-	if makeopts == "" {
-		cores := runtime.NumCPU()
-		makeopts = fmt.Sprintf("-j%d", cores)
+	makeopts := m.makeOpts()
+
+	// Distcc spreads jobs over the helper hosts, keep the load limit local
+	if m.config.Distcc.Enabled {
+		makeopts = distccMakeOpts(makeopts, m.config.Distcc.RemoteJobs(), runtime.NumCPU())
 	}
 
 	// Build make.conf content
@@ -79,16 +148,18 @@ func (m *Manager) GenerateMakeConf() error {
 		content.WriteString(fmt.Sprintf("USE=\"%s\"\n\n", strings.Join(cfg.UseFlags, " ")))
 	}
 
-	// VIDEO_CARDS
-	if len(cfg.VideoCards) > 0 {
+	// VIDEO_CARDS, derived from the graphics setup unless set explicitly
+	videoCards := strings.Join(cfg.VideoCards, " ")
+	if videoCards == "" {
+		videoCards = graphics.NewManager(m.config, m.targetDir).VideoCards()
+	}
+	if videoCards != "" {
 		content.WriteString("# Graphics drivers\n")
-		content.WriteString(fmt.Sprintf("VIDEO_CARDS=\"%s\"\n\n", strings.Join(cfg.VideoCards, " ")))
-	} else if m.config.Graphics.Driver != "" {
-		videoCards := m.config.Graphics.Driver.GetVideoCards()
-		if videoCards != "" {
-			content.WriteString("# Graphics drivers\n")
-			content.WriteString(fmt.Sprintf("VIDEO_CARDS=\"%s\"\n\n", videoCards))
-		}
+		content.WriteString(fmt.Sprintf("VIDEO_CARDS=\"%s\"\n\n", videoCards))
+	} else if m.config.Headless() {
+		// Clear the profile's default list, so nothing builds GPU drivers
+		content.WriteString("# Headless, no graphics drivers\n")
+		content.WriteString("VIDEO_CARDS=\"\"\n\n")
 	}
 
 	// INPUT_DEVICES
@@ -111,12 +182,16 @@ func (m *Manager) GenerateMakeConf() error {
 	}
 	content.WriteString(fmt.Sprintf("ACCEPT_LICENSE=\"%s\"\n\n", acceptLicense))
 
-	// Features
-	features := cfg.Features
+	// Features, copied so appending cannot modify the config
+	features := append([]string(nil), cfg.Features...)
 	if len(features) == 0 {
 		features = []string{"parallel-fetch", "candy", "buildpkg"}
 	}
 
+	if m.config.Distcc.Enabled {
+		features = append(features, "distcc")
+	}
+
 	// Add binary package features if enabled
 	if m.config.Packages.UseBinary != config.BinaryNone {
 		features = append(features, "getbinpkg")
@@ -134,12 +209,20 @@ func (m *Manager) GenerateMakeConf() error {
 		content.WriteString(fmt.Sprintf("GENTOO_MIRRORS=\"%s\"\n\n", strings.Join(cfg.Mirrors, " ")))
 	}
 
-	// Binary package host
-	if m.config.Packages.BinaryHost != "" {
-		content.WriteString("# Binary packages\n")
-		content.WriteString(fmt.Sprintf("PORTAGE_BINHOST=\"%s\"\n\n", m.config.Packages.BinaryHost))
+	// Custom locations
+	if cfg.DistDir != "" || cfg.PkgDir != "" {
+		content.WriteString("# Storage locations\n")
+		if cfg.DistDir != "" {
+			content.WriteString(fmt.Sprintf("DISTDIR=\"%s\"\n", cfg.DistDir))
+		}
+		if cfg.PkgDir != "" {
+			content.WriteString(fmt.Sprintf("PKGDIR=\"%s\"\n", cfg.PkgDir))
+		}
+		content.WriteString("\n")
 	}
 
+	// Binary package hosts are configured in binrepos.conf by the binpkg package
+
 	// Grub platforms
 	content.WriteString("# Bootloader\n")
 	if utils.IsUEFI() {
@@ -155,22 +238,22 @@ func (m *Manager) GenerateMakeConf() error {
 	content.WriteString(fmt.Sprintf("L10N=\"%s\"\n", strings.ToLower(strings.Replace(lang, "_", "-", 1))))
 	content.WriteString(fmt.Sprintf("LINGUAS=\"%s\"\n\n", strings.ToLower(strings.Split(lang, "_")[0])))
 
-	// Extra settings
+	// Extra settings, sorted as map order is random
 	if len(cfg.Extra) > 0 {
+		keys := make([]string, 0, len(cfg.Extra))
+		for key := range cfg.Extra {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
 		content.WriteString("# Additional settings\n")
-		for key, value := range cfg.Extra {
-			content.WriteString(fmt.Sprintf("%s=\"%s\"\n", key, value))
+		for _, key := range keys {
+			content.WriteString(fmt.Sprintf("%s=\"%s\"\n", key, cfg.Extra[key]))
 		}
 		content.WriteString("\n")
 	}
 
-	// Write the file
-	makeConfPath := filepath.Join(m.targetDir, "etc/portage/make.conf")
-	if err := utils.WriteFile(makeConfPath, content.String(), 0644); err != nil {
-		return utils.NewError("portage", "failed to write make.conf", err)
-	}
-
-	return nil
+	return content.String()
 }
 
 // SetupPackageUse sets up package.use directory and files.
@@ -287,21 +370,21 @@ func (m *Manager) SetupReposConf() error {
 main-repo = gentoo
 
 [gentoo]
-location = /var/db/repos/gentoo
+location = ` + m.config.Portage.GetRepoDir() + `
 sync-type = rsync
 sync-uri = rsync://rsync.gentoo.org/gentoo-portage
 auto-sync = yes
 sync-rsync-verify-jobs = 1
 sync-rsync-verify-metamanifest = yes
 sync-rsync-verify-max-age = 24
-sync-openpgp-key-path = /usr/share/openpgp-keys/gentoo-release.asc
+sync-openpgp-key-path = ` + gentooReleaseKey + `
 sync-openpgp-keyserver = hkps://keys.gentoo.org
 sync-openpgp-key-refresh-retry-count = 40
 sync-openpgp-key-refresh-retry-overall-timeout = 1200
 sync-openpgp-key-refresh-retry-delay-exp-base = 2
 sync-openpgp-key-refresh-retry-delay-max = 60
 sync-openpgp-key-refresh-retry-delay-mult = 4
-sync-webrsync-verify-signature = yes
+sync-webrsync-verify-signature = ` + yesNo(!m.config.Portage.SkipSnapshotVerify) + `
 `
 	gentooConfPath := filepath.Join(reposDir, "gentoo.conf")
 	if err := utils.WriteFile(gentooConfPath, gentooConf, 0644); err != nil {
@@ -338,45 +421,347 @@ func (m *Manager) SelectProfile() error {
 
 	utils.Info("Selecting profile: %s", profile)
 
+	err := m.setProfile(profile)
+	if err == nil {
+		return nil
+	}
+
+	// The profile path may have drifted between Gentoo releases
+	utils.Warn("Failed to select profile %s: %v", profile, err)
+
+	available, listErr := m.ListProfiles()
+	if listErr != nil {
+		return utils.NewError("portage", "failed to select profile", err)
+	}
+
+	match, matchErr := MatchProfile(profile, available)
+	if matchErr != nil {
+		utils.Warn("%v", matchErr)
+	} else if match != profile {
+		utils.Warn("Profile %s not available, using closest match %s", profile, match)
+		if m.setProfile(match) == nil {
+			return nil
+		}
+	}
+
+	fallback := DefaultProfile(m.config.InitSystem, available)
+	if fallback == "" {
+		return utils.NewError("portage", "failed to select profile", err)
+	}
+
+	utils.Warn("Falling back to default profile %s", fallback)
+	if fallbackErr := m.setProfile(fallback); fallbackErr != nil {
+		return utils.NewError("portage", "failed to select profile", fallbackErr)
+	}
+
+	return nil
+}
+
+// setProfile runs eselect profile set, retrying with the full profile path.
+func (m *Manager) setProfile(profile string) error {
 	result := utils.RunInChroot(m.targetDir, "eselect", "profile", "set", profile)
 	if result.Error != nil {
 		// Try with full path
 		result = utils.RunInChroot(m.targetDir, "eselect", "profile", "set",
-			"/var/db/repos/gentoo/profiles/"+profile)
+			filepath.Join(m.config.Portage.GetRepoDir(), "profiles", profile))
 		if result.Error != nil {
-			return utils.NewError("portage", "failed to select profile", result.Error)
+			return result.Error
 		}
 	}
 
 	return nil
 }
 
+// ListProfiles returns the profile paths reported by eselect.
+func (m *Manager) ListProfiles() ([]string, error) {
+	result := utils.RunInChroot(m.targetDir, "eselect", "profile", "list")
+	if result.Error != nil {
+		return nil, utils.NewError("portage", "failed to list profiles", result.Error)
+	}
+
+	return parseProfileList(result.Stdout), nil
+}
+
+// parseProfileList extracts profile paths from eselect profile list output,
+// where lines look like "  [23]  default/linux/amd64/23.0/desktop (stable) *".
+func parseProfileList(output string) []string {
+	var profiles []string
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "[") {
+			continue
+		}
+
+		end := strings.Index(line, "]")
+		if end < 0 {
+			continue
+		}
+
+		fields := strings.Fields(line[end+1:])
+		if len(fields) == 0 {
+			continue
+		}
+		profiles = append(profiles, fields[0])
+	}
+	return profiles
+}
+
+// MatchProfile returns the available profile closest to want. The release
+// version is ignored, preferring the newest. When want itself is not
+// available, its trailing components are dropped one at a time down to the
+// architecture, keeping the systemd flavour, so a missing
+// desktop/plasma/systemd falls back to desktop/systemd and never to another
+// desktop. It returns an error when nothing matches.
+func MatchProfile(want string, available []string) (string, error) {
+	wantParts := profileComponents(want)
+	if len(wantParts) == 0 {
+		return "", fmt.Errorf("invalid profile %q", want)
+	}
+
+	for _, candidate := range available {
+		if candidate == want {
+			return candidate, nil
+		}
+	}
+
+	// Split off the flavour, it is kept while the rest is shortened
+	base, flavour := wantParts, []string(nil)
+	if n := len(base); n > 0 && base[n-1] == "systemd" {
+		base, flavour = base[:n-1], base[n-1:]
+	}
+
+	shortest := 1
+	for i, part := range base {
+		if part == "linux" && i+1 < len(base) {
+			shortest = i + 2 // Keep the architecture
+		}
+	}
+
+	for n := len(base); n >= shortest; n-- {
+		prefix := append(append([]string(nil), base[:n]...), flavour...)
+
+		best := ""
+		var bestVersion []int
+		for _, candidate := range available {
+			if !sameComponents(profileComponents(candidate), prefix) {
+				continue
+			}
+			if version := profileVersion(candidate); best == "" || compareProfileVersions(version, bestVersion) > 0 {
+				best, bestVersion = candidate, version
+			}
+		}
+		if best != "" {
+			return best, nil
+		}
+	}
+
+	return "", fmt.Errorf("no available profile matches %s", want)
+}
+
+// sameComponents reports whether two profile component lists are equal.
+func sameComponents(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// DefaultProfile returns a safe base profile for the init system, taken from
+// the available list when possible.
+func DefaultProfile(init config.InitSystem, available []string) string {
+	want := "default/linux/amd64/23.0"
+	if init == config.InitSystemd {
+		want += "/systemd"
+	}
+
+	if len(available) == 0 {
+		return want
+	}
+
+	match, err := MatchProfile(want, available)
+	if err != nil {
+		return ""
+	}
+	return match
+}
+
+// profileComponents splits a profile path into components, dropping
+// release version numbers such as 17.1 or 23.0.
+func profileComponents(profile string) []string {
+	var parts []string
+	for _, part := range strings.Split(strings.Trim(profile, "/"), "/") {
+		if part == "" || isProfileVersion(part) {
+			continue
+		}
+		parts = append(parts, part)
+	}
+	return parts
+}
+
+// profileVersion returns the numeric release version of a profile path.
+func profileVersion(profile string) []int {
+	for _, part := range strings.Split(profile, "/") {
+		if !isProfileVersion(part) {
+			continue
+		}
+		var version []int
+		for _, field := range strings.Split(part, ".") {
+			n, _ := strconv.Atoi(field)
+			version = append(version, n)
+		}
+		return version
+	}
+	return nil
+}
+
+// compareProfileVersions compares two numeric release versions.
+func compareProfileVersions(a, b []int) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			if a[i] < b[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return len(a) - len(b)
+}
+
+// isProfileVersion reports whether a path component is a release version.
+func isProfileVersion(part string) bool {
+	if part == "" {
+		return false
+	}
+	for _, r := range part {
+		if (r < '0' || r > '9') && r != '.' {
+			return false
+		}
+	}
+	return true
+}
+
 // SyncPortage syncs the Portage tree.
 func (m *Manager) SyncPortage() error {
 	utils.Info("Syncing Portage tree")
 
 	// Use emerge-webrsync for initial sync
-	result := utils.RunInChroot(m.targetDir, "emerge-webrsync")
+	args := []string{"-v"}
+	if m.config.Portage.Snapshot != "" {
+		utils.Info("Using pinned Portage snapshot %s", m.config.Portage.Snapshot)
+		args = append(args, "--revert="+m.config.Portage.Snapshot)
+	}
+
+	if m.config.Portage.SkipSnapshotVerify {
+		utils.Warn("Portage snapshot signature verification is disabled")
+		args = append(args, "--no-pgp-verify")
+	} else if !utils.IsDryRun() && !utils.FileExists(filepath.Join(m.targetDir, gentooReleaseKey)) {
+		return utils.NewError("portage", fmt.Sprintf("cannot verify the Portage snapshot: %s is missing", gentooReleaseKey), nil)
+	}
+
+	result := utils.RunInChroot(m.targetDir, "emerge-webrsync", args...)
 	if result.Error != nil {
+		if !m.config.Portage.SkipSnapshotVerify && strings.Contains(strings.ToLower(result.Stdout+result.Stderr), "signature") {
+			return utils.NewError("portage", "Portage snapshot signature verification failed", result.Error)
+		}
 		return utils.NewError("portage", "failed to sync portage", result.Error)
 	}
 
+	return m.recordSnapshot()
+}
+
+// gentooReleaseKey is the key Portage snapshots are signed with, shipped in
+// every stage3.
+const gentooReleaseKey = "/usr/share/openpgp-keys/gentoo-release.asc"
+
+// yesNo formats b as a repos.conf boolean.
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+// SnapshotRecordPath is where the synced Portage snapshot is recorded in the target.
+const SnapshotRecordPath = "/var/lib/yuno/portage-snapshot"
+
+// recordSnapshot records the timestamp of the synced gentoo repository.
+func (m *Manager) recordSnapshot() error {
+	repoDir := filepath.Join(m.targetDir, m.config.Portage.GetRepoDir())
+	timestamp, err := utils.ReadFile(filepath.Join(repoDir, "metadata/timestamp.chk"))
+	if err != nil {
+		utils.Warn("Could not read Portage snapshot timestamp: %v", err)
+		return nil
+	}
+
+	content := fmt.Sprintf("SNAPSHOT=%s\n", strings.TrimSpace(timestamp))
+	if m.config.Portage.Snapshot != "" {
+		content += fmt.Sprintf("SNAPSHOT_DATE=%s\n", m.config.Portage.Snapshot)
+	}
+
+	path := filepath.Join(m.targetDir, SnapshotRecordPath)
+	if err := utils.WriteFile(path, content, 0644); err != nil {
+		return utils.NewError("portage", "failed to record portage snapshot", err)
+	}
 	return nil
 }
 
+// SetupDistcc installs distcc and writes the helper hosts list.
+func (m *Manager) SetupDistcc(progress func(line string)) error {
+	if !m.config.Distcc.Enabled {
+		return nil
+	}
+
+	utils.Info("Setting up distcc with %d helper hosts", len(m.config.Distcc.Hosts))
+
+	args := []string{m.targetDir, "emerge", "--ask=n", "sys-devel/distcc"}
+
+	result := utils.RunCommandStreaming(progress, "chroot", args...)
+	if result.Error != nil {
+		return utils.NewError("portage", "failed to install distcc", result.Error)
+	}
+
+	hostsPath := filepath.Join(m.targetDir, "etc/distcc/hosts")
+	if err := utils.WriteFile(hostsPath, m.generateDistccHosts(), 0644); err != nil {
+		return utils.NewError("portage", "failed to write distcc hosts", err)
+	}
+
+	return nil
+}
+
+// generateDistccHosts renders the /etc/distcc/hosts file.
+func (m *Manager) generateDistccHosts() string {
+	var content strings.Builder
+
+	content.WriteString("# Yuno OS distcc hosts - Generated by installer\n")
+	content.WriteString(fmt.Sprintf("localhost/%d\n", runtime.NumCPU()))
+	for _, host := range m.config.Distcc.Hosts {
+		content.WriteString(host.HostsLine() + "\n")
+	}
+
+	return content.String()
+}
+
 // UpdateWorld updates @world set.
 func (m *Manager) UpdateWorld(progress func(line string)) error {
 	utils.Info("Updating @world")
 
 	args := []string{m.targetDir, "emerge", "--update", "--deep", "--newuse", "@world"}
-
-	if progress != nil {
-		return utils.RunCommandWithOutput(progress, "chroot", args...)
+	if m.config.Portage.KeepGoing {
+		args = append(args, "--keep-going")
 	}
 
-	result := utils.RunCommand("chroot", args...)
+	result := utils.RunCommandStreaming(progress, "chroot", args...)
 	if result.Error != nil {
-		return utils.NewError("portage", "failed to update @world", result.Error)
+		failed := utils.ParseEmergeFailures(result.Stdout + "\n" + result.Stderr)
+		if !m.config.Portage.KeepGoing || len(failed) == 0 {
+			return utils.NewError("portage", "failed to update @world", result.Error)
+		}
+		utils.Warn("%d packages failed to update: %s", len(failed), strings.Join(failed, " "))
 	}
 
 	return nil
@@ -0,0 +1,261 @@
+package portage
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/japaneseenrichmentorganization/yuno_os/pkg/config"
+	"github.com/japaneseenrichmentorganization/yuno_os/pkg/utils"
+)
+
+func TestDistccMakeOpts(t *testing.T) {
+	tests := []struct {
+		makeopts string
+		remote   int
+		want     string
+	}{
+		{"-j8 -l8", 12, "-j20 -l8"},
+		{"-j4", 8, "-j12 -l8"},
+		{"-j 4 --load-average=3.5", 8, "-j12 --load-average=3.5"},
+		{"--jobs=6 -l6 --keep-going", 4, "-j10 -l6 --keep-going"},
+		{"--jobs 2 -s", 4, "-j6 -s -l8"},
+		{"-s", 4, "-j12 -s -l8"},
+		{"-jx", 4, "-jx"}, // Unparsable, kept
+	}
+
+	for _, tt := range tests {
+		if got := distccMakeOpts(tt.makeopts, tt.remote, 8); got != tt.want {
+			t.Errorf("distccMakeOpts(%q, %d, 8) = %q, want %q", tt.makeopts, tt.remote, got, tt.want)
+		}
+	}
+}
+
+func TestMatchProfile(t *testing.T) {
+	available := []string{
+		"default/linux/amd64/17.1/desktop/plasma",
+		"default/linux/amd64/23.0",
+		"default/linux/amd64/23.0/systemd",
+		"default/linux/amd64/23.0/desktop",
+		"default/linux/amd64/23.0/desktop/systemd",
+		"default/linux/amd64/23.0/desktop/gnome",
+		"default/linux/amd64/23.0/desktop/gnome/systemd",
+		"default/linux/arm64/23.0/desktop/plasma",
+	}
+
+	tests := []struct {
+		want    string
+		match   string
+		wantErr bool
+	}{
+		{"default/linux/amd64/23.0/desktop/gnome", "default/linux/amd64/23.0/desktop/gnome", false},
+		// Newer release of the same profile
+		{"default/linux/amd64/17.1/desktop/gnome", "default/linux/amd64/23.0/desktop/gnome", false},
+		// Older release when it is the only one
+		{"default/linux/amd64/23.0/desktop/plasma", "default/linux/amd64/17.1/desktop/plasma", false},
+		// Never another desktop, drop trailing components instead
+		{"default/linux/amd64/23.0/desktop/plasma/systemd", "default/linux/amd64/23.0/desktop/systemd", false},
+		{"default/linux/amd64/23.0/desktop/plasma/wayland", "default/linux/amd64/17.1/desktop/plasma", false},
+		{"default/linux/amd64/23.0/hardened/systemd", "default/linux/amd64/23.0/systemd", false},
+		{"default/linux/amd64/23.0/no-multilib", "default/linux/amd64/23.0", false},
+		// The architecture is never dropped
+		{"default/linux/riscv/23.0/rv64/lp64d", "", true},
+		{"", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			got, err := MatchProfile(tt.want, available)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("MatchProfile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.match {
+				t.Errorf("MatchProfile() = %q, want %q", got, tt.match)
+			}
+		})
+	}
+}
+
+func TestDefaultProfile(t *testing.T) {
+	available := []string{
+		"default/linux/amd64/17.1",
+		"default/linux/amd64/23.0",
+		"default/linux/amd64/23.0/systemd",
+		"default/linux/amd64/23.0/desktop",
+	}
+
+	if got := DefaultProfile(config.InitOpenRC, available); got != "default/linux/amd64/23.0" {
+		t.Errorf("DefaultProfile(openrc) = %q", got)
+	}
+	if got := DefaultProfile(config.InitSystemd, available); got != "default/linux/amd64/23.0/systemd" {
+		t.Errorf("DefaultProfile(systemd) = %q", got)
+	}
+	if got := DefaultProfile(config.InitSystemd, available[:2]); got != "" {
+		t.Errorf("DefaultProfile(systemd) = %q without a systemd profile, want none", got)
+	}
+}
+
+func TestParseProfileList(t *testing.T) {
+	output := `Available profile symlink targets:
+  [1]   default/linux/amd64/23.0 (stable)
+  [2]   default/linux/amd64/23.0/systemd (stable) *
+  [3]   default/linux/amd64/23.0/desktop/plasma (stable)
+  [4]   default/linux/amd64/23.0/hardened (dev)
+  [5]
+`
+	want := []string{
+		"default/linux/amd64/23.0",
+		"default/linux/amd64/23.0/systemd",
+		"default/linux/amd64/23.0/desktop/plasma",
+		"default/linux/amd64/23.0/hardened",
+	}
+
+	if got := parseProfileList(output); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseProfileList() = %q, want %q", got, want)
+	}
+}
+
+func TestProfileVersion(t *testing.T) {
+	tests := []struct {
+		profile string
+		want    []int
+	}{
+		{"default/linux/amd64/23.0/desktop", []int{23, 0}},
+		{"default/linux/amd64/17.1", []int{17, 1}},
+		{"default/linux/amd64", nil},
+	}
+
+	for _, tt := range tests {
+		if got := profileVersion(tt.profile); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("profileVersion(%q) = %v, want %v", tt.profile, got, tt.want)
+		}
+	}
+
+	if compareProfileVersions([]int{23, 0}, []int{17, 1}) <= 0 {
+		t.Error("compareProfileVersions: 23.0 is not newer than 17.1")
+	}
+}
+
+func TestMakeConfDeterministic(t *testing.T) {
+	cfg := config.NewDefaultConfig()
+	cfg.Portage.Features = []string{"parallel-fetch"}
+	cfg.Portage.Extra = map[string]string{
+		"GRUB_PLATFORMS":   "efi-64",
+		"ACCEPT_KEYWORDS":  "~amd64",
+		"PORTAGE_NICENESS": "10",
+		"CPU_FLAGS_X86":    "avx2",
+	}
+
+	want := NewManager(cfg, "").MakeConf()
+	for i := 0; i < 20; i++ {
+		if got := NewManager(cfg, "").MakeConf(); got != want {
+			t.Fatalf("MakeConf() changed between runs:\n%s\nthen:\n%s", want, got)
+		}
+	}
+
+	extra := want[strings.Index(want, "# Additional settings\n"):]
+	wantExtra := `# Additional settings
+ACCEPT_KEYWORDS="~amd64"
+CPU_FLAGS_X86="avx2"
+GRUB_PLATFORMS="efi-64"
+PORTAGE_NICENESS="10"
+`
+	if !strings.HasPrefix(extra, wantExtra) {
+		t.Errorf("extra settings = %q, want %q", extra, wantExtra)
+	}
+
+	if !reflect.DeepEqual(cfg.Portage.Features, []string{"parallel-fetch"}) {
+		t.Errorf("MakeConf() modified Features: %q", cfg.Portage.Features)
+	}
+}
+
+func TestMakeConfStorageLocations(t *testing.T) {
+	cfg := config.NewDefaultConfig()
+	cfg.Graphics.Driver = config.GPUNone
+	if conf := NewManager(cfg, "").MakeConf(); strings.Contains(conf, "DISTDIR") || strings.Contains(conf, "PKGDIR") {
+		t.Errorf("make.conf sets storage locations by default:\n%s", conf)
+	}
+
+	cfg.Portage.DistDir = "/srv/distfiles"
+	cfg.Portage.PkgDir = "/srv/binpkgs"
+	conf := NewManager(cfg, "").MakeConf()
+	for _, line := range []string{`DISTDIR="/srv/distfiles"`, `PKGDIR="/srv/binpkgs"`} {
+		if !strings.Contains(conf, line+"\n") {
+			t.Errorf("make.conf does not set %s:\n%s", line, conf)
+		}
+	}
+}
+
+func TestRecordSnapshot(t *testing.T) {
+	tests := []struct {
+		name     string
+		snapshot string
+		want     string
+	}{
+		{"latest", "", "SNAPSHOT=Tue, 02 Jan 2024 00:45:00 +0000\n"},
+		{"pinned", "20240102", "SNAPSHOT=Tue, 02 Jan 2024 00:45:00 +0000\nSNAPSHOT_DATE=20240102\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.NewDefaultConfig()
+			cfg.Portage.Snapshot = tt.snapshot
+			target := t.TempDir()
+
+			timestamp := filepath.Join(target, cfg.Portage.GetRepoDir(), "metadata/timestamp.chk")
+			if err := os.MkdirAll(filepath.Dir(timestamp), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(timestamp, []byte("Tue, 02 Jan 2024 00:45:00 +0000\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := NewManager(cfg, target).recordSnapshot(); err != nil {
+				t.Fatalf("recordSnapshot() error = %v", err)
+			}
+			got, err := os.ReadFile(filepath.Join(target, SnapshotRecordPath))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("snapshot record = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRecordSnapshotWithoutTimestamp(t *testing.T) {
+	target := t.TempDir()
+	if err := NewManager(config.NewDefaultConfig(), target).recordSnapshot(); err != nil {
+		t.Fatalf("recordSnapshot() error = %v, want a warning only", err)
+	}
+	if _, err := os.Stat(filepath.Join(target, SnapshotRecordPath)); !os.IsNotExist(err) {
+		t.Errorf("snapshot recorded without a timestamp: %v", err)
+	}
+}
+
+func TestMakeOpts(t *testing.T) {
+	cores, memoryMB := runtime.NumCPU(), utils.GetMemoryMB()
+	computed := config.ComputeMakeOpts(cores, memoryMB)
+
+	tests := []struct {
+		makeOpts string
+		want     string
+	}{
+		{"", computed},
+		{"-j1 -l1", "-j1 -l1"},
+		{"-jx", "-jx"}, // Unparsable, kept
+		{"-j100000", computed},
+	}
+
+	for _, tt := range tests {
+		cfg := config.NewDefaultConfig()
+		cfg.Portage.MakeOpts = tt.makeOpts
+		if got := NewManager(cfg, "").makeOpts(); got != tt.want {
+			t.Errorf("makeOpts() with MAKEOPTS %q = %q, want %q", tt.makeOpts, got, tt.want)
+		}
+	}
+}
@@ -24,6 +24,9 @@ const (
 
 	// Stage3Path is the path to stage3 tarballs on mirrors.
 	Stage3Path = "/releases/amd64/autobuilds"
+
+	// RecordPath is where the installed stage3 is recorded in the target.
+	RecordPath = "/var/lib/yuno/stage3"
 )
 
 // Manager handles stage3 operations.
@@ -57,6 +60,7 @@ type Stage3Info struct {
 	Date       time.Time
 	Variant    string
 	InitSystem string
+	SHA256     string // Set once the checksum has been verified
 }
 
 // Stage3Variant represents different stage3 variants.
@@ -66,6 +70,7 @@ const (
 	VariantDesktop        Stage3Variant = "desktop"
 	VariantDesktopSystemd Stage3Variant = "desktop-systemd"
 	VariantMinimal        Stage3Variant = "minimal"
+	VariantSystemd        Stage3Variant = "systemd"
 	VariantHardened       Stage3Variant = "hardened"
 	VariantNoMultilib     Stage3Variant = "nomultilib"
 )
@@ -79,6 +84,8 @@ func (v Stage3Variant) GetStage3Pattern() string {
 		return "stage3-amd64-desktop-systemd"
 	case VariantMinimal:
 		return "stage3-amd64-openrc"
+	case VariantSystemd:
+		return "stage3-amd64-systemd"
 	case VariantHardened:
 		return "stage3-amd64-hardened-openrc"
 	case VariantNoMultilib:
@@ -88,6 +95,21 @@ func (v Stage3Variant) GetStage3Pattern() string {
 	}
 }
 
+// InitSystem returns the init system the variant is built with.
+func (v Stage3Variant) InitSystem() config.InitSystem {
+	if strings.HasSuffix(v.GetStage3Pattern(), "-systemd") {
+		return config.InitSystemd
+	}
+	return config.InitOpenRC
+}
+
+// fallbackVariants maps a variant to the minimal variant with the same init
+// system, used when the mirror has no build of the preferred one.
+var fallbackVariants = map[Stage3Variant]Stage3Variant{
+	VariantDesktop:        VariantMinimal,
+	VariantDesktopSystemd: VariantSystemd,
+}
+
 // ListMirrors returns a list of Gentoo mirrors.
 func (m *Manager) ListMirrors() []string {
 	return []string{
@@ -107,8 +129,28 @@ func (m *Manager) SetMirror(mirror string) {
 	m.mirror = mirror
 }
 
-// GetLatestStage3 finds the latest stage3 tarball for the given variant.
+// GetLatestStage3 finds the latest stage3 tarball for the given variant,
+// falling back to the minimal variant with the same init system.
 func (m *Manager) GetLatestStage3(variant Stage3Variant) (*Stage3Info, error) {
+	info, err := m.findLatestStage3(variant)
+	if err == nil {
+		return info, nil
+	}
+
+	fallback, ok := fallbackVariants[variant]
+	if !ok {
+		return nil, err
+	}
+	if fallback.InitSystem() != variant.InitSystem() {
+		return nil, utils.NewError("stage3", fmt.Sprintf("fallback %s stage3 does not use %s", fallback, variant.InitSystem()), err)
+	}
+
+	utils.Warn("No %s stage3 available (%v), using a %s base; desktop packages will be emerged later", variant, err, fallback)
+	return m.findLatestStage3(fallback)
+}
+
+// findLatestStage3 finds the latest stage3 tarball of exactly the given variant.
+func (m *Manager) findLatestStage3(variant Stage3Variant) (*Stage3Info, error) {
 	utils.Info("Looking for latest %s stage3", variant)
 
 	// Fetch the latest-stage3 file
@@ -153,9 +195,10 @@ func (m *Manager) GetLatestStage3(variant Stage3Variant) (*Stage3Info, error) {
 			filename := match[2]
 
 			info := Stage3Info{
-				Filename: filename,
-				URL:      fmt.Sprintf("%s%s/%s%s", m.mirror, Stage3Path, dateStr, filename),
-				Variant:  string(variant),
+				Filename:   filename,
+				URL:        fmt.Sprintf("%s%s/%s%s", m.mirror, Stage3Path, dateStr, filename),
+				Variant:    string(variant),
+				InitSystem: string(variant.InitSystem()),
 			}
 
 			// Parse size if available
@@ -186,6 +229,25 @@ func (m *Manager) GetLatestStage3(variant Stage3Variant) (*Stage3Info, error) {
 	return &matches[0], nil
 }
 
+// GetStage3ForDate returns the stage3 tarball of a specific build date.
+func (m *Manager) GetStage3ForDate(variant Stage3Variant, date string) (*Stage3Info, error) {
+	buildDate, err := time.Parse(config.Stage3DateLayout, date)
+	if err != nil {
+		return nil, utils.NewError("stage3", fmt.Sprintf("invalid stage3 date %q", date), err)
+	}
+
+	utils.Info("Using pinned %s stage3 from %s", variant, date)
+
+	filename := fmt.Sprintf("%s-%s.tar.xz", variant.GetStage3Pattern(), date)
+	return &Stage3Info{
+		Filename:   filename,
+		URL:        fmt.Sprintf("%s%s/%s/%s", m.mirror, Stage3Path, date, filename),
+		Date:       buildDate,
+		Variant:    string(variant),
+		InitSystem: string(variant.InitSystem()),
+	}, nil
+}
+
 // findStage3Direct tries to find stage3 by directly parsing the autobuilds directory.
 func (m *Manager) findStage3Direct(variant Stage3Variant) (*Stage3Info, error) {
 	// Fetch the current directory listing
@@ -210,9 +272,10 @@ func (m *Manager) findStage3Direct(variant Stage3Variant) (*Stage3Info, error) {
 	filename := matches[len(matches)-1][1]
 
 	return &Stage3Info{
-		Filename: filename,
-		URL:      url + filename,
-		Variant:  string(variant),
+		Filename:   filename,
+		URL:        url + filename,
+		Variant:    string(variant),
+		InitSystem: string(variant.InitSystem()),
 	}, nil
 }
 
@@ -245,14 +308,22 @@ func (m *Manager) Download(info *Stage3Info, progress utils.ProgressCallback) (s
 func (m *Manager) VerifyChecksum(tarballPath string, info *Stage3Info) error {
 	utils.Info("Verifying stage3 checksum")
 
+	if utils.IsDryRun() {
+		utils.RecordAction("verify", "sha256 of %s", tarballPath)
+		return nil
+	}
+
 	// Download the DIGESTS file
 	digestsURL := info.URL + ".sha256"
-	digestsContent, err := m.fetchURL(digestsURL)
+	digestsContent, err := m.fetchDigests(digestsURL)
 	if err != nil {
 		// Try .DIGESTS file
 		digestsURL = info.URL[:len(info.URL)-7] + ".DIGESTS"
-		digestsContent, err = m.fetchURL(digestsURL)
+		digestsContent, err = m.fetchDigests(digestsURL)
 		if err != nil {
+			if m.config.Reproducible {
+				return utils.NewError("stage3", "could not fetch checksums for "+info.Filename, err)
+			}
 			utils.Warn("Could not fetch checksums, skipping verification")
 			return nil
 		}
@@ -272,6 +343,9 @@ func (m *Manager) VerifyChecksum(tarballPath string, info *Stage3Info) error {
 	}
 
 	if expectedHash == "" {
+		if m.config.Reproducible {
+			return utils.NewError("stage3", fmt.Sprintf("no checksum listed for %s", info.Filename), nil)
+		}
 		utils.Warn("Could not find checksum for %s", info.Filename)
 		return nil
 	}
@@ -294,6 +368,8 @@ func (m *Manager) VerifyChecksum(tarballPath string, info *Stage3Info) error {
 		return utils.NewError("stage3", fmt.Sprintf("checksum mismatch: expected %s, got %s", expectedHash, actualHash), nil)
 	}
 
+	info.SHA256 = actualHash
+
 	utils.Info("Checksum verified successfully")
 	return nil
 }
@@ -302,11 +378,16 @@ func (m *Manager) VerifyChecksum(tarballPath string, info *Stage3Info) error {
 func (m *Manager) VerifyGPG(tarballPath string, info *Stage3Info) error {
 	utils.Info("Verifying GPG signature")
 
-	// Download the signature
+	// Download the signature, a local tarball brings its own
 	sigURL := info.URL + ".asc"
 	sigPath := tarballPath + ".asc"
 
-	if err := utils.DownloadFile(sigURL, sigPath, nil); err != nil {
+	if isLocal(info) {
+		if !utils.FileExists(sigPath) {
+			utils.Warn("No GPG signature next to %s, skipping verification", tarballPath)
+			return nil
+		}
+	} else if err := utils.DownloadFile(sigURL, sigPath, nil); err != nil {
 		utils.Warn("Could not fetch GPG signature, skipping verification")
 		return nil
 	}
@@ -345,12 +426,16 @@ func (m *Manager) Extract(tarballPath string, progress utils.ProgressCallback) e
 
 // GetVariantForConfig returns the appropriate stage3 variant based on config.
 func (m *Manager) GetVariantForConfig() Stage3Variant {
+	desktop := m.config.Desktop.Type != config.DesktopNone
+
 	if m.config.InitSystem == config.InitSystemd {
-		return VariantDesktopSystemd
+		if desktop {
+			return VariantDesktopSystemd
+		}
+		return VariantSystemd
 	}
 
-	// Check if desktop packages are requested
-	if m.config.Desktop.Type != config.DesktopNone {
+	if desktop {
 		return VariantDesktop
 	}
 
@@ -362,16 +447,28 @@ func (m *Manager) Install(progress utils.ProgressCallback) error {
 	// Determine variant
 	variant := m.GetVariantForConfig()
 
-	// Find latest stage3
-	info, err := m.GetLatestStage3(variant)
+	// Find the local, pinned or latest stage3
+	var info *Stage3Info
+	var err error
+	switch {
+	case m.config.Stage3.Tarball != "":
+		info, err = m.LocalStage3(m.config.Stage3.Tarball, variant)
+	case m.config.Stage3.Date != "":
+		info, err = m.GetStage3ForDate(variant, m.config.Stage3.Date)
+	default:
+		info, err = m.GetLatestStage3(variant)
+	}
 	if err != nil {
 		return err
 	}
 
 	// Download
-	tarballPath, err := m.Download(info, progress)
-	if err != nil {
-		return err
+	tarballPath := m.config.Stage3.Tarball
+	if !isLocal(info) {
+		tarballPath, err = m.Download(info, progress)
+		if err != nil {
+			return err
+		}
 	}
 
 	// Verify checksum
@@ -387,12 +484,118 @@ func (m *Manager) Install(progress utils.ProgressCallback) error {
 		return err
 	}
 
+	if err := m.record(info); err != nil {
+		return err
+	}
+
 	utils.Info("Stage3 installation complete")
 	return nil
 }
 
-// Helper function to fetch URL content.
+// record writes the installed stage3 and its checksum to the target.
+func (m *Manager) record(info *Stage3Info) error {
+	var content strings.Builder
+	content.WriteString(fmt.Sprintf("STAGE3=%s\n", info.Filename))
+	content.WriteString(fmt.Sprintf("STAGE3_URL=%s\n", info.URL))
+	if info.SHA256 != "" {
+		content.WriteString(fmt.Sprintf("STAGE3_SHA256=%s\n", info.SHA256))
+	}
+
+	path := filepath.Join(m.targetDir, RecordPath)
+	if err := utils.WriteFile(path, content.String(), 0644); err != nil {
+		return utils.NewError("stage3", "failed to record stage3", err)
+	}
+	return nil
+}
+
+// stage3Name matches the file name of a stage3 tarball.
+var stage3Name = regexp.MustCompile(`^stage3-.+\.tar\.(xz|gz|bz2|zst)$`)
+
+// compressionMagic holds the leading bytes of the compression formats
+// stage3 tarballs are published in.
+var compressionMagic = [][]byte{
+	{0xfd, '7', 'z', 'X', 'Z', 0x00}, // xz
+	{0x1f, 0x8b},                     // gzip
+	{'B', 'Z', 'h'},                  // bzip2
+	{0x28, 0xb5, 0x2f, 0xfd},         // zstd
+}
+
+// LocalStage3 describes a stage3 tarball already on disk, for installs
+// without network access. Checksums and signatures are looked for next to
+// it.
+func (m *Manager) LocalStage3(path string, variant Stage3Variant) (*Stage3Info, error) {
+	utils.Info("Using local stage3 %s", path)
+
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, utils.NewError("stage3", "cannot read the local stage3 tarball", err)
+	}
+
+	name := filepath.Base(path)
+	if !stage3Name.MatchString(name) {
+		return nil, utils.NewError("stage3", fmt.Sprintf("%s is not named like a stage3 tarball (stage3-*.tar.xz)", name), nil)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, utils.NewError("stage3", "cannot read the local stage3 tarball", err)
+	}
+	defer file.Close()
+
+	head := make([]byte, 6)
+	n, _ := io.ReadFull(file, head)
+	compressed := false
+	for _, magic := range compressionMagic {
+		if n >= len(magic) && string(head[:len(magic)]) == string(magic) {
+			compressed = true
+			break
+		}
+	}
+	if !compressed {
+		return nil, utils.NewError("stage3", fmt.Sprintf("%s is not a compressed tarball", path), nil)
+	}
+
+	if !strings.HasPrefix(name, variant.GetStage3Pattern()+"-") {
+		utils.Warn("%s is not a %s stage3, the installed system may not match the configuration", name, variant.GetStage3Pattern())
+	}
+
+	return &Stage3Info{
+		Filename: name,
+		URL:      "file://" + path,
+		Size:     stat.Size(),
+		Date:     stat.ModTime(),
+		Variant:  string(variant),
+	}, nil
+}
+
+// isLocal reports whether the stage3 is a local tarball.
+func isLocal(info *Stage3Info) bool {
+	return strings.HasPrefix(info.URL, "file://")
+}
+
+// fetchDigests fetches a checksum file, reading it from disk for a local
+// tarball.
+func (m *Manager) fetchDigests(url string) (string, error) {
+	if path, ok := strings.CutPrefix(url, "file://"); ok {
+		content, err := os.ReadFile(path)
+		return string(content), err
+	}
+	return m.fetchURL(url)
+}
+
+// Helper function to fetch URL content, retrying on failure.
 func (m *Manager) fetchURL(url string) (string, error) {
+	var body string
+	err := utils.Retry(utils.NetworkAttempts, utils.NetworkBackoff, func() error {
+		var err error
+		body, err = fetchOnce(url)
+		return err
+	})
+	return body, err
+}
+
+// fetchOnce fetches URL content.
+func fetchOnce(url string) (string, error) {
 	resp, err := http.Get(url)
 	if err != nil {
 		return "", err
@@ -400,7 +603,12 @@ func (m *Manager) fetchURL(url string) (string, error) {
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("HTTP %d: %s", resp.StatusCode, resp.Status)
+		err := fmt.Errorf("HTTP %d: %s", resp.StatusCode, resp.Status)
+		if resp.StatusCode >= 400 && resp.StatusCode < 500 {
+			// Retrying will not make a missing file appear
+			return "", utils.Permanent(err)
+		}
+		return "", err
 	}
 
 	body, err := io.ReadAll(resp.Body)
@@ -0,0 +1,138 @@
+package stage3
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/japaneseenrichmentorganization/yuno_os/pkg/config"
+)
+
+func TestVariantInitSystem(t *testing.T) {
+	tests := []struct {
+		variant Stage3Variant
+		want    config.InitSystem
+	}{
+		{VariantDesktop, config.InitOpenRC},
+		{VariantDesktopSystemd, config.InitSystemd},
+		{VariantMinimal, config.InitOpenRC},
+		{VariantSystemd, config.InitSystemd},
+		{VariantHardened, config.InitOpenRC},
+	}
+
+	for _, tt := range tests {
+		if got := tt.variant.InitSystem(); got != tt.want {
+			t.Errorf("%s.InitSystem() = %q, want %q", tt.variant, got, tt.want)
+		}
+	}
+
+	for variant, fallback := range fallbackVariants {
+		if variant.InitSystem() != fallback.InitSystem() {
+			t.Errorf("fallback %s for %s changes the init system", fallback, variant)
+		}
+	}
+}
+
+func TestGetVariantForConfig(t *testing.T) {
+	tests := []struct {
+		init    config.InitSystem
+		desktop config.DesktopType
+		want    Stage3Variant
+	}{
+		{config.InitOpenRC, config.DesktopKDE, VariantDesktop},
+		{config.InitOpenRC, config.DesktopNone, VariantMinimal},
+		{config.InitSystemd, config.DesktopKDE, VariantDesktopSystemd},
+		{config.InitSystemd, config.DesktopNone, VariantSystemd},
+	}
+
+	for _, tt := range tests {
+		cfg := config.NewDefaultConfig()
+		cfg.InitSystem = tt.init
+		cfg.Desktop.Type = tt.desktop
+
+		if got := NewManager(cfg, "").GetVariantForConfig(); got != tt.want {
+			t.Errorf("GetVariantForConfig() with %s and %s = %s, want %s", tt.init, tt.desktop, got, tt.want)
+		}
+	}
+}
+
+// stage3Mirror serves latest-stage3 files by path and 404 for anything else.
+func stage3Mirror(t *testing.T, files map[string]string) string {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(content))
+	}))
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+func TestGetLatestStage3FallsBackToMinimal(t *testing.T) {
+	tests := []struct {
+		name         string
+		variant      Stage3Variant
+		files        map[string]string
+		wantVariant  Stage3Variant
+		wantFilename string
+		wantErr      bool
+	}{
+		{
+			"desktop available",
+			VariantDesktop,
+			map[string]string{
+				Stage3Path + "/latest-stage3-amd64-desktop.txt": "20240107T170309Z/stage3-amd64-desktop-openrc-20240107T170309Z.tar.xz 1073741824\n",
+				Stage3Path + "/latest-stage3-amd64-minimal.txt": "20240107T170309Z/stage3-amd64-openrc-20240107T170309Z.tar.xz 268435456\n",
+			},
+			VariantDesktop, "stage3-amd64-desktop-openrc-20240107T170309Z.tar.xz", false,
+		},
+		{
+			"desktop missing",
+			VariantDesktop,
+			map[string]string{
+				Stage3Path + "/latest-stage3-amd64-minimal.txt": "20240107T170309Z/stage3-amd64-openrc-20240107T170309Z.tar.xz 268435456\n",
+			},
+			VariantMinimal, "stage3-amd64-openrc-20240107T170309Z.tar.xz", false,
+		},
+		{
+			"desktop systemd missing",
+			VariantDesktopSystemd,
+			map[string]string{
+				Stage3Path + "/latest-stage3-amd64-systemd.txt": "20240107T170309Z/stage3-amd64-systemd-20240107T170309Z.tar.xz 268435456\n",
+			},
+			VariantSystemd, "stage3-amd64-systemd-20240107T170309Z.tar.xz", false,
+		},
+		{
+			"hardened has no fallback",
+			VariantHardened,
+			map[string]string{
+				Stage3Path + "/latest-stage3-amd64-minimal.txt": "20240107T170309Z/stage3-amd64-openrc-20240107T170309Z.tar.xz 268435456\n",
+			},
+			"", "", true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewManager(config.NewDefaultConfig(), t.TempDir())
+			m.SetMirror(stage3Mirror(t, tt.files))
+
+			info, err := m.GetLatestStage3(tt.variant)
+			if gotErr := err != nil; gotErr != tt.wantErr {
+				t.Fatalf("GetLatestStage3() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if info.Variant != string(tt.wantVariant) || info.Filename != tt.wantFilename {
+				t.Errorf("GetLatestStage3() = %s %s, want %s %s", info.Variant, info.Filename, tt.wantVariant, tt.wantFilename)
+			}
+			if info.InitSystem != string(tt.variant.InitSystem()) {
+				t.Errorf("InitSystem = %q, want %q", info.InitSystem, tt.variant.InitSystem())
+			}
+		})
+	}
+}
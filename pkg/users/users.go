@@ -27,23 +27,38 @@ func NewManager(cfg *config.InstallConfig, targetDir string) *Manager {
 // SetRootPassword sets the root password.
 func (m *Manager) SetRootPassword(password string) error {
 	utils.Info("Setting root password")
+	return m.setPassword("root", password)
+}
+
+// setPassword sets the password of an account. The password is hashed here
+// and passed on stdin, so it never shows up in a command line.
+func (m *Manager) setPassword(username, password string) error {
+	hash, err := utils.GeneratePassword(password)
+	if err != nil {
+		return err
+	}
 
-	// Use chpasswd to set the password
-	cmd := fmt.Sprintf("echo 'root:%s' | chpasswd", password)
-	result := utils.RunInChroot(m.targetDir, "sh", "-c", cmd)
+	result := utils.RunCommandWithStdin(username+":"+hash+"\n", "chroot", m.targetDir, "chpasswd", "-e")
 	if result.Error != nil {
-		return utils.NewError("users", "failed to set root password", result.Error)
+		return utils.NewError("users", fmt.Sprintf("failed to set password for %s", username), result.Error)
 	}
 
 	return nil
 }
 
-// CreateUser creates a new user account.
+// CreateUser creates a new user account, or updates it if it already
+// exists from an earlier run.
 func (m *Manager) CreateUser(user config.UserConfig) error {
 	utils.Info("Creating user: %s", user.Username)
 
-	// Build useradd command
-	args := []string{"-m"} // Create home directory
+	command := "useradd"
+	var args []string
+	if m.accountExists("passwd", user.Username) {
+		command = "usermod"
+		args = append(args, "-a")
+	} else {
+		args = append(args, "-m") // Create home directory
+	}
 
 	// Add full name if provided
 	if user.FullName != "" {
@@ -57,52 +72,66 @@ func (m *Manager) CreateUser(user config.UserConfig) error {
 	}
 	args = append(args, "-s", shell)
 
-	// Add to groups
-	groups := user.Groups
-	if len(groups) == 0 {
-		groups = defaultGroups()
-	}
-	args = append(args, "-G", strings.Join(groups, ","))
+	args = append(args, "-G", strings.Join(m.userGroups(user), ","))
 
 	// Add username
 	args = append(args, user.Username)
 
 	// Create user
-	result := utils.RunInChroot(m.targetDir, "useradd", args...)
+	result := utils.RunInChroot(m.targetDir, command, args...)
 	if result.Error != nil {
 		return utils.NewError("users", fmt.Sprintf("failed to create user %s", user.Username), result.Error)
 	}
 
 	// Set password
 	if user.Password != "" {
-		cmd := fmt.Sprintf("echo '%s:%s' | chpasswd", user.Username, user.Password)
-		result = utils.RunInChroot(m.targetDir, "sh", "-c", cmd)
-		if result.Error != nil {
-			return utils.NewError("users", fmt.Sprintf("failed to set password for %s", user.Username), result.Error)
+		if err := m.setPassword(user.Username, user.Password); err != nil {
+			return err
 		}
 	}
 
-	// Configure sudo/doas
-	if user.Sudo {
-		if user.UseDoas {
-			if err := m.configureDoas(user.Username); err != nil {
-				return err
-			}
-		} else {
-			if err := m.configureSudo(user.Username); err != nil {
-				return err
+	return nil
+}
+
+// userGroups returns the supplementary groups of a user.
+func (m *Manager) userGroups(user config.UserConfig) []string {
+	groups := append([]string(nil), user.Groups...)
+	if len(groups) == 0 {
+		groups = defaultGroups()
+	}
+
+	// sudo and doas grant root to the wheel group
+	if user.Sudo && !containsGroup(groups, "wheel") {
+		groups = append(groups, "wheel")
+	}
+
+	// Desktop users need device access for sound and graphics
+	if m.config.Desktop.Type != config.DesktopNone {
+		for _, group := range []string{"audio", "video"} {
+			if !containsGroup(groups, group) {
+				groups = append(groups, group)
 			}
 		}
 	}
 
-	return nil
+	return groups
+}
+
+// accountExists reports whether the target has an entry for name in the
+// passwd or group database.
+func (m *Manager) accountExists(database, name string) bool {
+	// Nothing exists yet in a dry run, plan the creation
+	if utils.IsDryRun() {
+		return false
+	}
+	return utils.RunInChroot(m.targetDir, "getent", database, name).ExitCode == 0
 }
 
-// defaultGroups returns the default groups for a new user.
+// defaultGroups returns the default groups for a new user. wheel grants
+// root, so it is only added for sudo and doas users.
 func defaultGroups() []string {
 	return []string{
 		"users",
-		"wheel",
 		"audio",
 		"video",
 		"input",
@@ -111,19 +140,48 @@ func defaultGroups() []string {
 	}
 }
 
-// configureSudo configures sudo access for a user.
-func (m *Manager) configureSudo(username string) error {
-	utils.Info("Configuring sudo for %s", username)
+// containsGroup reports whether groups contains group.
+func containsGroup(groups []string, group string) bool {
+	for _, g := range groups {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
 
-	// Install sudo if not present
-	sudoPath := filepath.Join(m.targetDir, "usr/bin/sudo")
-	if !utils.FileExists(sudoPath) {
-		result := utils.RunInChroot(m.targetDir, "emerge", "--ask=n", "app-admin/sudo")
-		if result.Error != nil {
-			return utils.NewError("users", "failed to install sudo", result.Error)
+// configurePrivileges sets up sudo or doas for the wheel group if any user
+// is allowed to run commands as root.
+func (m *Manager) configurePrivileges() error {
+	var privileged []string
+	useDoas := false
+	for _, user := range m.config.Users {
+		if user.Sudo {
+			privileged = append(privileged, user.Username)
+			useDoas = useDoas || user.UseDoas
 		}
 	}
 
+	switch {
+	case len(privileged) == 0:
+		return nil
+	case useDoas:
+		return m.configureDoas(privileged)
+	default:
+		return m.configureSudo(privileged)
+	}
+}
+
+// configureSudo configures sudo access for the wheel group.
+func (m *Manager) configureSudo(usernames []string) error {
+	utils.Info("Configuring sudo for %s", strings.Join(usernames, ", "))
+
+	// Install sudo if not present
+	result := utils.RunInChroot(m.targetDir, "emerge", "--ask=n", "--noreplace", "app-admin/sudo")
+	if result.Error != nil {
+		return utils.NewError("users", "failed to install sudo", result.Error)
+	}
+
 	// Configure sudoers
 	sudoersDir := filepath.Join(m.targetDir, "etc/sudoers.d")
 	if err := utils.CreateDir(sudoersDir, 0750); err != nil {
@@ -145,31 +203,34 @@ func (m *Manager) configureSudo(username string) error {
 	return nil
 }
 
-// configureDoas configures doas access for a user.
-func (m *Manager) configureDoas(username string) error {
-	utils.Info("Configuring doas for %s", username)
+// doasConfig is the doas.conf granting root to the wheel group.
+const doasConfig = `# doas configuration - Generated by Yuno OS installer
+
+# Allow wheel group members to run commands as root
+permit persist :wheel
+`
+
+// configureDoas configures doas access for the wheel group.
+func (m *Manager) configureDoas(usernames []string) error {
+	utils.Info("Configuring doas for %s", strings.Join(usernames, ", "))
 
 	// Install doas
-	result := utils.RunInChroot(m.targetDir, "emerge", "--ask=n", "app-admin/doas")
+	result := utils.RunInChroot(m.targetDir, "emerge", "--ask=n", "--noreplace", "app-admin/doas")
 	if result.Error != nil {
 		return utils.NewError("users", "failed to install doas", result.Error)
 	}
 
-	// Configure doas.conf
-	doasContent := fmt.Sprintf(`# doas configuration - Generated by Yuno OS installer
-
-# Allow wheel group members to run commands as root
-permit persist :wheel
-
-# Allow specific user
-permit persist %s as root
-`, username)
-
 	doasPath := filepath.Join(m.targetDir, "etc/doas.conf")
-	if err := utils.WriteFile(doasPath, doasContent, 0400); err != nil {
+	if err := utils.WriteFile(doasPath, doasConfig, 0400); err != nil {
 		return utils.NewError("users", "failed to write doas.conf", err)
 	}
 
+	// A doas.conf doas cannot parse locks everyone out of root
+	result = utils.RunInChroot(m.targetDir, "doas", "-C", "/etc/doas.conf")
+	if result.Error != nil {
+		return utils.NewError("users", fmt.Sprintf("invalid doas.conf: %s", result.Stderr), result.Error)
+	}
+
 	return nil
 }
 
@@ -187,6 +248,69 @@ func (m *Manager) CreateUsers() error {
 		if err := m.CreateUser(user); err != nil {
 			return err
 		}
+		if err := m.InstallSSHKeys(user); err != nil {
+			return err
+		}
+	}
+
+	if err := m.configurePrivileges(); err != nil {
+		return err
+	}
+
+	if m.config.SSHKeyOnly {
+		return m.disableSSHPasswords()
+	}
+	return nil
+}
+
+// InstallSSHKeys writes the user's SSH public keys to authorized_keys.
+func (m *Manager) InstallSSHKeys(user config.UserConfig) error {
+	if len(user.SSHKeys) == 0 {
+		return nil
+	}
+
+	utils.Info("Installing %d SSH keys for %s", len(user.SSHKeys), user.Username)
+
+	sshDir := filepath.Join("/home", user.Username, ".ssh")
+	if err := utils.CreateDir(filepath.Join(m.targetDir, sshDir), 0700); err != nil {
+		return utils.NewError("users", fmt.Sprintf("failed to create %s", sshDir), err)
+	}
+
+	keys := strings.Join(user.SSHKeys, "\n") + "\n"
+	if err := utils.WriteFile(filepath.Join(m.targetDir, sshDir, "authorized_keys"), keys, 0600); err != nil {
+		return utils.NewError("users", fmt.Sprintf("failed to write authorized_keys for %s", user.Username), err)
+	}
+
+	// Written from outside, so the files still belong to root; sshd ignores
+	// keys the user does not own. chown in the chroot resolves the group
+	// from the target's passwd.
+	result := utils.RunInChroot(m.targetDir, "chown", "-R", user.Username+":", sshDir)
+	if result.Error != nil {
+		return utils.NewError("users", fmt.Sprintf("failed to change the owner of %s", sshDir), result.Error)
+	}
+
+	return nil
+}
+
+// sshKeyOnlyConfig turns off every way of logging in with a password.
+const sshKeyOnlyConfig = `# Generated by Yuno OS installer: only public keys are accepted
+PasswordAuthentication no
+KbdInteractiveAuthentication no
+PermitRootLogin prohibit-password
+`
+
+// disableSSHPasswords makes sshd accept public keys only. Drop-ins are read
+// before the rest of sshd_config, and sshd keeps the first value it reads.
+func (m *Manager) disableSSHPasswords() error {
+	utils.Info("Disabling SSH password logins")
+
+	dir := filepath.Join(m.targetDir, "etc/ssh/sshd_config.d")
+	if err := utils.CreateDir(dir, 0755); err != nil {
+		return err
+	}
+
+	if err := utils.WriteFile(filepath.Join(dir, "10-yuno-key-only.conf"), sshKeyOnlyConfig, 0644); err != nil {
+		return utils.NewError("users", "failed to write the sshd configuration", err)
 	}
 
 	return nil
@@ -239,10 +363,6 @@ HISTCONTROL=ignoreboth
 # Prompt
 PS1='\[\e[1;32m\]\u@\h\[\e[0m\]:\[\e[1;34m\]\w\[\e[0m\]\$ '
 
-# Environment
-export EDITOR=nano
-export VISUAL=$EDITOR
-
 # Load local binaries
 export PATH="$HOME/.local/bin:$PATH"
 `
@@ -338,19 +458,27 @@ func (m *Manager) LockRootAccount() error {
 	return nil
 }
 
-// SetupGroups creates any necessary groups.
+// SetupGroups creates the groups the configured users are added to, as
+// useradd refuses groups that do not exist.
 func (m *Manager) SetupGroups() error {
 	groups := []string{"plugdev", "usb", "input"}
+	for _, user := range m.config.Users {
+		for _, group := range m.userGroups(user) {
+			if !containsGroup(groups, group) {
+				groups = append(groups, group)
+			}
+		}
+	}
 
 	for _, group := range groups {
-		// Check if group exists
-		result := utils.RunInChroot(m.targetDir, "getent", "group", group)
-		if result.ExitCode != 0 {
-			// Create group
-			result = utils.RunInChroot(m.targetDir, "groupadd", group)
-			if result.Error != nil {
-				utils.Warn("Failed to create group %s: %v", group, result.Error)
-			}
+		if m.accountExists("group", group) {
+			continue
+		}
+
+		utils.Debug("Creating group %s", group)
+		result := utils.RunInChroot(m.targetDir, "groupadd", group)
+		if result.Error != nil {
+			return utils.NewError("users", fmt.Sprintf("failed to create group %s", group), result.Error)
 		}
 	}
 
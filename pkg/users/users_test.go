@@ -0,0 +1,72 @@
+package users
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/japaneseenrichmentorganization/yuno_os/pkg/config"
+	"github.com/japaneseenrichmentorganization/yuno_os/pkg/utils"
+)
+
+func TestConfigurePrivileges(t *testing.T) {
+	tests := []struct {
+		name     string
+		users    []config.UserConfig
+		wantSudo bool
+		wantDoas bool
+	}{
+		{"unprivileged", []config.UserConfig{{Username: "alice"}}, false, false},
+		{"sudo", []config.UserConfig{{Username: "alice", Sudo: true}, {Username: "bob"}}, true, false},
+		{"doas", []config.UserConfig{{Username: "alice", Sudo: true, UseDoas: true}}, false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			utils.SetDryRun(true)
+			defer utils.SetDryRun(false)
+
+			cfg := config.NewDefaultConfig()
+			cfg.Users = tt.users
+			if err := NewManager(cfg, "/mnt/test").configurePrivileges(); err != nil {
+				t.Fatalf("configurePrivileges() error = %v", err)
+			}
+
+			// Files that were not planned read as empty in a dry run
+			sudoers, _ := utils.ReadFile("/mnt/test/etc/sudoers.d/wheel")
+			if gotSudo := sudoers != ""; gotSudo != tt.wantSudo {
+				t.Errorf("sudoers written = %v, want %v", gotSudo, tt.wantSudo)
+			}
+			doasConf, _ := utils.ReadFile("/mnt/test/etc/doas.conf")
+			if tt.wantDoas && doasConf != doasConfig || !tt.wantDoas && doasConf != "" {
+				t.Errorf("doas.conf = %q, want written %v", doasConf, tt.wantDoas)
+			}
+		})
+	}
+}
+
+func TestUserGroups(t *testing.T) {
+	tests := []struct {
+		name    string
+		desktop config.DesktopType
+		user    config.UserConfig
+		want    []string
+	}{
+		{"defaults", config.DesktopNone, config.UserConfig{}, []string{"users", "audio", "video", "input", "plugdev", "usb"}},
+		{"sudo defaults", config.DesktopNone, config.UserConfig{Sudo: true}, []string{"users", "audio", "video", "input", "plugdev", "usb", "wheel"}},
+		{"sudo", config.DesktopNone, config.UserConfig{Groups: []string{"users"}, Sudo: true}, []string{"users", "wheel"}},
+		{"doas", config.DesktopNone, config.UserConfig{Groups: []string{"users"}, Sudo: true, UseDoas: true}, []string{"users", "wheel"}},
+		{"already in wheel", config.DesktopNone, config.UserConfig{Groups: []string{"wheel", "users"}, Sudo: true}, []string{"wheel", "users"}},
+		{"unprivileged", config.DesktopNone, config.UserConfig{Groups: []string{"users"}}, []string{"users"}},
+		{"desktop", config.DesktopKDE, config.UserConfig{Groups: []string{"users"}, Sudo: true}, []string{"users", "wheel", "audio", "video"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.NewDefaultConfig()
+			cfg.Desktop.Type = tt.desktop
+			if got := NewManager(cfg, "/mnt/test").userGroups(tt.user); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("userGroups() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
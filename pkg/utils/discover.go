@@ -0,0 +1,374 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// DiscoveredPartition describes a partition found while probing a disk.
+type DiscoveredPartition struct {
+	Device     string // Block device path (e.g., /dev/sda2)
+	FSType     string // Filesystem type as reported by lsblk/blkid
+	Label      string
+	UUID       string
+	PartUUID   string
+	Encrypted  bool   // Whether this is a LUKS container
+	MappedPath string // /dev/mapper/<name> once the LUKS container is opened
+}
+
+// MountDevice returns the device that should be mounted for this partition.
+func (p *DiscoveredPartition) MountDevice() string {
+	if p.MappedPath != "" {
+		return p.MappedPath
+	}
+	return p.Device
+}
+
+// DiscoveredInstall describes an existing Gentoo installation on a disk.
+type DiscoveredInstall struct {
+	Disk       string
+	Root       *DiscoveredPartition
+	Partitions []DiscoveredPartition
+	MountPlan  []MountPoint // Targets are relative to the mount root ("/", "/boot", ...)
+	OpenedLUKS []string     // Mapper names opened during discovery
+	Repair     bool         // Repair filesystems with errors instead of refusing to mount them
+}
+
+// DiscoverGentooInstall probes the partitions of disk, opening LUKS containers
+// with passphrase if given, and identifies the Gentoo root filesystem.
+// The returned install carries a mount plan derived from the root's fstab.
+// Callers should call Close once done to release any opened LUKS mappings.
+func DiscoverGentooInstall(disk, passphrase string) (*DiscoveredInstall, error) {
+	Info("Probing %s for an existing Gentoo installation", disk)
+
+	parts, err := probePartitions(disk)
+	if err != nil {
+		return nil, err
+	}
+
+	install := &DiscoveredInstall{Disk: disk}
+
+	// Open LUKS containers so their contents can be probed
+	for i := range parts {
+		if !parts[i].Encrypted {
+			continue
+		}
+		if passphrase == "" {
+			Warn("Skipping LUKS container %s: no passphrase provided", parts[i].Device)
+			continue
+		}
+
+		name := "yuno-" + filepath.Base(parts[i].Device)
+		result := RunCommandWithStdin(passphrase, "cryptsetup", "luksOpen", "--key-file=-", parts[i].Device, name)
+		if result.Error != nil {
+			Warn("Failed to open LUKS container %s: %v", parts[i].Device, result.Error)
+			continue
+		}
+		install.OpenedLUKS = append(install.OpenedLUKS, name)
+		parts[i].MappedPath = filepath.Join("/dev/mapper", name)
+
+		// Probe the filesystem inside the container
+		blkid := RunCommand("blkid", "-o", "export", parts[i].MappedPath)
+		if blkid.Error == nil {
+			fields := parseBlkidExport(blkid.Stdout)
+			parts[i].FSType = fields["TYPE"]
+			parts[i].UUID = fields["UUID"]
+			parts[i].Label = fields["LABEL"]
+		}
+	}
+
+	install.Partitions = parts
+
+	// Identify the root filesystem: prefer /etc/gentoo-release, fall back to /etc/fstab
+	var fstabRoot *DiscoveredPartition
+	var fstabContent string
+	for i := range install.Partitions {
+		part := &install.Partitions[i]
+		if !isProbeableFS(part.FSType) {
+			continue
+		}
+
+		hasRelease, fstab, err := probeRootMarkers(part.MountDevice())
+		if err != nil {
+			Debug("Could not probe %s: %v", part.MountDevice(), err)
+			continue
+		}
+
+		if hasRelease {
+			install.Root = part
+			fstabContent = fstab
+			break
+		}
+		if fstab != "" && fstabRoot == nil {
+			fstabRoot = part
+			fstabContent = fstab
+		}
+	}
+
+	if install.Root == nil {
+		install.Root = fstabRoot
+	}
+
+	if install.Root == nil {
+		install.Close()
+		return nil, NewError("discover", fmt.Sprintf("no Gentoo installation found on %s", disk), nil)
+	}
+
+	Info("Found Gentoo root on %s", install.Root.MountDevice())
+
+	install.MountPlan = buildMountPlan(install.Root, install.Partitions, parseFstab(fstabContent))
+
+	return install, nil
+}
+
+// Mount mounts the discovered installation under targetRoot following the
+// mount plan. If a mount fails, the ones done before it are undone.
+func (d *DiscoveredInstall) Mount(targetRoot string) (err error) {
+	var mounted []string
+	defer func() {
+		if err == nil {
+			return
+		}
+		for i := len(mounted) - 1; i >= 0; i-- {
+			if unmountErr := Unmount(mounted[i]); unmountErr != nil {
+				Warn("Failed to unmount %s: %v", mounted[i], unmountErr)
+			}
+		}
+	}()
+
+	checked := make(map[string]bool)
+	for _, mp := range d.MountPlan {
+		target := filepath.Join(targetRoot, mp.Target)
+		if err := CreateDir(target, 0755); err != nil {
+			return NewError("discover", fmt.Sprintf("failed to create mount point %s", target), err)
+		}
+		// Mounting a dirty filesystem read-write can make the damage worse.
+		// Btrfs subvolumes share a device, so check each device once.
+		if !checked[mp.Source] {
+			if err := CheckFilesystem(mp.Source, mp.FSType, d.Repair); err != nil {
+				return err
+			}
+			checked[mp.Source] = true
+		}
+		if err := Mount(mp.Source, target, mp.FSType, mp.Flags); err != nil {
+			return err
+		}
+		mounted = append(mounted, target)
+	}
+	return nil
+}
+
+// Close closes any LUKS mappings opened during discovery.
+func (d *DiscoveredInstall) Close() {
+	for i := len(d.OpenedLUKS) - 1; i >= 0; i-- {
+		name := d.OpenedLUKS[i]
+		if result := RunCommand("cryptsetup", "luksClose", name); result.Error != nil {
+			Warn("Failed to close LUKS mapping %s: %v", name, result.Error)
+		}
+	}
+	d.OpenedLUKS = nil
+}
+
+// probePartitions lists the partitions of a disk using lsblk.
+func probePartitions(disk string) ([]DiscoveredPartition, error) {
+	result := RunCommand("lsblk", "-J", "-o", "PATH,TYPE,FSTYPE,LABEL,UUID,PARTUUID", disk)
+	if result.Error != nil {
+		return nil, NewError("discover", fmt.Sprintf("failed to list partitions of %s", disk), result.Error)
+	}
+
+	var output struct {
+		BlockDevices []struct {
+			Path     string `json:"path"`
+			Type     string `json:"type"`
+			Children []struct {
+				Path     string `json:"path"`
+				Type     string `json:"type"`
+				FSType   string `json:"fstype"`
+				Label    string `json:"label"`
+				UUID     string `json:"uuid"`
+				PartUUID string `json:"partuuid"`
+			} `json:"children"`
+		} `json:"blockdevices"`
+	}
+
+	if err := json.Unmarshal([]byte(result.Stdout), &output); err != nil {
+		return nil, NewError("discover", "failed to parse lsblk output", err)
+	}
+
+	var parts []DiscoveredPartition
+	for _, dev := range output.BlockDevices {
+		for _, child := range dev.Children {
+			if child.Type != "part" {
+				continue
+			}
+			parts = append(parts, DiscoveredPartition{
+				Device:    child.Path,
+				FSType:    child.FSType,
+				Label:     child.Label,
+				UUID:      child.UUID,
+				PartUUID:  child.PartUUID,
+				Encrypted: child.FSType == "crypto_LUKS",
+			})
+		}
+	}
+
+	if len(parts) == 0 {
+		return nil, NewError("discover", fmt.Sprintf("no partitions found on %s", disk), nil)
+	}
+
+	return parts, nil
+}
+
+// probeRootMarkers mounts device read-only and checks for Gentoo root markers.
+// It returns whether /etc/gentoo-release exists and the contents of /etc/fstab.
+func probeRootMarkers(device string) (bool, string, error) {
+	dir, err := os.MkdirTemp("", "yuno-probe-")
+	if err != nil {
+		return false, "", err
+	}
+	defer os.Remove(dir)
+
+	if err := Mount(device, dir, "", "ro"); err != nil {
+		return false, "", err
+	}
+	defer Unmount(dir)
+
+	hasRelease := FileExists(filepath.Join(dir, "etc/gentoo-release"))
+	fstab, _ := ReadFile(filepath.Join(dir, "etc/fstab"))
+
+	return hasRelease, fstab, nil
+}
+
+// isProbeableFS reports whether a filesystem could hold a root filesystem.
+func isProbeableFS(fstype string) bool {
+	switch fstype {
+	case "ext4", "ext3", "ext2", "btrfs", "xfs", "f2fs":
+		return true
+	default:
+		return false
+	}
+}
+
+// fstabEntry is a single parsed line from /etc/fstab.
+type fstabEntry struct {
+	Spec       string
+	MountPoint string
+	FSType     string
+	Options    string
+}
+
+// parseFstab parses fstab content, skipping comments, swap and pseudo filesystems.
+func parseFstab(content string) []fstabEntry {
+	var entries []fstabEntry
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			continue
+		}
+		if !strings.HasPrefix(fields[1], "/") {
+			continue
+		}
+
+		switch fields[2] {
+		case "swap", "proc", "sysfs", "tmpfs", "devtmpfs", "devpts", "efivarfs":
+			continue
+		}
+
+		entry := fstabEntry{
+			Spec:       fields[0],
+			MountPoint: fields[1],
+			FSType:     fields[2],
+		}
+		if len(fields) > 3 {
+			entry.Options = fields[3]
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// buildMountPlan resolves fstab entries against the discovered partitions.
+// The fstab options are kept, so btrfs subvolumes and the like mount as
+// they do on the installed system.
+func buildMountPlan(root *DiscoveredPartition, parts []DiscoveredPartition, entries []fstabEntry) []MountPoint {
+	plan := []MountPoint{{Source: root.MountDevice(), Target: "/", FSType: root.FSType}}
+
+	for _, entry := range entries {
+		if entry.MountPoint == "/" {
+			plan[0].Flags = entry.Options
+			continue
+		}
+
+		part := matchFstabSpec(entry.Spec, parts)
+		if part == nil {
+			Warn("Could not resolve fstab entry %s for %s", entry.Spec, entry.MountPoint)
+			continue
+		}
+
+		fstype := entry.FSType
+		if fstype == "auto" {
+			fstype = part.FSType
+		}
+
+		plan = append(plan, MountPoint{
+			Source: part.MountDevice(),
+			Target: entry.MountPoint,
+			FSType: fstype,
+			Flags:  entry.Options,
+		})
+	}
+
+	// Mount parents before children (root stays first)
+	rest := plan[1:]
+	sort.SliceStable(rest, func(i, j int) bool {
+		return strings.Count(rest[i].Target, "/") < strings.Count(rest[j].Target, "/")
+	})
+
+	return plan
+}
+
+// matchFstabSpec finds the partition referenced by an fstab device spec.
+func matchFstabSpec(spec string, parts []DiscoveredPartition) *DiscoveredPartition {
+	for i := range parts {
+		p := &parts[i]
+		switch {
+		case strings.HasPrefix(spec, "UUID="):
+			if p.UUID != "" && strings.TrimPrefix(spec, "UUID=") == p.UUID {
+				return p
+			}
+		case strings.HasPrefix(spec, "PARTUUID="):
+			if p.PartUUID != "" && strings.TrimPrefix(spec, "PARTUUID=") == p.PartUUID {
+				return p
+			}
+		case strings.HasPrefix(spec, "LABEL="):
+			if p.Label != "" && strings.TrimPrefix(spec, "LABEL=") == p.Label {
+				return p
+			}
+		default:
+			if spec == p.Device || (p.MappedPath != "" && spec == p.MappedPath) {
+				return p
+			}
+		}
+	}
+	return nil
+}
+
+// parseBlkidExport parses `blkid -o export` output into a key/value map.
+func parseBlkidExport(output string) map[string]string {
+	fields := make(map[string]string)
+	for _, line := range strings.Split(output, "\n") {
+		if key, value, ok := strings.Cut(strings.TrimSpace(line), "="); ok {
+			fields[key] = value
+		}
+	}
+	return fields
+}
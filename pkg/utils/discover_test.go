@@ -0,0 +1,178 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBuildMountPlanFromFstab(t *testing.T) {
+	fstab, err := os.ReadFile(filepath.Join("testdata", "fstab"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parts := []DiscoveredPartition{
+		{Device: "/dev/sda1", FSType: "vfat", UUID: "1111-2222"},
+		{Device: "/dev/sda2", FSType: "btrfs", UUID: "6f0d3d5e-0000-4000-8000-000000000001"},
+		{Device: "/dev/sda4", FSType: "xfs", Label: "data"},
+		{Device: "/dev/sda5", FSType: "ext4", PartUUID: "deadbeef-04"},
+	}
+
+	got := buildMountPlan(&parts[1], parts, parseFstab(string(fstab)))
+	want := []MountPoint{
+		{Source: "/dev/sda2", Target: "/", FSType: "btrfs", Flags: "noatime,compress=zstd,subvol=@"},
+		{Source: "/dev/sda1", Target: "/boot", FSType: "vfat", Flags: "noauto,noatime,umask=0077"},
+		{Source: "/dev/sda2", Target: "/home", FSType: "btrfs", Flags: "noatime,subvol=@home"},
+		{Source: "/dev/sda5", Target: "/var", FSType: "ext4", Flags: "noatime"},
+		{Source: "/dev/sda4", Target: "/srv/data", FSType: "xfs", Flags: "defaults"},
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("buildMountPlan() =\n%+v\nwant\n%+v", got, want)
+	}
+}
+
+// fakeMountCommands puts mount and umount scripts first in PATH that log
+// their arguments to the returned file. Mounting on failTarget fails.
+func fakeMountCommands(t *testing.T, failTarget string) string {
+	t.Helper()
+
+	bin := t.TempDir()
+	log := filepath.Join(bin, "log")
+	scripts := map[string]string{
+		"mount":  `for last; do :; done; echo "mount $last" >> ` + log + `; [ "$last" != "` + failTarget + `" ]`,
+		"umount": `echo "umount $*" >> ` + log,
+	}
+	for name, body := range scripts {
+		if err := os.WriteFile(filepath.Join(bin, name), []byte("#!/bin/sh\n"+body+"\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return log
+}
+
+func TestMountRollsBackOnFailure(t *testing.T) {
+	root := t.TempDir()
+	log := fakeMountCommands(t, filepath.Join(root, "home"))
+
+	install := &DiscoveredInstall{MountPlan: []MountPoint{
+		{Source: "/dev/sda2", Target: "/"},
+		{Source: "/dev/sda1", Target: "/boot"},
+		{Source: "/dev/sda3", Target: "/home"},
+		{Source: "/dev/sda4", Target: "/var"},
+	}}
+
+	if err := install.Mount(root); err == nil {
+		t.Fatal("Mount() succeeded with a failing mount")
+	}
+
+	content, err := os.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Split(strings.TrimSpace(string(content)), "\n")
+	want := []string{
+		"mount " + root,
+		"mount " + filepath.Join(root, "boot"),
+		"mount " + filepath.Join(root, "home"),
+		"umount -R " + filepath.Join(root, "boot"),
+		"umount -R " + root,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("commands =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestMountKeepsMountsOnSuccess(t *testing.T) {
+	root := t.TempDir()
+	log := fakeMountCommands(t, "")
+
+	install := &DiscoveredInstall{MountPlan: []MountPoint{
+		{Source: "/dev/sda2", Target: "/"},
+		{Source: "/dev/sda1", Target: "/boot"},
+	}}
+
+	if err := install.Mount(root); err != nil {
+		t.Fatalf("Mount() error = %v", err)
+	}
+
+	content, err := os.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(content), "umount") {
+		t.Errorf("Mount() unmounted after succeeding:\n%s", content)
+	}
+}
+
+func TestParseFstab(t *testing.T) {
+	content := `# comment
+UUID=abcd  /      ext4   noatime  0 1
+
+/dev/sda1  /boot  vfat   defaults 0 2
+/dev/sda3  none   swap   sw       0 0
+proc       /proc  proc   defaults 0 0
+tmpfs      /tmp   tmpfs  size=1G  0 0
+/dev/sdb1  /data  xfs
+broken line
+`
+	want := []fstabEntry{
+		{Spec: "UUID=abcd", MountPoint: "/", FSType: "ext4", Options: "noatime"},
+		{Spec: "/dev/sda1", MountPoint: "/boot", FSType: "vfat", Options: "defaults"},
+		{Spec: "/dev/sdb1", MountPoint: "/data", FSType: "xfs"},
+	}
+
+	if got := parseFstab(content); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseFstab() =\n%+v\nwant\n%+v", got, want)
+	}
+}
+
+func TestMatchFstabSpec(t *testing.T) {
+	parts := []DiscoveredPartition{
+		{Device: "/dev/sda1", UUID: "1111", Label: "EFI"},
+		{Device: "/dev/sda2", PartUUID: "p-2", MappedPath: "/dev/mapper/yuno-sda2"},
+		{Device: "/dev/sda3"},
+	}
+
+	tests := []struct {
+		spec string
+		want string // Device, "" for no match
+	}{
+		{"UUID=1111", "/dev/sda1"},
+		{"LABEL=EFI", "/dev/sda1"},
+		{"PARTUUID=p-2", "/dev/sda2"},
+		{"/dev/mapper/yuno-sda2", "/dev/sda2"},
+		{"/dev/sda3", "/dev/sda3"},
+		{"UUID=", ""}, // Partitions without a UUID never match
+		{"LABEL=root", ""},
+		{"/dev/sdb1", ""},
+	}
+
+	for _, tt := range tests {
+		got := ""
+		if part := matchFstabSpec(tt.spec, parts); part != nil {
+			got = part.Device
+		}
+		if got != tt.want {
+			t.Errorf("matchFstabSpec(%q) = %q, want %q", tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestParseBlkidExport(t *testing.T) {
+	output := "DEVNAME=/dev/mapper/root\nUUID=abcd-ef\nTYPE=ext4\nLABEL=a=b\n"
+	want := map[string]string{
+		"DEVNAME": "/dev/mapper/root",
+		"UUID":    "abcd-ef",
+		"TYPE":    "ext4",
+		"LABEL":   "a=b",
+	}
+
+	if got := parseBlkidExport(output); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseBlkidExport() = %v, want %v", got, want)
+	}
+}
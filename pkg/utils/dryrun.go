@@ -0,0 +1,116 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// PlanAction is a command or file change recorded instead of being
+// performed in dry-run mode.
+type PlanAction struct {
+	Kind   string // run, write, append, copy, mkdir, chmod, symlink, verify
+	Detail string
+}
+
+// String renders the action as a single plan line.
+func (a PlanAction) String() string {
+	return fmt.Sprintf("%-7s %s", a.Kind, a.Detail)
+}
+
+// readOnlyCommands still run in dry-run mode, since later decisions such
+// as the partition layout depend on their output.
+var readOnlyCommands = map[string]bool{
+	"lsblk":      true,
+	"lspci":      true,
+	"blkid":      true,
+	"findmnt":    true,
+	"mountpoint": true,
+	"nproc":      true,
+	"uname":      true,
+}
+
+var (
+	dryRunMu     sync.Mutex
+	dryRun       bool
+	plan         []PlanAction
+	plannedFiles map[string]string // Content of files written during the plan
+)
+
+// SetDryRun enables or disables dry-run mode. Enabling it starts a new plan.
+func SetDryRun(enabled bool) {
+	dryRunMu.Lock()
+	defer dryRunMu.Unlock()
+
+	dryRun = enabled
+	if enabled {
+		plan = nil
+		plannedFiles = make(map[string]string)
+	}
+}
+
+// IsDryRun reports whether dry-run mode is enabled.
+func IsDryRun() bool {
+	dryRunMu.Lock()
+	defer dryRunMu.Unlock()
+	return dryRun
+}
+
+// Plan returns the actions recorded by the last dry run, in order.
+func Plan() []PlanAction {
+	dryRunMu.Lock()
+	defer dryRunMu.Unlock()
+	return append([]PlanAction(nil), plan...)
+}
+
+// RecordAction adds an action to the plan. It does nothing outside dry-run mode.
+func RecordAction(kind, format string, args ...interface{}) {
+	dryRunMu.Lock()
+	defer dryRunMu.Unlock()
+
+	if dryRun {
+		plan = append(plan, PlanAction{Kind: kind, Detail: fmt.Sprintf(format, args...)})
+	}
+}
+
+// planCommand records a command that would change the system. It reports
+// whether the command must be skipped.
+func planCommand(name string, args []string) bool {
+	if !IsDryRun() || readOnlyCommands[name] {
+		return false
+	}
+	RecordAction("run", "%s", strings.TrimSpace(name+" "+strings.Join(args, " ")))
+	return true
+}
+
+// planWrite records a file write and remembers its content so later reads
+// see it. It reports whether the write must be skipped.
+func planWrite(kind, path, content string, perm os.FileMode) bool {
+	if !IsDryRun() {
+		return false
+	}
+
+	dryRunMu.Lock()
+	if kind == "append" {
+		plannedFiles[path] += content
+	} else {
+		plannedFiles[path] = content
+	}
+	dryRunMu.Unlock()
+
+	RecordAction(kind, "%s (%04o, %d bytes)", path, perm, len(content))
+	return true
+}
+
+// plannedFile returns the content of a file written during the current plan.
+func plannedFile(path string) (string, bool) {
+	dryRunMu.Lock()
+	defer dryRunMu.Unlock()
+
+	if !dryRun {
+		return "", false
+	}
+	content, ok := plannedFiles[path]
+	return content, ok
+}
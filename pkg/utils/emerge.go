@@ -0,0 +1,43 @@
+package utils
+
+import (
+	"regexp"
+	"strings"
+)
+
+// emergeFailedPattern matches a package line of emerge's failure summary,
+// e.g. " * (app-misc/foo-1.0:0/0::gentoo, ebuild scheduled for merge), Log file:".
+var emergeFailedPattern = regexp.MustCompile(`^\s*\*\s+\(?([a-z0-9][\w+.-]*/[\w+.-]+?)(?:[:,)\s]|$)`)
+
+// ParseEmergeFailures returns the packages that emerge --keep-going reports
+// as failed or dropped in its output, in order.
+func ParseEmergeFailures(output string) []string {
+	var failed []string
+	seen := make(map[string]bool)
+	inSummary := false
+
+	for _, line := range strings.Split(output, "\n") {
+		trimmed := strings.TrimSpace(line)
+		text := strings.TrimSpace(strings.TrimPrefix(trimmed, "*"))
+		switch {
+		case strings.HasPrefix(text, "The following package has failed"),
+			strings.HasPrefix(text, "The following packages have failed"),
+			strings.HasPrefix(text, "The following package has been dropped"),
+			strings.HasPrefix(text, "The following packages have been dropped"):
+			inSummary = true
+			continue
+		case trimmed == "" || !inSummary:
+			continue
+		case !strings.HasPrefix(trimmed, "*"):
+			inSummary = false
+			continue
+		}
+
+		if match := emergeFailedPattern.FindStringSubmatch(line); match != nil && !seen[match[1]] {
+			seen[match[1]] = true
+			failed = append(failed, match[1])
+		}
+	}
+
+	return failed
+}
@@ -0,0 +1,68 @@
+package utils
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseEmergeFailures(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   []string
+	}{
+		{
+			name:   "success",
+			output: ">>> Installing (1 of 1) app-misc/foo-1.0::gentoo\n>>> Completed (1 of 1) app-misc/foo-1.0::gentoo\n",
+			want:   nil,
+		},
+		{
+			name: "failed",
+			output: ` * Messages for package app-misc/foo-1.0:
+
+ * The following packages have failed to build, install, or execute postinst:
+ *
+ *  (app-misc/foo-1.0:0/0::gentoo, ebuild scheduled for merge), Log file:
+ *   '/var/tmp/portage/app-misc/foo-1.0/temp/build.log'
+ *  (dev-libs/bar-2.1:0/0::gentoo, ebuild scheduled for merge), Log file:
+ *   '/var/tmp/portage/dev-libs/bar-2.1/temp/build.log'
+
+>>> Auto-cleaning packages...
+`,
+			want: []string{"app-misc/foo-1.0", "dev-libs/bar-2.1"},
+		},
+		{
+			name: "single failure",
+			output: ` * The following package has failed to build, install, or execute postinst:
+ *
+ *  (app-misc/foo-1.0:0/0::gentoo, ebuild scheduled for merge), Log file:
+ *   '/var/tmp/portage/app-misc/foo-1.0/temp/build.log'
+`,
+			want: []string{"app-misc/foo-1.0"},
+		},
+		{
+			name: "dropped",
+			output: ` * The following packages have been dropped due to unsatisfied dependencies:
+ *
+ *  x11-libs/gtk+-3.24.41:3/3::gentoo
+ *  app-misc/foo-1.0:0/0::gentoo
+`,
+			want: []string{"x11-libs/gtk+-3.24.41", "app-misc/foo-1.0"},
+		},
+		{
+			name: "package lines outside the summary",
+			output: ` * app-misc/foo-1.0 is masked
+ * (dev-libs/bar-2.1, ebuild scheduled for merge)
+`,
+			want: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ParseEmergeFailures(tt.output); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseEmergeFailures() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package utils
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// fsckTool describes how to check one filesystem type.
+type fsckTool struct {
+	name       string
+	checkArgs  []string // Read-only check
+	repairArgs []string // Non-interactive repair
+	fixedCodes []int    // Exit codes meaning errors were found and fixed
+}
+
+// fsckTools maps filesystem types, as reported by blkid, to their checkers.
+var fsckTools = map[string]fsckTool{
+	"ext2":  {name: "e2fsck", checkArgs: []string{"-f", "-n"}, repairArgs: []string{"-f", "-p"}, fixedCodes: []int{1, 2}},
+	"ext3":  {name: "e2fsck", checkArgs: []string{"-f", "-n"}, repairArgs: []string{"-f", "-p"}, fixedCodes: []int{1, 2}},
+	"ext4":  {name: "e2fsck", checkArgs: []string{"-f", "-n"}, repairArgs: []string{"-f", "-p"}, fixedCodes: []int{1, 2}},
+	"xfs":   {name: "xfs_repair", checkArgs: []string{"-n"}},
+	"btrfs": {name: "btrfs", checkArgs: []string{"check", "--readonly"}, repairArgs: []string{"check", "--repair", "--force"}},
+	"f2fs":  {name: "fsck.f2fs", checkArgs: []string{"--dry-run"}, repairArgs: []string{"-a"}},
+	"vfat":  {name: "fsck.fat", checkArgs: []string{"-n"}, repairArgs: []string{"-a"}, fixedCodes: []int{1}},
+	"fat32": {name: "fsck.fat", checkArgs: []string{"-n"}, repairArgs: []string{"-a"}, fixedCodes: []int{1}},
+}
+
+// fsckCommand returns the command checking device, and false if fstype has
+// no offline checker.
+func fsckCommand(device, fstype string, repair bool) (string, []string, bool) {
+	tool, ok := fsckTools[fstype]
+	if !ok {
+		return "", nil, false
+	}
+
+	args := tool.checkArgs
+	if repair && tool.repairArgs != nil {
+		args = tool.repairArgs
+	}
+	return tool.name, append(append([]string(nil), args...), device), true
+}
+
+// CheckFilesystem checks the filesystem on device before it is mounted,
+// repairing it if repair is set. Filesystems without an offline checker,
+// such as swap or ZFS, are skipped.
+func CheckFilesystem(device, fstype string, repair bool) error {
+	name, args, ok := fsckCommand(device, fstype, repair)
+	if !ok {
+		Debug("No filesystem check for %s (%s)", device, fstype)
+		return nil
+	}
+	if repair && fsckTools[fstype].repairArgs == nil {
+		Warn("%s cannot repair %s unattended, only checking it", name, fstype)
+	}
+
+	if !IsDryRun() {
+		if _, err := exec.LookPath(name); err != nil {
+			return NewError("fsck", fmt.Sprintf("%s is required to check %s filesystems", name, fstype), err)
+		}
+	}
+
+	Info("Checking %s filesystem on %s", fstype, device)
+	result := RunCommand(name, args...)
+	if result.Error == nil {
+		return nil
+	}
+
+	if repair {
+		for _, code := range fsckTools[fstype].fixedCodes {
+			if result.ExitCode == code {
+				Warn("Repaired errors in the filesystem on %s", device)
+				return nil
+			}
+		}
+	}
+
+	return NewError("fsck", fmt.Sprintf("filesystem on %s has errors (exit code %d): %s",
+		device, result.ExitCode, result.Stderr), result.Error)
+}
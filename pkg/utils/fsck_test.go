@@ -0,0 +1,125 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFsckCommand(t *testing.T) {
+	tests := []struct {
+		fstype   string
+		repair   bool
+		wantName string
+		wantArgs []string
+		wantOK   bool
+	}{
+		{"ext4", false, "e2fsck", []string{"-f", "-n", "/dev/sda2"}, true},
+		{"ext4", true, "e2fsck", []string{"-f", "-p", "/dev/sda2"}, true},
+		{"btrfs", false, "btrfs", []string{"check", "--readonly", "/dev/sda2"}, true},
+		{"btrfs", true, "btrfs", []string{"check", "--repair", "--force", "/dev/sda2"}, true},
+		{"vfat", true, "fsck.fat", []string{"-a", "/dev/sda2"}, true},
+		{"xfs", true, "xfs_repair", []string{"-n", "/dev/sda2"}, true}, // No unattended repair
+		{"swap", false, "", nil, false},
+		{"zfs", true, "", nil, false},
+	}
+
+	for _, tt := range tests {
+		name, args, ok := fsckCommand("/dev/sda2", tt.fstype, tt.repair)
+		if name != tt.wantName || !reflect.DeepEqual(args, tt.wantArgs) || ok != tt.wantOK {
+			t.Errorf("fsckCommand(%s, repair=%v) = %s %q %v, want %s %q %v",
+				tt.fstype, tt.repair, name, args, ok, tt.wantName, tt.wantArgs, tt.wantOK)
+		}
+	}
+
+	// The shared argument slices must not be modified
+	if args := fsckTools["ext4"].checkArgs; !reflect.DeepEqual(args, []string{"-f", "-n"}) {
+		t.Errorf("fsckTools[ext4].checkArgs = %q, modified by fsckCommand", args)
+	}
+}
+
+// fakeChecker puts an e2fsck and a btrfs script first in PATH that log
+// their arguments to the returned file and exit with exitCode.
+func fakeChecker(t *testing.T, exitCode string) string {
+	t.Helper()
+
+	bin := t.TempDir()
+	log := filepath.Join(bin, "log")
+	for _, name := range []string{"e2fsck", "btrfs"} {
+		body := "#!/bin/sh\necho \"" + name + " $*\" >> " + log + "\nexit " + exitCode + "\n"
+		if err := os.WriteFile(filepath.Join(bin, name), []byte(body), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return log
+}
+
+func TestCheckFilesystem(t *testing.T) {
+	tests := []struct {
+		name     string
+		exitCode string
+		repair   bool
+		wantErr  bool
+	}{
+		{"clean", "0", false, false},
+		{"errors found", "4", false, true},
+		{"errors fixed", "1", true, false},
+		{"reboot needed after fix", "2", true, false},
+		{"fix code without repair", "1", false, true},
+		{"left uncorrected", "4", true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeChecker(t, tt.exitCode)
+
+			err := CheckFilesystem("/dev/sda2", "ext4", tt.repair)
+			if gotErr := err != nil; gotErr != tt.wantErr {
+				t.Errorf("CheckFilesystem() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMountChecksEachDeviceOnce(t *testing.T) {
+	root := t.TempDir()
+	fakeMountCommands(t, "")
+	log := fakeChecker(t, "0")
+
+	install := &DiscoveredInstall{MountPlan: []MountPoint{
+		{Source: "/dev/sda2", Target: "/", FSType: "btrfs", Flags: "subvol=@"},
+		{Source: "/dev/sda2", Target: "/home", FSType: "btrfs", Flags: "subvol=@home"},
+		{Source: "/dev/sda1", Target: "/boot", FSType: "swap"},
+	}}
+	if err := install.Mount(root); err != nil {
+		t.Fatalf("Mount() error = %v", err)
+	}
+
+	data, err := os.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checks := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if want := []string{"btrfs check --readonly /dev/sda2"}; !reflect.DeepEqual(checks, want) {
+		t.Errorf("checks = %q, want %q", checks, want)
+	}
+}
+
+func TestMountRefusesDirtyFilesystem(t *testing.T) {
+	root := t.TempDir()
+	mountLog := fakeMountCommands(t, "")
+	fakeChecker(t, "4")
+
+	install := &DiscoveredInstall{MountPlan: []MountPoint{
+		{Source: "/dev/sda2", Target: "/", FSType: "ext4"},
+	}}
+	if err := install.Mount(root); err == nil {
+		t.Fatal("Mount() succeeded on a filesystem with errors")
+	}
+	if data, _ := os.ReadFile(mountLog); strings.Contains(string(data), "mount ") {
+		t.Errorf("dirty filesystem was mounted: %s", data)
+	}
+}
@@ -0,0 +1,121 @@
+package utils
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"fmt"
+	"strings"
+)
+
+// cryptAlphabet is the base64 alphabet used by crypt(3).
+const cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// sha512CryptRounds is the crypt(3) default, which is left out of the hash.
+const sha512CryptRounds = 5000
+
+// sha512CryptOrder is the order crypt(3) encodes the digest bytes in, three
+// at a time.
+var sha512CryptOrder = [...][3]int{
+	{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4},
+	{47, 5, 26}, {6, 27, 48}, {28, 49, 7}, {50, 8, 29}, {9, 30, 51},
+	{31, 52, 10}, {53, 11, 32}, {12, 33, 54}, {34, 55, 13}, {56, 14, 35},
+	{15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19},
+	{62, 20, 41},
+}
+
+// GeneratePassword generates a hashed password for /etc/shadow, in the
+// SHA-512 crypt ($6$) format glibc and openssl passwd -6 produce.
+func GeneratePassword(plaintext string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", NewError("password", "failed to generate salt", err)
+	}
+	for n, b := range salt {
+		salt[n] = cryptAlphabet[int(b)%len(cryptAlphabet)]
+	}
+
+	return sha512Crypt([]byte(plaintext), salt), nil
+}
+
+// sha512Crypt hashes password with the SHA-512 crypt algorithm using the
+// default number of rounds. See https://www.akkadia.org/drepper/SHA-crypt.txt.
+func sha512Crypt(password, salt []byte) string {
+	if len(salt) > 16 {
+		salt = salt[:16]
+	}
+
+	// repeat returns digest repeated to n bytes
+	repeat := func(digest []byte, n int) []byte {
+		out := make([]byte, 0, n)
+		for len(out) < n {
+			out = append(out, digest[:min(len(digest), n-len(out))]...)
+		}
+		return out
+	}
+
+	alt := sha512.New()
+	alt.Write(password)
+	alt.Write(salt)
+	alt.Write(password)
+	altSum := alt.Sum(nil)
+
+	a := sha512.New()
+	a.Write(password)
+	a.Write(salt)
+	a.Write(repeat(altSum, len(password)))
+	for n := len(password); n > 0; n >>= 1 {
+		if n&1 != 0 {
+			a.Write(altSum)
+		} else {
+			a.Write(password)
+		}
+	}
+	sum := a.Sum(nil)
+
+	dp := sha512.New()
+	for range password {
+		dp.Write(password)
+	}
+	p := repeat(dp.Sum(nil), len(password))
+
+	ds := sha512.New()
+	for n := 0; n < 16+int(sum[0]); n++ {
+		ds.Write(salt)
+	}
+	s := repeat(ds.Sum(nil), len(salt))
+
+	for round := 0; round < sha512CryptRounds; round++ {
+		c := sha512.New()
+		if round&1 != 0 {
+			c.Write(p)
+		} else {
+			c.Write(sum)
+		}
+		if round%3 != 0 {
+			c.Write(s)
+		}
+		if round%7 != 0 {
+			c.Write(p)
+		}
+		if round&1 != 0 {
+			c.Write(sum)
+		} else {
+			c.Write(p)
+		}
+		sum = c.Sum(nil)
+	}
+
+	var encoded strings.Builder
+	encode := func(w uint32, chars int) {
+		for ; chars > 0; chars-- {
+			encoded.WriteByte(cryptAlphabet[w&0x3f])
+			w >>= 6
+		}
+	}
+	for _, o := range sha512CryptOrder {
+		encode(uint32(sum[o[0]])<<16|uint32(sum[o[1]])<<8|uint32(sum[o[2]]), 4)
+	}
+	encode(uint32(sum[63]), 2)
+
+	return fmt.Sprintf("$6$%s$%s", salt, encoded.String())
+}
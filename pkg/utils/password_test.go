@@ -0,0 +1,54 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSHA512Crypt(t *testing.T) {
+	// Expected hashes are from the SHA-crypt specification and openssl passwd -6
+	tests := []struct {
+		password string
+		salt     string
+		want     string
+	}{
+		{"Hello world!", "saltstring", "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1"},
+		{"This is just a test", "toolongsaltstring", "$6$toolongsaltstrin$lQ8jolhgVRVhY4b5pZKaysCLi0QBxGoNeKQzQ3glMhwllF7oGDZxUhx1yxdYcz/e1JSbq3y6JMxxl8audkUEm0"},
+		{
+			"a very long passphrase that is longer than one sha-512 digest of sixty-four bytes",
+			"kLmN0pQrStUvWxYz",
+			"$6$kLmN0pQrStUvWxYz$2XaWIzTmcafa5fvCfY1asvY1avu4B1gbIYO6b4/KwQswAvpTspS4mrbQlo.FdYWlquTkB.rzfwQozLqEDq0kw0",
+		},
+	}
+
+	for _, tt := range tests {
+		if got := sha512Crypt([]byte(tt.password), []byte(tt.salt)); got != tt.want {
+			t.Errorf("sha512Crypt(%q, %q) = %q, want %q", tt.password, tt.salt, got, tt.want)
+		}
+	}
+}
+
+func TestGeneratePassword(t *testing.T) {
+	first, err := GeneratePassword("secret")
+	if err != nil {
+		t.Fatalf("GeneratePassword() error = %v", err)
+	}
+	second, err := GeneratePassword("secret")
+	if err != nil {
+		t.Fatalf("GeneratePassword() error = %v", err)
+	}
+	if first == second {
+		t.Errorf("GeneratePassword() reused the salt: %q", first)
+	}
+
+	fields := strings.Split(first, "$")
+	if len(fields) != 4 || fields[1] != "6" || len(fields[2]) != 16 || len(fields[3]) != 86 {
+		t.Fatalf("GeneratePassword() = %q, want $6$<16 char salt>$<86 char hash>", first)
+	}
+	if strings.Trim(fields[2], cryptAlphabet) != "" {
+		t.Errorf("salt %q has characters outside the crypt alphabet", fields[2])
+	}
+	if got := sha512Crypt([]byte("secret"), []byte(fields[2])); got != first {
+		t.Errorf("GeneratePassword() = %q, does not verify as %q", first, got)
+	}
+}
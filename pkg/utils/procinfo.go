@@ -0,0 +1,129 @@
+package utils
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Default locations of the kernel's memory and CPU information.
+const (
+	MemInfoPath = "/proc/meminfo"
+	CPUInfoPath = "/proc/cpuinfo"
+)
+
+// MemInfo holds the fields of /proc/meminfo the installer uses, in KiB.
+type MemInfo struct {
+	TotalKB     int64
+	AvailableKB int64
+	SwapTotalKB int64
+	SwapFreeKB  int64
+}
+
+// ReadMemInfo parses a meminfo file such as MemInfoPath.
+func ReadMemInfo(path string) (*MemInfo, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, NewError("procinfo", "failed to read "+path, err)
+	}
+
+	info := &MemInfo{}
+	fields := map[string]*int64{
+		"MemTotal":     &info.TotalKB,
+		"MemAvailable": &info.AvailableKB,
+		"SwapTotal":    &info.SwapTotalKB,
+		"SwapFree":     &info.SwapFreeKB,
+	}
+
+	// Lines look like "MemTotal:       16318412 kB"
+	for _, line := range strings.Split(string(content), "\n") {
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		field, ok := fields[key]
+		if !ok {
+			continue
+		}
+		number := strings.TrimSuffix(strings.TrimSpace(value), " kB")
+		if kb, err := strconv.ParseInt(number, 10, 64); err == nil {
+			*field = kb
+		}
+	}
+
+	if info.TotalKB == 0 {
+		return nil, NewError("procinfo", "no MemTotal in "+path, nil)
+	}
+	return info, nil
+}
+
+// CPUInfo summarises a cpuinfo file. Model, vendor and flags are taken from
+// the first processor.
+type CPUInfo struct {
+	VendorID string   // e.g. GenuineIntel, AuthenticAMD
+	Model    string   // Model name
+	Threads  int      // Logical processors
+	Cores    int      // Physical cores, or Threads if not reported
+	Flags    []string // Feature flags, e.g. avx2
+}
+
+// HasFlag reports whether the CPU has the given feature flag.
+func (c *CPUInfo) HasFlag(flag string) bool {
+	for _, f := range c.Flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadCPUInfo parses a cpuinfo file such as CPUInfoPath.
+func ReadCPUInfo(path string) (*CPUInfo, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, NewError("procinfo", "failed to read "+path, err)
+	}
+
+	info := &CPUInfo{}
+	cores := make(map[string]bool) // "physical id/core id" pairs
+	var physicalID string
+
+	for _, line := range strings.Split(string(content), "\n") {
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+
+		switch key {
+		case "processor":
+			info.Threads++
+		case "vendor_id":
+			if info.VendorID == "" {
+				info.VendorID = value
+			}
+		case "model name":
+			if info.Model == "" {
+				info.Model = value
+			}
+		case "flags":
+			if info.Flags == nil {
+				info.Flags = strings.Fields(value)
+			}
+		case "physical id":
+			physicalID = value
+		case "core id":
+			cores[physicalID+"/"+value] = true
+		}
+	}
+
+	if info.Threads == 0 {
+		return nil, NewError("procinfo", "no processors listed in "+path, nil)
+	}
+
+	info.Cores = len(cores)
+	if info.Cores == 0 {
+		info.Cores = info.Threads
+	}
+	return info, nil
+}
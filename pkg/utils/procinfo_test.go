@@ -0,0 +1,161 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// writeProcFile writes content to a file in a temporary directory and
+// returns its path.
+func writeProcFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "info")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadMemInfo(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    *MemInfo
+		wantErr bool
+	}{
+		{
+			name: "full",
+			content: `MemTotal:       16318412 kB
+MemFree:         1203456 kB
+MemAvailable:    9876543 kB
+Buffers:          123456 kB
+SwapTotal:       8388604 kB
+SwapFree:        8388000 kB
+HugePages_Total:       0
+`,
+			want: &MemInfo{TotalKB: 16318412, AvailableKB: 9876543, SwapTotalKB: 8388604, SwapFreeKB: 8388000},
+		},
+		{
+			name:    "no swap",
+			content: "MemTotal:        2048000 kB\nMemAvailable:    1024000 kB\n",
+			want:    &MemInfo{TotalKB: 2048000, AvailableKB: 1024000},
+		},
+		{"no MemTotal", "MemFree:         1203456 kB\n", nil, true},
+		{"empty", "", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ReadMemInfo(writeProcFile(t, tt.content))
+			if gotErr := err != nil; gotErr != tt.wantErr {
+				t.Fatalf("ReadMemInfo() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ReadMemInfo() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadCPUInfo(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    *CPUInfo
+		wantErr bool
+	}{
+		{
+			name: "hyperthreaded",
+			content: `processor	: 0
+vendor_id	: GenuineIntel
+model name	: Intel(R) Core(TM) i7-8700 CPU @ 3.20GHz
+physical id	: 0
+core id		: 0
+flags		: fpu sse4_2 avx2
+
+processor	: 1
+vendor_id	: GenuineIntel
+model name	: Intel(R) Core(TM) i7-8700 CPU @ 3.20GHz
+physical id	: 0
+core id		: 1
+flags		: fpu sse4_2 avx2
+
+processor	: 2
+vendor_id	: GenuineIntel
+model name	: Intel(R) Core(TM) i7-8700 CPU @ 3.20GHz
+physical id	: 0
+core id		: 0
+flags		: fpu sse4_2 avx2
+
+processor	: 3
+vendor_id	: GenuineIntel
+model name	: Intel(R) Core(TM) i7-8700 CPU @ 3.20GHz
+physical id	: 0
+core id		: 1
+flags		: fpu sse4_2 avx2
+`,
+			want: &CPUInfo{
+				VendorID: "GenuineIntel",
+				Model:    "Intel(R) Core(TM) i7-8700 CPU @ 3.20GHz",
+				Threads:  4,
+				Cores:    2,
+				Flags:    []string{"fpu", "sse4_2", "avx2"},
+			},
+		},
+		{
+			// ARM kernels report neither the vendor nor core ids
+			name: "no topology",
+			content: `processor	: 0
+Features	: fp asimd
+
+processor	: 1
+Features	: fp asimd
+`,
+			want: &CPUInfo{Threads: 2, Cores: 2},
+		},
+		{"empty", "", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ReadCPUInfo(writeProcFile(t, tt.content))
+			if gotErr := err != nil; gotErr != tt.wantErr {
+				t.Fatalf("ReadCPUInfo() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ReadCPUInfo() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadProcInfoMissingFile(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "missing")
+	if _, err := ReadMemInfo(missing); err == nil {
+		t.Error("ReadMemInfo() of a missing file succeeded")
+	}
+	if _, err := ReadCPUInfo(missing); err == nil {
+		t.Error("ReadCPUInfo() of a missing file succeeded")
+	}
+}
+
+func TestCPUInfoHasFlag(t *testing.T) {
+	info := &CPUInfo{Flags: []string{"sse4_2", "avx2"}}
+	tests := []struct {
+		flag string
+		want bool
+	}{
+		{"avx2", true},
+		{"sse4_2", true},
+		{"avx", false},
+		{"avx512f", false},
+	}
+
+	for _, tt := range tests {
+		if got := info.HasFlag(tt.flag); got != tt.want {
+			t.Errorf("HasFlag(%q) = %v, want %v", tt.flag, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// Network retry defaults for downloads and fetches.
+const (
+	NetworkAttempts = 3
+	NetworkBackoff  = 2 * time.Second
+)
+
+// permanentError is an error that retrying cannot fix.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// Permanent marks err as one Retry should return at once, such as an HTTP
+// 404.
+func Permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+// Retry calls fn up to attempts times until it succeeds. The wait before
+// each retry doubles from backoff, plus up to half as much again at random
+// so parallel clients do not retry in step. Retrying stops early when the
+// command context is cancelled or fn returns a Permanent error. The
+// returned error wraps the last one fn returned.
+func Retry(attempts int, backoff time.Duration, fn func() error) error {
+	ctx := commandContext()
+
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if err = fn(); err == nil {
+			return nil
+		}
+		var permanent *permanentError
+		if errors.As(err, &permanent) {
+			return permanent.err
+		}
+		if attempt == attempts {
+			break
+		}
+
+		delay := backoff << (attempt - 1)
+		delay += time.Duration(rand.Int63n(int64(delay)/2 + 1))
+		Warn("Attempt %d of %d failed: %v, retrying in %s", attempt, attempts, err, delay.Round(100*time.Millisecond))
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return fmt.Errorf("gave up after %d attempts: %w", attempt, err)
+		}
+	}
+
+	return fmt.Errorf("failed after %d attempts: %w", attempts, err)
+}
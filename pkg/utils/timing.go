@@ -0,0 +1,103 @@
+package utils
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CommandTiming records how long a single command took.
+type CommandTiming struct {
+	Operation string // Program that did the work (the inner command for chroot)
+	Command   string
+	Duration  time.Duration
+}
+
+// OperationTiming aggregates the timings of one operation.
+type OperationTiming struct {
+	Operation string
+	Count     int
+	Total     time.Duration
+}
+
+var (
+	timingsMu sync.Mutex
+	timings   []CommandTiming
+)
+
+// recordTiming stores the duration of a finished command.
+func recordTiming(d time.Duration, name string, args []string) {
+	operation := name
+	if name == "chroot" && len(args) > 1 {
+		operation = args[1]
+	}
+
+	timingsMu.Lock()
+	defer timingsMu.Unlock()
+	timings = append(timings, CommandTiming{
+		Operation: operation,
+		Command:   strings.TrimSpace(name + " " + strings.Join(args, " ")),
+		Duration:  d,
+	})
+}
+
+// SlowestCommands returns up to n recorded commands, slowest first.
+func SlowestCommands(n int) []CommandTiming {
+	timingsMu.Lock()
+	sorted := append([]CommandTiming(nil), timings...)
+	timingsMu.Unlock()
+
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Duration > sorted[j].Duration
+	})
+	if n >= 0 && len(sorted) > n {
+		sorted = sorted[:n]
+	}
+	return sorted
+}
+
+// OperationTimings returns the total time spent per operation, slowest first.
+func OperationTimings() []OperationTiming {
+	timingsMu.Lock()
+	byOp := make(map[string]*OperationTiming)
+	for _, t := range timings {
+		op, ok := byOp[t.Operation]
+		if !ok {
+			op = &OperationTiming{Operation: t.Operation}
+			byOp[t.Operation] = op
+		}
+		op.Count++
+		op.Total += t.Duration
+	}
+	timingsMu.Unlock()
+
+	result := make([]OperationTiming, 0, len(byOp))
+	for _, op := range byOp {
+		result = append(result, *op)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Total != result[j].Total {
+			return result[i].Total > result[j].Total
+		}
+		return result[i].Operation < result[j].Operation
+	})
+	return result
+}
+
+// ResetCommandTimings discards all recorded timings.
+func ResetCommandTimings() {
+	timingsMu.Lock()
+	defer timingsMu.Unlock()
+	timings = nil
+}
+
+// LogTimingReport logs the slowest commands and the time spent per operation.
+func LogTimingReport(n int) {
+	for _, op := range OperationTimings() {
+		Info("Timing: %-12s %4d runs %s", op.Operation, op.Count, op.Total.Round(time.Second))
+	}
+	for _, t := range SlowestCommands(n) {
+		Info("Slow command (%s): %s", t.Duration.Round(time.Second), t.Command)
+	}
+}
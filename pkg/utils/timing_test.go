@@ -0,0 +1,43 @@
+package utils
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCommandTimings(t *testing.T) {
+	ResetCommandTimings()
+	defer ResetCommandTimings()
+
+	recordTiming(3*time.Second, "emerge", []string{"--sync"})
+	recordTiming(10*time.Second, "chroot", []string{"/mnt/gentoo", "emerge", "-uDN", "@world"})
+	recordTiming(1*time.Second, "mount", []string{"/dev/sda2", "/mnt/gentoo"})
+	recordTiming(1*time.Second, "chroot", []string{"/mnt/gentoo"})
+
+	slowest := SlowestCommands(2)
+	wantSlowest := []CommandTiming{
+		{Operation: "emerge", Command: "chroot /mnt/gentoo emerge -uDN @world", Duration: 10 * time.Second},
+		{Operation: "emerge", Command: "emerge --sync", Duration: 3 * time.Second},
+	}
+	if !reflect.DeepEqual(slowest, wantSlowest) {
+		t.Errorf("SlowestCommands(2) = %+v, want %+v", slowest, wantSlowest)
+	}
+	if got := len(SlowestCommands(-1)); got != 4 {
+		t.Errorf("len(SlowestCommands(-1)) = %d, want 4", got)
+	}
+
+	wantOps := []OperationTiming{
+		{Operation: "emerge", Count: 2, Total: 13 * time.Second},
+		{Operation: "chroot", Count: 1, Total: time.Second},
+		{Operation: "mount", Count: 1, Total: time.Second},
+	}
+	if got := OperationTimings(); !reflect.DeepEqual(got, wantOps) {
+		t.Errorf("OperationTimings() = %+v, want %+v", got, wantOps)
+	}
+
+	ResetCommandTimings()
+	if got := SlowestCommands(10); len(got) != 0 {
+		t.Errorf("SlowestCommands() after reset = %+v, want none", got)
+	}
+}
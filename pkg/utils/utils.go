@@ -4,8 +4,11 @@ package utils
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -16,10 +19,18 @@ import (
 
 // Logger handles logging for the installer.
 type Logger struct {
-	mu       sync.Mutex
-	file     *os.File
-	verbose  bool
-	callback func(level LogLevel, msg string)
+	mu        sync.Mutex
+	file      *os.File
+	verbose   bool
+	level     LogLevel // Messages below it only go to the file
+	callbacks []logCallback
+	nextID    int
+}
+
+// logCallback is a registered log callback.
+type logCallback struct {
+	id int
+	fn func(level LogLevel, msg string)
 }
 
 // LogLevel defines log severity levels.
@@ -59,14 +70,65 @@ func InitLogger(logPath string, verbose bool) error {
 	defaultLogger = &Logger{
 		file:    file,
 		verbose: verbose,
+		level:   LogDebug,
 	}
 	return nil
 }
 
-// SetLogCallback sets a callback for log messages (useful for TUI).
+// SetLevel drops messages below level from the console and the callbacks.
+// The log file keeps receiving everything.
+func SetLevel(level LogLevel) {
+	if defaultLogger == nil {
+		return
+	}
+
+	defaultLogger.mu.Lock()
+	defer defaultLogger.mu.Unlock()
+	defaultLogger.level = level
+}
+
+// SetLogCallback replaces all log callbacks with callback, or removes them
+// when it is nil.
 func SetLogCallback(callback func(level LogLevel, msg string)) {
-	if defaultLogger != nil {
-		defaultLogger.callback = callback
+	if defaultLogger == nil {
+		return
+	}
+
+	defaultLogger.mu.Lock()
+	defaultLogger.callbacks = nil
+	defaultLogger.mu.Unlock()
+
+	if callback != nil {
+		AddLogCallback(callback)
+	}
+}
+
+// AddLogCallback registers another callback for log messages, so that more
+// than one front end can follow the log. Callbacks are called in the order
+// they were added, and must not log themselves. The returned function
+// removes the callback.
+func AddLogCallback(callback func(level LogLevel, msg string)) (remove func()) {
+	if defaultLogger == nil {
+		return func() {}
+	}
+
+	defaultLogger.mu.Lock()
+	defer defaultLogger.mu.Unlock()
+
+	id := defaultLogger.nextID
+	defaultLogger.nextID++
+	defaultLogger.callbacks = append(defaultLogger.callbacks, logCallback{id: id, fn: callback})
+
+	return func() {
+		defaultLogger.mu.Lock()
+		defer defaultLogger.mu.Unlock()
+
+		for n, cb := range defaultLogger.callbacks {
+			if cb.id == id {
+				defaultLogger.callbacks = append(defaultLogger.callbacks[:n:n], defaultLogger.callbacks[n+1:]...)
+				return
+			}
+		}
 	}
 }
 
@@ -87,12 +149,16 @@ func Log(level LogLevel, format string, args ...interface{}) {
 		defaultLogger.file.WriteString(logLine)
 	}
 
+	if level < defaultLogger.level {
+		return
+	}
+
 	if defaultLogger.verbose || level >= LogWarn {
 		fmt.Print(logLine)
 	}
 
-	if defaultLogger.callback != nil {
-		defaultLogger.callback(level, msg)
+	for _, cb := range defaultLogger.callbacks {
+		cb.fn(level, msg)
 	}
 }
 
@@ -129,77 +195,206 @@ type CommandResult struct {
 	Stderr   string
 	ExitCode int
 	Error    error
+	Duration time.Duration // Wall-clock run time
+	TimedOut bool          // Killed because its context's deadline passed
+}
+
+var (
+	commandCtxMu sync.Mutex
+	commandCtx   = context.Background()
+)
+
+// SetCommandContext sets the context the RunCommand family runs commands
+// under. Cancelling it kills whatever is running and makes later commands
+// fail straight away, which is how an installation is aborted. A nil
+// context restores context.Background().
+func SetCommandContext(ctx context.Context) {
+	commandCtxMu.Lock()
+	defer commandCtxMu.Unlock()
+
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	commandCtx = ctx
+}
+
+// commandContext returns the context set with SetCommandContext.
+func commandContext() context.Context {
+	commandCtxMu.Lock()
+	defer commandCtxMu.Unlock()
+	return commandCtx
+}
+
+// finishResult fills in the fields shared by every command runner once cmd
+// has exited.
+func finishResult(ctx context.Context, cmd *exec.Cmd, result *CommandResult) {
+	if cmd.ProcessState != nil {
+		result.ExitCode = cmd.ProcessState.ExitCode()
+	}
+	result.TimedOut = errors.Is(ctx.Err(), context.DeadlineExceeded)
+
+	if result.Error != nil {
+		switch {
+		case result.TimedOut:
+			result.Error = fmt.Errorf("command timed out: %w", result.Error)
+		case ctx.Err() != nil:
+			result.Error = fmt.Errorf("command cancelled: %w", result.Error)
+		}
+		Debug("Command failed: %v, stderr: %s", result.Error, result.Stderr)
+	}
 }
 
 // RunCommand executes a command and returns the result.
 func RunCommand(name string, args ...string) *CommandResult {
+	return RunCommandContext(commandContext(), name, args...)
+}
+
+// RunCommandContext executes a command, killing it if ctx is cancelled or
+// its deadline passes before the command exits.
+func RunCommandContext(ctx context.Context, name string, args ...string) *CommandResult {
 	Debug("Running command: %s %s", name, strings.Join(args, " "))
 
-	cmd := exec.Command(name, args...)
+	if planCommand(name, args) {
+		return &CommandResult{}
+	}
+
+	cmd := exec.CommandContext(ctx, name, args...)
 	var stdout, stderr bytes.Buffer
 	cmd.Stdout = &stdout
 	cmd.Stderr = &stderr
 
+	start := time.Now()
 	err := cmd.Run()
 
 	result := &CommandResult{
-		Stdout: strings.TrimSpace(stdout.String()),
-		Stderr: strings.TrimSpace(stderr.String()),
-		Error:  err,
+		Stdout:   strings.TrimSpace(stdout.String()),
+		Stderr:   strings.TrimSpace(stderr.String()),
+		Error:    err,
+		Duration: time.Since(start),
 	}
+	recordTiming(result.Duration, name, args)
+	finishResult(ctx, cmd, result)
 
-	if cmd.ProcessState != nil {
-		result.ExitCode = cmd.ProcessState.ExitCode()
+	return result
+}
+
+// RunCommandWithStdin executes a command, feeding input to its stdin.
+// Use this instead of shell pipes when passing secrets such as passphrases.
+func RunCommandWithStdin(input string, name string, args ...string) *CommandResult {
+	Debug("Running command with stdin: %s %s", name, strings.Join(args, " "))
+
+	// Input is never recorded, it usually holds a secret
+	if planCommand(name, args) {
+		return &CommandResult{}
 	}
 
-	if err != nil {
-		Debug("Command failed: %v, stderr: %s", err, result.Stderr)
+	ctx := commandContext()
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdin = strings.NewReader(input)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	start := time.Now()
+	err := cmd.Run()
+
+	result := &CommandResult{
+		Stdout:   strings.TrimSpace(stdout.String()),
+		Stderr:   strings.TrimSpace(stderr.String()),
+		Error:    err,
+		Duration: time.Since(start),
 	}
+	recordTiming(result.Duration, name, args)
+	finishResult(ctx, cmd, result)
 
 	return result
 }
 
 // RunCommandWithOutput executes a command and streams output to a callback.
 func RunCommandWithOutput(callback func(line string), name string, args ...string) error {
+	return RunCommandStreaming(callback, name, args...).Error
+}
+
+// RunCommandStreaming executes a command, streaming stdout and stderr lines
+// to callback as they arrive while also capturing them in the result.
+// callback may be nil.
+func RunCommandStreaming(callback func(line string), name string, args ...string) *CommandResult {
 	Debug("Running command with output: %s %s", name, strings.Join(args, " "))
 
-	cmd := exec.Command(name, args...)
+	if planCommand(name, args) {
+		return &CommandResult{}
+	}
+
+	ctx := commandContext()
+	cmd := exec.CommandContext(ctx, name, args...)
+	result := &CommandResult{}
 
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
-		return fmt.Errorf("failed to get stdout pipe: %w", err)
+		result.Error = fmt.Errorf("failed to get stdout pipe: %w", err)
+		return result
 	}
 
 	stderr, err := cmd.StderrPipe()
 	if err != nil {
-		return fmt.Errorf("failed to get stderr pipe: %w", err)
+		result.Error = fmt.Errorf("failed to get stderr pipe: %w", err)
+		return result
 	}
 
+	start := time.Now()
 	if err := cmd.Start(); err != nil {
-		return fmt.Errorf("failed to start command: %w", err)
+		result.Error = fmt.Errorf("failed to start command: %w", err)
+		return result
 	}
 
-	// Read stdout and stderr concurrently
+	// Read stdout and stderr concurrently; the callback is serialised
 	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var stdoutBuf, stderrBuf bytes.Buffer
 	wg.Add(2)
 
-	readPipe := func(pipe io.Reader) {
+	// Lines are read whole whatever their length: emerge can print lines
+	// longer than a bufio.Scanner buffer, and a scanner stops at the first
+	// one. Splitting on '\n' never cuts a multi-byte UTF-8 sequence.
+	readPipe := func(pipe io.Reader, buf *bytes.Buffer) {
 		defer wg.Done()
-		scanner := bufio.NewScanner(pipe)
-		for scanner.Scan() {
-			line := scanner.Text()
-			if callback != nil {
-				callback(line)
+		reader := bufio.NewReader(pipe)
+		for {
+			line, err := reader.ReadString('\n')
+			if line != "" {
+				line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+				mu.Lock()
+				buf.WriteString(line)
+				buf.WriteByte('\n')
+				if callback != nil {
+					callback(line)
+				}
+				mu.Unlock()
+			}
+			if err != nil {
+				if err != io.EOF {
+					Debug("Failed to read command output: %v", err)
+					// Drain the pipe so the command cannot block on a full pipe
+					io.Copy(io.Discard, pipe)
+				}
+				return
 			}
 		}
 	}
 
-	go readPipe(stdout)
-	go readPipe(stderr)
+	go readPipe(stdout, &stdoutBuf)
+	go readPipe(stderr, &stderrBuf)
 
 	wg.Wait()
 
-	return cmd.Wait()
+	result.Error = cmd.Wait()
+	result.Duration = time.Since(start)
+	recordTiming(result.Duration, name, args)
+	result.Stdout = strings.TrimSpace(stdoutBuf.String())
+	result.Stderr = strings.TrimSpace(stderrBuf.String())
+	finishResult(ctx, cmd, result)
+
+	return result
 }
 
 // RunInChroot executes a command inside a chroot environment.
@@ -212,7 +407,12 @@ func RunInChroot(chrootPath string, name string, args ...string) *CommandResult
 func RunInChrootWithEnv(chrootPath string, env map[string]string, name string, args ...string) *CommandResult {
 	Debug("Running in chroot %s: %s %s", chrootPath, name, strings.Join(args, " "))
 
-	cmd := exec.Command("chroot", append([]string{chrootPath, name}, args...)...)
+	if planCommand("chroot", append([]string{chrootPath, name}, args...)) {
+		return &CommandResult{}
+	}
+
+	ctx := commandContext()
+	cmd := exec.CommandContext(ctx, "chroot", append([]string{chrootPath, name}, args...)...)
 
 	// Set environment variables
 	cmd.Env = os.Environ()
@@ -224,23 +424,26 @@ func RunInChrootWithEnv(chrootPath string, env map[string]string, name string, a
 	cmd.Stdout = &stdout
 	cmd.Stderr = &stderr
 
+	start := time.Now()
 	err := cmd.Run()
 
 	result := &CommandResult{
-		Stdout: strings.TrimSpace(stdout.String()),
-		Stderr: strings.TrimSpace(stderr.String()),
-		Error:  err,
-	}
-
-	if cmd.ProcessState != nil {
-		result.ExitCode = cmd.ProcessState.ExitCode()
+		Stdout:   strings.TrimSpace(stdout.String()),
+		Stderr:   strings.TrimSpace(stderr.String()),
+		Error:    err,
+		Duration: time.Since(start),
 	}
+	recordTiming(result.Duration, "chroot", append([]string{chrootPath, name}, args...))
+	finishResult(ctx, cmd, result)
 
 	return result
 }
 
 // FileExists checks if a file exists.
 func FileExists(path string) bool {
+	if _, ok := plannedFile(path); ok {
+		return true
+	}
 	_, err := os.Stat(path)
 	return err == nil
 }
@@ -256,11 +459,20 @@ func DirExists(path string) bool {
 
 // CreateDir creates a directory with all parents.
 func CreateDir(path string, perm os.FileMode) error {
+	if IsDryRun() {
+		RecordAction("mkdir", "%s (%04o)", path, perm)
+		return nil
+	}
 	return os.MkdirAll(path, perm)
 }
 
 // CopyFile copies a file from src to dst.
 func CopyFile(src, dst string) error {
+	if IsDryRun() {
+		RecordAction("copy", "%s -> %s", src, dst)
+		return nil
+	}
+
 	sourceFile, err := os.Open(src)
 	if err != nil {
 		return fmt.Errorf("failed to open source file: %w", err)
@@ -288,6 +500,10 @@ func CopyFile(src, dst string) error {
 
 // WriteFile writes content to a file.
 func WriteFile(path string, content string, perm os.FileMode) error {
+	if planWrite("write", path, content, perm) {
+		return nil
+	}
+
 	dir := filepath.Dir(path)
 	if err := CreateDir(dir, 0755); err != nil {
 		return fmt.Errorf("failed to create directory: %w", err)
@@ -295,10 +511,19 @@ func WriteFile(path string, content string, perm os.FileMode) error {
 	return os.WriteFile(path, []byte(content), perm)
 }
 
-// ReadFile reads a file and returns its content.
+// ReadFile reads a file and returns its content. In dry-run mode files
+// written during the plan are returned as written, and missing files read
+// as empty since the steps that would have created them did not run.
 func ReadFile(path string) (string, error) {
+	if content, ok := plannedFile(path); ok {
+		return content, nil
+	}
+
 	data, err := os.ReadFile(path)
 	if err != nil {
+		if IsDryRun() {
+			return "", nil
+		}
 		return "", err
 	}
 	return string(data), nil
@@ -306,6 +531,10 @@ func ReadFile(path string) (string, error) {
 
 // AppendToFile appends content to a file.
 func AppendToFile(path string, content string) error {
+	if planWrite("append", path, content, 0644) {
+		return nil
+	}
+
 	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
 		return fmt.Errorf("failed to open file: %w", err)
@@ -319,34 +548,69 @@ func AppendToFile(path string, content string) error {
 	return nil
 }
 
+// Chmod changes the permissions of a file.
+func Chmod(path string, perm os.FileMode) error {
+	if IsDryRun() {
+		RecordAction("chmod", "%s (%04o)", path, perm)
+		return nil
+	}
+	return os.Chmod(path, perm)
+}
+
+// Symlink creates newname as a symbolic link to oldname, replacing any
+// existing file.
+func Symlink(oldname, newname string) error {
+	if IsDryRun() {
+		RecordAction("symlink", "%s -> %s", newname, oldname)
+		return nil
+	}
+	os.Remove(newname)
+	return os.Symlink(oldname, newname)
+}
+
 // IsUEFI checks if the system is booted in UEFI mode.
 func IsUEFI() bool {
 	return DirExists("/sys/firmware/efi")
 }
 
-// GetCPUCount returns the number of CPU cores.
+// GetCPUCount returns the number of logical CPUs.
 func GetCPUCount() int {
-	result := RunCommand("nproc")
-	if result.Error != nil {
+	info, err := ReadCPUInfo(CPUInfoPath)
+	if err != nil {
 		return 1
 	}
-	var count int
-	fmt.Sscanf(result.Stdout, "%d", &count)
-	if count <= 0 {
-		return 1
+	return info.Threads
+}
+
+// CPU vendors as reported by GetCPUVendor.
+const (
+	CPUVendorIntel = "intel"
+	CPUVendorAMD   = "amd"
+)
+
+// GetCPUVendor returns the CPU vendor from /proc/cpuinfo, or "" if unknown.
+func GetCPUVendor() string {
+	info, err := ReadCPUInfo(CPUInfoPath)
+	if err != nil {
+		return ""
+	}
+
+	switch info.VendorID {
+	case "GenuineIntel":
+		return CPUVendorIntel
+	case "AuthenticAMD":
+		return CPUVendorAMD
 	}
-	return count
+	return ""
 }
 
 // GetMemoryMB returns the total memory in MB.
 func GetMemoryMB() int {
-	result := RunCommand("grep", "MemTotal", "/proc/meminfo")
-	if result.Error != nil {
+	info, err := ReadMemInfo(MemInfoPath)
+	if err != nil {
 		return 0
 	}
-	var total int
-	fmt.Sscanf(result.Stdout, "MemTotal: %d kB", &total)
-	return total / 1024
+	return int(info.TotalKB / 1024)
 }
 
 // YunoError represents an installer error with context.
@@ -379,30 +643,156 @@ func NewError(op, message string, err error) *YunoError {
 // ProgressCallback is a function called to report progress.
 type ProgressCallback func(current, total int64, message string)
 
-// DownloadFile downloads a file from a URL with progress reporting.
+// DownloadFile downloads url to destPath, reporting byte counts to
+// progress. The file is written under a temporary name and only renamed
+// to destPath once complete, so an interrupted download never looks like
+// a finished one. Failed downloads are retried, and wget is tried last.
 func DownloadFile(url, destPath string, progress ProgressCallback) error {
-	// We'll use wget or curl for downloading as they handle redirects better
+	if IsDryRun() {
+		RecordAction("download", "%s -> %s", url, destPath)
+		return nil
+	}
+
+	err := Retry(NetworkAttempts, NetworkBackoff, func() error {
+		return downloadHTTP(url, destPath, progress)
+	})
+	if err == nil {
+		return nil
+	}
+	if commandContext().Err() != nil {
+		return NewError("download", fmt.Sprintf("failed to download %s", url), err)
+	}
+
+	Warn("Download of %s failed (%v), retrying with wget", url, err)
+	if _, lookErr := exec.LookPath("wget"); lookErr != nil {
+		return NewError("download", fmt.Sprintf("failed to download %s", url), err)
+	}
+	return downloadWget(url, destPath, progress)
+}
+
+// downloadHTTP downloads url with net/http, which follows redirects.
+func downloadHTTP(url, destPath string, progress ProgressCallback) error {
+	req, err := http.NewRequestWithContext(commandContext(), http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("HTTP %s", resp.Status)
+		if resp.StatusCode >= 400 && resp.StatusCode < 500 {
+			return Permanent(err)
+		}
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
+		return err
+	}
+	partPath := destPath + ".part"
+	out, err := os.Create(partPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(partPath)
+
+	var body io.Reader = resp.Body
+	if progress != nil {
+		body = &progressReader{
+			r:        resp.Body,
+			total:    resp.ContentLength,
+			name:     filepath.Base(destPath),
+			callback: progress,
+		}
+	}
+
+	start := time.Now()
+	if _, err := io.Copy(out, body); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	Debug("Downloaded %s in %s", url, time.Since(start).Round(time.Second))
+
+	return os.Rename(partPath, destPath)
+}
+
+// progressReader reports the bytes read through it. Reports are limited to
+// one per percent, or one per 10 MiB when the size is unknown.
+type progressReader struct {
+	r        io.Reader
+	current  int64
+	total    int64 // -1 when the server sent no Content-Length
+	name     string
+	callback ProgressCallback
+	reported int64
+}
+
+func (p *progressReader) Read(buf []byte) (int, error) {
+	n, err := p.r.Read(buf)
+	p.current += int64(n)
+
+	step := int64(10 << 20)
+	if p.total > 0 {
+		step = p.total / 100
+	}
+	if p.current-p.reported >= step || (err == io.EOF && p.current != p.reported) {
+		p.reported = p.current
+		total := p.total
+		if total < 0 {
+			total = 0
+		}
+		p.callback(p.current, total, p.message())
+	}
+
+	return n, err
+}
+
+func (p *progressReader) message() string {
+	const mib = 1 << 20
+	if p.total > 0 {
+		return fmt.Sprintf("Downloading %s: %d/%d MiB (%d%%)", p.name, p.current/mib, p.total/mib, p.current*100/p.total)
+	}
+	return fmt.Sprintf("Downloading %s: %d MiB", p.name, p.current/mib)
+}
+
+// downloadWget downloads url with wget, passing its progress lines through.
+func downloadWget(url, destPath string, progress ProgressCallback) error {
+	partPath := destPath + ".part"
+	defer os.Remove(partPath)
+
 	args := []string{
 		"-q", "--show-progress", "--progress=bar:force",
-		"-O", destPath,
+		"-O", partPath,
 		url,
 	}
 
+	var result *CommandResult
 	if progress != nil {
-		return RunCommandWithOutput(func(line string) {
+		result = RunCommandStreaming(func(line string) {
 			progress(0, 0, line)
 		}, "wget", args...)
+	} else {
+		result = RunCommand("wget", args...)
 	}
-
-	result := RunCommand("wget", args...)
 	if result.Error != nil {
 		return NewError("download", fmt.Sprintf("failed to download %s", url), result.Error)
 	}
 
-	return nil
+	return os.Rename(partPath, destPath)
 }
 
-// ExtractTarball extracts a tarball to a destination directory.
+// ExtractTarball extracts a tarball to a destination directory, keeping
+// permissions, xattrs and numeric owners. With a progress callback the
+// tarball is fed to tar through a pipe, so the percentage is the share of
+// the compressed file read and the message counts the files extracted.
 func ExtractTarball(tarPath, destPath string, progress ProgressCallback) error {
 	Info("Extracting %s to %s", tarPath, destPath)
 
@@ -414,21 +804,112 @@ func ExtractTarball(tarPath, destPath string, progress ProgressCallback) error {
 		"-C", destPath,
 	}
 
-	if progress != nil {
-		args = append([]string{"xpvf", tarPath, "--xattrs-include=*.*", "--numeric-owner", "-C", destPath}, args[5:]...)
-		return RunCommandWithOutput(func(line string) {
-			progress(0, 0, line)
-		}, "tar", args...)
+	if progress == nil {
+		result := RunCommand("tar", args...)
+		if result.Error != nil {
+			return NewError("extract", fmt.Sprintf("failed to extract %s", tarPath), result.Error)
+		}
+		return nil
 	}
 
-	result := RunCommand("tar", args...)
+	// tar cannot detect the compression of a pipe
+	args = []string{"-x", "-p", "-v", "-f", "-", "--xattrs-include=*.*", "--numeric-owner", "-C", destPath}
+	if flag := compressionFlag(tarPath); flag != "" {
+		args = append(args, flag)
+	}
+	if planCommand("tar", append(args, "<", tarPath)) {
+		return nil
+	}
+
+	file, err := os.Open(tarPath)
+	if err != nil {
+		return NewError("extract", fmt.Sprintf("failed to open %s", tarPath), err)
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return NewError("extract", fmt.Sprintf("failed to open %s", tarPath), err)
+	}
+
+	// tar -v prints one line per extracted file
+	files := &lineCounter{}
+	name := filepath.Base(tarPath)
+
+	ctx := commandContext()
+	cmd := exec.CommandContext(ctx, "tar", args...)
+	cmd.Stdin = &progressReader{
+		r:     file,
+		total: stat.Size(),
+		name:  name,
+		callback: func(current, total int64, _ string) {
+			percent := int64(100)
+			if total > 0 {
+				percent = current * 100 / total
+			}
+			progress(current, total, fmt.Sprintf("Extracting %s: %d files (%d%%)", name, files.count(), percent))
+		},
+	}
+	var stderr bytes.Buffer
+	cmd.Stdout = files
+	cmd.Stderr = &stderr
+
+	start := time.Now()
+	err = cmd.Run()
+
+	result := &CommandResult{
+		Stderr:   strings.TrimSpace(stderr.String()),
+		Error:    err,
+		Duration: time.Since(start),
+	}
+	recordTiming(result.Duration, "tar", args)
+	finishResult(ctx, cmd, result)
+
 	if result.Error != nil {
-		return NewError("extract", fmt.Sprintf("failed to extract %s", tarPath), result.Error)
+		return NewError("extract", fmt.Sprintf("failed to extract %s: %s", tarPath, result.Stderr), result.Error)
 	}
 
+	Debug("Extracted %d files from %s", files.count(), name)
 	return nil
 }
 
+// compressionFlag returns the tar flag decompressing the file, from its
+// extension.
+func compressionFlag(path string) string {
+	switch {
+	case strings.HasSuffix(path, ".xz"), strings.HasSuffix(path, ".txz"):
+		return "-J"
+	case strings.HasSuffix(path, ".gz"), strings.HasSuffix(path, ".tgz"):
+		return "-z"
+	case strings.HasSuffix(path, ".bz2"), strings.HasSuffix(path, ".tbz2"):
+		return "-j"
+	case strings.HasSuffix(path, ".zst"):
+		return "--zstd"
+	default:
+		return ""
+	}
+}
+
+// lineCounter counts the lines written to it. It is written by the command
+// and read by the progress reporter, so the count is kept under a lock.
+type lineCounter struct {
+	mu    sync.Mutex
+	lines int
+}
+
+func (c *lineCounter) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	c.lines += bytes.Count(p, []byte{'\n'})
+	c.mu.Unlock()
+	return len(p), nil
+}
+
+func (c *lineCounter) count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lines
+}
+
 // MountPoint represents a mount point.
 type MountPoint struct {
 	Source string
@@ -476,20 +957,38 @@ func IsMounted(path string) bool {
 	return result.ExitCode == 0
 }
 
-// SyncFilesystems syncs all filesystems.
-func SyncFilesystems() {
-	RunCommand("sync")
-}
+// WaitForDevice waits until the device node at path exists. udev creates
+// the nodes of new partitions asynchronously, and on slow disks they can
+// appear after udevadm settle returns. In dry-run mode nothing is created,
+// so it returns at once.
+func WaitForDevice(path string, timeout time.Duration) error {
+	if IsDryRun() {
+		return nil
+	}
 
-// GeneratePassword generates a hashed password for /etc/shadow.
-func GeneratePassword(plaintext string) (string, error) {
-	result := RunCommand("openssl", "passwd", "-6", "-stdin")
-	if result.Error != nil {
-		// Fallback to mkpasswd if available
-		result = RunCommand("mkpasswd", "-m", "sha-512", plaintext)
-		if result.Error != nil {
-			return "", NewError("password", "failed to generate password hash", result.Error)
+	ctx, cancel := context.WithTimeout(commandContext(), timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		if _, err := os.Stat(path); err == nil {
+			return nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			if _, err := os.Stat(path); err == nil {
+				return nil
+			}
+			return NewError("device", fmt.Sprintf("%s did not appear within %s", path, timeout), ctx.Err())
 		}
 	}
-	return result.Stdout, nil
+}
+
+// SyncFilesystems syncs all filesystems.
+func SyncFilesystems() {
+	RunCommand("sync")
 }
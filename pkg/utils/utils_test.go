@@ -0,0 +1,95 @@
+package utils
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRunCommandStreaming(t *testing.T) {
+	tests := []struct {
+		name       string
+		script     string
+		wantLines  []string
+		wantStdout string
+		wantStderr string
+		wantErr    bool
+	}{
+		{"stdout", `printf 'one\ntwo\n'`, []string{"one", "two"}, "one\ntwo", "", false},
+		{"no trailing newline", `printf 'one'`, []string{"one"}, "one", "", false},
+		{"carriage return", `printf 'one\r\n'`, []string{"one"}, "one", "", false},
+		{"stderr", `echo oops >&2`, []string{"oops"}, "", "oops", false},
+		{"exit status", `echo partial; exit 3`, []string{"partial"}, "partial", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var lines []string
+			result := RunCommandStreaming(func(line string) {
+				lines = append(lines, line)
+			}, "sh", "-c", tt.script)
+
+			if gotErr := result.Error != nil; gotErr != tt.wantErr {
+				t.Fatalf("Error = %v, wantErr %v", result.Error, tt.wantErr)
+			}
+			if !reflect.DeepEqual(lines, tt.wantLines) {
+				t.Errorf("callback lines = %q, want %q", lines, tt.wantLines)
+			}
+			if result.Stdout != tt.wantStdout {
+				t.Errorf("Stdout = %q, want %q", result.Stdout, tt.wantStdout)
+			}
+			if result.Stderr != tt.wantStderr {
+				t.Errorf("Stderr = %q, want %q", result.Stderr, tt.wantStderr)
+			}
+		})
+	}
+}
+
+func TestRunCommandStreamingNilCallback(t *testing.T) {
+	result := RunCommandStreaming(nil, "sh", "-c", "echo captured")
+	if result.Error != nil {
+		t.Fatalf("Error = %v", result.Error)
+	}
+	if result.Stdout != "captured" {
+		t.Errorf("Stdout = %q, want %q", result.Stdout, "captured")
+	}
+}
+
+func TestRunCommandStreamingDryRun(t *testing.T) {
+	SetDryRun(true)
+	defer SetDryRun(false)
+
+	called := false
+	result := RunCommandStreaming(func(string) { called = true }, "sh", "-c", "echo ran")
+	if result.Error != nil || result.Stdout != "" || called {
+		t.Errorf("dry run ran the command: %+v", result)
+	}
+	if plan := Plan(); len(plan) != 1 {
+		t.Errorf("Plan() = %v, want the command recorded", plan)
+	}
+}
+
+func TestRunCommandStreamingLongLines(t *testing.T) {
+	// Longer than the 64KB default token size of a bufio.Scanner
+	const length = 200 * 1024
+	script := fmt.Sprintf("head -c %d /dev/zero | tr '\\0' x; echo; printf '\\342\\234\\223 done\\n'", length)
+
+	var lines []string
+	result := RunCommandStreaming(func(line string) {
+		lines = append(lines, line)
+	}, "sh", "-c", script)
+	if result.Error != nil {
+		t.Fatalf("Error = %v", result.Error)
+	}
+
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want 2", len(lines))
+	}
+	if lines[0] != strings.Repeat("x", length) {
+		t.Errorf("long line has %d bytes, want %d", len(lines[0]), length)
+	}
+	if lines[1] != "\u2713 done" {
+		t.Errorf("line after the long one = %q, want %q", lines[1], "\u2713 done")
+	}
+}